@@ -11,11 +11,38 @@ type API struct {
 	NotesInfoFunc        func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error)
 	UpdateNoteFieldsFunc func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error
 	ModelNamesFunc       func() ([]string, error)
+	ModelFieldNamesFunc  func(modelName string) ([]string, error)
+	ModelTemplatesFunc   func(modelName string) (map[string]ankiconnect.CreateModelCardTemplate, error)
 	CreateModelFunc      func(params ankiconnect.CreateModelParams) error
 	FindCardsFunc        func(query string) ([]ankiconnect.CardID, error)
 	ChangeDeckFunc       func(deckName string, noteIDs []ankiconnect.CardID) error
 	StoreMediaFileFunc   func(fileName string, fileData io.Reader, replaceExisting bool) error
 	AddTagsFn            func(noteIDs []ankiconnect.NoteID, tags []string) error
+	RemoveTagsFunc       func(noteIDs []ankiconnect.NoteID, tags []string) error
+	CardsInfoFunc        func(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error)
+	ExportPackageFunc    func(deckName string, path string, includeScheduling bool) error
+
+	// decks:
+	DeckNamesFunc         func() ([]string, error)
+	CreateDeckFunc        func(deckName string) error
+	GetDeckConfigFunc     func(deckName string) (ankiconnect.DeckConfig, error)
+	SaveDeckConfigFunc    func(config ankiconnect.DeckConfig) error
+	SetDeckConfigIDFunc   func(deckNames []string, configID ankiconnect.DeckConfigID) error
+	CloneDeckConfigIDFunc func(name string, cloneFrom ankiconnect.DeckConfigID) (ankiconnect.DeckConfigID, error)
+
+	// cards state:
+	SuspendFunc            func(cardIDs []ankiconnect.CardID) error
+	UnsuspendFunc          func(cardIDs []ankiconnect.CardID) error
+	ForgetCardsFunc        func(cardIDs []ankiconnect.CardID) error
+	SetDueDateFunc         func(cardIDs []ankiconnect.CardID, days string) error
+	SetNewCardPositionFunc func(cardID ankiconnect.CardID, position int64) error
+	SetCardSchedulingFunc  func(cardID ankiconnect.CardID, scheduling ankiconnect.CardScheduling) error
+
+	// import:
+	AddNotesFunc func(notes []ankiconnect.NewNote) ([]*ankiconnect.NoteID, error)
+
+	// dedupe:
+	DeleteNotesFunc func(noteIDs []ankiconnect.NoteID) error
 }
 
 var _ ankiconnect.API = (*API)(nil)
@@ -52,6 +79,20 @@ func (api *API) ModelNames() ([]string, error) {
 	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not set for method ModelNames")))
 }
 
+func (api *API) ModelFieldNames(modelName string) ([]string, error) {
+	if behaviour := api.ModelFieldNamesFunc; behaviour != nil {
+		return behaviour(modelName)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not set for method ModelFieldNames")))
+}
+
+func (api *API) ModelTemplates(modelName string) (map[string]ankiconnect.CreateModelCardTemplate, error) {
+	if behaviour := api.ModelTemplatesFunc; behaviour != nil {
+		return behaviour(modelName)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not set for method ModelTemplates")))
+}
+
 func (api *API) CreateModel(params ankiconnect.CreateModelParams) error {
 	if behaviour := api.CreateModelFunc; behaviour != nil {
 		return behaviour(params)
@@ -86,3 +127,122 @@ func (api *API) AddTags(noteIDs []ankiconnect.NoteID, tags []string) error {
 	}
 	panic(errorx.Panic(errorx.NotImplemented.New("Moch behaviour is not set for method AddTags")))
 }
+
+func (api *API) RemoveTags(noteIDs []ankiconnect.NoteID, tags []string) error {
+	if behaviour := api.RemoveTagsFunc; behaviour != nil {
+		return behaviour(noteIDs, tags)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method RemoveTags")))
+}
+
+func (api *API) CardsInfo(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error) {
+	if behaviour := api.CardsInfoFunc; behaviour != nil {
+		return behaviour(cardIDs)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method CardsInfo")))
+}
+
+func (api *API) ExportPackage(deckName string, path string, includeScheduling bool) error {
+	if behaviour := api.ExportPackageFunc; behaviour != nil {
+		return behaviour(deckName, path, includeScheduling)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method ExportPackage")))
+}
+
+func (api *API) DeckNames() ([]string, error) {
+	if behaviour := api.DeckNamesFunc; behaviour != nil {
+		return behaviour()
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method DeckNames")))
+}
+
+func (api *API) CreateDeck(deckName string) error {
+	if behaviour := api.CreateDeckFunc; behaviour != nil {
+		return behaviour(deckName)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method CreateDeck")))
+}
+
+func (api *API) GetDeckConfig(deckName string) (ankiconnect.DeckConfig, error) {
+	if behaviour := api.GetDeckConfigFunc; behaviour != nil {
+		return behaviour(deckName)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method GetDeckConfig")))
+}
+
+func (api *API) SaveDeckConfig(config ankiconnect.DeckConfig) error {
+	if behaviour := api.SaveDeckConfigFunc; behaviour != nil {
+		return behaviour(config)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method SaveDeckConfig")))
+}
+
+func (api *API) SetDeckConfigID(deckNames []string, configID ankiconnect.DeckConfigID) error {
+	if behaviour := api.SetDeckConfigIDFunc; behaviour != nil {
+		return behaviour(deckNames, configID)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method SetDeckConfigID")))
+}
+
+func (api *API) CloneDeckConfigID(name string, cloneFrom ankiconnect.DeckConfigID) (ankiconnect.DeckConfigID, error) {
+	if behaviour := api.CloneDeckConfigIDFunc; behaviour != nil {
+		return behaviour(name, cloneFrom)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method CloneDeckConfigID")))
+}
+
+func (api *API) Suspend(cardIDs []ankiconnect.CardID) error {
+	if behaviour := api.SuspendFunc; behaviour != nil {
+		return behaviour(cardIDs)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method Suspend")))
+}
+
+func (api *API) Unsuspend(cardIDs []ankiconnect.CardID) error {
+	if behaviour := api.UnsuspendFunc; behaviour != nil {
+		return behaviour(cardIDs)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method Unsuspend")))
+}
+
+func (api *API) ForgetCards(cardIDs []ankiconnect.CardID) error {
+	if behaviour := api.ForgetCardsFunc; behaviour != nil {
+		return behaviour(cardIDs)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method ForgetCards")))
+}
+
+func (api *API) SetDueDate(cardIDs []ankiconnect.CardID, days string) error {
+	if behaviour := api.SetDueDateFunc; behaviour != nil {
+		return behaviour(cardIDs, days)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method SetDueDate")))
+}
+
+func (api *API) SetNewCardPosition(cardID ankiconnect.CardID, position int64) error {
+	if behaviour := api.SetNewCardPositionFunc; behaviour != nil {
+		return behaviour(cardID, position)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method SetNewCardPosition")))
+}
+
+func (api *API) SetCardScheduling(cardID ankiconnect.CardID, scheduling ankiconnect.CardScheduling) error {
+	if behaviour := api.SetCardSchedulingFunc; behaviour != nil {
+		return behaviour(cardID, scheduling)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method SetCardScheduling")))
+}
+
+func (api *API) AddNotes(notes []ankiconnect.NewNote) ([]*ankiconnect.NoteID, error) {
+	if behaviour := api.AddNotesFunc; behaviour != nil {
+		return behaviour(notes)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method AddNotes")))
+}
+
+func (api *API) DeleteNotes(noteIDs []ankiconnect.NoteID) error {
+	if behaviour := api.DeleteNotesFunc; behaviour != nil {
+		return behaviour(noteIDs)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method DeleteNotes")))
+}
@@ -4,14 +4,14 @@ import (
 	"anki-rest-enhancer/ankihelperconf"
 	"anki-rest-enhancer/util/base64x"
 	"anki-rest-enhancer/util/httputil"
+	"anki-rest-enhancer/util/logx"
 	"bytes"
-	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/joomcode/errorx"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
@@ -23,7 +23,7 @@ import (
 func NewAPI(conf ankihelperconf.Anki) *api {
 	client := &http.Client{Timeout: conf.RequestTimeout}
 	if conf.LogRequests {
-		client.Transport = httputil.NewLoggingRoundTripper(http.DefaultTransport)
+		client.Transport = httputil.NewLoggingRoundTripper(http.DefaultTransport, conf.RequestLog)
 	}
 
 	return &api{
@@ -56,9 +56,14 @@ func (api api) FindCards(query string) ([]CardID, error) {
 }
 
 type NoteInfo struct {
-	ID     NoteID
-	Fields map[string]string
-	Tags   []string
+	ID        NoteID
+	ModelName string
+	Fields    map[string]string
+	Tags      []string
+	// ModifiedAt is zero if AnkiConnect doesn't report modification time.
+	ModifiedAt time.Time
+	// Cards are the cards of the note.
+	Cards []CardID
 }
 
 func (api api) NotesInfo(noteIDs []NoteID) (map[NoteID]NoteInfo, error) {
@@ -75,13 +80,18 @@ func (api api) NotesInfo(noteIDs []NoteID) (map[NoteID]NoteInfo, error) {
 	notes := make(map[NoteID]NoteInfo, len(result))
 	for _, noteInfo := range result {
 		note := NoteInfo{
-			ID:     noteInfo.NoteID,
-			Fields: map[string]string{},
+			ID:        noteInfo.NoteID,
+			ModelName: noteInfo.ModelName,
+			Fields:    map[string]string{},
 		}
 		for name, value := range noteInfo.Fields {
 			note.Fields[name] = value.Value
 		}
 		note.Tags = noteInfo.Tags
+		note.Cards = noteInfo.Cards
+		if noteInfo.Mod > 0 {
+			note.ModifiedAt = time.Unix(noteInfo.Mod, 0)
+		}
 		notes[noteInfo.NoteID] = note
 	}
 	return notes, nil
@@ -106,15 +116,13 @@ func (api api) UpdateNoteFields(noteID NoteID, fields map[string]FieldUpdate) er
 			// Thus, we ask it both to set the field to empty string and then to add audio to the field,
 			// achieving 'set field to audio' behaviour instead of simply 'add audio to the field'.
 			params.Note.Fields[field] = ""
-
-			fileName := fmt.Sprintf("%x.mp3", md5.Sum(fieldUpdate.AudioData))
 			params.Note.Audio = append(params.Note.Audio, updateNoteFieldsAudio{
-				FileName:   fileName,
+				FileName:   fieldUpdate.audioFileName(),
 				Base64Data: base64.StdEncoding.EncodeToString(fieldUpdate.AudioData),
 				Fields:     []string{field},
 			})
 		default:
-			log.Printf("WARN: %+v", errorx.IllegalState.New("got empty field %q update for note %d", field, noteID))
+			slog.Warn("Got empty field update", logx.KeyNoteID, noteID, logx.KeyField, field)
 		}
 	}
 
@@ -130,6 +138,32 @@ func (api api) ModelNames() ([]string, error) {
 	return rawResult.(modelNamesResult), nil
 }
 
+func (api api) ModelFieldNames(modelName string) ([]string, error) {
+	rawResult, err := api.doReq(modelFieldNamesParams{ModelName: modelName}, 5)
+	if err != nil {
+		return nil, err
+	}
+	return rawResult.(modelFieldNamesResult), nil
+}
+
+func (api api) ModelTemplates(modelName string) (map[string]CreateModelCardTemplate, error) {
+	rawResult, err := api.doReq(modelTemplatesParams{ModelName: modelName}, 5)
+	if err != nil {
+		return nil, err
+	}
+	result := rawResult.(modelTemplatesResult)
+
+	templates := make(map[string]CreateModelCardTemplate, len(result))
+	for name, sides := range result {
+		templates[name] = CreateModelCardTemplate{
+			Name:  name,
+			Front: sides["Front"],
+			Back:  sides["Back"],
+		}
+	}
+	return templates, nil
+}
+
 func (api api) CreateModel(params CreateModelParams) error {
 	_, err := api.doReq(params, 1) // NOTE: this request is not idempotent so it should not be retried
 	if err != nil {
@@ -159,11 +193,277 @@ func (api api) AddTags(noteIDs []NoteID, tags []string) error {
 	return err
 }
 
-func (api api) doReq(params interface{}, maxAttempts int) (interface{}, error) {
+func (api api) RemoveTags(noteIDs []NoteID, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	params := removeTagsParams{
+		Notes: noteIDs,
+		Tags:  strings.Join(tags, " "),
+	}
+	_, err := api.doReq(params, 5)
+	return err
+}
+
+type CardInfo struct {
+	ID       CardID
+	NoteID   NoteID
+	DeckName string
+	// Template is the name of the card template.
+	Template string
+	// Ord is the index of the card template in the note type.
+	Ord int
+	// Fields are the fields of the card's note.
+	Fields map[string]string
+	// Due is the position of a new card, or the day the card is due on.
+	Due int64
+	// Interval is the current interval of the card in days. It's zero for new and learning cards.
+	Interval int
+	// Type is one of CardTypeNew, CardTypeLearning, CardTypeReview and CardTypeRelearning.
+	Type int
+	// Queue is negative for suspended and buried cards, see CardQueueSuspended.
+	Queue int
+	// Reviews is the number of reviews of the card.
+	Reviews int
+	// Lapses is the number of times the card was forgotten.
+	Lapses int
+	// Ease is the ease factor in permille, e.g. 2500. It's zero for new cards.
+	Ease int
+}
+
+// CardScheduling is the part of the card state changed by scheduling operations.
+// The fields have the same meaning as the ones of CardInfo.
+type CardScheduling struct {
+	Type     int   `json:"type"`
+	Queue    int   `json:"queue"`
+	Due      int64 `json:"due"`
+	Interval int   `json:"interval"`
+	Ease     int   `json:"ease"`
+}
+
+func (c CardInfo) Scheduling() CardScheduling {
+	return CardScheduling{Type: c.Type, Queue: c.Queue, Due: c.Due, Interval: c.Interval, Ease: c.Ease}
+}
+
+// Card types and queues as they are stored by Anki.
+const (
+	CardTypeNew        = 0
+	CardTypeLearning   = 1
+	CardTypeReview     = 2
+	CardTypeRelearning = 3
+
+	CardQueueSuspended = -1
+)
+
+func (api api) CardsInfo(cardIDs []CardID) (map[CardID]CardInfo, error) {
+	if len(cardIDs) == 0 {
+		return nil, nil
+	}
+
+	rawResult, err := api.doReq(cardsInfoParams{CardIDs: cardIDs}, 5)
+	if err != nil {
+		return nil, err
+	}
+	result := rawResult.(cardsInfoResult)
+
+	cards := make(map[CardID]CardInfo, len(result))
+	for _, cardInfo := range result {
+		fields := make(map[string]string, len(cardInfo.Fields))
+		for name, field := range cardInfo.Fields {
+			fields[name] = field.Value
+		}
+		cards[cardInfo.CardID] = CardInfo{
+			ID:       cardInfo.CardID,
+			NoteID:   cardInfo.NoteID,
+			DeckName: cardInfo.DeckName,
+			Template: cardInfo.Template,
+			Ord:      cardInfo.Ord,
+			Fields:   fields,
+			Due:      cardInfo.Due,
+			Interval: cardInfo.Interval,
+			Type:     cardInfo.Type,
+			Queue:    cardInfo.Queue,
+			Reviews:  cardInfo.Reps,
+			Lapses:   cardInfo.Lapses,
+			Ease:     cardInfo.Factor,
+		}
+	}
+	return cards, nil
+}
+
+func (api api) ExportPackage(deckName string, path string, includeScheduling bool) error {
+	params := exportPackageParams{Deck: deckName, Path: path, IncludeSched: includeScheduling}
+	result, err := api.doReq(params, 1)
+	if err != nil {
+		return err
+	}
+	if !result.(exportPackageResult) {
+		return errorx.ExternalError.New("AnkiConnect failed to export deck %q to %s", deckName, path)
+	}
+	return nil
+}
+
+func (api api) DeckNames() ([]string, error) {
+	result, err := api.doReq(deckNamesParams{}, 5)
+	if err != nil {
+		return nil, err
+	}
+	return result.(deckNamesResult), nil
+}
+
+func (api api) CreateDeck(deckName string) error {
+	_, err := api.doReq(createDeckParams{Deck: deckName}, 1)
+	return err
+}
+
+func (api api) GetDeckConfig(deckName string) (DeckConfig, error) {
+	result, err := api.doReq(getDeckConfigParams{Deck: deckName}, 5)
+	if err != nil {
+		return DeckConfig{}, errorx.Decorate(err, "failed to get config of deck %q", deckName)
+	}
+	return result.(getDeckConfigResult), nil
+}
+
+func (api api) SaveDeckConfig(config DeckConfig) error {
+	result, err := api.doReq(saveDeckConfigParams{Config: config}, 1)
+	if err != nil {
+		return err
+	}
+	if !result.(saveDeckConfigResult) {
+		return errorx.ExternalError.New("AnkiConnect failed to save deck config %q", config.Name)
+	}
+	return nil
+}
+
+func (api api) SetDeckConfigID(deckNames []string, configID DeckConfigID) error {
+	result, err := api.doReq(setDeckConfigIDParams{Decks: deckNames, ConfigID: configID}, 1)
+	if err != nil {
+		return err
+	}
+	if !result.(setDeckConfigIDResult) {
+		return errorx.ExternalError.New("AnkiConnect failed to set config %d of decks %v", configID, deckNames)
+	}
+	return nil
+}
+
+func (api api) CloneDeckConfigID(name string, cloneFrom DeckConfigID) (DeckConfigID, error) {
+	result, err := api.doReq(cloneDeckConfigIDParams{Name: name, CloneFrom: cloneFrom}, 1)
+	if err != nil {
+		return 0, errorx.Decorate(err, "failed to create deck config %q", name)
+	}
+	return DeckConfigID(result.(cloneDeckConfigIDResult)), nil
+}
+
+func (api api) Suspend(cardIDs []CardID) error {
+	if len(cardIDs) == 0 {
+		return nil
+	}
+	_, err := api.doReq(suspendParams{CardIDs: cardIDs}, 1)
+	return err
+}
+
+func (api api) Unsuspend(cardIDs []CardID) error {
+	if len(cardIDs) == 0 {
+		return nil
+	}
+	_, err := api.doReq(unsuspendParams{CardIDs: cardIDs}, 1)
+	return err
+}
+
+func (api api) ForgetCards(cardIDs []CardID) error {
+	if len(cardIDs) == 0 {
+		return nil
+	}
+	_, err := api.doReq(forgetCardsParams{CardIDs: cardIDs}, 1)
+	return err
+}
+
+func (api api) SetDueDate(cardIDs []CardID, days string) error {
+	if len(cardIDs) == 0 {
+		return nil
+	}
+	result, err := api.doReq(setDueDateParams{CardIDs: cardIDs, Days: days}, 1)
+	if err != nil {
+		return err
+	}
+	if !result.(setDueDateResult) {
+		return errorx.ExternalError.New("AnkiConnect failed to set due date %q", days)
+	}
+	return nil
+}
+
+func (api api) SetNewCardPosition(cardID CardID, position int64) error {
+	if err := api.setCardValues(cardID, []string{"due"}, []interface{}{position}); err != nil {
+		return errorx.Decorate(err, "failed to set position of card %d", cardID)
+	}
+	return nil
+}
+
+func (api api) SetCardScheduling(cardID CardID, scheduling CardScheduling) error {
+	keys := []string{"type", "queue", "due", "ivl", "factor"}
+	values := []interface{}{scheduling.Type, scheduling.Queue, scheduling.Due, scheduling.Interval, scheduling.Ease}
+	return api.setCardValues(cardID, keys, values)
+}
+
+// setCardValues sets the values of the card columns, which AnkiConnect only allows with warning_check.
+func (api api) setCardValues(cardID CardID, keys []string, values []interface{}) error {
+	params := setSpecificValueOfCardParams{CardID: cardID, Keys: keys, NewValues: values, WarningCheck: true}
+	result, err := api.doReq(params, 1)
+	if err != nil {
+		return err
+	}
+	if set := result.(setSpecificValueOfCardResult); !set.OK {
+		return errorx.ExternalError.New("AnkiConnect failed to set %v of card %d: %s", keys, cardID, set.Error)
+	}
+	return nil
+}
+
+func (api api) AddNotes(notes []NewNote) ([]*NoteID, error) {
+	if len(notes) == 0 {
+		return nil, nil
+	}
+	params := addNotesParams{Notes: make([]addNotesNote, len(notes))}
+	for i, note := range notes {
+		tags := note.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		params.Notes[i] = addNotesNote{
+			DeckName:  note.Deck,
+			ModelName: note.NoteType,
+			Fields:    note.Fields,
+			Tags:      tags,
+			Options:   addNotesNoteOption{AllowDuplicate: true},
+		}
+	}
+	result, err := api.doReq(params, 1)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to add notes")
+	}
+	noteIDs := result.(addNotesResult)
+	if len(noteIDs) != len(notes) {
+		return nil, errorx.ExternalError.New("AnkiConnect returned %d note IDs for %d notes", len(noteIDs), len(notes))
+	}
+	return noteIDs, nil
+}
+
+func (api api) DeleteNotes(noteIDs []NoteID) error {
+	if len(noteIDs) == 0 {
+		return nil
+	}
+	_, err := api.doReq(deleteNotesParams{NoteIDs: noteIDs}, 1)
+	return err
+}
+
+func (api api) doReq(params interface{}, maxAttempts int) (_ interface{}, err error) {
 	actionName, ok := actionParamsMapping[reflect.TypeOf(params)]
 	if !ok {
 		panic(errorx.IllegalState.New("got action params of unexpected type: %+v", params))
 	}
+	start := time.Now()
+	defer func() { observeRequest(actionName, start, err) }()
+
 	marshalled, err := json.Marshal(requestPayload{
 		Action:  actionName,
 		Version: 6,
@@ -211,10 +511,11 @@ func (api api) doReqWithBodyAndRetry(body []byte, maxAttempts int) (*http.Respon
 	}
 
 	var errs []error
+	unreachable := true
 	retryDelay := 100 * time.Millisecond
 	for i := 0; i < maxAttempts; i++ {
 		if i > 0 {
-			log.Printf("Retrying Anki request error in %s...", retryDelay)
+			slog.Warn("Retrying Anki request error", "delay", retryDelay, logx.Err(errs[len(errs)-1]))
 			time.Sleep(retryDelay)
 			retryDelay = time.Duration(1.5*float64(retryDelay.Milliseconds())) * time.Millisecond
 		}
@@ -223,8 +524,13 @@ func (api api) doReqWithBodyAndRetry(body []byte, maxAttempts int) (*http.Respon
 			return resp, nil
 		}
 		errs = append(errs, err)
+		unreachable = unreachable && errorx.IsOfType(err, Unreachable)
+	}
+	errType := errorx.ExternalError
+	if unreachable {
+		errType = Unreachable
 	}
-	return nil, errorx.WrapMany(errorx.ExternalError, fmt.Sprintf("Failed to do Anki request %d times", maxAttempts), errs...)
+	return nil, errorx.WrapMany(errType, fmt.Sprintf("Failed to do Anki request %d times", maxAttempts), errs...)
 }
 
 func (api api) doReqWithBody(reqBody []byte) (*http.Response, error) {
@@ -246,7 +552,7 @@ func (api api) doReqWithBody(reqBody []byte) (*http.Response, error) {
 		if timeoutErr, ok := err.(net.Error); ok && timeoutErr.Timeout() {
 			return nil, errorx.TimeoutElapsed.Wrap(err, "Text-to-speech api request timed out")
 		}
-		return nil, errorx.ExternalError.Wrap(err, "Anki API request failed")
+		return nil, Unreachable.Wrap(err, "Anki API request failed")
 	}
 
 	defer func() { _ = resp.Body.Close() }()
@@ -0,0 +1,60 @@
+package ankiconnect
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newTestAPI starts a server replying with the result to all the requests and returns the API calling it
+// along with the bodies of the requests.
+func newTestAPI(t *testing.T, result string) (*api, *[]string) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests = append(requests, string(body))
+		_, _ = io.WriteString(w, `{"result": `+result+`, "error": null}`)
+	}))
+	t.Cleanup(server.Close)
+	connectURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return NewAPI(ankihelperconf.Anki{ConnectURL: connectURL, RequestTimeout: 5 * time.Second}), &requests
+}
+
+func TestSetNewCardPosition(t *testing.T) {
+	// given:
+	api, requests := newTestAPI(t, `[true]`)
+
+	// when:
+	err := api.SetNewCardPosition(1498938915662, 42)
+
+	// then:
+	require.NoError(t, err)
+	require.Len(t, *requests, 1)
+	require.JSONEq(t, `{
+		"action": "setSpecificValueOfCard",
+		"version": 6,
+		"params": {"card": 1498938915662, "keys": ["due"], "newValues": [42], "warning_check": true}
+	}`, (*requests)[0])
+}
+
+func TestSetNewCardPosition_Failures(t *testing.T) {
+	for _, result := range []string{`false`, `[[false, "card not found"]]`, `[]`} {
+		t.Run(result, func(t *testing.T) {
+			// given:
+			api, _ := newTestAPI(t, result)
+
+			// when:
+			err := api.SetNewCardPosition(1498938915662, 42)
+
+			// then:
+			require.ErrorContains(t, err, "failed to set position of card 1498938915662")
+		})
+	}
+}
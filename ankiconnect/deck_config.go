@@ -0,0 +1,101 @@
+package ankiconnect
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/joomcode/errorx"
+)
+
+type DeckConfigID int64
+
+// DeckConfig is an options group shared by decks, called preset in Anki UI.
+// Only the options managed by the tool are exposed. The other ones are preserved as is when the config is saved,
+// so a config should be obtained with GetDeckConfig before it's saved.
+type DeckConfig struct {
+	ID   DeckConfigID
+	Name string
+
+	NewCardsPerDay int
+	ReviewsPerDay  int
+	// LearningSteps and RelearningSteps are in minutes.
+	LearningSteps   []float64
+	RelearningSteps []float64
+
+	// raw is the config as returned by AnkiConnect.
+	raw map[string]interface{}
+}
+
+// rawDeckConfig lists the fields of AnkiConnect deck config exposed by DeckConfig.
+type rawDeckConfig struct {
+	ID   DeckConfigID `json:"id"`
+	Name string       `json:"name"`
+	New  struct {
+		PerDay int       `json:"perDay"`
+		Delays []float64 `json:"delays"`
+	} `json:"new"`
+	Rev struct {
+		PerDay int `json:"perDay"`
+	} `json:"rev"`
+	Lapse struct {
+		Delays []float64 `json:"delays"`
+	} `json:"lapse"`
+}
+
+func (c *DeckConfig) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("false")) {
+		// AnkiConnect returns false if there is no such deck
+		return errorx.IllegalArgument.New("deck doesn't exist")
+	}
+	var parsed rawDeckConfig
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	// numbers are decoded as json.Number to preserve them exactly when the config is saved
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+
+	*c = DeckConfig{
+		ID:              parsed.ID,
+		Name:            parsed.Name,
+		NewCardsPerDay:  parsed.New.PerDay,
+		ReviewsPerDay:   parsed.Rev.PerDay,
+		LearningSteps:   parsed.New.Delays,
+		RelearningSteps: parsed.Lapse.Delays,
+		raw:             raw,
+	}
+	return nil
+}
+
+func (c DeckConfig) MarshalJSON() ([]byte, error) {
+	raw := make(map[string]interface{}, len(c.raw))
+	for key, value := range c.raw {
+		raw[key] = value
+	}
+	raw["id"] = c.ID
+	raw["name"] = c.Name
+	setNested(raw, "new", "perDay", c.NewCardsPerDay)
+	setNested(raw, "rev", "perDay", c.ReviewsPerDay)
+	// Anki doesn't accept null steps
+	if c.LearningSteps != nil {
+		setNested(raw, "new", "delays", c.LearningSteps)
+	}
+	if c.RelearningSteps != nil {
+		setNested(raw, "lapse", "delays", c.RelearningSteps)
+	}
+	return json.Marshal(raw)
+}
+
+// setNested sets raw[section][key] without modifying the original section map.
+func setNested(raw map[string]interface{}, section, key string, value interface{}) {
+	original, _ := raw[section].(map[string]interface{})
+	updated := make(map[string]interface{}, len(original)+1)
+	for k, v := range original {
+		updated[k] = v
+	}
+	updated[key] = value
+	raw[section] = updated
+}
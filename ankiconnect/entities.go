@@ -2,6 +2,7 @@ package ankiconnect
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
 )
 
@@ -67,6 +68,9 @@ type noteInfo struct {
 	ModelName string                `json:"modelName"`
 	Tags      []string              `json:"tags"`
 	Fields    map[string]fieldValue `json:"fields"`
+	// Mod is the note modification time in seconds since epoch.
+	Mod   int64    `json:"mod"`
+	Cards []CardID `json:"cards"`
 }
 
 type fieldValue struct {
@@ -159,3 +163,254 @@ type addTagsParams struct {
 type addTagsResult struct {
 	// nop
 }
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionRemoveTags = declareAction("removeTags", removeTagsParams{}, removeTagsResult{})
+
+type removeTagsParams struct {
+	Notes []NoteID `json:"notes"`
+	// Tags is a space-separated list of tags, the same as in addTagsParams.
+	Tags string `json:"tags"`
+}
+
+type removeTagsResult struct {
+	// nop
+}
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionCardsInfo = declareAction("cardsInfo", cardsInfoParams{}, cardsInfoResult{})
+
+type cardsInfoParams struct {
+	CardIDs []CardID `json:"cards"`
+}
+
+type cardsInfoResult []cardInfo
+
+type cardInfo struct {
+	CardID   CardID `json:"cardId"`
+	NoteID   NoteID `json:"note"`
+	DeckName string `json:"deckName"`
+	// Template is the name of the card template and Ord is its index.
+	Template string                `json:"template"`
+	Ord      int                   `json:"ord"`
+	Fields   map[string]fieldValue `json:"fields"`
+	// Due is the position of a new card, or the day the card is due on.
+	Due      int64 `json:"due"`
+	Interval int   `json:"interval"`
+	// Type and Queue are the card type and queue as they are stored by Anki.
+	Type   int `json:"type"`
+	Queue  int `json:"queue"`
+	Reps   int `json:"reps"`
+	Lapses int `json:"lapses"`
+	// Factor is the ease factor in permille.
+	Factor int `json:"factor"`
+}
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionExportPackage = declareAction("exportPackage", exportPackageParams{}, exportPackageResult(false))
+
+type exportPackageParams struct {
+	Deck         string `json:"deck"`
+	Path         string `json:"path"`
+	IncludeSched bool   `json:"includeSched"`
+}
+
+type exportPackageResult bool
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionModelFieldNames = declareAction("modelFieldNames", modelFieldNamesParams{}, modelFieldNamesResult{})
+
+type modelFieldNamesParams struct {
+	ModelName string `json:"modelName"`
+}
+
+type modelFieldNamesResult []string
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionModelTemplates = declareAction("modelTemplates", modelTemplatesParams{}, modelTemplatesResult{})
+
+type modelTemplatesParams struct {
+	ModelName string `json:"modelName"`
+}
+
+// modelTemplatesResult maps card template name to its sides, e.g. {"Card 1": {"Front": "...", "Back": "..."}}
+type modelTemplatesResult map[string]map[string]string
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionDeckNames = declareAction("deckNames", deckNamesParams{}, deckNamesResult{})
+
+type deckNamesParams struct {
+	// nop
+}
+
+type deckNamesResult []string
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionCreateDeck = declareAction("createDeck", createDeckParams{}, createDeckResult(0))
+
+type createDeckParams struct {
+	Deck string `json:"deck"`
+}
+
+type createDeckResult int64
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionGetDeckConfig = declareAction("getDeckConfig", getDeckConfigParams{}, getDeckConfigResult{})
+
+type getDeckConfigParams struct {
+	Deck string `json:"deck"`
+}
+
+type getDeckConfigResult = DeckConfig
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionSaveDeckConfig = declareAction("saveDeckConfig", saveDeckConfigParams{}, saveDeckConfigResult(false))
+
+type saveDeckConfigParams struct {
+	Config DeckConfig `json:"config"`
+}
+
+type saveDeckConfigResult bool
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionSetDeckConfigID = declareAction("setDeckConfigId", setDeckConfigIDParams{}, setDeckConfigIDResult(false))
+
+type setDeckConfigIDParams struct {
+	Decks    []string     `json:"decks"`
+	ConfigID DeckConfigID `json:"configId"`
+}
+
+type setDeckConfigIDResult bool
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionCloneDeckConfigID = declareAction("cloneDeckConfigId", cloneDeckConfigIDParams{}, cloneDeckConfigIDResult(0))
+
+type cloneDeckConfigIDParams struct {
+	Name      string       `json:"name"`
+	CloneFrom DeckConfigID `json:"cloneFrom"`
+}
+
+// cloneDeckConfigIDResult is the ID of the created config.
+// AnkiConnect returns false if the source config is missing, so unmarshalling fails in that case.
+type cloneDeckConfigIDResult DeckConfigID
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionSuspend = declareAction("suspend", suspendParams{}, suspendResult(false))
+
+type suspendParams struct {
+	CardIDs []CardID `json:"cards"`
+}
+
+// suspendResult is false if all the cards are already suspended.
+type suspendResult bool
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionUnsuspend = declareAction("unsuspend", unsuspendParams{}, unsuspendResult(false))
+
+type unsuspendParams struct {
+	CardIDs []CardID `json:"cards"`
+}
+
+// unsuspendResult is false if none of the cards is suspended.
+type unsuspendResult bool
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionForgetCards = declareAction("forgetCards", forgetCardsParams{}, forgetCardsResult{})
+
+type forgetCardsParams struct {
+	CardIDs []CardID `json:"cards"`
+}
+
+type forgetCardsResult struct {
+	// nop
+}
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionSetDueDate = declareAction("setDueDate", setDueDateParams{}, setDueDateResult(false))
+
+type setDueDateParams struct {
+	CardIDs []CardID `json:"cards"`
+	// Days is a number of days from today or a range, e.g. 0, 1-7 or 3! to reset the interval as well.
+	Days string `json:"days"`
+}
+
+type setDueDateResult bool
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionSetSpecificValueOfCard = declareAction("setSpecificValueOfCard", setSpecificValueOfCardParams{}, setSpecificValueOfCardResult{})
+
+type setSpecificValueOfCardParams struct {
+	CardID    CardID        `json:"card"`
+	Keys      []string      `json:"keys"`
+	NewValues []interface{} `json:"newValues"`
+	// WarningCheck allows setting scheduling keys, e.g. type, queue and ivl. Without it AnkiConnect refuses
+	// to set them and returns false.
+	WarningCheck bool `json:"warning_check"`
+}
+
+// setSpecificValueOfCardResult reports whether the values have been set. AnkiConnect replies with false
+// if the request is refused, [true] on success and [[false, "error message"]] if setting failed.
+type setSpecificValueOfCardResult struct {
+	OK    bool
+	Error string
+}
+
+func (r *setSpecificValueOfCardResult) UnmarshalJSON(data []byte) error {
+	var refused bool
+	if err := json.Unmarshal(data, &refused); err == nil {
+		*r = setSpecificValueOfCardResult{Error: "the request is refused"}
+		return nil
+	}
+	var results []json.RawMessage
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+	*r = setSpecificValueOfCardResult{OK: len(results) > 0}
+	for _, result := range results {
+		var ok bool
+		if err := json.Unmarshal(result, &ok); err == nil {
+			r.OK = r.OK && ok
+			continue
+		}
+		var failure []any
+		if err := json.Unmarshal(result, &failure); err != nil {
+			return err
+		}
+		r.OK = false
+		r.Error = fmt.Sprint(failure[1:]...)
+	}
+	return nil
+}
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionAddNotes = declareAction("addNotes", addNotesParams{}, addNotesResult{})
+
+type addNotesParams struct {
+	Notes []addNotesNote `json:"notes"`
+}
+
+type addNotesNote struct {
+	DeckName  string             `json:"deckName"`
+	ModelName string             `json:"modelName"`
+	Fields    map[string]string  `json:"fields"`
+	Tags      []string           `json:"tags"`
+	Options   addNotesNoteOption `json:"options"`
+}
+
+type addNotesNoteOption struct {
+	AllowDuplicate bool `json:"allowDuplicate"`
+}
+
+// addNotesResult contains IDs of the created notes, or nulls for the notes that failed to be created.
+type addNotesResult []*NoteID
+
+//goland:noinspection GoUnusedGlobalVariable
+var actionDeleteNotes = declareAction("deleteNotes", deleteNotesParams{}, deleteNotesResult{})
+
+type deleteNotesParams struct {
+	NoteIDs []NoteID `json:"notes"`
+}
+
+type deleteNotesResult struct {
+	// nop
+}
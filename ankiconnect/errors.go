@@ -0,0 +1,10 @@
+package ankiconnect
+
+import "github.com/joomcode/errorx"
+
+var (
+	Errors = errorx.NewNamespace("ankiconnect")
+
+	// Unreachable means that AnkiConnect could not be reached at all, e.g. Anki is not running.
+	Unreachable = errorx.NewType(Errors, "unreachable")
+)
@@ -1,6 +1,10 @@
 package ankiconnect
 
-import "io"
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+)
 
 type NoteID int64
 
@@ -10,6 +14,29 @@ type FieldUpdate struct {
 	// one of
 	Value     *string // what value to write to the field
 	AudioData []byte  // make field to contain specified Audio. Any previous content of the field is reset.
+
+	// AudioFormat is the extension of the audio file created for AudioData. Default: mp3
+	AudioFormat string
+	// AudioFileName is the name of the media file created for AudioData.
+	// Default: <md5 of the audio data>.<AudioFormat>
+	AudioFileName string
+}
+
+// AudioValue returns the value of the field after the AudioData update.
+// Anki may still rename the media file if another file with the same name exists.
+func (u FieldUpdate) AudioValue() string {
+	return fmt.Sprintf("[sound:%s]", u.audioFileName())
+}
+
+func (u FieldUpdate) audioFileName() string {
+	if u.AudioFileName != "" {
+		return u.AudioFileName
+	}
+	format := u.AudioFormat
+	if format == "" {
+		format = "mp3"
+	}
+	return fmt.Sprintf("%x.%s", md5.Sum(u.AudioData), format)
 }
 
 type CreateModelParams struct {
@@ -26,14 +53,54 @@ type CreateModelCardTemplate struct {
 	Back  string `json:"Back"`
 }
 
+// NewNote describes a note to be created.
+type NewNote struct {
+	Deck     string
+	NoteType string
+	Fields   map[string]string
+	Tags     []string
+}
+
 type API interface {
 	FindNotes(query string) ([]NoteID, error)
 	FindCards(query string) ([]CardID, error)
 	NotesInfo(noteIDs []NoteID) (map[NoteID]NoteInfo, error)
 	UpdateNoteFields(noteID NoteID, fields map[string]FieldUpdate) error
+	// AddNotes creates the notes and returns their IDs in the same order.
+	// The ID is nil if the note failed to be created. Duplicates are allowed.
+	AddNotes(notes []NewNote) ([]*NoteID, error)
+	// DeleteNotes deletes the notes along with their cards.
+	DeleteNotes(noteIDs []NoteID) error
 	ModelNames() ([]string, error)
+	ModelFieldNames(modelName string) ([]string, error)
+	// ModelTemplates returns card templates of the model by their names.
+	// Name field of the returned templates is set as well.
+	ModelTemplates(modelName string) (map[string]CreateModelCardTemplate, error)
 	CreateModel(params CreateModelParams) error
 	ChangeDeck(deckName string, noteIDs []CardID) error
 	StoreMediaFile(fileName string, fileData io.Reader, replaceExisting bool) error
 	AddTags(noteIDs []NoteID, tags []string) error
+	RemoveTags(noteIDs []NoteID, tags []string) error
+	CardsInfo(cardIDs []CardID) (map[CardID]CardInfo, error)
+	// ExportPackage exports the deck to .apkg file. The path is resolved by Anki, so it should be absolute.
+	ExportPackage(deckName string, path string, includeScheduling bool) error
+	DeckNames() ([]string, error)
+	// CreateDeck creates the deck unless it already exists.
+	CreateDeck(deckName string) error
+	GetDeckConfig(deckName string) (DeckConfig, error)
+	SaveDeckConfig(config DeckConfig) error
+	SetDeckConfigID(deckNames []string, configID DeckConfigID) error
+	// CloneDeckConfigID creates a new deck config with the options of the existing one.
+	CloneDeckConfigID(name string, cloneFrom DeckConfigID) (DeckConfigID, error)
+	Suspend(cardIDs []CardID) error
+	Unsuspend(cardIDs []CardID) error
+	// ForgetCards resets the cards to new ones.
+	ForgetCards(cardIDs []CardID) error
+	// SetDueDate sets the due date of the cards. days is a number of days from today or a range, e.g. 0 or 1-7.
+	// Exclamation mark suffix, e.g. 3!, resets the interval of the cards to the due date.
+	SetDueDate(cardIDs []CardID, days string) error
+	// SetNewCardPosition sets the position of a new card in the new cards queue.
+	SetNewCardPosition(cardID CardID, position int64) error
+	// SetCardScheduling overwrites the scheduling of the card, e.g. to restore the one it had before.
+	SetCardScheduling(cardID CardID, scheduling CardScheduling) error
 }
@@ -0,0 +1,33 @@
+package ankiconnect
+
+import (
+	"anki-rest-enhancer/metrics"
+	"github.com/joomcode/errorx"
+	"time"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"anki_helper_ankiconnect_requests_total",
+		"AnkiConnect requests by action and outcome: success, unreachable or error.",
+		"action", "outcome",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"anki_helper_ankiconnect_request_duration_seconds",
+		"Duration of AnkiConnect requests by action, including retries.",
+		metrics.DefaultBuckets,
+		"action",
+	)
+)
+
+func observeRequest(actionName action, start time.Time, err error) {
+	outcome := "success"
+	switch {
+	case errorx.IsOfType(err, Unreachable):
+		outcome = "unreachable"
+	case err != nil:
+		outcome = "error"
+	}
+	requestsTotal.Inc(string(actionName), outcome)
+	requestDuration.Observe(time.Since(start).Seconds(), string(actionName))
+}
@@ -0,0 +1,55 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/util/logx"
+	"log/slog"
+	"sort"
+	"unicode/utf8"
+)
+
+// selectTextsWithinBudget selects texts to convert to speech so that they fit the remaining character budget.
+// Texts are taken in a stable order, so that the same texts are converted if the run is repeated.
+func (h Helper) selectTextsWithinBudget(tasksByText map[string][]ttsTask) (selected map[string]struct{}, skipped []string) {
+	selected = make(map[string]struct{}, len(tasksByText))
+	remaining, limited := 0, false
+	if h.ttsBudget != nil {
+		remaining, limited = h.ttsBudget.Remaining()
+	}
+	if !limited {
+		for text := range tasksByText {
+			selected[text] = struct{}{}
+		}
+		return selected, nil
+	}
+
+	texts := make([]string, 0, len(tasksByText))
+	for text := range tasksByText {
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+	for _, text := range texts {
+		if characters := utf8.RuneCountInString(text); characters <= remaining {
+			selected[text] = struct{}{}
+			remaining -= characters
+		} else {
+			skipped = append(skipped, text)
+		}
+	}
+	return selected, skipped
+}
+
+// finishTTSBudget persists the characters converted to speech that are not saved yet and reports them.
+func (h Helper) finishTTSBudget(logger *slog.Logger, report *Report) {
+	if h.ttsBudget == nil {
+		return
+	}
+	if err := h.ttsBudget.Save(); err != nil {
+		logger.Error("Failed to save text-to-speech usage", logx.Err(err))
+	}
+	if monthCharacters, warn := h.ttsBudget.ShouldWarn(); warn {
+		logger.Warn("Text-to-speech usage is approaching the monthly limit", "characters", monthCharacters)
+	}
+	if usage := h.ttsBudget.Usage(); usage.Characters > 0 {
+		report.TTSUsage = &usage
+	}
+}
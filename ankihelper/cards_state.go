@@ -0,0 +1,294 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/logx"
+	"cmp"
+	"context"
+	"errors"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cardsStateChange describes cards whose state would be changed by a cards state rule.
+type cardsStateChange struct {
+	// Cards are the cards the operation is applied to. Unlock operation suspends them.
+	Cards []ankiconnect.CardID
+	// Unsuspended are the cards unsuspended by unlock operation.
+	Unsuspended []ankiconnect.CardID
+	// Positions are the new positions of the cards, set for reposition operation only.
+	Positions map[ankiconnect.CardID]int64
+	// Failures are the cards whose new state can't be determined.
+	Failures []cardFailure
+}
+
+type cardFailure struct {
+	CardID ankiconnect.CardID
+	NoteID ankiconnect.NoteID
+	Err    error
+}
+
+// cardsStateQuery returns the query for cards matching the rule that are not in the state set by the rule yet,
+// so that repeated runs don't change the same cards. Due date is set for all the matching cards though.
+func cardsStateQuery(rule ankihelperconf.CardsStateRule, noteQuery string) string {
+	query := restrictQuery(rule.Filter, noteQuery)
+	switch rule.Operation {
+	case ankihelperconf.CardsSuspend:
+		return restrictQuery(query, "-is:suspended")
+	case ankihelperconf.CardsUnsuspend:
+		return restrictQuery(query, "is:suspended")
+	case ankihelperconf.CardsForget:
+		return restrictQuery(query, "-is:new")
+	case ankihelperconf.CardsReposition:
+		return restrictQuery(query, "is:new")
+	default:
+		return query
+	}
+}
+
+func (h Helper) findCardsStateChange(rule ankihelperconf.CardsStateRule, noteQuery string) (cardsStateChange, error) {
+	if rule.Operation == ankihelperconf.CardsUnlock {
+		return h.findSiblingsUnlock(rule, noteQuery)
+	}
+	cardIDs, err := h.ankiConnect.FindCards(cardsStateQuery(rule, noteQuery))
+	if err != nil {
+		return cardsStateChange{}, err
+	}
+	if rule.Operation != ankihelperconf.CardsReposition || len(cardIDs) == 0 {
+		return cardsStateChange{Cards: cardIDs}, nil
+	}
+
+	cards, err := h.ankiConnect.CardsInfo(cardIDs)
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to get cards to reposition")
+	}
+	change := cardsStateChange{Positions: make(map[ankiconnect.CardID]int64)}
+	for _, cardID := range cardIDs {
+		card, ok := cards[cardID]
+		if !ok {
+			continue
+		}
+		value, ok := card.Fields[rule.PositionField]
+		if !ok {
+			err := errorx.IllegalState.New("there is no field %q in note %d", rule.PositionField, card.NoteID)
+			change.Failures = append(change.Failures, cardFailure{CardID: cardID, NoteID: card.NoteID, Err: err})
+			continue
+		}
+		position, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			err := errorx.IllegalFormat.Wrap(err, "malformed position %q in field %q", value, rule.PositionField)
+			change.Failures = append(change.Failures, cardFailure{CardID: cardID, NoteID: card.NoteID, Err: err})
+			continue
+		}
+		if position != card.Due {
+			change.Cards = append(change.Cards, cardID)
+			change.Positions[cardID] = position
+		}
+	}
+	return change, nil
+}
+
+func (h Helper) changeCardsState(
+	ctx context.Context,
+	report *Report,
+	rules []ankihelperconf.CardsStateRule,
+	noteQuery string,
+) error {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionCardsState)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	logger.Info("Applying cards state rules...")
+	for i, rule := range rules {
+		ruleLogger := logger.With(logx.KeyRule, ruleTitle(i, rule.Name))
+		action := report.startAction(ActionCardsState, i, rule.Name)
+		if err := action.finish(h.applyCardsStateRule(ruleLogger, action, rule, noteQuery)); err != nil {
+			return errorx.Decorate(err, "failed to apply cards state rule %s", ruleTitle(i, rule.Name))
+		}
+	}
+	logger.Info("Successfully applied cards state rules.")
+	return nil
+}
+
+func (h Helper) applyCardsStateRule(
+	logger *slog.Logger,
+	action *ActionReport,
+	rule ankihelperconf.CardsStateRule,
+	noteQuery string,
+) error {
+	change, err := h.findCardsStateChange(rule, noteQuery)
+	if err != nil {
+		return err
+	}
+	for _, failure := range change.Failures {
+		logger.Warn("Skip card", "card", failure.CardID, logx.KeyNoteID, failure.NoteID, logx.Err(failure.Err))
+		action.noteFailed(failure.NoteID, rule.PositionField, failure.Err)
+	}
+	if len(change.Cards) == 0 && len(change.Unsuspended) == 0 {
+		logger.Info("Found no cards to change", "operation", rule.Operation)
+		return nil
+	}
+	logger.Info("Found cards to change", "operation", rule.Operation, "cards", len(change.Cards)+len(change.Unsuspended))
+	previous, err := h.cardsScheduling(append(slices.Clone(change.Cards), change.Unsuspended...))
+	if err != nil {
+		return errorx.Decorate(err, "failed to get the state of the cards before the change")
+	}
+
+	switch rule.Operation {
+	case ankihelperconf.CardsSuspend:
+		err = h.ankiConnect.Suspend(change.Cards)
+	case ankihelperconf.CardsUnsuspend:
+		err = h.ankiConnect.Unsuspend(change.Cards)
+	case ankihelperconf.CardsForget:
+		err = h.ankiConnect.ForgetCards(change.Cards)
+	case ankihelperconf.CardsSetDue:
+		err = h.ankiConnect.SetDueDate(change.Cards, rule.DueDays)
+	case ankihelperconf.CardsUnlock:
+		if err := h.ankiConnect.Suspend(change.Cards); err != nil {
+			action.Failed += len(change.Cards) + len(change.Unsuspended)
+			return err
+		}
+		action.Succeeded += len(change.Cards)
+		if err := h.ankiConnect.Unsuspend(change.Unsuspended); err != nil {
+			action.Failed += len(change.Unsuspended)
+			return errors.Join(err, h.recordCardsChange(action, change.Cards, previous))
+		}
+		action.Succeeded += len(change.Unsuspended)
+		logger.Info("Successfully unlocked cards", "suspended", len(change.Cards), "unsuspended", len(change.Unsuspended))
+		return h.recordCardsChange(action, append(slices.Clone(change.Cards), change.Unsuspended...), previous)
+	case ankihelperconf.CardsReposition:
+		var repositioned []ankiconnect.CardID
+		for _, cardID := range change.Cards {
+			if err := h.ankiConnect.SetNewCardPosition(cardID, change.Positions[cardID]); err != nil {
+				logger.Warn("Failed to reposition card", "card", cardID, logx.Err(err))
+				action.Failed++
+				continue
+			}
+			action.Succeeded++
+			repositioned = append(repositioned, cardID)
+		}
+		logger.Info("Repositioned cards", "succeeded", action.Succeeded, "failed", action.Failed)
+		return h.recordCardsChange(action, repositioned, previous)
+	default:
+		panic(errorx.Panic(errorx.IllegalState.New("unexpected cards operation %q", rule.Operation)))
+	}
+	if err != nil {
+		action.Failed += len(change.Cards)
+		return err
+	}
+	action.Succeeded += len(change.Cards)
+	logger.Info("Successfully changed cards", "operation", rule.Operation, "cards", len(change.Cards))
+	return h.recordCardsChange(action, change.Cards, previous)
+}
+
+// cardsScheduling returns the scheduling of the cards to record their changes in the journal.
+// Nothing is returned if the journal is not kept.
+func (h Helper) cardsScheduling(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardScheduling, error) {
+	if h.journal == nil || len(cardIDs) == 0 {
+		return nil, nil
+	}
+	cards, err := h.ankiConnect.CardsInfo(cardIDs)
+	if err != nil {
+		return nil, err
+	}
+	scheduling := make(map[ankiconnect.CardID]ankiconnect.CardScheduling, len(cards))
+	for cardID, card := range cards {
+		scheduling[cardID] = card.Scheduling()
+	}
+	return scheduling, nil
+}
+
+// recordCardsChange records the scheduling of the changed cards before and after the change in the journal.
+func (h Helper) recordCardsChange(
+	action *ActionReport,
+	cardIDs []ankiconnect.CardID,
+	previous map[ankiconnect.CardID]ankiconnect.CardScheduling,
+) error {
+	current, err := h.cardsScheduling(cardIDs)
+	if err != nil {
+		return errorx.Decorate(err, "failed to get the state of the cards after the change")
+	}
+	change := journal.Entry{Cards: make(map[ankiconnect.CardID]journal.CardChange)}
+	for cardID, value := range current {
+		if before, ok := previous[cardID]; ok && before != value {
+			change.Cards[cardID] = journal.CardChange{Previous: before, Value: value}
+		}
+	}
+	if len(change.Cards) == 0 {
+		return nil
+	}
+	return h.recordChange(action, change)
+}
+
+// findSiblingsUnlock finds secondary cards of notes whose primary cards are not mature yet, to be suspended,
+// and suspended new secondary cards of notes whose primary cards are mature, to be unsuspended.
+// Notes without primary cards are left intact.
+func (h Helper) findSiblingsUnlock(rule ankihelperconf.CardsStateRule, noteQuery string) (cardsStateChange, error) {
+	unlock := rule.Unlock
+	query := restrictQuery(rule.Filter, noteQuery)
+
+	primaryIDs, err := h.ankiConnect.FindCards(restrictQuery(query, unlock.PrimaryCards))
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to find primary cards")
+	}
+	primary, err := h.ankiConnect.CardsInfo(primaryIDs)
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to get primary cards")
+	}
+	// mature reports whether all the primary cards of a note reached the interval
+	mature := make(map[ankiconnect.NoteID]bool)
+	for _, card := range primary {
+		isMature, ok := mature[card.NoteID]
+		mature[card.NoteID] = (isMature || !ok) && card.Interval >= unlock.MinInterval
+	}
+
+	secondaryQuery := restrictQuery(query, "-("+unlock.PrimaryCards+")")
+	var change cardsStateChange
+	locked, err := h.ankiConnect.FindCards(restrictQuery(secondaryQuery, "is:new -is:suspended"))
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to find secondary cards")
+	}
+	lockedCards, err := h.ankiConnect.CardsInfo(locked)
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to get secondary cards")
+	}
+	for _, cardID := range locked {
+		if isMature, ok := mature[lockedCards[cardID].NoteID]; ok && !isMature {
+			change.Cards = append(change.Cards, cardID)
+		}
+	}
+
+	// only new cards are unsuspended, since reviewed cards are never locked by the rule,
+	// so they are suspended by Anki as leeches or by the user
+	suspended, err := h.ankiConnect.FindCards(restrictQuery(secondaryQuery, "is:new is:suspended"))
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to find suspended secondary cards")
+	}
+	suspendedCards, err := h.ankiConnect.CardsInfo(suspended)
+	if err != nil {
+		return cardsStateChange{}, errorx.Decorate(err, "failed to get suspended secondary cards")
+	}
+	// cards are unlocked in the order of their templates, so that a limited unlock is predictable
+	slices.SortFunc(suspended, func(a, b ankiconnect.CardID) int {
+		if byNote := cmp.Compare(suspendedCards[a].NoteID, suspendedCards[b].NoteID); byNote != 0 {
+			return byNote
+		}
+		return cmp.Compare(suspendedCards[a].Ord, suspendedCards[b].Ord)
+	})
+	unlockedByNote := make(map[ankiconnect.NoteID]int)
+	for _, cardID := range suspended {
+		noteID := suspendedCards[cardID].NoteID
+		if !mature[noteID] || (unlock.PerRun > 0 && unlockedByNote[noteID] >= unlock.PerRun) {
+			continue
+		}
+		change.Unsuspended = append(change.Unsuspended, cardID)
+		unlockedByNote[noteID]++
+	}
+	return change, nil
+}
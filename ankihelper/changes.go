@@ -0,0 +1,80 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/util/lang/set"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OwnChanges describes notes modified by a run of the helper, so that they are not considered changed
+// by the following run.
+type OwnChanges struct {
+	NoteIDs set.Set[ankiconnect.NoteID]
+	// FinishedAt is the end of the run. Notes modified after it are considered changed even if the run modified them.
+	FinishedAt time.Time
+}
+
+// ChangedNotes returns IDs of notes added or modified after the specified moment, except the notes modified
+// by the helper itself.
+//
+// Anki search only supports day precision for modification time (edited:N), so notes edited
+// during the last days are fetched first, and then filtered by their exact modification time.
+func (h Helper) ChangedNotes(since time.Time, now time.Time, own OwnChanges) ([]ankiconnect.NoteID, error) {
+	noteIDs, err := h.ankiConnect.FindNotes(fmt.Sprintf("edited:%d", daysSince(since, now)))
+	if err != nil {
+		return nil, err
+	}
+	notes, err := h.ankiConnect.NotesInfo(noteIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []ankiconnect.NoteID
+	for noteID, note := range notes {
+		// notes with unknown modification time are considered changed to be on the safe side
+		if note.ModifiedAt.IsZero() {
+			changed = append(changed, noteID)
+			continue
+		}
+		ownChange := own.NoteIDs.Contains(noteID) && !note.ModifiedAt.After(own.FinishedAt)
+		if !ownChange && !note.ModifiedAt.Before(since.Truncate(time.Second)) {
+			changed = append(changed, noteID)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+	return changed, nil
+}
+
+// maxRatedDays is the maximal number of days rated:N search accepts.
+const maxRatedDays = 365
+
+// ReviewedNotes returns IDs of notes whose cards were reviewed after the specified moment.
+// Anki search only supports day precision for reviews (rated:N), so all the notes reviewed during the last days
+// are returned.
+func (h Helper) ReviewedNotes(since time.Time, now time.Time) ([]ankiconnect.NoteID, error) {
+	noteIDs, err := h.ankiConnect.FindNotes(fmt.Sprintf("rated:%d", min(daysSince(since, now), maxRatedDays)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(noteIDs, func(i, j int) bool { return noteIDs[i] < noteIDs[j] })
+	return noteIDs, nil
+}
+
+// daysSince returns the number of days between the moments rounded up, at least 1.
+func daysSince(since time.Time, now time.Time) int {
+	return max(int(math.Ceil(now.Sub(since).Hours()/24)), 1)
+}
+
+// NoteIDsQuery returns Anki search query matching the notes with the specified IDs.
+// Use it as Selection.NoteQuery to restrict actions to the notes. The list should not be empty.
+func NoteIDsQuery(noteIDs []ankiconnect.NoteID) string {
+	ids := make([]string, len(noteIDs))
+	for i, noteID := range noteIDs {
+		ids[i] = fmt.Sprint(noteID)
+	}
+	return "nid:" + strings.Join(ids, ",")
+}
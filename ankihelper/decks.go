@@ -0,0 +1,158 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+func (h Helper) ensureDecks(ctx context.Context, report *Report, decks []ankihelperconf.AnkiDeck) error {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionDecks)
+	if len(decks) == 0 {
+		return nil
+	}
+
+	logger.Info("Ensure decks...")
+	existingDecks, err := h.ankiConnect.DeckNames()
+	if err != nil {
+		return err
+	}
+	presets := &deckPresets{api: h.ankiConnect, decks: existingDecks}
+
+	var updated int
+	for i, deck := range decks {
+		deckLogger := logger.With(logx.KeyRule, deck.Name)
+		action := report.startAction(ActionDecks, i, deck.Name)
+		changed, err := h.ensureDeck(deckLogger, presets, deck)
+		if err := action.finish(err); err != nil {
+			action.Failed++
+			return errorx.Decorate(err, "failed to ensure deck %q", deck.Name)
+		}
+		if changed {
+			action.Succeeded++
+			updated++
+		}
+	}
+
+	logger.Info("Finished deck creation", "updated", updated, "upToDate", len(decks)-updated)
+	return nil
+}
+
+// ensureDeck creates the deck and assigns its preset. It reports whether anything has been changed in Anki.
+func (h Helper) ensureDeck(logger *slog.Logger, presets *deckPresets, deck ankihelperconf.AnkiDeck) (changed bool, err error) {
+	if !slices.Contains(presets.decks, deck.Name) {
+		if err := h.ankiConnect.CreateDeck(deck.Name); err != nil {
+			return false, err
+		}
+		logger.Info("Created deck")
+		presets.decks = append(presets.decks, deck.Name)
+		changed = true
+	}
+	if deck.Preset == nil {
+		return changed, nil
+	}
+
+	config, err := h.ankiConnect.GetDeckConfig(deck.Name)
+	if err != nil {
+		return changed, err
+	}
+	if config.Name != deck.Preset.Name {
+		configID, err := presets.find(deck.Preset.Name)
+		if err != nil {
+			return changed, err
+		}
+		if configID == nil {
+			created, err := h.ankiConnect.CloneDeckConfigID(deck.Preset.Name, config.ID)
+			if err != nil {
+				return changed, err
+			}
+			logger.Info("Created deck preset", "preset", deck.Preset.Name)
+			presets.byName[deck.Preset.Name] = created
+			configID = &created
+		}
+		if err := h.ankiConnect.SetDeckConfigID([]string{deck.Name}, *configID); err != nil {
+			return changed, err
+		}
+		logger.Info("Assigned preset to deck", "preset", deck.Preset.Name)
+		changed = true
+
+		config, err = h.ankiConnect.GetDeckConfig(deck.Name)
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	if applyDeckPreset(&config, *deck.Preset) {
+		if err := h.ankiConnect.SaveDeckConfig(config); err != nil {
+			return changed, err
+		}
+		logger.Info("Updated options of deck preset", "preset", deck.Preset.Name)
+		changed = true
+	}
+	return changed, nil
+}
+
+// applyDeckPreset sets the configured options of the preset to the config and reports whether any of them changed.
+func applyDeckPreset(config *ankiconnect.DeckConfig, preset ankihelperconf.AnkiDeckPreset) bool {
+	changed := false
+	if limit := preset.NewCardsPerDay; limit != nil && config.NewCardsPerDay != *limit {
+		config.NewCardsPerDay = *limit
+		changed = true
+	}
+	if limit := preset.ReviewsPerDay; limit != nil && config.ReviewsPerDay != *limit {
+		config.ReviewsPerDay = *limit
+		changed = true
+	}
+	if steps := preset.LearningSteps; steps != nil && !slices.Equal(config.LearningSteps, stepMinutes(steps)) {
+		config.LearningSteps = stepMinutes(steps)
+		changed = true
+	}
+	if steps := preset.RelearningSteps; steps != nil && !slices.Equal(config.RelearningSteps, stepMinutes(steps)) {
+		config.RelearningSteps = stepMinutes(steps)
+		changed = true
+	}
+	return changed
+}
+
+// stepMinutes converts learning steps to minutes, as they are stored by Anki.
+func stepMinutes(steps []time.Duration) []float64 {
+	minutes := make([]float64, len(steps))
+	for i, step := range steps {
+		minutes[i] = step.Minutes()
+	}
+	return minutes
+}
+
+// deckPresets finds deck presets by their names. AnkiConnect can only get the preset of a deck,
+// so presets are collected from all the decks once a preset is looked up.
+type deckPresets struct {
+	api ankiconnect.API
+	// decks are the names of all the decks in Anki.
+	decks []string
+	// byName is nil until the presets are collected.
+	byName map[string]ankiconnect.DeckConfigID
+}
+
+// find returns the ID of the preset with the name, or nil if there is no such preset.
+func (p *deckPresets) find(name string) (*ankiconnect.DeckConfigID, error) {
+	if p.byName == nil {
+		byName := make(map[string]ankiconnect.DeckConfigID)
+		for _, deck := range p.decks {
+			config, err := p.api.GetDeckConfig(deck)
+			if err != nil {
+				return nil, err
+			}
+			byName[config.Name] = config.ID
+		}
+		p.byName = byName
+	}
+	if id, ok := p.byName[name]; ok {
+		return &id, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,210 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/lang/mapx"
+	"anki-rest-enhancer/util/logx"
+	"cmp"
+	"context"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// DuplicateGroup is a group of notes of the same note type having the same normalized key.
+// The notes are merged into the one with the most reviews.
+type DuplicateGroup struct {
+	NoteType string
+	Key      string
+	// Keep is the note the others are merged into.
+	Keep ankiconnect.NoteID
+	// Delete are the notes deleted once their fields and tags are copied to the kept note.
+	Delete []ankiconnect.NoteID
+	// Fields are the values copied to the empty fields of the kept note.
+	Fields map[string]string
+	// Tags are the tags of the deleted notes added to the kept note.
+	Tags []string
+
+	// previousFields are the values of Fields of the kept note before the merge.
+	previousFields map[string]string
+	// deletedFields are the fields of the deleted notes.
+	deletedFields map[ankiconnect.NoteID]map[string]string
+}
+
+// dedupeKey normalizes the value of the key field, so that notes with the same key are considered duplicates.
+func dedupeKey(rule ankihelperconf.DedupeRule, value string) string {
+	for _, processor := range rule.KeyPreprocessors {
+		value = processor.Process(value)
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// findDuplicates finds groups of notes matching the rule that have the same key. Notes with an empty key are ignored.
+func (h Helper) findDuplicates(rule ankihelperconf.DedupeRule) ([]DuplicateGroup, error) {
+	noteIDs, err := h.ankiConnect.FindNotes(rule.NoteFilter)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to find notes")
+	}
+	notes, err := h.ankiConnect.NotesInfo(noteIDs)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to get notes")
+	}
+	slices.Sort(noteIDs)
+
+	type groupKey struct{ noteType, key string }
+	notesByKey := make(map[groupKey][]ankiconnect.NoteInfo)
+	var keys []groupKey
+	for _, noteID := range noteIDs {
+		note, ok := notes[noteID]
+		if !ok {
+			continue
+		}
+		value, ok := note.Fields[rule.KeyField]
+		if !ok {
+			continue
+		}
+		key := groupKey{noteType: note.ModelName, key: dedupeKey(rule, value)}
+		if key.key == "" {
+			continue
+		}
+		if _, ok := notesByKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		notesByKey[key] = append(notesByKey[key], note)
+	}
+
+	var cardIDs []ankiconnect.CardID
+	for _, key := range keys {
+		if duplicates := notesByKey[key]; len(duplicates) > 1 {
+			for _, note := range duplicates {
+				cardIDs = append(cardIDs, note.Cards...)
+			}
+		}
+	}
+	cards, err := h.ankiConnect.CardsInfo(cardIDs)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to get cards of duplicate notes")
+	}
+	reviews := make(map[ankiconnect.NoteID]int)
+	for _, card := range cards {
+		reviews[card.NoteID] += card.Reviews
+	}
+
+	var groups []DuplicateGroup
+	for _, key := range keys {
+		duplicates := notesByKey[key]
+		if len(duplicates) < 2 {
+			continue
+		}
+		// the note with the most reviews is kept, or the oldest one if there are no reviews
+		slices.SortStableFunc(duplicates, func(a, b ankiconnect.NoteInfo) int {
+			return cmp.Compare(reviews[b.ID], reviews[a.ID])
+		})
+		keep := duplicates[0]
+		group := DuplicateGroup{
+			NoteType:       key.noteType,
+			Key:            key.key,
+			Keep:           keep.ID,
+			Fields:         make(map[string]string),
+			previousFields: make(map[string]string),
+			deletedFields:  make(map[ankiconnect.NoteID]map[string]string),
+		}
+		tags := keep.Tags
+		for _, note := range duplicates[1:] {
+			group.Delete = append(group.Delete, note.ID)
+			group.deletedFields[note.ID] = note.Fields
+			for field, value := range note.Fields {
+				_, copied := group.Fields[field]
+				if previous, ok := keep.Fields[field]; ok && !copied && isBlankField(previous) && !isBlankField(value) {
+					group.Fields[field] = value
+					group.previousFields[field] = previous
+				}
+			}
+			missing := missingTags(tags, note.Tags)
+			group.Tags = append(group.Tags, missing...)
+			tags = append(slices.Clone(tags), missing...)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func isBlankField(value string) bool {
+	return strings.TrimSpace(value) == ""
+}
+
+func (h Helper) dedupeNotes(ctx context.Context, report *Report, rules []ankihelperconf.DedupeRule) error {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionDedupe)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	logger.Info("Merging duplicate notes...")
+	for i, rule := range rules {
+		ruleLogger := logger.With(logx.KeyRule, ruleTitle(i, rule.Name))
+		action := report.startAction(ActionDedupe, i, rule.Name)
+		if err := action.finish(h.applyDedupeRule(ruleLogger, action, rule)); err != nil {
+			return errorx.Decorate(err, "failed to apply dedupe rule %s", ruleTitle(i, rule.Name))
+		}
+	}
+	logger.Info("Successfully merged duplicate notes.")
+	return nil
+}
+
+func (h Helper) applyDedupeRule(logger *slog.Logger, action *ActionReport, rule ankihelperconf.DedupeRule) error {
+	groups, err := h.findDuplicates(rule)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		logger.Info("Found no duplicate notes")
+		return nil
+	}
+	logger.Info("Found duplicate notes", "groups", len(groups))
+
+	for _, group := range groups {
+		groupLogger := logger.With(logx.KeyNoteID, group.Keep, "key", group.Key, "deleted", group.Delete)
+		groupLogger.Info("Merge duplicate notes")
+		if err := h.mergeDuplicates(action, group); err != nil {
+			groupLogger.Warn("Failed to merge duplicate notes", logx.Err(err))
+			action.noteFailed(group.Keep, "", err)
+			continue
+		}
+		groupLogger.Debug("Merged duplicate notes", "fields", mapx.Keys(group.Fields), "tags", group.Tags)
+		action.noteSucceeded(group.Keep)
+	}
+	logger.Info("Finished merging duplicate notes", "succeeded", action.Succeeded, "failed", action.Failed)
+	return nil
+}
+
+// mergeDuplicates copies fields and tags to the kept note and deletes the other notes of the group.
+// The deleted notes are recorded in the journal along with the changes of the kept note,
+// so that they could be recreated manually, though undo can't restore them.
+func (h Helper) mergeDuplicates(action *ActionReport, group DuplicateGroup) error {
+	change := journal.Entry{NoteID: group.Keep, DeletedNotes: group.deletedFields}
+	if len(group.Fields) > 0 {
+		fieldUpdates := make(map[string]ankiconnect.FieldUpdate, len(group.Fields))
+		change.Fields = make(map[string]journal.FieldChange, len(group.Fields))
+		for field, value := range group.Fields {
+			value := value
+			fieldUpdates[field] = ankiconnect.FieldUpdate{Value: &value}
+			change.Fields[field] = journal.FieldChange{Previous: group.previousFields[field], Value: value}
+		}
+		if err := h.ankiConnect.UpdateNoteFields(group.Keep, fieldUpdates); err != nil {
+			return err
+		}
+	}
+	if len(group.Tags) > 0 {
+		if err := h.ankiConnect.AddTags([]ankiconnect.NoteID{group.Keep}, group.Tags); err != nil {
+			return err
+		}
+		change.AddedTags = group.Tags
+	}
+	if err := h.recordChange(action, change); err != nil {
+		return errorx.Decorate(err, "duplicates are not deleted, since the merge is not recorded")
+	}
+	return h.ankiConnect.DeleteNotes(group.Delete)
+}
@@ -3,171 +3,401 @@ package ankihelper
 import (
 	"anki-rest-enhancer/ankiconnect"
 	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/audioprocessing"
 	"anki-rest-enhancer/azuretts"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/llm"
+	"anki-rest-enhancer/llmcache"
 	"anki-rest-enhancer/noteprocessing"
 	"anki-rest-enhancer/ratelimit"
+	"anki-rest-enhancer/statestore"
+	"anki-rest-enhancer/ttsbudget"
 	"anki-rest-enhancer/util/iox"
 	"anki-rest-enhancer/util/lang"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/logx"
 	"anki-rest-enhancer/util/stringx"
 	"anki-rest-enhancer/util/templatex"
 	"context"
+	"crypto/md5"
 	"fmt"
 	"github.com/joomcode/errorx"
-	"log"
+	"log/slog"
 	"os"
+	"path"
+	"strings"
+	"text/template"
+	"unicode/utf8"
 )
 
 func NewHelper(
 	ankiConnect ankiconnect.API,
 	azureTTS azuretts.API,
 	scriptRunner noteprocessing.ScriptRunner,
+	audioProcessor audioprocessing.Processor,
+	// stateStore is optional. If it's nil, note processing rules are applied to all the matching notes on each run.
+	stateStore statestore.Store,
+	// changeJournal is optional. If it's nil, modifications are not recorded and can't be reverted.
+	changeJournal journal.Journal,
+	// ttsBudget is optional. If it's nil, characters converted to speech are neither limited nor reported.
+	ttsBudget *ttsbudget.VoiceBudget,
+	// llmAPI is optional. If it's nil, llm actions fail.
+	llmAPI llm.API,
+	// llmCache is optional. If it's nil, replies of the language model are not cached.
+	llmCache llmcache.Cache,
 ) *Helper {
 	return &Helper{
-		ankiConnect:  ankiConnect,
-		azureTTS:     azureTTS,
-		scriptRunner: scriptRunner,
+		ankiConnect:    ankiConnect,
+		azureTTS:       azureTTS,
+		scriptRunner:   scriptRunner,
+		audioProcessor: audioProcessor,
+		stateStore:     stateStore,
+		journal:        changeJournal,
+		ttsBudget:      ttsBudget,
+		llm:            llmAPI,
+		llmCache:       llmCache,
 	}
 }
 
 type Helper struct {
-	ankiConnect  ankiconnect.API
-	azureTTS     azuretts.API
-	scriptRunner noteprocessing.ScriptRunner
+	ankiConnect    ankiconnect.API
+	azureTTS       azuretts.API
+	scriptRunner   noteprocessing.ScriptRunner
+	audioProcessor audioprocessing.Processor
+	stateStore     statestore.Store
+	journal        journal.Journal
+	ttsBudget      *ttsbudget.VoiceBudget
+	llm            llm.API
+	llmCache       llmcache.Cache
 }
 
-func (h Helper) Run(conf ankihelperconf.Actions) error {
-	ctx := context.TODO()
+// Run executes all the configured actions.
+func (h Helper) Run(ctx context.Context, conf ankihelperconf.Actions) error {
+	_, err := h.RunSelected(ctx, conf, Selection{})
+	return err
+}
 
-	if err := h.uploadMedia(conf.UploadMedia); err != nil {
-		return err
+// RunSelected executes configured actions chosen by the selection.
+// The report is returned even if the run is aborted with an error, and covers the actions executed so far.
+func (h Helper) RunSelected(ctx context.Context, conf ankihelperconf.Actions, selection Selection) (Report, error) {
+	selected := selection.Apply(conf)
+	report := &Report{}
+
+	if err := h.uploadMedia(ctx, report, selected.UploadMedia); err != nil {
+		return *report, err
 	}
-	if err := h.ensureNoteTypes(conf.NoteTypes); err != nil {
-		return err
+	if err := h.ensureNoteTypes(ctx, report, selected.NoteTypes); err != nil {
+		return *report, err
 	}
-	if err := h.processNotes(ctx, conf.NoteProcessing); err != nil {
-		return err
+	if err := h.ensureDecks(ctx, report, selected.Decks); err != nil {
+		return *report, err
 	}
-	if err := h.generateTTS(conf); err != nil {
-		return err
+	// imported notes are created before note processing and TTS, so that the rest of their fields are filled in
+	if err := h.importNotes(ctx, report, selected.Import); err != nil {
+		return *report, err
 	}
-	if err := h.organizeCards(conf.CardsOrganization); err != nil {
-		return err
+	if err := h.dedupeNotes(ctx, report, selected.Dedupe); err != nil {
+		return *report, err
 	}
-	return nil
+	if err := h.processNotes(ctx, report, selected.NoteProcessing, selection.NoteQuery); err != nil {
+		return *report, err
+	}
+	// generated fields may be converted to speech by the same run
+	if err := h.generateWithLLM(ctx, report, selected.LLM, selection.NoteQuery); err != nil {
+		return *report, err
+	}
+	// NOTE: all the configured note types are passed to resolve generated note type references
+	// even if note type creation is not selected.
+	if err := h.generateTTS(ctx, report, selected.TTS, conf.NoteTypes, selection.NoteQuery); err != nil {
+		return *report, err
+	}
+	if err := h.organizeCards(ctx, report, selected.CardsOrganization, selection.cardsNoteQuery()); err != nil {
+		return *report, err
+	}
+	if err := h.changeCardsState(ctx, report, selected.CardsState, selection.cardsNoteQuery()); err != nil {
+		return *report, err
+	}
+	return *report, nil
 }
 
 type ttsTask struct {
 	NoteID          ankiconnect.NoteID
+	NoteType        string
 	Text            string
 	TargetFieldName string
+	// PreviousAudio is the value of the target field before the audio is generated.
+	PreviousAudio string
+	// SourceIdx is the index of the ttsTaskSource this task was produced by.
+	SourceIdx int
 }
 
 type ttsTaskSource struct {
+	// ActionIdx and ActionName identify the TTS action this source was produced by.
+	ActionIdx  int
+	ActionName string
+
 	NoteFilter, TextField, AudioField string
 	TextPreprocessors                 []ankihelperconf.TextProcessor
+	AudioPostProcessing               []ankihelperconf.AudioProcessingStep
+	AudioFileName                     *template.Template
+}
+
+// AudioFileNameData is the data available in the audio file name template of a TTS action.
+type AudioFileNameData struct {
+	// NoteType is the name of the note's type.
+	NoteType string
+	NoteID   ankiconnect.NoteID
+	// Field is the name of the field the audio is stored in.
+	Field string
+	// TextField is the name of the field the text was taken from.
+	TextField string
+	// Hash is the MD5 hash of the audio data.
+	Hash string
+	// Format is the extension of the audio file, e.g. mp3
+	Format string
 }
 
-func (h Helper) uploadMedia(media []ankihelperconf.AnkiUploadMedia) error {
+func (h Helper) uploadMedia(ctx context.Context, report *Report, media []ankihelperconf.AnkiUploadMedia) error {
 	for i, mediaUpload := range media {
-		if err := h.uploadSingleMedia(mediaUpload); err != nil {
-			return errorx.Decorate(err, "failed to upload media #%d", i)
+		logger := logx.FromContext(ctx).With(logx.KeyAction, ActionUploadMedia, logx.KeyRule, ruleTitle(i, mediaUpload.Name))
+		action := report.startAction(ActionUploadMedia, i, mediaUpload.Name)
+		if err := action.finish(h.uploadSingleMedia(logger, mediaUpload)); err != nil {
+			action.Failed++
+			return errorx.Decorate(err, "failed to upload media %s", ruleTitle(i, mediaUpload.Name))
 		}
+		action.Succeeded++
 	}
 	return nil
 }
 
-func (h Helper) uploadSingleMedia(media ankihelperconf.AnkiUploadMedia) error {
+func (h Helper) uploadSingleMedia(logger *slog.Logger, media ankihelperconf.AnkiUploadMedia) error {
 	f, err := os.Open(media.FilePath)
 	if err != nil {
 		return errorx.ExternalError.Wrap(err, "failed to open media file %q", media.FilePath)
 	}
 	defer iox.Close(f)
 
-	log.Printf("Uploading file %q to Anki under name %q...", media.FilePath, media.AnkiName)
+	logger.Info("Uploading media file to Anki", "path", media.FilePath, "ankiName", media.AnkiName)
 	return h.ankiConnect.StoreMediaFile(media.AnkiName, f, true)
 }
 
-func (h Helper) generateTTS(conf ankihelperconf.Actions) error {
-	log.Println("Generate test-to-speech...")
+func (h Helper) generateTTS(
+	ctx context.Context,
+	report *Report,
+	tts []ankihelperconf.AnkiTTS,
+	noteTypes []ankihelperconf.AnkiNoteType,
+	noteQuery string,
+) (err error) {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionTTS)
+	logger.Info("Generate text-to-speech...")
+
+	// All the TTS actions are executed together, so they share the duration and the error.
+	actions := make([]*ActionReport, len(tts))
+	for i, action := range tts {
+		actions[i] = report.startAction(ActionTTS, i, action.Name)
+	}
+	defer func() {
+		for _, action := range actions {
+			_ = action.finish(err)
+		}
+	}()
+	defer h.finishTTSBudget(logger, report)
 
 	// 0. Determine how to look for notes with missing Audio
-	taskSources, err := h.getTTSTaskSources(conf)
+	taskSources, err := h.getTTSTaskSources(tts, noteTypes)
 	if err != nil {
 		return err
 	}
 
 	// 1. Find all the notes with missing audio in Anki
-	ttsTasks, err := h.findTTSTasks(taskSources)
+	ttsTasks, err := h.findTTSTasks(taskSources, noteQuery)
 	if err != nil {
 		return err
 	}
 	if len(ttsTasks) == 0 {
-		log.Println("No text to generate speech found. Skip text-to-speech generation")
+		logger.Info("No text to generate speech found. Skip text-to-speech generation")
 		return nil
 	}
 
-	// 2. Generate audio for all the texts
-	texts := make(map[string]struct{}, len(ttsTasks))
+	// 2. Generate audio for all the texts and update Anki notes as soon as each audio is ready.
+	// Since note filters only match notes with empty audio fields, an interrupted generation
+	// is resumed from where it stopped on the next run.
+	tasksByText := make(map[string][]ttsTask, len(ttsTasks))
 	for task := range ttsTasks {
-		texts[task.Text] = struct{}{}
+		tasksByText[task.Text] = append(tasksByText[task.Text], task)
+	}
+	texts, skippedTexts := h.selectTextsWithinBudget(tasksByText)
+	if len(skippedTexts) > 0 {
+		var skippedTasks int
+		for _, text := range skippedTexts {
+			for _, task := range tasksByText[text] {
+				actions[taskSources[task.SourceIdx].ActionIdx].Skipped++
+				skippedTasks++
+			}
+		}
+		logger.Warn("Text-to-speech character budget is exhausted, skip the remaining fields till the next run",
+			"texts", len(skippedTexts), "fields", skippedTasks)
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+
+	sourceLoggers := make([]*slog.Logger, len(taskSources))
+	for i, source := range taskSources {
+		sourceLoggers[i] = logger.With(logx.KeyRule, ruleTitle(source.ActionIdx, source.ActionName))
 	}
-	textToSpeech := h.azureTTS.TextToSpeech(texts)
 
-	// 3. Update Anki Cards
 	var succeeded, failed int
-	for task := range ttsTasks {
-		speech := textToSpeech[task.Text]
-		if err := speech.Error; err != nil {
-			log.Printf("Skip field %q in note %d due to text-to-speech error: %+v", task.TargetFieldName, task.NoteID, err)
-			failed++
-			continue
+	err = h.azureTTS.TextToSpeech(ctx, texts, func(text string, speech azuretts.TextToSpeechResult) {
+		if speech.Error == nil && h.ttsBudget != nil {
+			h.ttsBudget.Consume(utf8.RuneCountInString(text))
+			// the usage is saved as soon as it's paid for, so that it's not lost if the run is interrupted
+			if err := h.ttsBudget.Save(); err != nil {
+				logger.Error("Failed to save text-to-speech usage", logx.Err(err))
+			}
 		}
-		err := h.ankiConnect.UpdateNoteFields(task.NoteID, map[string]ankiconnect.FieldUpdate{
-			task.TargetFieldName: {AudioData: speech.AudioMP3},
-		})
-		if err != nil {
-			log.Printf("Failed to update field %q of note %d due to AnkiConnect error: %+v", task.TargetFieldName, task.NoteID, err)
-			failed++
-			continue
+		// the same text may be post-processed differently by different task sources
+		processedBySource := make(map[int]audioprocessing.Audio)
+		for _, task := range tasksByText[text] {
+			action := actions[taskSources[task.SourceIdx].ActionIdx]
+			taskLogger := sourceLoggers[task.SourceIdx].With(logx.KeyNoteID, task.NoteID, logx.KeyField, task.TargetFieldName)
+			if err := speech.Error; err != nil {
+				taskLogger.Warn("Skip field due to text-to-speech error", logx.Err(err))
+				action.noteFailed(task.NoteID, task.TargetFieldName, err)
+				failed++
+				continue
+			}
+			audio, ok := processedBySource[task.SourceIdx]
+			if !ok {
+				audio = audioprocessing.Audio{Data: speech.Audio, Format: speech.Format}
+				if steps := taskSources[task.SourceIdx].AudioPostProcessing; len(steps) > 0 {
+					processed, err := h.audioProcessor.Process(ctx, steps, audio)
+					if err != nil {
+						taskLogger.Warn("Skip field due to audio post-processing error", logx.Err(err))
+						action.noteFailed(task.NoteID, task.TargetFieldName, err)
+						failed++
+						continue
+					}
+					audio = processed
+				}
+				processedBySource[task.SourceIdx] = audio
+			}
+			fileName, err := h.audioFileName(taskSources[task.SourceIdx], task, audio)
+			if err != nil {
+				taskLogger.Warn("Skip field due to malformed audio file name", logx.Err(err))
+				action.noteFailed(task.NoteID, task.TargetFieldName, err)
+				failed++
+				continue
+			}
+			update := ankiconnect.FieldUpdate{AudioData: audio.Data, AudioFormat: audio.Format, AudioFileName: fileName}
+			err = h.ankiConnect.UpdateNoteFields(task.NoteID, map[string]ankiconnect.FieldUpdate{task.TargetFieldName: update})
+			if err != nil {
+				taskLogger.Warn("Failed to update field due to AnkiConnect error", logx.Err(err))
+				action.noteFailed(task.NoteID, task.TargetFieldName, err)
+				failed++
+				continue
+			}
+			err = h.recordChange(action, journal.Entry{
+				NoteID: task.NoteID,
+				Fields: map[string]journal.FieldChange{
+					task.TargetFieldName: {Previous: task.PreviousAudio, Value: update.AudioValue()},
+				},
+			})
+			if err != nil {
+				taskLogger.Warn("Stored generated audio, but failed to record it in the journal", logx.Err(err))
+				action.noteFailed(task.NoteID, task.TargetFieldName, err)
+				failed++
+				continue
+			}
+			taskLogger.Debug("Stored generated audio", "fileName", fileName)
+			action.noteSucceeded(task.NoteID)
+			succeeded++
 		}
-		succeeded++
+	})
+	if err != nil {
+		return errorx.Decorate(err, "text-to-speech generation interrupted after %d/%d generations (succeeded/failed)", succeeded, failed)
 	}
 
-	log.Printf("Finished text-to-speech generation. Generations count (succeeded/failed): %d/%d", succeeded, failed)
+	logger.Info("Finished text-to-speech generation", "succeeded", succeeded, "failed", failed)
 	return nil
 }
 
-func (h Helper) getTTSTaskSources(conf ankihelperconf.Actions) ([]ttsTaskSource, error) {
+// mediaFileNameReplacer replaces characters that are not allowed in file names on some platforms.
+var mediaFileNameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", `"`, "_", "<", "_", ">", "_", "|", "_",
+)
+
+// audioFileName renders the audio file name template of the task source.
+// Empty name is returned if the source doesn't define the template, so that the default name is used.
+func (h Helper) audioFileName(source ttsTaskSource, task ttsTask, audio audioprocessing.Audio) (string, error) {
+	if source.AudioFileName == nil {
+		return "", nil
+	}
+	data := AudioFileNameData{
+		NoteType:  task.NoteType,
+		NoteID:    task.NoteID,
+		Field:     task.TargetFieldName,
+		TextField: source.TextField,
+		Hash:      fmt.Sprintf("%x", md5.Sum(audio.Data)),
+		Format:    audio.Format,
+	}
+	name, err := templatex.Execute(source.AudioFileName, data)
+	if err != nil {
+		return "", errorx.IllegalFormat.Wrap(err, "failed to execute audio file name template")
+	}
+	name = mediaFileNameReplacer.Replace(strings.TrimSpace(name))
+	if name == "" {
+		return "", errorx.IllegalState.New("audio file name template produced an empty name")
+	}
+	// the template may end with an extension of another format, e.g. if post-processing converts the audio
+	if ext := path.Ext(name); audioExtensions.Contains(strings.ToLower(strings.TrimPrefix(ext, "."))) {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name + "." + audio.Format, nil
+}
+
+// audioExtensions are the extensions of audio files replaced in rendered audio file names.
+var audioExtensions = set.FromSlice("mp3", "opus", "ogg", "oga", "wav", "webm", "amr", "m4a", "aac", "flac")
+
+func (h Helper) getTTSTaskSources(ttsActions []ankihelperconf.AnkiTTS, noteTypes []ankihelperconf.AnkiNoteType) ([]ttsTaskSource, error) {
 	noteTypeByName := map[string]ankihelperconf.AnkiNoteType{}
-	for _, noteType := range conf.NoteTypes {
+	for _, noteType := range noteTypes {
 		noteTypeByName[noteType.Name] = noteType
 	}
 
 	// 0. Determine note filters to use
 	var taskSources []ttsTaskSource
-	for i, tts := range conf.TTS {
+	for i, tts := range ttsActions {
 		switch {
 		case tts.Fields != nil:
 			taskSources = append(taskSources, ttsTaskSource{
-				NoteFilter:        tts.Fields.NoteFilter,
-				TextField:         tts.Fields.TextField,
-				AudioField:        tts.Fields.AudioField,
-				TextPreprocessors: tts.TextPreprocessors,
+				ActionIdx:           i,
+				ActionName:          tts.Name,
+				NoteFilter:          tts.Fields.NoteFilter,
+				TextField:           tts.Fields.TextField,
+				AudioField:          tts.Fields.AudioField,
+				TextPreprocessors:   tts.TextPreprocessors,
+				AudioPostProcessing: tts.AudioPostProcessing,
+				AudioFileName:       tts.AudioFileName,
 			})
 		case tts.GeneratedNoteTypeName != nil:
 			typeName := *tts.GeneratedNoteTypeName
 			noteType, ok := noteTypeByName[typeName]
 			if !ok {
-				return nil, errorx.IllegalState.New("Broken generated note type reference %q in TTS #%d", typeName, i)
+				return nil, errorx.IllegalState.New("Broken generated note type reference %q in TTS %s", typeName, ruleTitle(i, tts.Name))
 			}
 			for _, field := range noteType.Fields {
 				names := h.fieldNames(field)
 				if names.Field != "" && names.FieldVoiceover != "" {
 					taskSources = append(taskSources, ttsTaskSource{
-						NoteFilter:        fmt.Sprintf(`"note:%s" "%s:_*" "%s:"`, typeName, names.Field, names.FieldVoiceover),
-						TextField:         names.Field,
-						AudioField:        names.FieldVoiceover,
-						TextPreprocessors: tts.TextPreprocessors,
+						ActionIdx:           i,
+						ActionName:          tts.Name,
+						NoteFilter:          fmt.Sprintf(`"note:%s" "%s:_*" "%s:"`, typeName, names.Field, names.FieldVoiceover),
+						TextField:           names.Field,
+						AudioField:          names.FieldVoiceover,
+						TextPreprocessors:   tts.TextPreprocessors,
+						AudioPostProcessing: tts.AudioPostProcessing,
+						AudioFileName:       tts.AudioFileName,
 					})
 				}
 			}
@@ -178,10 +408,11 @@ func (h Helper) getTTSTaskSources(conf ankihelperconf.Actions) ([]ttsTaskSource,
 	return taskSources, nil
 }
 
-func (h Helper) findTTSTasks(taskSources []ttsTaskSource) (map[ttsTask]struct{}, error) {
+// findTTSTasks finds notes missing audio. noteQuery optionally restricts the notes, see Selection.NoteQuery.
+func (h Helper) findTTSTasks(taskSources []ttsTaskSource, noteQuery string) (map[ttsTask]struct{}, error) {
 	ttsTasks := make(map[ttsTask]struct{})
 	for i, tts := range taskSources {
-		noteIDs, err := h.ankiConnect.FindNotes(tts.NoteFilter)
+		noteIDs, err := h.ankiConnect.FindNotes(restrictQuery(tts.NoteFilter, noteQuery))
 		if err != nil {
 			return nil, errorx.Decorate(err, "failed to find notes matching filter for TTS #%d", i)
 		}
@@ -202,8 +433,11 @@ func (h Helper) findTTSTasks(taskSources []ttsTaskSource) (map[ttsTask]struct{},
 
 			task := ttsTask{
 				NoteID:          noteID,
+				NoteType:        note.ModelName,
 				Text:            text,
 				TargetFieldName: tts.AudioField,
+				PreviousAudio:   note.Fields[tts.AudioField],
+				SourceIdx:       i,
 			}
 			ttsTasks[task] = struct{}{}
 		}
@@ -211,13 +445,14 @@ func (h Helper) findTTSTasks(taskSources []ttsTaskSource) (map[ttsTask]struct{},
 	return ttsTasks, nil
 }
 
-func (h Helper) ensureNoteTypes(noteTypes []ankihelperconf.AnkiNoteType) error {
+func (h Helper) ensureNoteTypes(ctx context.Context, report *Report, noteTypes []ankihelperconf.AnkiNoteType) error {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionNoteTypes)
 	if len(noteTypes) == 0 {
-		log.Println("No note types defined in the configuration. Skip note type creation.")
+		logger.Info("No note types defined in the configuration. Skip note type creation.")
 		return nil
 	}
 
-	log.Println("Ensure note types...")
+	logger.Info("Ensure note types...")
 	existingNoteTypeNamesSlice, err := h.ankiConnect.ModelNames()
 	if err != nil {
 		return err
@@ -228,24 +463,37 @@ func (h Helper) ensureNoteTypes(noteTypes []ankihelperconf.AnkiNoteType) error {
 	}
 
 	var created, skipped int
-	for _, noteType := range noteTypes {
+	for i, noteType := range noteTypes {
+		action := report.startAction(ActionNoteTypes, i, noteType.Name)
 		if _, ok := existingNoteTypeNamesSet[noteType.Name]; ok {
-			log.Printf("Note Type %q already exists in Anki. Skip its creation...", noteType.Name)
+			logger.Info("Note type already exists in Anki. Skip its creation...", logx.KeyRule, noteType.Name)
+			_ = action.finish(nil)
 			skipped++
 			continue
 		}
 
-		if err := h.createNoteType(noteType); err != nil {
+		if err := action.finish(h.createNoteType(noteType)); err != nil {
+			action.Failed++
 			return errorx.Decorate(err, "failed to create type type %q", noteType.Name)
 		}
+		action.Succeeded++
 		created++
 	}
 
-	log.Printf("Finished Note Type creation (created/skipped): %d/%d", created, skipped)
+	logger.Info("Finished note type creation", "created", created, "skipped", skipped)
 	return nil
 }
 
 func (h Helper) createNoteType(conf ankihelperconf.AnkiNoteType) error {
+	params, err := h.noteTypeModel(conf)
+	if err != nil {
+		return err
+	}
+	return h.ankiConnect.CreateModel(params)
+}
+
+// noteTypeModel generates Anki model definition for the configured note type.
+func (h Helper) noteTypeModel(conf ankihelperconf.AnkiNoteType) (ankiconnect.CreateModelParams, error) {
 	// Generate field names. First, we add Field, FieldExample and FieldExplanation
 	// Voiceover fields are added at the end of the field list since they are not intended for manual modification
 	var fieldNames []string
@@ -271,18 +519,18 @@ func (h Helper) createNoteType(conf ankihelperconf.AnkiNoteType) error {
 
 			cardTemplateName, err := templatex.Execute(cardTemplate.Name, substitutions)
 			if err != nil {
-				return errorx.Decorate(err, "failed to build card template name for template #%d and field %q", tmplIdx, field.Name)
+				return ankiconnect.CreateModelParams{}, errorx.Decorate(err, "failed to build card template name for template #%d and field %q", tmplIdx, field.Name)
 			}
 			if err := ankihelperconf.ValidateName(cardTemplateName); err != nil {
-				return errorx.Decorate(err, "got invalid template name after variables substitution: %s", cardTemplateName)
+				return ankiconnect.CreateModelParams{}, errorx.Decorate(err, "got invalid template name after variables substitution: %s", cardTemplateName)
 			}
 			front, err := templatex.Execute(cardTemplate.Front, substitutions)
 			if err != nil {
-				return errorx.Decorate(err, "failed to build card template front for template #%d and field %q", tmplIdx, field.Name)
+				return ankiconnect.CreateModelParams{}, errorx.Decorate(err, "failed to build card template front for template #%d and field %q", tmplIdx, field.Name)
 			}
 			back, err := templatex.Execute(cardTemplate.Back, substitutions)
 			if err != nil {
-				return errorx.Decorate(err, "failed to build card template back for template #%d and field %q", tmplIdx, field.Name)
+				return ankiconnect.CreateModelParams{}, errorx.Decorate(err, "failed to build card template back for template #%d and field %q", tmplIdx, field.Name)
 			}
 
 			templates = append(templates, ankiconnect.CreateModelCardTemplate{
@@ -293,15 +541,13 @@ func (h Helper) createNoteType(conf ankihelperconf.AnkiNoteType) error {
 		}
 	}
 
-	params := ankiconnect.CreateModelParams{
+	return ankiconnect.CreateModelParams{
 		ModelName:     conf.Name,
 		InOrderFields: fieldNames,
 		CSS:           conf.CSS,
 		IsCloze:       false,
 		CardTemplates: templates,
-	}
-
-	return h.ankiConnect.CreateModel(params)
+	}, nil
 }
 
 type FieldNames struct {
@@ -319,55 +565,38 @@ func (h Helper) fieldNames(field ankihelperconf.AnkiNoteField) FieldNames {
 	return names
 }
 
-func (h Helper) organizeCards(rules []ankihelperconf.NotesOrganizationRule) error {
-	log.Println("Applying notes organization rules...")
-	for i, rule := range rules {
-		log.Printf("Applying %d-th notes organization rule...", i)
-		if err := h.applyOrganizationRule(rule); err != nil {
-			return errorx.Decorate(err, "failed to apply %d-th notes organization rule", i)
-		}
-	}
-	log.Println("Successfully applied notes organization rules.")
-	return nil
-}
-
-func (h Helper) applyOrganizationRule(rule ankihelperconf.NotesOrganizationRule) error {
-	targetDeck := rule.TargetDeckName
-	query := fmt.Sprintf(`-"deck:%s" %s`, targetDeck, rule.NotesFilter)
-	cardIDs, err := h.ankiConnect.FindCards(query)
-	if err != nil {
-		return err
-	}
-	if len(cardIDs) == 0 {
-		log.Printf("Found no cards to be moved to deck %s.", targetDeck)
-		return nil
-	}
-	log.Printf("Found %d cards to be moved to deck %s", len(cardIDs), targetDeck)
-
-	if err := h.ankiConnect.ChangeDeck(targetDeck, cardIDs); err != nil {
-		return err
-	}
-	log.Printf("Successfully moved %d cards to deck %s", len(cardIDs), targetDeck)
-	return nil
-}
-
-func (h Helper) processNotes(ctx context.Context, rules []ankihelperconf.NoteProcessingRule) error {
-	log.Println("Process notes...")
+func (h Helper) processNotes(
+	ctx context.Context,
+	report *Report,
+	rules []ankihelperconf.NoteProcessingRule,
+	noteQuery string,
+) error {
+	ctx = logx.With(ctx, logx.KeyAction, ActionNoteProcessing)
+	logx.FromContext(ctx).Info("Process notes...")
 
 	for i, rule := range rules {
-		log.Printf("Running note processing rule #%d...", i)
-		if err := h.applyProcessingRule(ctx, rule); err != nil {
-			return errorx.Decorate(err, "failed to execute note population rule #%d", i)
+		ruleCtx := logx.With(ctx, logx.KeyRule, ruleTitle(i, rule.Name))
+		logx.FromContext(ruleCtx).Info("Running note processing rule...")
+		action := report.startAction(ActionNoteProcessing, i, rule.Name)
+		stateKey := processingStateKey(i, rule)
+		if err := action.finish(h.applyProcessingRule(ruleCtx, action, stateKey, rule, noteQuery)); err != nil {
+			return errorx.Decorate(err, "failed to execute note population rule %s", ruleTitle(i, rule.Name))
 		}
 	}
 
-	log.Println("Successfully completed notes population with auto-generated content!")
+	logx.FromContext(ctx).Info("Successfully completed notes population with auto-generated content!")
 	return nil
 }
 
-func (h Helper) applyProcessingRule(ctx context.Context, rule ankihelperconf.NoteProcessingRule) error {
+func (h Helper) applyProcessingRule(
+	ctx context.Context,
+	action *ActionReport,
+	stateKey string,
+	rule ankihelperconf.NoteProcessingRule,
+	noteQuery string,
+) error {
 	// 1. find notes to populate
-	noteIDs, err := h.ankiConnect.FindNotes(rule.NoteFilter)
+	noteIDs, err := h.ankiConnect.FindNotes(restrictQuery(rule.NoteFilter, noteQuery))
 	if err != nil {
 		return err
 	}
@@ -375,31 +604,50 @@ func (h Helper) applyProcessingRule(ctx context.Context, rule ankihelperconf.Not
 	if err != nil {
 		return err
 	}
-	log.Printf("Found %d notes to process...", len(notes))
+	logx.FromContext(ctx).Info("Found notes to process", "notes", len(notes))
 
 	// 2. for each note, run population
 	throttler := ratelimit.NewThrottler(rule.MinPauseBetweenExecutions)
 	idx := 0
 	for noteID, note := range notes {
 		idx++
+		fingerprint := processingFingerprint(rule, note.Fields)
+		if h.isUpToDate(stateKey, noteID, fingerprint) {
+			action.Skipped++
+			continue
+		}
 		throttler.Throttle()
 
-		err := h.processNote(ctx, rule, note, idx, len(notes))
+		noteCtx := logx.With(ctx, logx.KeyNoteID, noteID)
+		fields, modified, err := h.processNote(noteCtx, action, rule, note, idx, len(notes))
 		if err != nil {
-			log.Printf("Failed to process note %d, error: %s", noteID, err)
+			logx.FromContext(noteCtx).Warn("Failed to process note", logx.Err(err))
+			action.noteFailed(noteID, "", err)
+			h.recordProcessingState(stateKey, noteID, fingerprint, err)
 			continue
 		}
+		if modified {
+			action.noteSucceeded(noteID)
+		} else {
+			action.Succeeded++
+		}
+		// the fingerprint is taken after the modification, so that the note is not processed again because of it
+		h.recordProcessingState(stateKey, noteID, processingFingerprint(rule, fields), nil)
+	}
+	if action.Skipped > 0 {
+		logx.FromContext(ctx).Info("Skipped notes processed by previous runs with the same inputs", "notes", action.Skipped)
 	}
 
-	return nil
+	return h.saveState()
 }
 
 func (h Helper) processNote(
 	ctx context.Context,
+	action *ActionReport,
 	rule ankihelperconf.NoteProcessingRule,
 	note ankiconnect.NoteInfo,
 	noteIdx, totalNotes int,
-) error {
+) (fields map[string]string, modified bool, err error) {
 	progress := noteprocessing.ProgressInfo{
 		CurrentNoteIndex: noteIdx,
 		TotalNotesCount:  totalNotes,
@@ -410,7 +658,7 @@ func (h Helper) processNote(
 	}
 	modifications, err := h.scriptRunner.RunScript(ctx, rule, noteData, progress)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	fieldUpdates := make(map[string]ankiconnect.FieldUpdate)
@@ -434,15 +682,36 @@ func (h Helper) processNote(
 		}
 	}
 
+	fields = make(map[string]string, len(note.Fields))
+	for field, value := range note.Fields {
+		fields[field] = value
+	}
+	change := journal.Entry{NoteID: note.ID}
 	if len(fieldUpdates) > 0 {
+		change.Fields = make(map[string]journal.FieldChange, len(fieldUpdates))
+		for field, update := range fieldUpdates {
+			change.Fields[field] = journal.FieldChange{Previous: fields[field], Value: *update.Value}
+			fields[field] = *update.Value
+		}
 		if err := h.ankiConnect.UpdateNoteFields(note.ID, fieldUpdates); err != nil {
-			return err
+			return nil, false, err
 		}
 	}
+	var addTagsErr error
 	if len(tagsToAdd) > 0 {
-		if err := h.ankiConnect.AddTags([]ankiconnect.NoteID{note.ID}, tagsToAdd); err != nil {
-			return err
+		addTagsErr = h.ankiConnect.AddTags([]ankiconnect.NoteID{note.ID}, tagsToAdd)
+		if addTagsErr == nil {
+			change.AddedTags = missingTags(note.Tags, tagsToAdd)
 		}
 	}
-	return nil
+	// fields are recorded even if tags failed to be added, since they are modified anyway
+	if len(change.Fields) > 0 || len(change.AddedTags) > 0 {
+		if err := h.recordChange(action, change); err != nil {
+			return nil, true, err
+		}
+	}
+	if addTagsErr != nil {
+		return nil, true, addTagsErr
+	}
+	return fields, len(fieldUpdates) > 0 || len(tagsToAdd) > 0, nil
 }
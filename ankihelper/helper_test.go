@@ -5,11 +5,32 @@ import (
 	"anki-rest-enhancer/ankiconnect/ankiconnectmock"
 	"anki-rest-enhancer/ankihelper"
 	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/audioprocessing"
 	"anki-rest-enhancer/azuretts"
 	"anki-rest-enhancer/azuretts/azurettsmock"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/llm"
+	"anki-rest-enhancer/llm/llmmock"
+	"anki-rest-enhancer/llmcache"
+	"anki-rest-enhancer/noteprocessing"
+	"anki-rest-enhancer/noteprocessing/noteprocessingmock"
+	"anki-rest-enhancer/statestore"
+	"anki-rest-enhancer/ttsbudget"
+	"anki-rest-enhancer/util/lang"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/lang/slicex"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/suite"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 	"text/template"
+	"time"
 )
 
 func TestEnhancer(t *testing.T) {
@@ -19,20 +40,26 @@ func TestEnhancer(t *testing.T) {
 type EnhancerSuite struct {
 	suite.Suite
 
-	Enhancer *ankihelper.Helper
-	TTSMock  *azurettsmock.API
-	AnkiMock *ankiconnectmock.API
+	Enhancer   *ankihelper.Helper
+	TTSMock    *azurettsmock.API
+	AnkiMock   *ankiconnectmock.API
+	ScriptMock *noteprocessingmock.ScriptRunner
+	LLMMock    *llmmock.API
 }
 
 func (s *EnhancerSuite) SetupSuite() {
 	s.TTSMock = &azurettsmock.API{}
 	s.AnkiMock = &ankiconnectmock.API{}
-	s.Enhancer = ankihelper.NewHelper(s.AnkiMock, s.TTSMock)
+	s.ScriptMock = &noteprocessingmock.ScriptRunner{}
+	s.LLMMock = &llmmock.API{}
+	s.Enhancer = ankihelper.NewHelper(s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, nil, nil, s.LLMMock, nil)
 }
 
 func (s *EnhancerSuite) SetupTest() {
 	s.TTSMock.Reset()
 	s.AnkiMock.Reset()
+	s.ScriptMock.Reset()
+	s.LLMMock.Reset()
 }
 
 func (s *EnhancerSuite) TestNoteTypeCreation_AlreadyExists() {
@@ -55,7 +82,7 @@ func (s *EnhancerSuite) TestNoteTypeCreation_AlreadyExists() {
 	}}}
 
 	// when:
-	err := s.Enhancer.Run(actions)
+	err := s.Enhancer.Run(context.Background(), actions)
 
 	// then:
 	s.Require().NoError(err)
@@ -102,7 +129,7 @@ func (s *EnhancerSuite) TestNoteTypeCreation_CreateNewWithVoiceover() {
 	}
 
 	// when:
-	err := s.Enhancer.Run(actions)
+	err := s.Enhancer.Run(context.Background(), actions)
 
 	// then:
 	s.Require().NoError(err)
@@ -151,7 +178,7 @@ func (s *EnhancerSuite) TestNoteTypeCreation_CreateNewWithNoVoiceover() {
 	}
 
 	// when:
-	err := s.Enhancer.Run(actions)
+	err := s.Enhancer.Run(context.Background(), actions)
 
 	// then:
 	s.Require().NoError(err)
@@ -159,6 +186,87 @@ func (s *EnhancerSuite) TestNoteTypeCreation_CreateNewWithNoVoiceover() {
 	s.Require().Equal(expectedModel, createModelCalls[0])
 }
 
+func (s *EnhancerSuite) TestDiffNoteTypes() {
+	// setup:
+	s.AnkiMock.ModelNamesFunc = func() ([]string, error) {
+		return []string{"MyModel"}, nil
+	}
+	s.AnkiMock.ModelFieldNamesFunc = func(modelName string) ([]string, error) {
+		s.Require().Equal("MyModel", modelName)
+		return []string{"comment", "obsolete"}, nil
+	}
+	s.AnkiMock.ModelTemplatesFunc = func(modelName string) (map[string]ankiconnect.CreateModelCardTemplate, error) {
+		s.Require().Equal("MyModel", modelName)
+		return map[string]ankiconnect.CreateModelCardTemplate{
+			"CommentTemplate": {Name: "CommentTemplate", Front: "outdated front", Back: "{{ comment }}"},
+		}, nil
+	}
+
+	// given:
+	fieldComment := ankihelperconf.AnkiNoteField{Name: "comment", SkipVoiceover: true}
+	fieldExample := ankihelperconf.AnkiNoteField{Name: "example", SkipVoiceover: true}
+	noteTypes := []ankihelperconf.AnkiNoteType{
+		{
+			Name:   "MyModel",
+			Fields: []ankihelperconf.AnkiNoteField{fieldComment, fieldExample},
+			Templates: []ankihelperconf.AnkiCardTemplate{{
+				Name:      s.mustParse("CommentTemplate"),
+				ForFields: []ankihelperconf.AnkiNoteField{fieldComment},
+				Front:     s.mustParse("$$.Field$$"),
+				Back:      s.mustParse("{{ $$.Field$$ }}"),
+			}},
+		},
+		{Name: "NewModel"},
+	}
+
+	// when:
+	diffs, err := s.Enhancer.DiffNoteTypes(noteTypes)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankihelper.NoteTypeDiff{
+		{
+			Name:             "MyModel",
+			MissingFields:    []string{"example"},
+			ExtraFields:      []string{"obsolete"},
+			ChangedTemplates: []string{"CommentTemplate"},
+		},
+		{Name: "NewModel", Missing: true},
+	}, diffs)
+}
+
+func (s *EnhancerSuite) TestChangedNotes() {
+	// setup:
+	since := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+	now := since.Add(36 * time.Hour)
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		s.Require().Equal("edited:2", query)
+		return []ankiconnect.NoteID{1, 2, 3}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			1: {ModifiedAt: since.Add(-time.Hour)},
+			2: {ModifiedAt: since},
+			3: {ModifiedAt: since.Add(time.Hour)},
+			4: {ModifiedAt: since.Add(time.Minute)},
+			5: {ModifiedAt: since.Add(2 * time.Minute)},
+		}, nil
+	}
+	// notes 4 and 5 were modified by the previous run, and note 5 was modified by the user after that
+	own := ankihelper.OwnChanges{
+		NoteIDs:    set.FromSlice[ankiconnect.NoteID](4, 5),
+		FinishedAt: since.Add(time.Minute),
+	}
+
+	// when:
+	changed, err := s.Enhancer.ChangedNotes(since, now, own)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankiconnect.NoteID{2, 3, 5}, changed)
+	s.Require().Equal("nid:2,3,5", ankihelper.NoteIDsQuery(changed))
+}
+
 func (s *EnhancerSuite) TestTTSGeneration_Simple() {
 	// given:
 	const (
@@ -177,7 +285,7 @@ func (s *EnhancerSuite) TestTTSGeneration_Simple() {
 		}},
 		NoteTypes: nil,
 	}
-	expectedNoteUpdate := map[string]ankiconnect.FieldUpdate{audioField: {AudioData: []byte(audio)}}
+	expectedNoteUpdate := map[string]ankiconnect.FieldUpdate{audioField: {AudioData: []byte(audio), AudioFormat: "mp3"}}
 
 	// setup:
 	s.AnkiMock.FindNotesFunc = func(aQuery string) ([]ankiconnect.NoteID, error) {
@@ -196,9 +304,10 @@ func (s *EnhancerSuite) TestTTSGeneration_Simple() {
 			},
 		}, nil
 	}
-	s.TTSMock.TextToSpeechFunc = func(texts map[string]struct{}) map[string]azuretts.TextToSpeechResult {
+	s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
 		s.Require().Equal(map[string]struct{}{text: {}}, texts)
-		return map[string]azuretts.TextToSpeechResult{text: {AudioMP3: []byte(audio)}}
+		onResult(text, azuretts.TextToSpeechResult{Audio: []byte(audio), Format: "mp3"})
+		return nil
 	}
 	var updatedFields map[string]ankiconnect.FieldUpdate
 	s.AnkiMock.UpdateNoteFieldsFunc = func(aNoteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
@@ -209,7 +318,7 @@ func (s *EnhancerSuite) TestTTSGeneration_Simple() {
 	}
 
 	// when:
-	err := s.Enhancer.Run(actions)
+	err := s.Enhancer.Run(context.Background(), actions)
 
 	// then:
 	s.Require().NoError(err)
@@ -238,7 +347,7 @@ func (s *EnhancerSuite) TestTTSGeneration_SingleErrorIsIgnored() {
 	// Speech generation fails for the first note, so we expect the enhancer to skip that note and only
 	// update the second note for which the generation succeeded.
 	type noteUpdatesMap = map[ankiconnect.NoteID]map[string]ankiconnect.FieldUpdate
-	expectedUpdates := noteUpdatesMap{noteID2: {audioField: {AudioData: []byte(audio2)}}}
+	expectedUpdates := noteUpdatesMap{noteID2: {audioField: {AudioData: []byte(audio2), AudioFormat: "mp3"}}}
 
 	// setup:
 	s.AnkiMock.FindNotesFunc = func(aQuery string) ([]ankiconnect.NoteID, error) {
@@ -252,12 +361,11 @@ func (s *EnhancerSuite) TestTTSGeneration_SingleErrorIsIgnored() {
 			noteID2: {ID: noteID2, Fields: map[string]string{textField: text2, audioField: ""}},
 		}, nil
 	}
-	s.TTSMock.TextToSpeechFunc = func(texts map[string]struct{}) map[string]azuretts.TextToSpeechResult {
+	s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
 		s.Require().Equal(map[string]struct{}{text1: {}, text2: {}}, texts)
-		return map[string]azuretts.TextToSpeechResult{
-			text1: {Error: azuretts.TooManyRequests.NewWithNoMessage()},
-			text2: {AudioMP3: []byte(audio2)},
-		}
+		onResult(text1, azuretts.TextToSpeechResult{Error: azuretts.TooManyRequests.NewWithNoMessage()})
+		onResult(text2, azuretts.TextToSpeechResult{Audio: []byte(audio2), Format: "mp3"})
+		return nil
 	}
 	noteUpdates := make(noteUpdatesMap)
 	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
@@ -267,11 +375,1144 @@ func (s *EnhancerSuite) TestTTSGeneration_SingleErrorIsIgnored() {
 	}
 
 	// when:
-	err := s.Enhancer.Run(actions)
+	report, err := s.Enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
 
 	// then:
 	s.Require().NoError(err)
 	s.Require().Equal(expectedUpdates, noteUpdates)
+	// and: the failure is reported
+	s.Require().Len(report.Actions, 1)
+	action := report.Actions[0]
+	s.Require().Equal(ankihelper.ActionTTS, action.Type)
+	s.Require().Equal(1, action.Succeeded)
+	s.Require().Equal(1, action.Failed)
+	s.Require().Equal([]ankiconnect.NoteID{noteID2}, action.TouchedNoteIDs)
+	s.Require().Len(action.Errors, 1)
+	s.Require().Equal(noteID1, action.Errors[0].NoteID)
+	s.Require().Equal(audioField, action.Errors[0].Field)
+	s.Require().Empty(action.Error)
+}
+
+func (s *EnhancerSuite) TestTTSGeneration_NotesAreUpdatedBeforeBatchCompletes() {
+	// given:
+	const (
+		textField, audioField                    = "text", "audio"
+		noteID1, noteID2      ankiconnect.NoteID = 42, 16
+		query                                    = "text:_* audio:"
+		text1, audio1                            = "uno", "audio1"
+		text2                                    = "dos"
+	)
+	actions := ankihelperconf.Actions{
+		TTS: []ankihelperconf.AnkiTTS{{
+			Fields: &ankihelperconf.AnkiTTSFields{
+				NoteFilter: query,
+				TextField:  textField,
+				AudioField: audioField,
+			},
+		}},
+	}
+
+	// setup:
+	s.AnkiMock.FindNotesFunc = func(aQuery string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{noteID1, noteID2}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			noteID1: {ID: noteID1, Fields: map[string]string{textField: text1, audioField: ""}},
+			noteID2: {ID: noteID2, Fields: map[string]string{textField: text2, audioField: ""}},
+		}, nil
+	}
+	var updatedNotes []ankiconnect.NoteID
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		updatedNotes = append(updatedNotes, noteID)
+		return nil
+	}
+	// The first text is synthesized, and then the generation is interrupted (e.g. the process is killed).
+	interrupted := errors.New("interrupted")
+	s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
+		onResult(text1, azuretts.TextToSpeechResult{Audio: []byte(audio1), Format: "mp3"})
+		s.Require().Equal([]ankiconnect.NoteID{noteID1}, updatedNotes, "note should be updated as soon as its audio is ready")
+		return interrupted
+	}
+
+	// when:
+	err := s.Enhancer.Run(context.Background(), actions)
+
+	// then:
+	s.Require().ErrorIs(err, interrupted)
+	s.Require().Equal([]ankiconnect.NoteID{noteID1}, updatedNotes)
+}
+
+func (s *EnhancerSuite) TestTTSGeneration_AudioPostProcessing() {
+	// given:
+	const (
+		noteID                ankiconnect.NoteID = 42
+		textField, audioField                    = "foo", "bar"
+		text, audio                              = "Guten Tag", "abacabadabacaba"
+	)
+	actions := ankihelperconf.Actions{
+		TTS: []ankihelperconf.AnkiTTS{{
+			Fields: &ankihelperconf.AnkiTTSFields{
+				NoteFilter: "foo:_* bar:",
+				TextField:  textField,
+				AudioField: audioField,
+			},
+			AudioPostProcessing: []ankihelperconf.AudioProcessingStep{{
+				Exec: &ankihelperconf.AudioExec{
+					Command: "cp",
+					Args: []ankihelperconf.NoteProcessingExecArg{
+						{Template: s.mustParse("$$.Input$$")},
+						{Template: s.mustParse("$$.Output$$")},
+					},
+					OutputFormat: "ogg",
+				},
+			}},
+		}},
+	}
+
+	// setup:
+	s.AnkiMock.FindNotesFunc = func(aQuery string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{noteID}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			noteID: {ID: noteID, Fields: map[string]string{textField: text, audioField: ""}},
+		}, nil
+	}
+	s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
+		onResult(text, azuretts.TextToSpeechResult{Audio: []byte(audio), Format: "mp3"})
+		return nil
+	}
+	var updatedFields map[string]ankiconnect.FieldUpdate
+	s.AnkiMock.UpdateNoteFieldsFunc = func(aNoteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		updatedFields = fields
+		return nil
+	}
+
+	// when:
+	err := s.Enhancer.Run(context.Background(), actions)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal(map[string]ankiconnect.FieldUpdate{audioField: {AudioData: []byte(audio), AudioFormat: "ogg"}}, updatedFields)
+}
+
+func (s *EnhancerSuite) TestTTSGeneration_AudioFileNameTemplate() {
+	for _, fileName := range []string{
+		"tts_$$.NoteType$$_$$.Field$$_$$.Hash$$",
+		// the extension of another format is replaced
+		"tts_$$.NoteType$$_$$.Field$$_$$.Hash$$.mp3",
+	} {
+		s.Run(fileName, func() {
+			// given:
+			const (
+				noteID                ankiconnect.NoteID = 42
+				textField, audioField                    = "foo", "bar"
+				text, audio                              = "Guten Tag", "abacabadabacaba"
+			)
+			actions := ankihelperconf.Actions{
+				TTS: []ankihelperconf.AnkiTTS{{
+					Fields: &ankihelperconf.AnkiTTSFields{
+						NoteFilter: "foo:_* bar:",
+						TextField:  textField,
+						AudioField: audioField,
+					},
+					AudioFileName: s.mustParse(fileName),
+				}},
+			}
+			expectedFileName := fmt.Sprintf("tts_German_Noun_bar_%x.ogg", md5.Sum([]byte(audio)))
+
+			// setup:
+			s.AnkiMock.FindNotesFunc = func(aQuery string) ([]ankiconnect.NoteID, error) {
+				return []ankiconnect.NoteID{noteID}, nil
+			}
+			s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+				return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+					noteID: {ID: noteID, ModelName: "German/Noun", Fields: map[string]string{textField: text, audioField: ""}},
+				}, nil
+			}
+			s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
+				onResult(text, azuretts.TextToSpeechResult{Audio: []byte(audio), Format: "ogg"})
+				return nil
+			}
+			var updatedFields map[string]ankiconnect.FieldUpdate
+			s.AnkiMock.UpdateNoteFieldsFunc = func(aNoteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+				updatedFields = fields
+				return nil
+			}
+
+			// when:
+			err := s.Enhancer.Run(context.Background(), actions)
+
+			// then:
+			s.Require().NoError(err)
+			s.Require().Equal(expectedFileName, updatedFields[audioField].AudioFileName)
+		})
+	}
+}
+
+func (s *EnhancerSuite) TestTTSGeneration_CharacterBudget() {
+	// given: the budget allows only one of the texts to be converted
+	const query = "foo:_* fooVoiceover:"
+	actions := ankihelperconf.Actions{
+		TTS: []ankihelperconf.AnkiTTS{{
+			Fields: &ankihelperconf.AnkiTTSFields{NoteFilter: query, TextField: "foo", AudioField: "fooVoiceover"},
+		}},
+	}
+	budgetConf := ankihelperconf.AzureBudget{
+		UsageFilePath:             filepath.Join(s.T().TempDir(), "usage.json"),
+		RunCharacters:             5,
+		PricePerMillionCharacters: 16,
+	}
+
+	// setup:
+	budget, err := ttsbudget.Open(budgetConf)
+	s.Require().NoError(err)
+	enhancer := ankihelper.NewHelper(
+		s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, nil, budget.Voice("de-DE-KatjaNeural"), s.LLMMock, nil,
+	)
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{1, 2}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			1: {ID: 1, Fields: map[string]string{"foo": "Hund", "fooVoiceover": ""}},
+			2: {ID: 2, Fields: map[string]string{"foo": "Katze", "fooVoiceover": ""}},
+		}, nil
+	}
+	s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
+		s.Require().Equal(map[string]struct{}{"Hund": {}}, texts)
+		onResult("Hund", azuretts.TextToSpeechResult{Audio: []byte("audio"), Format: "mp3"})
+		return nil
+	}
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		return nil
+	}
+
+	// when:
+	report, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Len(report.Actions, 1)
+	s.Require().Equal(1, report.Actions[0].Succeeded)
+	s.Require().Equal(1, report.Actions[0].Skipped)
+	s.Require().Equal(&ttsbudget.Usage{Voice: "de-DE-KatjaNeural", Characters: 4, EstimatedCost: 4 * 16 / 1e6}, report.TTSUsage)
+	s.Require().FileExists(budgetConf.UsageFilePath)
+}
+
+func (s *EnhancerSuite) TestImport_CreatesAndUpdatesNotes() {
+	// given: Hund is up to date, Katze has a new translation and lacks the tag, Maus is missing in Anki
+	filePath := filepath.Join(s.T().TempDir(), "words.csv")
+	content := "\ufeffword,translation,comment\n" +
+		"Hund,dog,\n" +
+		"Katze,\"cat, tomcat\",not imported\n" +
+		"Maus,mouse,\n" +
+		",empty,\n"
+	s.Require().NoError(os.WriteFile(filePath, []byte(content), 0o644))
+	actions := ankihelperconf.Actions{
+		Import: []ankihelperconf.AnkiImport{{
+			Format:         ankihelperconf.ImportCSV,
+			FilePath:       filePath,
+			Delimiter:      ',',
+			NoteType:       "GermanNoun",
+			Deck:           "German::Nouns",
+			Fields:         map[string]string{"word": "Word", "translation": "Translation"},
+			KeyField:       "Word",
+			Tags:           []string{"imported"},
+			UpdateExisting: true,
+		}},
+	}
+
+	// setup:
+	s.AnkiMock.ModelFieldNamesFunc = func(modelName string) ([]string, error) {
+		s.Require().Equal("GermanNoun", modelName)
+		return []string{"Word", "Translation", "WordVoiceover"}, nil
+	}
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		s.Require().Equal(`"note:GermanNoun"`, query)
+		return []ankiconnect.NoteID{1, 2}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			1: {ID: 1, Fields: map[string]string{"Word": "Hund", "Translation": "dog", "WordVoiceover": "[sound:hund.mp3]"}, Tags: []string{"imported"}},
+			2: {ID: 2, Fields: map[string]string{"Word": "Katze", "Translation": "cat", "WordVoiceover": ""}},
+		}, nil
+	}
+	tagged := make(map[ankiconnect.NoteID][]string)
+	s.AnkiMock.AddTagsFn = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		for _, noteID := range noteIDs {
+			tagged[noteID] = append(tagged[noteID], tags...)
+		}
+		return nil
+	}
+	var added []ankiconnect.NewNote
+	s.AnkiMock.AddNotesFunc = func(notes []ankiconnect.NewNote) ([]*ankiconnect.NoteID, error) {
+		added = append(added, notes...)
+		return []*ankiconnect.NoteID{lang.New[ankiconnect.NoteID](3)}, nil
+	}
+	updated := make(map[ankiconnect.NoteID]map[string]string)
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		updated[noteID] = make(map[string]string)
+		for field, update := range fields {
+			updated[noteID][field] = *update.Value
+		}
+		return nil
+	}
+
+	// when:
+	report, err := s.Enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankiconnect.NewNote{{
+		Deck:     "German::Nouns",
+		NoteType: "GermanNoun",
+		Fields:   map[string]string{"Word": "Maus", "Translation": "mouse"},
+		Tags:     []string{"imported"},
+	}}, added)
+	s.Require().Equal(map[ankiconnect.NoteID]map[string]string{2: {"Translation": "cat, tomcat"}}, updated)
+	s.Require().Equal(map[ankiconnect.NoteID][]string{2: {"imported"}}, tagged)
+	s.Require().Len(report.Actions, 1)
+	s.Require().Equal(2, report.Actions[0].Succeeded)
+	s.Require().Equal(1, report.Actions[0].Failed, "the row with an empty key should fail")
+	s.Require().Len(report.Actions[0].Errors, 1)
+	s.Require().Equal(5, report.Actions[0].Errors[0].Line)
+	s.Require().Equal(1, report.Actions[0].Skipped)
+	s.Require().ElementsMatch([]ankiconnect.NoteID{2, 3}, report.Actions[0].TouchedNoteIDs)
+}
+
+func (s *EnhancerSuite) TestImport_KindleLookups() {
+	// given: Hund is looked up twice in different forms and already has a note
+	sqlitePath, err := exec.LookPath("sqlite3")
+	if err != nil {
+		s.T().Skip("sqlite3 is not installed")
+	}
+	dbPath := filepath.Join(s.T().TempDir(), "vocab.db")
+	output, err := exec.Command(sqlitePath, dbPath, `
+		CREATE TABLE WORDS (id TEXT PRIMARY KEY, word TEXT, stem TEXT, lang TEXT);
+		CREATE TABLE BOOK_INFO (id TEXT PRIMARY KEY, title TEXT);
+		CREATE TABLE LOOKUPS (id TEXT PRIMARY KEY, word_key TEXT, book_key TEXT, usage TEXT, timestamp INTEGER);
+		INSERT INTO WORDS VALUES ('de:Hunde', 'Hunde', 'Hund', 'de'), ('de:Hundes', 'Hundes', 'Hund', 'de'),
+			('de:Katzen', 'Katzen', 'Katze', 'de');
+		INSERT INTO BOOK_INFO VALUES ('b1', 'Emil');
+		INSERT INTO LOOKUPS VALUES ('1', 'de:Hunde', 'b1', 'Die Hunde bellen.', 100),
+			('2', 'de:Hundes', 'b1', 'Der Name des Hundes.', 200), ('3', 'de:Katzen', 'b1', 'Die Katzen schlafen.', 300);
+	`).CombinedOutput()
+	s.Require().NoError(err, string(output))
+	actions := ankihelperconf.Actions{
+		Import: []ankihelperconf.AnkiImport{{
+			Format:     ankihelperconf.ImportKindle,
+			FilePath:   dbPath,
+			SQLitePath: sqlitePath,
+			Language:   "de",
+			NoteType:   "GermanNoun",
+			Deck:       "German::Reading",
+			Fields:     map[string]string{"stem": "Word", "usage": "Example", "book": "Source"},
+			KeyField:   "Word",
+		}},
+	}
+
+	// setup:
+	s.AnkiMock.ModelFieldNamesFunc = func(modelName string) ([]string, error) {
+		return []string{"Word", "Example", "Source"}, nil
+	}
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{1}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			1: {ID: 1, Fields: map[string]string{"Word": "Hund", "Example": "edited", "Source": ""}},
+		}, nil
+	}
+	var added []ankiconnect.NewNote
+	s.AnkiMock.AddNotesFunc = func(notes []ankiconnect.NewNote) ([]*ankiconnect.NoteID, error) {
+		added = append(added, notes...)
+		return []*ankiconnect.NoteID{lang.New[ankiconnect.NoteID](2)}, nil
+	}
+
+	// when:
+	report, err := s.Enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankiconnect.NewNote{{
+		Deck:     "German::Reading",
+		NoteType: "GermanNoun",
+		Fields:   map[string]string{"Word": "Katze", "Example": "Die Katzen schlafen.", "Source": "Emil"},
+	}}, added)
+	s.Require().Len(report.Actions, 1)
+	s.Require().Equal(1, report.Actions[0].Succeeded)
+	s.Require().Equal(0, report.Actions[0].Failed)
+	s.Require().Equal(1, report.Actions[0].Skipped, "existing notes should be left intact")
+}
+
+func (s *EnhancerSuite) TestDedupe_MergesIntoMostReviewedNote() {
+	// given: Hund is added three times with different articles and case, note 2 has reviews
+	articles, err := ankihelperconf.YAMLTextProcessing{Regexp: "^(der|die|das) ", Replacement: ""}.Parse()
+	s.Require().NoError(err)
+	actions := ankihelperconf.Actions{
+		Dedupe: []ankihelperconf.DedupeRule{{
+			NoteFilter:       "note:GermanNoun",
+			KeyField:         "Word",
+			KeyPreprocessors: []ankihelperconf.TextProcessor{articles},
+		}},
+	}
+
+	// setup:
+	journalPath := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	enhancer := ankihelper.NewHelper(
+		s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, journal.OpenFile(journalPath, "run-1"), nil, s.LLMMock, nil,
+	)
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		s.Require().Equal("note:GermanNoun", query)
+		return []ankiconnect.NoteID{4, 3, 2, 1}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			1: {ID: 1, ModelName: "GermanNoun", Fields: map[string]string{"Word": "der Hund", "Gender": "der"},
+				Cards: []ankiconnect.CardID{10}},
+			2: {ID: 2, ModelName: "GermanNoun", Fields: map[string]string{"Word": "Hund", "Gender": " "},
+				Tags: []string{"a1"}, Cards: []ankiconnect.CardID{20}},
+			3: {ID: 3, ModelName: "GermanNoun", Fields: map[string]string{"Word": "hund ", "Gender": "das"},
+				Tags: []string{"b2", "A1"}, Cards: []ankiconnect.CardID{30}},
+			4: {ID: 4, ModelName: "GermanNoun", Fields: map[string]string{"Word": "Katze", "Gender": "die"},
+				Cards: []ankiconnect.CardID{40}},
+		}, nil
+	}
+	s.AnkiMock.CardsInfoFunc = func(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error) {
+		s.Require().ElementsMatch([]ankiconnect.CardID{10, 20, 30}, cardIDs)
+		return map[ankiconnect.CardID]ankiconnect.CardInfo{
+			10: {ID: 10, NoteID: 1},
+			20: {ID: 20, NoteID: 2, Reviews: 5},
+			30: {ID: 30, NoteID: 3},
+		}, nil
+	}
+	var updatedFields map[string]ankiconnect.FieldUpdate
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		s.Require().Equal(ankiconnect.NoteID(2), noteID)
+		updatedFields = fields
+		return nil
+	}
+	var addedTags []string
+	s.AnkiMock.AddTagsFn = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		s.Require().Equal([]ankiconnect.NoteID{2}, noteIDs)
+		addedTags = tags
+		return nil
+	}
+	var deleted []ankiconnect.NoteID
+	s.AnkiMock.DeleteNotesFunc = func(noteIDs []ankiconnect.NoteID) error {
+		deleted = append(deleted, noteIDs...)
+		return nil
+	}
+
+	// when:
+	report, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal(map[string]ankiconnect.FieldUpdate{"Gender": {Value: lang.New("der")}}, updatedFields,
+		"the first non-empty value should be copied")
+	s.Require().Equal([]string{"b2"}, addedTags, "tags should be compared case-insensitively")
+	s.Require().Equal([]ankiconnect.NoteID{1, 3}, deleted)
+	s.Require().Len(report.Actions, 1)
+	s.Require().Equal([]ankiconnect.NoteID{2}, report.Actions[0].TouchedNoteIDs)
+	entries, err := journal.ReadFile(journalPath)
+	s.Require().NoError(err)
+	s.Require().Len(entries, 1)
+	s.Require().Equal(map[ankiconnect.NoteID]map[string]string{
+		1: {"Word": "der Hund", "Gender": "der"},
+		3: {"Word": "hund ", "Gender": "das"},
+	}, entries[0].DeletedNotes, "deleted notes should be recorded to be recreated manually")
+}
+
+func (s *EnhancerSuite) TestCardsOrganization_OverlappingRulesAreResolvedByPriority() {
+	// given: card 2 is matched by both rules, card 3 is already in its target deck
+	actions := ankihelperconf.Actions{
+		CardsOrganization: []ankihelperconf.NotesOrganizationRule{
+			{NotesFilter: "note:GermanNoun", TargetDeckName: "German::00_Other"},
+			{NotesFilter: "card:Dativ", TargetDeckName: "German::02_WordForms", Priority: 1},
+		},
+	}
+	matching := map[string][]ankiconnect.CardID{
+		"note:GermanNoun":                          {1, 2},
+		`-"deck:German::00_Other" note:GermanNoun`: {1, 2},
+		"card:Dativ":                               {2, 3},
+		`-"deck:German::02_WordForms" card:Dativ`:  {2},
+	}
+
+	// setup:
+	s.AnkiMock.FindCardsFunc = func(query string) ([]ankiconnect.CardID, error) {
+		cards, ok := matching[query]
+		s.Require().True(ok, "unexpected query %q", query)
+		return cards, nil
+	}
+	moved := make(map[string][]ankiconnect.CardID)
+	s.AnkiMock.ChangeDeckFunc = func(deckName string, cardIDs []ankiconnect.CardID) error {
+		moved[deckName] = append(moved[deckName], cardIDs...)
+		return nil
+	}
+
+	// when:
+	err := s.Enhancer.Run(context.Background(), actions)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal(map[string][]ankiconnect.CardID{
+		"German::00_Other":     {1},
+		"German::02_WordForms": {2},
+	}, moved)
+}
+
+func (s *EnhancerSuite) TestCardsOrganization_ConflictFailsBeforeMovingCards() {
+	// given: card 2 is matched by both rules with the same priority
+	actions := ankihelperconf.Actions{
+		CardsOrganization: []ankihelperconf.NotesOrganizationRule{
+			{Name: "other", NotesFilter: "note:GermanNoun", TargetDeckName: "German::00_Other"},
+			{Name: "forms", NotesFilter: "card:Dativ", TargetDeckName: "German::02_WordForms"},
+		},
+	}
+
+	// setup:
+	s.AnkiMock.FindCardsFunc = func(query string) ([]ankiconnect.CardID, error) {
+		if strings.Contains(query, "note:GermanNoun") {
+			return []ankiconnect.CardID{1, 2}, nil
+		}
+		return []ankiconnect.CardID{2}, nil
+	}
+
+	// when:
+	report, err := s.Enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().Error(err)
+	s.Require().Contains(err.Error(), "1 cards are matched by rules #0 (other)")
+	s.Require().Len(report.Actions, 2)
+	for _, action := range report.Actions {
+		s.Require().NotEmpty(action.Error)
+		s.Require().Zero(action.Succeeded)
+	}
+
+	// when: the conflict is resolved
+	actions.CardsOrganization[1].Exclusive = true
+	var moved []ankiconnect.CardID
+	s.AnkiMock.ChangeDeckFunc = func(deckName string, cardIDs []ankiconnect.CardID) error {
+		if deckName == "German::02_WordForms" {
+			moved = append(moved, cardIDs...)
+		}
+		return nil
+	}
+	err = s.Enhancer.Run(context.Background(), actions)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankiconnect.CardID{2}, moved)
+}
+
+func (s *EnhancerSuite) TestDecks_CreateWithPreset() {
+	// given: the preset is defined by one deck and referenced by another
+	newCardsPerDay := 10
+	actions := ankihelperconf.Actions{
+		Decks: []ankihelperconf.AnkiDeck{
+			{Name: "German::01_VerbsInfinitive", Preset: &ankihelperconf.AnkiDeckPreset{
+				Name:           "German verbs",
+				NewCardsPerDay: &newCardsPerDay,
+				LearningSteps:  []time.Duration{time.Minute, 10 * time.Minute},
+			}},
+			{Name: "German::03_Irregular", Preset: &ankihelperconf.AnkiDeckPreset{Name: "German verbs"}},
+		},
+	}
+
+	// setup: the first deck exists with the default preset, the second one doesn't exist
+	configs := map[ankiconnect.DeckConfigID]ankiconnect.DeckConfig{
+		1: {ID: 1, Name: "Default", NewCardsPerDay: 20, ReviewsPerDay: 200, LearningSteps: []float64{1, 10}},
+	}
+	deckConfigs := map[string]ankiconnect.DeckConfigID{"Default": 1, "German::01_VerbsInfinitive": 1}
+	s.AnkiMock.DeckNamesFunc = func() ([]string, error) {
+		return []string{"Default", "German::01_VerbsInfinitive"}, nil
+	}
+	s.AnkiMock.CreateDeckFunc = func(deckName string) error {
+		deckConfigs[deckName] = 1
+		return nil
+	}
+	s.AnkiMock.GetDeckConfigFunc = func(deckName string) (ankiconnect.DeckConfig, error) {
+		return configs[deckConfigs[deckName]], nil
+	}
+	s.AnkiMock.CloneDeckConfigIDFunc = func(name string, cloneFrom ankiconnect.DeckConfigID) (ankiconnect.DeckConfigID, error) {
+		clone := configs[cloneFrom]
+		clone.ID, clone.Name = 2, name
+		configs[2] = clone
+		return 2, nil
+	}
+	s.AnkiMock.SetDeckConfigIDFunc = func(deckNames []string, configID ankiconnect.DeckConfigID) error {
+		for _, deck := range deckNames {
+			deckConfigs[deck] = configID
+		}
+		return nil
+	}
+	var saved []ankiconnect.DeckConfig
+	s.AnkiMock.SaveDeckConfigFunc = func(config ankiconnect.DeckConfig) error {
+		saved = append(saved, config)
+		configs[config.ID] = config
+		return nil
+	}
+
+	// when:
+	err := s.Enhancer.Run(context.Background(), actions)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal(map[string]ankiconnect.DeckConfigID{
+		"Default":                    1,
+		"German::01_VerbsInfinitive": 2,
+		"German::03_Irregular":       2,
+	}, deckConfigs)
+	s.Require().Len(saved, 1, "options should only be saved if they change")
+	s.Require().Equal(10, saved[0].NewCardsPerDay)
+	s.Require().Equal(200, saved[0].ReviewsPerDay)
+	s.Require().Equal([]float64{1, 10}, saved[0].LearningSteps)
+	s.Require().Equal(20, configs[1].NewCardsPerDay, "default preset should be intact")
+}
+
+func (s *EnhancerSuite) TestCardsState_SuspendAndReposition() {
+	// given:
+	actions := ankihelperconf.Actions{
+		CardsState: []ankihelperconf.CardsStateRule{
+			{Filter: "note:GermanVerb -card:*Infinitiv*", Operation: ankihelperconf.CardsSuspend},
+			{Filter: "note:GermanNoun", Operation: ankihelperconf.CardsReposition, PositionField: "Rank"},
+		},
+	}
+
+	// setup: card 11 is at its position already, card 12 has malformed rank
+	s.AnkiMock.FindCardsFunc = func(query string) ([]ankiconnect.CardID, error) {
+		switch query {
+		case "(note:GermanVerb -card:*Infinitiv*) (-is:suspended)":
+			return []ankiconnect.CardID{1, 2}, nil
+		case "(note:GermanNoun) (is:new)":
+			return []ankiconnect.CardID{10, 11, 12}, nil
+		}
+		s.FailNow("unexpected query", query)
+		return nil, nil
+	}
+	var suspended []ankiconnect.CardID
+	s.AnkiMock.SuspendFunc = func(cardIDs []ankiconnect.CardID) error {
+		suspended = append(suspended, cardIDs...)
+		return nil
+	}
+	s.AnkiMock.CardsInfoFunc = func(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error) {
+		return map[ankiconnect.CardID]ankiconnect.CardInfo{
+			10: {ID: 10, NoteID: 100, Fields: map[string]string{"Rank": "5"}, Due: 1000},
+			11: {ID: 11, NoteID: 110, Fields: map[string]string{"Rank": " 7 "}, Due: 7},
+			12: {ID: 12, NoteID: 120, Fields: map[string]string{"Rank": "n/a"}, Due: 1001},
+		}, nil
+	}
+	positions := make(map[ankiconnect.CardID]int64)
+	s.AnkiMock.SetNewCardPositionFunc = func(cardID ankiconnect.CardID, position int64) error {
+		positions[cardID] = position
+		return nil
+	}
+
+	// when:
+	report, err := s.Enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankiconnect.CardID{1, 2}, suspended)
+	s.Require().Equal(map[ankiconnect.CardID]int64{10: 5}, positions)
+	s.Require().Len(report.Actions, 2)
+	s.Require().Equal(1, report.Actions[1].Succeeded)
+	s.Require().Equal(1, report.Actions[1].Failed)
+	s.Require().Equal(ankiconnect.NoteID(120), report.Actions[1].Errors[0].NoteID)
+}
+
+func (s *EnhancerSuite) TestCardsState_UnlockSiblings() {
+	// given: note 1 has a young primary card, note 2 has mature ones
+	actions := ankihelperconf.Actions{
+		CardsState: []ankihelperconf.CardsStateRule{{
+			Filter:    "note:SpanishVerb",
+			Operation: ankihelperconf.CardsUnlock,
+			Unlock:    &ankihelperconf.SiblingsUnlock{PrimaryCards: "card:FillInWord*", MinInterval: 7, PerRun: 2},
+		}},
+	}
+	cards := map[ankiconnect.CardID]ankiconnect.CardInfo{
+		10: {ID: 10, NoteID: 1, Ord: 0, Interval: 3},
+		11: {ID: 11, NoteID: 1, Ord: 1},
+		12: {ID: 12, NoteID: 1, Ord: 2},
+		20: {ID: 20, NoteID: 2, Ord: 0, Interval: 10},
+		21: {ID: 21, NoteID: 2, Ord: 1, Interval: 8},
+		// the reviewed card is suspended as a leech, so it's not unlocked
+		25: {ID: 25, NoteID: 2, Ord: 2, Type: ankiconnect.CardTypeReview, Interval: 2},
+		22: {ID: 22, NoteID: 2, Ord: 3},
+		23: {ID: 23, NoteID: 2, Ord: 4},
+		24: {ID: 24, NoteID: 2, Ord: 5},
+		// note 3 has no primary cards, so it's left intact
+		30: {ID: 30, NoteID: 3, Ord: 1},
+	}
+
+	// setup:
+	s.AnkiMock.FindCardsFunc = func(query string) ([]ankiconnect.CardID, error) {
+		switch query {
+		case "(note:SpanishVerb) (card:FillInWord*)":
+			return []ankiconnect.CardID{10, 20, 21}, nil
+		case "((note:SpanishVerb) (-(card:FillInWord*))) (is:new -is:suspended)":
+			return []ankiconnect.CardID{11, 30}, nil
+		case "((note:SpanishVerb) (-(card:FillInWord*))) (is:new is:suspended)":
+			return slicex.Filter([]ankiconnect.CardID{24, 12, 25, 23, 22}, func(cardID ankiconnect.CardID) bool {
+				return cards[cardID].Type == ankiconnect.CardTypeNew
+			}), nil
+		}
+		s.FailNow("unexpected query", query)
+		return nil, nil
+	}
+	s.AnkiMock.CardsInfoFunc = func(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error) {
+		result := make(map[ankiconnect.CardID]ankiconnect.CardInfo)
+		for _, cardID := range cardIDs {
+			result[cardID] = cards[cardID]
+		}
+		return result, nil
+	}
+	var suspended, unsuspended []ankiconnect.CardID
+	s.AnkiMock.SuspendFunc = func(cardIDs []ankiconnect.CardID) error {
+		suspended = append(suspended, cardIDs...)
+		return nil
+	}
+	s.AnkiMock.UnsuspendFunc = func(cardIDs []ankiconnect.CardID) error {
+		unsuspended = append(unsuspended, cardIDs...)
+		return nil
+	}
+
+	// when:
+	err := s.Enhancer.Run(context.Background(), actions)
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]ankiconnect.CardID{11}, suspended)
+	s.Require().Equal([]ankiconnect.CardID{22, 23}, unsuspended,
+		"new cards should be unlocked in template order, reviewed cards should stay suspended")
+}
+
+func (s *EnhancerSuite) TestNoteProcessing_UpToDateNotesAreSkipped() {
+	// setup:
+	store, err := statestore.OpenFile(filepath.Join(s.T().TempDir(), "state.json"))
+	s.Require().NoError(err)
+	enhancer := ankihelper.NewHelper(s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), store, nil, nil, s.LLMMock, nil)
+
+	notes := map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+		1: {ID: 1, Fields: map[string]string{"Word": "Hund", "Translation": ""}},
+		2: {ID: 2, Fields: map[string]string{"Word": "Katze", "Translation": ""}},
+	}
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{1, 2}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return notes, nil
+	}
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		for field, update := range fields {
+			notes[noteID].Fields[field] = *update.Value
+		}
+		return nil
+	}
+	var processedWords []string
+	s.ScriptMock.RunScriptFunc = func(
+		ctx context.Context,
+		rule ankihelperconf.NoteProcessingRule,
+		note noteprocessing.NoteData,
+		progress noteprocessing.ProgressInfo,
+	) ([]noteprocessing.Modification, error) {
+		processedWords = append(processedWords, note.Fields["Word"])
+		return []noteprocessing.Modification{
+			{SetField: &map[string]string{"Translation": "translation of " + note.Fields["Word"]}},
+		}, nil
+	}
+
+	// given:
+	actions := ankihelperconf.Actions{NoteProcessing: []ankihelperconf.NoteProcessingRule{{
+		Name:           "translate",
+		NoteFilter:     "deck:German",
+		DefinitionHash: "v1",
+	}}}
+
+	// when:
+	firstReport, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+	notes[2].Fields["Word"] = "Kater"
+	processedWords = nil
+	secondReport, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+
+	// then:
+	s.Require().Equal(2, firstReport.Actions[0].Succeeded)
+	s.Require().Equal([]string{"Kater"}, processedWords, "only the note with changed input should be processed again")
+	s.Require().Equal(1, secondReport.Actions[0].Succeeded)
+	s.Require().Equal(1, secondReport.Actions[0].Skipped)
+
+	// when:
+	actions.NoteProcessing[0].DefinitionHash = "v2"
+	processedWords = nil
+	_, err = enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().ElementsMatch([]string{"Hund", "Kater"}, processedWords, "all the notes should be processed once the rule is changed")
+
+	// when:
+	invalidated, err := enhancer.InvalidateNoteProcessing(actions.NoteProcessing, set.FromSlice("translate"))
+	s.Require().NoError(err)
+	processedWords = nil
+	_, err = enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal(2, invalidated)
+	s.Require().ElementsMatch([]string{"Hund", "Kater"}, processedWords, "all the notes should be processed once the state is removed")
+}
+
+func (s *EnhancerSuite) TestLLM_GeneratesFieldsAndTags() {
+	// given:
+	actions := ankihelperconf.Actions{
+		LLM: []ankihelperconf.LLMRule{{
+			Name:       "translate",
+			NoteFilter: "Translation:",
+			Model:      "gpt-4o-mini",
+			Prompt:     s.mustParse(`Translate $$ .Note.Fields.Word $$ to English. Reply with JSON.`),
+			Fields:     map[string]string{"translation": "Translation", "example": "Example"},
+			TagsKey:    "tags",
+			Tags:       []string{"llm"},
+		}},
+	}
+
+	// setup:
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		s.Require().Equal("Translation:", query)
+		return []ankiconnect.NoteID{2, 1}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+			1: {ID: 1, Fields: map[string]string{"Word": "Hund", "Translation": "", "Example": ""}, Tags: []string{"a1"}},
+			2: {ID: 2, Fields: map[string]string{"Word": "Katze", "Translation": "", "Example": ""}},
+		}, nil
+	}
+	var requests []llm.Request
+	s.LLMMock.GenerateFunc = func(ctx context.Context, req llm.Request) (string, error) {
+		requests = append(requests, req)
+		if strings.Contains(req.Prompt, "Hund") {
+			return "```json\n" + `{"translation": "dog", "example": "Der Hund bellt.", "tags": ["A1", "animals"]}` + "\n```", nil
+		}
+		return "Sorry, I can't help with that.", nil
+	}
+	updatedFields := make(map[ankiconnect.NoteID]map[string]ankiconnect.FieldUpdate)
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		updatedFields[noteID] = fields
+		return nil
+	}
+	addedTags := make(map[ankiconnect.NoteID][]string)
+	s.AnkiMock.AddTagsFn = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		for _, noteID := range noteIDs {
+			addedTags[noteID] = append(addedTags[noteID], tags...)
+		}
+		return nil
+	}
+
+	// when:
+	report, err := s.Enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal([]llm.Request{
+		{Model: "gpt-4o-mini", Prompt: "Translate Hund to English. Reply with JSON."},
+		{Model: "gpt-4o-mini", Prompt: "Translate Katze to English. Reply with JSON."},
+	}, requests)
+	s.Require().Equal(map[ankiconnect.NoteID]map[string]ankiconnect.FieldUpdate{
+		1: {"Translation": {Value: lang.New("dog")}, "Example": {Value: lang.New("Der Hund bellt.")}},
+	}, updatedFields)
+	s.Require().Equal(map[ankiconnect.NoteID][]string{1: {"animals", "llm"}}, addedTags,
+		"tags should be compared case-insensitively")
+	s.Require().Len(report.Actions, 1)
+	s.Require().Equal(1, report.Actions[0].Succeeded)
+	s.Require().Equal(1, report.Actions[0].Failed)
+	s.Require().Equal(ankiconnect.NoteID(2), report.Actions[0].Errors[0].NoteID)
+	s.Require().Contains(report.Actions[0].Errors[0].Error, "not a JSON object")
+}
+
+func (s *EnhancerSuite) TestLLM_CachedRepliesAndProvenance() {
+	// setup:
+	cache, err := llmcache.OpenFile(filepath.Join(s.T().TempDir(), "llm-cache.json"))
+	s.Require().NoError(err)
+	enhancer := ankihelper.NewHelper(s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, nil, nil, s.LLMMock, cache)
+
+	note := ankiconnect.NoteInfo{
+		ID:     1,
+		Fields: map[string]string{"Word": "Hund", "Translation": "", "Source": ""},
+		Tags:   []string{"llm::gpt-4o::0123456789ab"},
+	}
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{note.ID}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		return map[ankiconnect.NoteID]ankiconnect.NoteInfo{note.ID: note}, nil
+	}
+	generations := 0
+	s.LLMMock.GenerateFunc = func(ctx context.Context, req llm.Request) (string, error) {
+		generations++
+		return `{"translation": "dog"}`, nil
+	}
+	var updatedFields []map[string]ankiconnect.FieldUpdate
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		updatedFields = append(updatedFields, fields)
+		return nil
+	}
+	var addedTags, removedTags []string
+	s.AnkiMock.AddTagsFn = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		addedTags = append(addedTags, tags...)
+		return nil
+	}
+	s.AnkiMock.RemoveTagsFunc = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		removedTags = append(removedTags, tags...)
+		return nil
+	}
+
+	// given:
+	rule := ankihelperconf.LLMRule{
+		Name:            "translate",
+		NoteFilter:      "Translation:",
+		Model:           "gpt-4o-mini",
+		Prompt:          s.mustParse(`Translate $$ .Note.Fields.Word $$`),
+		Fields:          map[string]string{"translation": "Translation"},
+		ProvenanceField: "Source",
+		ProvenanceTag:   "llm",
+	}
+	actions := ankihelperconf.Actions{LLM: []ankihelperconf.LLMRule{rule}}
+	key := llmcache.Key(llm.Request{Model: "gpt-4o-mini", Prompt: "Translate Hund"})
+
+	// when:
+	_, err = enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+	_, err = enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+
+	// then:
+	s.Require().Equal(1, generations, "the second run should use the cached reply")
+	s.Require().Len(updatedFields, 2)
+	s.Require().Equal(updatedFields[0], updatedFields[1])
+	s.Require().Equal(map[string]ankiconnect.FieldUpdate{
+		"Translation": {Value: lang.New("dog")},
+		"Source":      {Value: lang.New("gpt-4o-mini " + key)},
+	}, updatedFields[0])
+	s.Require().Equal([]string{"llm::gpt-4o-mini::" + key[:12]}, addedTags[:1])
+	s.Require().Equal([]string{"llm::gpt-4o::0123456789ab"}, removedTags[:1], "tags of previous generations should be removed")
+	entry, ok := cache.Entry(key)
+	s.Require().True(ok)
+	s.Require().Equal("llm:translate", entry.Rule)
+
+	// when:
+	s.Require().Equal(1, cache.Invalidate("llm:translate"))
+	_, err = enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+
+	// then:
+	s.Require().NoError(err)
+	s.Require().Equal(2, generations, "the reply should be generated again once the cache is invalidated")
+}
+
+func (s *EnhancerSuite) TestUndo_NoteProcessing() {
+	// setup:
+	journalPath := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	enhancer := ankihelper.NewHelper(
+		s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, journal.OpenFile(journalPath, "run-1"), nil, s.LLMMock, nil,
+	)
+
+	notes := map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+		1: {ID: 1, Fields: map[string]string{"Gender": "feminine"}},
+		2: {ID: 2, Fields: map[string]string{"Gender": "masculine"}, Tags: []string{"Normalized"}},
+	}
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{1, 2}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		result := make(map[ankiconnect.NoteID]ankiconnect.NoteInfo)
+		for _, noteID := range noteIDs {
+			result[noteID] = notes[noteID]
+		}
+		return result, nil
+	}
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		for field, update := range fields {
+			notes[noteID].Fields[field] = *update.Value
+		}
+		return nil
+	}
+	s.AnkiMock.AddTagsFn = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		return nil
+	}
+	s.ScriptMock.RunScriptFunc = func(
+		ctx context.Context,
+		rule ankihelperconf.NoteProcessingRule,
+		note noteprocessing.NoteData,
+		progress noteprocessing.ProgressInfo,
+	) ([]noteprocessing.Modification, error) {
+		gender := note.Fields["Gender"][:1]
+		return []noteprocessing.Modification{
+			{SetField: &map[string]string{"Gender": gender}},
+			{AddTag: lang.New("normalized")},
+		}, nil
+	}
+
+	// given:
+	actions := ankihelperconf.Actions{NoteProcessing: []ankihelperconf.NoteProcessingRule{{NoteFilter: "Gender:_*"}}}
+	_, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+	s.Require().Equal("f", notes[1].Fields["Gender"])
+	// the field is modified by the user after the run
+	notes[2].Fields["Gender"] = "male"
+
+	entries, err := journal.ReadFile(journalPath)
+	s.Require().NoError(err)
+	s.Require().Len(entries, 2)
+	var removedTags []string
+	s.AnkiMock.RemoveTagsFunc = func(noteIDs []ankiconnect.NoteID, tags []string) error {
+		removedTags = append(removedTags, tags...)
+		return nil
+	}
+
+	// when:
+	result := enhancer.Undo(context.Background(), journal.RunEntries(entries, "run-1"), false)
+
+	// then:
+	s.Require().Equal(ankihelper.UndoResult{Reverted: 1, Conflicts: 1}, result)
+	s.Require().Equal("feminine", notes[1].Fields["Gender"])
+	s.Require().Equal("male", notes[2].Fields["Gender"], "fields modified after the run should be left intact")
+	s.Require().Equal([]string{"normalized"}, removedTags, "tags the note had before the run should be kept")
+}
+
+func (s *EnhancerSuite) TestUndo_CardsState() {
+	// setup:
+	journalPath := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	enhancer := ankihelper.NewHelper(
+		s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, journal.OpenFile(journalPath, "run-1"), nil, s.LLMMock, nil,
+	)
+
+	cards := map[ankiconnect.CardID]ankiconnect.CardInfo{
+		11: {ID: 11, NoteID: 1, Type: ankiconnect.CardTypeReview, Queue: 2, Due: 700, Interval: 30, Ease: 2500},
+		12: {ID: 12, NoteID: 2, Type: ankiconnect.CardTypeReview, Queue: 2, Due: 710, Interval: 12, Ease: 2300},
+	}
+	s.AnkiMock.FindCardsFunc = func(query string) ([]ankiconnect.CardID, error) {
+		return []ankiconnect.CardID{11, 12}, nil
+	}
+	s.AnkiMock.CardsInfoFunc = func(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error) {
+		result := make(map[ankiconnect.CardID]ankiconnect.CardInfo)
+		for _, cardID := range cardIDs {
+			result[cardID] = cards[cardID]
+		}
+		return result, nil
+	}
+	s.AnkiMock.ForgetCardsFunc = func(cardIDs []ankiconnect.CardID) error {
+		for i, cardID := range cardIDs {
+			cards[cardID] = ankiconnect.CardInfo{ID: cardID, NoteID: cards[cardID].NoteID, Due: int64(100 + i)}
+		}
+		return nil
+	}
+	restored := make(map[ankiconnect.CardID]ankiconnect.CardScheduling)
+	s.AnkiMock.SetCardSchedulingFunc = func(cardID ankiconnect.CardID, scheduling ankiconnect.CardScheduling) error {
+		restored[cardID] = scheduling
+		return nil
+	}
+
+	// given:
+	actions := ankihelperconf.Actions{CardsState: []ankihelperconf.CardsStateRule{{
+		Name:      "reset",
+		Filter:    "deck:German",
+		Operation: ankihelperconf.CardsForget,
+	}}}
+	_, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+	// the card is studied after the run
+	card := cards[12]
+	card.Type, card.Queue = ankiconnect.CardTypeLearning, 1
+	cards[12] = card
+
+	entries, err := journal.ReadFile(journalPath)
+	s.Require().NoError(err)
+	s.Require().Len(entries, 1)
+
+	// when:
+	result := enhancer.Undo(context.Background(), journal.RunEntries(entries, "run-1"), false)
+
+	// then:
+	s.Require().Equal(ankihelper.UndoResult{Conflicts: 1}, result)
+	s.Require().Equal(map[ankiconnect.CardID]ankiconnect.CardScheduling{
+		11: {Type: ankiconnect.CardTypeReview, Queue: 2, Due: 700, Interval: 30, Ease: 2500},
+	}, restored, "cards studied after the run should be left intact")
+}
+
+func (s *EnhancerSuite) TestUndo_TTS() {
+	// setup:
+	journalPath := filepath.Join(s.T().TempDir(), "journal.jsonl")
+	enhancer := ankihelper.NewHelper(
+		s.AnkiMock, s.TTSMock, s.ScriptMock, audioprocessing.NewProcessor(), nil, journal.OpenFile(journalPath, "run-1"), nil, s.LLMMock, nil,
+	)
+
+	notes := map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+		1: {ID: 1, Fields: map[string]string{"foo": "Hund", "fooVoiceover": ""}},
+		2: {ID: 2, Fields: map[string]string{"foo": "Katze", "fooVoiceover": ""}},
+	}
+	s.AnkiMock.FindNotesFunc = func(query string) ([]ankiconnect.NoteID, error) {
+		return []ankiconnect.NoteID{1, 2}, nil
+	}
+	s.AnkiMock.NotesInfoFunc = func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+		result := make(map[ankiconnect.NoteID]ankiconnect.NoteInfo)
+		for _, noteID := range noteIDs {
+			result[noteID] = notes[noteID]
+		}
+		return result, nil
+	}
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		for field, update := range fields {
+			if update.Value != nil {
+				notes[noteID].Fields[field] = *update.Value
+			} else {
+				notes[noteID].Fields[field] = update.AudioValue()
+			}
+		}
+		return nil
+	}
+	s.TTSMock.TextToSpeechFunc = func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
+		for text := range texts {
+			onResult(text, azuretts.TextToSpeechResult{Audio: []byte(text), Format: "mp3"})
+		}
+		return nil
+	}
+
+	// given:
+	actions := ankihelperconf.Actions{
+		TTS: []ankihelperconf.AnkiTTS{{
+			Fields: &ankihelperconf.AnkiTTSFields{NoteFilter: "foo:_* fooVoiceover:", TextField: "foo", AudioField: "fooVoiceover"},
+		}},
+	}
+	_, err := enhancer.RunSelected(context.Background(), actions, ankihelper.Selection{})
+	s.Require().NoError(err)
+	// the audio is replaced by the user after the run
+	notes[2].Fields["fooVoiceover"] = "[sound:katze.mp3]"
+
+	entries, err := journal.ReadFile(journalPath)
+	s.Require().NoError(err)
+	s.Require().Len(entries, 2)
+	updatedNotes := set.New[ankiconnect.NoteID](0)
+	s.AnkiMock.UpdateNoteFieldsFunc = func(noteID ankiconnect.NoteID, fields map[string]ankiconnect.FieldUpdate) error {
+		updatedNotes[noteID] = struct{}{}
+		for field, update := range fields {
+			notes[noteID].Fields[field] = *update.Value
+		}
+		return nil
+	}
+
+	// when:
+	result := enhancer.Undo(context.Background(), journal.RunEntries(entries, "run-1"), false)
+
+	// then:
+	s.Require().Equal(ankihelper.UndoResult{Reverted: 1, Conflicts: 1}, result)
+	s.Require().Equal("", notes[1].Fields["fooVoiceover"])
+	s.Require().Equal("[sound:katze.mp3]", notes[2].Fields["fooVoiceover"], "audio replaced after the run should be left intact")
+	s.Require().Equal(set.FromSlice[ankiconnect.NoteID](1), updatedNotes, "nothing should be updated in notes with conflicts")
 }
 
 func (s *EnhancerSuite) mustParse(text string) *template.Template {
@@ -0,0 +1,357 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/lang/mapx"
+	"anki-rest-enhancer/util/lang/slicex"
+	"anki-rest-enhancer/util/logx"
+	"anki-rest-enhancer/vocabdb"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// importRow is a row of an imported file with the values of note fields.
+type importRow struct {
+	// Line is the line of the row in the file, or the number of the lookup in an e-reader database.
+	// It's used to refer to the row in logs.
+	Line   int
+	Fields map[string]string
+}
+
+// importChanges describes notes an import would create and update.
+type importChanges struct {
+	New     []importNew
+	Updates []importUpdate
+	// UpToDate is the number of rows whose notes already have the imported values,
+	// or just exist if existing notes are not updated.
+	UpToDate int
+	Failures []importFailure
+}
+
+type importNew struct {
+	Line int
+	Note ankiconnect.NewNote
+}
+
+type importUpdate struct {
+	NoteID ankiconnect.NoteID
+	// Fields contains only the fields whose values differ from the imported ones.
+	Fields map[string]string
+	// Previous contains the values of Fields before the update.
+	Previous map[string]string
+	// Tags are the tags of the import the note lacks.
+	Tags []string
+}
+
+type importFailure struct {
+	Line int
+	Err  error
+}
+
+// readImportRows reads the rows of the imported file.
+// It returns the note fields the columns are imported to along with the rows.
+func readImportRows(ctx context.Context, imp ankihelperconf.AnkiImport) ([]string, []importRow, error) {
+	switch imp.Format {
+	case ankihelperconf.ImportCSV:
+		return readImportFile(imp)
+	case ankihelperconf.ImportKindle, ankihelperconf.ImportKOReader:
+		return readLookups(ctx, imp)
+	default:
+		panic(errorx.Panic(errorx.IllegalState.New("unexpected import format %q", imp.Format)))
+	}
+}
+
+// readImportFile reads the rows of a CSV or TSV file. The first row is the header naming the columns.
+func readImportFile(imp ankihelperconf.AnkiImport) ([]string, []importRow, error) {
+	file, err := os.Open(imp.FilePath)
+	if err != nil {
+		return nil, nil, errorx.ExternalError.Wrap(err, "failed to open import file")
+	}
+	defer func() { _ = file.Close() }()
+
+	reader := csv.NewReader(file)
+	reader.Comma = imp.Delimiter
+	// TSV files exported by spreadsheets don't quote values
+	reader.LazyQuotes = imp.Delimiter == '\t'
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errorx.IllegalFormat.New("import file %s is empty", imp.FilePath)
+	}
+	if err != nil {
+		return nil, nil, errorx.IllegalFormat.Wrap(err, "malformed header of import file %s", imp.FilePath)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // byte order mark written by spreadsheets
+	}
+	fieldByColumn, err := importedColumns(imp, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return mapx.Values(fieldByColumn), rows, nil
+		}
+		if err != nil {
+			return nil, nil, errorx.IllegalFormat.Wrap(err, "malformed import file %s", imp.FilePath)
+		}
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, importRow{Line: line, Fields: rowFields(fieldByColumn, record)})
+	}
+}
+
+// readLookups reads words looked up on an e-reader. A word may be looked up several times, possibly in different
+// forms sharing the key field, e.g. its stem. Only the latest lookup of each key is returned then.
+func readLookups(ctx context.Context, imp ankihelperconf.AnkiImport) ([]string, []importRow, error) {
+	var lookups []vocabdb.Lookup
+	var err error
+	if imp.Format == ankihelperconf.ImportKindle {
+		lookups, err = vocabdb.ReadKindle(ctx, imp.SQLitePath, imp.FilePath, imp.Language)
+	} else {
+		lookups, err = vocabdb.ReadKOReader(ctx, imp.SQLitePath, imp.FilePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fieldByColumn, err := importedColumns(imp, ankihelperconf.LookupColumns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []importRow
+	seenKeys := make(map[string]struct{})
+	for i, lookup := range lookups {
+		// lookups are ordered from the latest ones
+		row := importRow{
+			Line:   i + 1,
+			Fields: rowFields(fieldByColumn, []string{lookup.Word, lookup.Stem, lookup.Usage, lookup.Book}),
+		}
+		key := strings.TrimSpace(row.Fields[imp.KeyField])
+		if _, ok := seenKeys[key]; ok && key != "" {
+			continue
+		}
+		seenKeys[key] = struct{}{}
+		rows = append(rows, row)
+	}
+	return mapx.Values(fieldByColumn), rows, nil
+}
+
+// importedColumns maps indices of the columns to the note fields they are imported to.
+func importedColumns(imp ankihelperconf.AnkiImport, header []string) (map[int]string, error) {
+	fieldByColumn := make(map[int]string)
+	for i, column := range header {
+		column = strings.TrimSpace(column)
+		field := column
+		if imp.Fields != nil {
+			field = imp.Fields[column]
+		}
+		if field != "" {
+			fieldByColumn[i] = field
+		}
+	}
+	if !slices.Contains(mapx.Values(fieldByColumn), imp.KeyField) {
+		return nil, errorx.IllegalFormat.New("there is no column for key field %q in %s", imp.KeyField, imp.FilePath)
+	}
+	return fieldByColumn, nil
+}
+
+func rowFields(fieldByColumn map[int]string, record []string) map[string]string {
+	fields := make(map[string]string, len(fieldByColumn))
+	for i, field := range fieldByColumn {
+		fields[field] = record[i]
+	}
+	return fields
+}
+
+// findImportChanges compares the rows of the import file with the existing notes of the note type.
+// Notes are matched to rows by the value of the key field.
+func (h Helper) findImportChanges(ctx context.Context, imp ankihelperconf.AnkiImport) (importChanges, error) {
+	fields, rows, err := readImportRows(ctx, imp)
+	if err != nil {
+		return importChanges{}, err
+	}
+
+	fieldNames, err := h.ankiConnect.ModelFieldNames(imp.NoteType)
+	if err != nil {
+		return importChanges{}, errorx.Decorate(err, "failed to get fields of note type %q", imp.NoteType)
+	}
+	for _, field := range fields {
+		if !slices.Contains(fieldNames, field) {
+			return importChanges{}, errorx.IllegalArgument.New("there is no field %q in note type %q", field, imp.NoteType)
+		}
+	}
+
+	noteIDs, err := h.ankiConnect.FindNotes(fmt.Sprintf(`"note:%s"`, imp.NoteType))
+	if err != nil {
+		return importChanges{}, errorx.Decorate(err, "failed to find notes of type %q", imp.NoteType)
+	}
+	notes, err := h.ankiConnect.NotesInfo(noteIDs)
+	if err != nil {
+		return importChanges{}, errorx.Decorate(err, "failed to get notes of type %q", imp.NoteType)
+	}
+	notesByKey := make(map[string][]ankiconnect.NoteInfo)
+	for _, noteID := range noteIDs {
+		if note, ok := notes[noteID]; ok {
+			key := strings.TrimSpace(note.Fields[imp.KeyField])
+			notesByKey[key] = append(notesByKey[key], note)
+		}
+	}
+
+	var changes importChanges
+	linesByKey := make(map[string]int)
+	for _, row := range rows {
+		key := strings.TrimSpace(row.Fields[imp.KeyField])
+		if key == "" {
+			err := errorx.IllegalFormat.New("key field %q is empty", imp.KeyField)
+			changes.Failures = append(changes.Failures, importFailure{Line: row.Line, Err: err})
+			continue
+		}
+		if line, ok := linesByKey[key]; ok {
+			err := errorx.IllegalFormat.New("key %q is already imported from line %d", key, line)
+			changes.Failures = append(changes.Failures, importFailure{Line: row.Line, Err: err})
+			continue
+		}
+		linesByKey[key] = row.Line
+
+		existing := notesByKey[key]
+		switch len(existing) {
+		case 0:
+			changes.New = append(changes.New, importNew{Line: row.Line, Note: ankiconnect.NewNote{
+				Deck:     imp.Deck,
+				NoteType: imp.NoteType,
+				Fields:   row.Fields,
+				Tags:     imp.Tags,
+			}})
+		case 1:
+			if !imp.UpdateExisting {
+				changes.UpToDate++
+				continue
+			}
+			note := existing[0]
+			update := importUpdate{
+				NoteID:   note.ID,
+				Fields:   make(map[string]string),
+				Previous: make(map[string]string),
+				Tags:     missingTags(note.Tags, imp.Tags),
+			}
+			for field, value := range row.Fields {
+				if note.Fields[field] != value {
+					update.Fields[field] = value
+					update.Previous[field] = note.Fields[field]
+				}
+			}
+			if len(update.Fields) == 0 && len(update.Tags) == 0 {
+				changes.UpToDate++
+				continue
+			}
+			changes.Updates = append(changes.Updates, update)
+		default:
+			err := errorx.IllegalState.New("key %q is used by %d notes of type %q", key, len(existing), imp.NoteType)
+			changes.Failures = append(changes.Failures, importFailure{Line: row.Line, Err: err})
+		}
+	}
+	return changes, nil
+}
+
+func (h Helper) importNotes(ctx context.Context, report *Report, imports []ankihelperconf.AnkiImport) error {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionImport)
+	if len(imports) == 0 {
+		return nil
+	}
+
+	logger.Info("Importing notes...")
+	for i, imp := range imports {
+		importLogger := logger.With(logx.KeyRule, ruleTitle(i, imp.Name))
+		action := report.startAction(ActionImport, i, imp.Name)
+		if err := action.finish(h.applyImport(ctx, importLogger, action, imp)); err != nil {
+			return errorx.Decorate(err, "failed to import %s", ruleTitle(i, imp.Name))
+		}
+	}
+	logger.Info("Successfully imported notes.")
+	return nil
+}
+
+func (h Helper) applyImport(ctx context.Context, logger *slog.Logger, action *ActionReport, imp ankihelperconf.AnkiImport) error {
+	changes, err := h.findImportChanges(ctx, imp)
+	if err != nil {
+		return err
+	}
+	for _, failure := range changes.Failures {
+		logger.Warn("Skip row", "file", imp.FilePath, "line", failure.Line, logx.Err(failure.Err))
+		action.rowFailed(failure.Line, failure.Err)
+	}
+	action.Skipped += changes.UpToDate
+	logger.Info("Found notes to import", "file", imp.FilePath,
+		"new", len(changes.New), "updated", len(changes.Updates), "upToDate", changes.UpToDate)
+
+	if len(changes.New) > 0 {
+		notes := slicex.Map(changes.New, func(n importNew) ankiconnect.NewNote { return n.Note })
+		noteIDs, err := h.ankiConnect.AddNotes(notes)
+		if err != nil {
+			action.Failed += len(changes.New)
+			return err
+		}
+		for i, noteID := range noteIDs {
+			if noteID == nil {
+				err := errorx.ExternalError.New("AnkiConnect failed to create the note")
+				logger.Warn("Failed to create note", "line", changes.New[i].Line, imp.KeyField, notes[i].Fields[imp.KeyField], logx.Err(err))
+				action.rowFailed(changes.New[i].Line, err)
+				continue
+			}
+			action.noteSucceeded(*noteID)
+		}
+	}
+
+	for _, update := range changes.Updates {
+		noteLogger := logger.With(logx.KeyNoteID, update.NoteID)
+		fieldUpdates := make(map[string]ankiconnect.FieldUpdate, len(update.Fields))
+		change := journal.Entry{NoteID: update.NoteID, Fields: make(map[string]journal.FieldChange, len(update.Fields))}
+		for field, value := range update.Fields {
+			value := value
+			fieldUpdates[field] = ankiconnect.FieldUpdate{Value: &value}
+			change.Fields[field] = journal.FieldChange{Previous: update.Previous[field], Value: value}
+		}
+		if len(fieldUpdates) > 0 {
+			if err := h.ankiConnect.UpdateNoteFields(update.NoteID, fieldUpdates); err != nil {
+				noteLogger.Warn("Failed to update note", logx.Err(err))
+				action.noteFailed(update.NoteID, "", err)
+				continue
+			}
+		}
+		var addTagsErr error
+		if len(update.Tags) > 0 {
+			addTagsErr = h.ankiConnect.AddTags([]ankiconnect.NoteID{update.NoteID}, update.Tags)
+			if addTagsErr == nil {
+				change.AddedTags = update.Tags
+			}
+		}
+		// fields are recorded even if tags failed to be added, since they are modified anyway
+		if len(change.Fields) > 0 || len(change.AddedTags) > 0 {
+			if err := h.recordChange(action, change); err != nil {
+				noteLogger.Warn("Updated note, but failed to record it in the journal", logx.Err(err))
+				action.noteFailed(update.NoteID, "", err)
+				continue
+			}
+		}
+		if addTagsErr != nil {
+			noteLogger.Warn("Failed to tag note", logx.Err(addTagsErr))
+			action.noteFailed(update.NoteID, "", addTagsErr)
+			continue
+		}
+		action.noteSucceeded(update.NoteID)
+	}
+	logger.Info("Finished import", "succeeded", action.Succeeded, "failed", action.Failed)
+	return nil
+}
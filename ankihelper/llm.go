@@ -0,0 +1,304 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/llm"
+	"anki-rest-enhancer/llmcache"
+	"anki-rest-enhancer/noteprocessing"
+	"anki-rest-enhancer/util/lang"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/lang/slicex"
+	"anki-rest-enhancer/util/logx"
+	"anki-rest-enhancer/util/templatex"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+func (h Helper) generateWithLLM(
+	ctx context.Context,
+	report *Report,
+	rules []ankihelperconf.LLMRule,
+	noteQuery string,
+) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	ctx = logx.With(ctx, logx.KeyAction, ActionLLM)
+	if h.llm == nil {
+		return errorx.IllegalState.New("llm actions are configured, but the language model is not")
+	}
+	logx.FromContext(ctx).Info("Generate fields with language model...")
+
+	for i, rule := range rules {
+		ruleCtx := logx.With(ctx, logx.KeyRule, ruleTitle(i, rule.Name))
+		action := report.startAction(ActionLLM, i, rule.Name)
+		if err := action.finish(h.applyLLMRule(ruleCtx, action, llmStateKey(i, rule), rule, noteQuery)); err != nil {
+			return errorx.Decorate(err, "failed to execute llm rule %s", ruleTitle(i, rule.Name))
+		}
+	}
+
+	logx.FromContext(ctx).Info("Finished generating fields with language model")
+	return nil
+}
+
+func (h Helper) applyLLMRule(
+	ctx context.Context,
+	action *ActionReport,
+	stateKey string,
+	rule ankihelperconf.LLMRule,
+	noteQuery string,
+) error {
+	noteIDs, err := h.ankiConnect.FindNotes(restrictQuery(rule.NoteFilter, noteQuery))
+	if err != nil {
+		return err
+	}
+	notes, err := h.ankiConnect.NotesInfo(noteIDs)
+	if err != nil {
+		return err
+	}
+	slices.Sort(noteIDs)
+	logx.FromContext(ctx).Info("Found notes to generate fields for", "notes", len(notes))
+
+	for i, noteID := range noteIDs {
+		note, ok := notes[noteID]
+		if !ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		fingerprint := llmFingerprint(rule, note.Fields)
+		if h.isUpToDate(stateKey, noteID, fingerprint) {
+			action.Skipped++
+			continue
+		}
+
+		noteCtx := logx.With(ctx, logx.KeyNoteID, noteID)
+		logx.FromContext(noteCtx).Debug("Generate note fields", "progress", fmt.Sprintf("%d/%d", i+1, len(noteIDs)))
+		fields, err := h.generateNoteFields(noteCtx, action, stateKey, rule, note)
+		if err != nil {
+			logx.FromContext(noteCtx).Warn("Failed to generate note fields", logx.Err(err))
+			action.noteFailed(noteID, "", err)
+			h.recordProcessingState(stateKey, noteID, fingerprint, err)
+			continue
+		}
+		action.noteSucceeded(noteID)
+		// the fingerprint is taken after the modification, so that the note is not generated again because of it
+		h.recordProcessingState(stateKey, noteID, llmFingerprint(rule, fields), nil)
+	}
+	if action.Skipped > 0 {
+		logx.FromContext(ctx).Info("Skipped notes generated by previous runs with the same inputs", "notes", action.Skipped)
+	}
+
+	// the state of the notes and the replies generated so far are kept even if the run is interrupted
+	if err := h.saveState(); err != nil {
+		return err
+	}
+	if h.llmCache != nil {
+		if err := h.llmCache.Save(); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// InvalidateLLM removes the cached replies and the note states of the llm rules with the names,
+// so that the next run asks the model again. Empty set means all the rules.
+// The numbers of removed replies and note states are returned.
+func (h Helper) InvalidateLLM(rules []ankihelperconf.LLMRule, names set.Set[string]) (replies, notes int, err error) {
+	for i, rule := range rules {
+		if len(names) > 0 && !names.Contains(rule.Name) {
+			continue
+		}
+		stateKey := llmStateKey(i, rule)
+		if h.llmCache != nil {
+			replies += h.llmCache.Invalidate(stateKey)
+		}
+		if h.stateStore != nil {
+			notes += h.stateStore.DeleteRule(stateKey)
+		}
+	}
+	if h.llmCache != nil {
+		if err := h.llmCache.Save(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := h.saveState(); err != nil {
+		return 0, 0, err
+	}
+	return replies, notes, nil
+}
+
+// generateNoteFields asks the model for the note fields, unless the reply is cached, and stores the reply in the note.
+// cacheRule identifies the rule in the cache. The fields of the note after the modification are returned.
+func (h Helper) generateNoteFields(
+	ctx context.Context,
+	action *ActionReport,
+	cacheRule string,
+	rule ankihelperconf.LLMRule,
+	note ankiconnect.NoteInfo,
+) (map[string]string, error) {
+	req, err := llmRequest(rule, note)
+	if err != nil {
+		return nil, err
+	}
+	key := llmcache.Key(req)
+	var reply string
+	cached := false
+	if h.llmCache != nil {
+		var entry llmcache.Entry
+		if entry, cached = h.llmCache.Entry(key); cached {
+			logx.FromContext(ctx).Debug("Use cached reply", "key", key, "createdAt", entry.CreatedAt)
+			reply = entry.Reply
+		}
+	}
+	if !cached {
+		if reply, err = h.llm.Generate(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+	generated, tags, err := parseLLMReply(rule, reply)
+	if err != nil {
+		return nil, err
+	}
+	// only replies that could be stored are cached, so that malformed ones are requested again
+	if h.llmCache != nil && !cached {
+		h.llmCache.Put(llmcache.Entry{Key: key, Rule: cacheRule, Model: req.Model, Reply: reply, CreatedAt: time.Now()})
+	}
+	if rule.ProvenanceField != "" {
+		generated[rule.ProvenanceField] = llmcache.ProvenanceValue(req.Model, key)
+	}
+	if rule.ProvenanceTag != "" {
+		tag := llmcache.ProvenanceTag(rule.ProvenanceTag, req.Model, key)
+		if err := h.removeStaleProvenanceTags(note, rule.ProvenanceTag, tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	fields := maps.Clone(note.Fields)
+	fieldUpdates := make(map[string]ankiconnect.FieldUpdate)
+	change := journal.Entry{NoteID: note.ID}
+	for field, value := range generated {
+		previous, ok := note.Fields[field]
+		if !ok {
+			return nil, errorx.IllegalState.New("there is no field %q in note %d", field, note.ID)
+		}
+		if previous == value {
+			continue
+		}
+		if change.Fields == nil {
+			change.Fields = make(map[string]journal.FieldChange)
+		}
+		fieldUpdates[field] = ankiconnect.FieldUpdate{Value: lang.New(value)}
+		change.Fields[field] = journal.FieldChange{Previous: previous, Value: value}
+		fields[field] = value
+	}
+	if len(fieldUpdates) > 0 {
+		if err := h.ankiConnect.UpdateNoteFields(note.ID, fieldUpdates); err != nil {
+			return nil, err
+		}
+	}
+	var addTagsErr error
+	if missing := missingTags(note.Tags, append(tags, rule.Tags...)); len(missing) > 0 {
+		addTagsErr = h.ankiConnect.AddTags([]ankiconnect.NoteID{note.ID}, missing)
+		if addTagsErr == nil {
+			change.AddedTags = missing
+		}
+	}
+	// fields are recorded even if tags failed to be added, since they are modified anyway
+	if len(change.Fields) > 0 || len(change.AddedTags) > 0 {
+		if err := h.recordChange(action, change); err != nil {
+			return nil, err
+		}
+	}
+	if addTagsErr != nil {
+		return nil, addTagsErr
+	}
+	return fields, nil
+}
+
+// removeStaleProvenanceTags removes provenance tags left by previous generations of the note.
+// The removal is not recorded in the journal, since the tags only describe the replaced fields.
+func (h Helper) removeStaleProvenanceTags(note ankiconnect.NoteInfo, prefix, current string) error {
+	stale := slicex.Filter(note.Tags, func(tag string) bool {
+		return llmcache.IsProvenanceTag(prefix, tag) && !strings.EqualFold(tag, current)
+	})
+	if len(stale) == 0 {
+		return nil
+	}
+	return h.ankiConnect.RemoveTags([]ankiconnect.NoteID{note.ID}, stale)
+}
+
+// llmRequest renders the templates of the rule for the note.
+func llmRequest(rule ankihelperconf.LLMRule, note ankiconnect.NoteInfo) (llm.Request, error) {
+	data := noteprocessing.TemplateData{Note: noteprocessing.NoteData{Fields: note.Fields, Tags: note.Tags}}
+	req := llm.Request{Model: rule.Model, Temperature: rule.Temperature}
+	if rule.System != nil {
+		system, err := templatex.Execute(rule.System, data)
+		if err != nil {
+			return llm.Request{}, errorx.IllegalFormat.Wrap(err, "failed to execute system template")
+		}
+		req.System = system
+	}
+	prompt, err := templatex.Execute(rule.Prompt, data)
+	if err != nil {
+		return llm.Request{}, errorx.IllegalFormat.Wrap(err, "failed to execute prompt template")
+	}
+	req.Prompt = prompt
+	return req, nil
+}
+
+// parseLLMReply extracts the fields and the tags from the JSON object replied by the model.
+// String values are stored as is, other values are stored as JSON.
+func parseLLMReply(rule ankihelperconf.LLMRule, reply string) (fields map[string]string, tags []string, err error) {
+	// some models wrap JSON in a markdown code block even if they are asked not to
+	reply = strings.TrimSpace(reply)
+	if strings.HasPrefix(reply, "```") && strings.HasSuffix(reply, "```") {
+		reply = strings.TrimSuffix(reply, "```")
+		if newline := strings.IndexByte(reply, '\n'); newline >= 0 {
+			reply = reply[newline+1:]
+		}
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(reply), &object); err != nil {
+		return nil, nil, errorx.IllegalFormat.Wrap(err, "model reply is not a JSON object: %s", reply)
+	}
+
+	fields = make(map[string]string, len(rule.Fields))
+	for key, field := range rule.Fields {
+		raw, ok := object[key]
+		if !ok {
+			return nil, nil, errorx.IllegalFormat.New("model reply has no key %q: %s", key, reply)
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+		fields[field] = strings.TrimSpace(value)
+	}
+
+	if raw, ok := object[rule.TagsKey]; ok && rule.TagsKey != "" {
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return nil, nil, errorx.IllegalFormat.New("%q of model reply should be a list of tags, got %s", rule.TagsKey, raw)
+			}
+			list = []string{value}
+		}
+		for _, tag := range list {
+			// Anki tags can't contain spaces
+			tags = append(tags, strings.Fields(tag)...)
+		}
+	}
+	return fields, tags, nil
+}
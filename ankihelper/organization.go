@@ -0,0 +1,203 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// OrganizationConflict describes cards matched by several cards organization rules with different target decks,
+// which can't be resolved with rule priorities.
+type OrganizationConflict struct {
+	// Rules are the titles of the conflicting rules.
+	Rules []string
+	// Decks are the target decks of the rules, in the same order.
+	Decks []string
+	Cards []ankiconnect.CardID
+}
+
+func (c OrganizationConflict) String() string {
+	rules := make([]string, len(c.Rules))
+	for i := range c.Rules {
+		rules[i] = fmt.Sprintf("%s -> %q", c.Rules[i], c.Decks[i])
+	}
+	return fmt.Sprintf("%d cards are matched by rules %s", len(c.Cards), strings.Join(rules, ", "))
+}
+
+// cardsAssignment is the outcome of evaluating all the cards organization rules together.
+type cardsAssignment struct {
+	// CardsByRule lists cards to be moved by each rule, in the order of the rules.
+	// Each card is assigned to at most one rule.
+	CardsByRule [][]ankiconnect.CardID
+	Conflicts   []OrganizationConflict
+}
+
+// assignCards finds cards matched by the rules and decides which rule moves each of them.
+// Cards matched by several rules are assigned according to Exclusive and Priority settings of the rules.
+// Cards already in the target deck of their rule are not assigned.
+func (h Helper) assignCards(rules []ankihelperconf.NotesOrganizationRule, noteQuery string) (cardsAssignment, error) {
+	matchingRules := make(map[ankiconnect.CardID][]int)
+	var matchingOrder []ankiconnect.CardID
+	cardsToMove := make([]map[ankiconnect.CardID]struct{}, len(rules))
+	for i, rule := range rules {
+		matched, err := h.ankiConnect.FindCards(restrictQuery(rule.NotesFilter, noteQuery))
+		if err != nil {
+			return cardsAssignment{}, errorx.Decorate(err, "failed to find cards for notes organization rule %s", ruleTitle(i, rule.Name))
+		}
+		for _, cardID := range matched {
+			if _, ok := matchingRules[cardID]; !ok {
+				matchingOrder = append(matchingOrder, cardID)
+			}
+			matchingRules[cardID] = append(matchingRules[cardID], i)
+		}
+
+		toMove, err := h.ankiConnect.FindCards(organizationQuery(rule, noteQuery))
+		if err != nil {
+			return cardsAssignment{}, errorx.Decorate(err, "failed to find cards for notes organization rule %s", ruleTitle(i, rule.Name))
+		}
+		cardsToMove[i] = make(map[ankiconnect.CardID]struct{}, len(toMove))
+		for _, cardID := range toMove {
+			cardsToMove[i][cardID] = struct{}{}
+		}
+	}
+
+	assignment := cardsAssignment{CardsByRule: make([][]ankiconnect.CardID, len(rules))}
+	conflicts := make(map[string]*OrganizationConflict)
+	var conflictKeys []string
+	for _, cardID := range matchingOrder {
+		winners := organizationWinners(rules, matchingRules[cardID])
+		if len(winners) > 1 {
+			key := fmt.Sprint(winners)
+			conflict, ok := conflicts[key]
+			if !ok {
+				conflict = &OrganizationConflict{}
+				for _, i := range winners {
+					conflict.Rules = append(conflict.Rules, ruleTitle(i, rules[i].Name))
+					conflict.Decks = append(conflict.Decks, rules[i].TargetDeckName)
+				}
+				conflicts[key] = conflict
+				conflictKeys = append(conflictKeys, key)
+			}
+			conflict.Cards = append(conflict.Cards, cardID)
+			continue
+		}
+		if _, ok := cardsToMove[winners[0]][cardID]; ok {
+			assignment.CardsByRule[winners[0]] = append(assignment.CardsByRule[winners[0]], cardID)
+		}
+	}
+	for _, key := range conflictKeys {
+		assignment.Conflicts = append(assignment.Conflicts, *conflicts[key])
+	}
+	return assignment, nil
+}
+
+// organizationWinners returns the indices of the rules that should move a card matched by the matching rules.
+// More than one index is returned if the conflict can't be resolved.
+func organizationWinners(rules []ankihelperconf.NotesOrganizationRule, matching []int) []int {
+	candidates := slices.DeleteFunc(slices.Clone(matching), func(i int) bool { return !rules[i].Exclusive })
+	if len(candidates) == 0 {
+		topPriority := rules[matching[0]].Priority
+		for _, i := range matching {
+			topPriority = max(topPriority, rules[i].Priority)
+		}
+		candidates = slices.DeleteFunc(slices.Clone(matching), func(i int) bool { return rules[i].Priority != topPriority })
+	}
+	// rules moving cards to the same deck don't conflict, so the first of them wins
+	winners := []int{candidates[0]}
+	for _, i := range candidates[1:] {
+		if !slices.ContainsFunc(winners, func(j int) bool { return rules[j].TargetDeckName == rules[i].TargetDeckName }) {
+			winners = append(winners, i)
+		}
+	}
+	return winners
+}
+
+func (h Helper) organizeCards(
+	ctx context.Context,
+	report *Report,
+	rules []ankihelperconf.NotesOrganizationRule,
+	noteQuery string,
+) error {
+	logger := logx.FromContext(ctx).With(logx.KeyAction, ActionCardsOrganization)
+	logger.Info("Applying notes organization rules...")
+
+	assignment, err := h.assignCards(rules, noteQuery)
+	if err == nil && len(assignment.Conflicts) > 0 {
+		descriptions := make([]string, len(assignment.Conflicts))
+		for i, conflict := range assignment.Conflicts {
+			logger.Error("Cards are matched by several rules with different target decks",
+				"rules", conflict.Rules, "decks", conflict.Decks, "cards", conflict.Cards)
+			descriptions[i] = conflict.String()
+		}
+		err = errorx.IllegalState.New(
+			"notes organization rules conflict, set priority or exclusive to resolve: %s", strings.Join(descriptions, "; "))
+	}
+	if err != nil {
+		// rules are evaluated together, so they share the error and no cards are moved
+		for i, rule := range rules {
+			_ = report.startAction(ActionCardsOrganization, i, rule.Name).finish(err)
+		}
+		return err
+	}
+
+	for i, rule := range rules {
+		ruleLogger := logger.With(logx.KeyRule, ruleTitle(i, rule.Name))
+		ruleLogger.Info("Applying notes organization rule...")
+		action := report.startAction(ActionCardsOrganization, i, rule.Name)
+		if err := action.finish(h.applyOrganizationRule(ruleLogger, action, rule, assignment.CardsByRule[i])); err != nil {
+			return errorx.Decorate(err, "failed to apply notes organization rule %s", ruleTitle(i, rule.Name))
+		}
+	}
+	logger.Info("Successfully applied notes organization rules.")
+	return nil
+}
+
+// organizationQuery returns the query for cards that should be moved to the rule's target deck.
+func organizationQuery(rule ankihelperconf.NotesOrganizationRule, noteQuery string) string {
+	return restrictQuery(fmt.Sprintf(`-"deck:%s" %s`, rule.TargetDeckName, rule.NotesFilter), noteQuery)
+}
+
+func (h Helper) applyOrganizationRule(
+	logger *slog.Logger,
+	action *ActionReport,
+	rule ankihelperconf.NotesOrganizationRule,
+	cardIDs []ankiconnect.CardID,
+) error {
+	targetDeck := rule.TargetDeckName
+	if len(cardIDs) == 0 {
+		logger.Info("Found no cards to be moved", "deck", targetDeck)
+		return nil
+	}
+	logger.Info("Found cards to be moved", "deck", targetDeck, "cards", len(cardIDs))
+
+	var previousDecks map[ankiconnect.CardID]string
+	if h.journal != nil {
+		cards, err := h.ankiConnect.CardsInfo(cardIDs)
+		if err != nil {
+			return errorx.Decorate(err, "failed to get current decks of the cards")
+		}
+		previousDecks = make(map[ankiconnect.CardID]string, len(cards))
+		for cardID, card := range cards {
+			previousDecks[cardID] = card.DeckName
+		}
+	}
+
+	if err := h.ankiConnect.ChangeDeck(targetDeck, cardIDs); err != nil {
+		action.Failed += len(cardIDs)
+		return err
+	}
+	if err := h.recordChange(action, journal.Entry{Deck: targetDeck, PreviousDecks: previousDecks}); err != nil {
+		action.Failed += len(cardIDs)
+		return errorx.Decorate(err, "cards are moved, but the change is not recorded")
+	}
+	action.Succeeded += len(cardIDs)
+	logger.Info("Successfully moved cards", "deck", targetDeck, "cards", len(cardIDs))
+	return nil
+}
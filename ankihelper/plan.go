@@ -0,0 +1,416 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/llmcache"
+	"anki-rest-enhancer/util/lang/set"
+	"context"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"slices"
+	"sort"
+)
+
+// Plan describes what a run of the selected actions would do, given the current state of Anki.
+type Plan struct {
+	UploadMedia       []PlannedMediaUpload
+	NoteTypes         []PlannedNoteType
+	Decks             []PlannedDeck
+	Import            []PlannedImport
+	Dedupe            []PlannedDedupe
+	NoteProcessing    []PlannedNoteProcessing
+	LLM               []PlannedLLM
+	TTS               []PlannedTTS
+	CardsOrganization []PlannedCardsOrganization
+	CardsState        []PlannedCardsState
+	// OrganizationConflicts lists cards that would make the cards organization fail.
+	OrganizationConflicts []OrganizationConflict
+}
+
+type PlannedMediaUpload struct {
+	Rule     string
+	AnkiName string
+	FilePath string
+}
+
+type PlannedNoteType struct {
+	Name string
+	// Exists is true if the note type is already present in Anki, so it won't be created.
+	Exists bool
+}
+
+type PlannedDeck struct {
+	Name string
+	// Exists is true if the deck is already present in Anki, so it won't be created.
+	Exists bool
+	// Preset is the name of the configured preset, empty if options of the deck are not managed.
+	Preset string
+	// AssignPreset is true if the preset would be assigned to the deck.
+	AssignPreset bool
+	// UpdateOptions is true if options of the already assigned preset would be changed.
+	UpdateOptions bool
+}
+
+type PlannedImport struct {
+	Rule     string
+	FilePath string
+	// New and Updated are the numbers of notes that would be created and updated.
+	New, Updated int
+	// UpToDate is the number of rows whose notes already have the imported values.
+	UpToDate int
+	// Failures is the number of rows that would fail, e.g. because of an empty key field.
+	Failures int
+}
+
+type PlannedDedupe struct {
+	Rule string
+	// Groups are the groups of duplicate notes that would be merged.
+	Groups []DuplicateGroup
+}
+
+type PlannedNoteProcessing struct {
+	Rule       string
+	NoteFilter string
+	// Notes is the number of notes the script would be executed for.
+	Notes int
+	// UpToDate is the number of matching notes that would be skipped,
+	// because they were processed by previous runs with the same inputs.
+	UpToDate int
+}
+
+type PlannedLLM struct {
+	Rule       string
+	NoteFilter string
+	Model      string
+	// Notes is the number of notes the model would be asked to generate fields for.
+	Notes int
+	// UpToDate is the number of matching notes that would be skipped,
+	// because their fields were generated by previous runs with the same inputs.
+	UpToDate int
+	// Cached is the number of Notes whose fields would be taken from the cache without asking the model.
+	Cached int
+}
+
+type PlannedTTS struct {
+	Rule                  string
+	NoteFilter            string
+	TextField, AudioField string
+	// Notes is the number of notes that would get audio.
+	Notes int
+	// Characters is the total length of texts to be converted to speech.
+	Characters int
+}
+
+type PlannedCardsOrganization struct {
+	Rule       string
+	TargetDeck string
+	// Cards is the number of cards that would be moved to the target deck.
+	Cards int
+}
+
+type PlannedCardsState struct {
+	Rule      string
+	Operation ankihelperconf.CardsOperation
+	// Cards is the number of cards that would be changed. Unlock operation would suspend them.
+	Cards int
+	// Unsuspended is the number of cards that would be unsuspended by unlock operation.
+	Unsuspended int
+	// Failures is the number of cards that would fail, e.g. because of a malformed position field.
+	Failures int
+}
+
+// Plan evaluates the selected actions against the current state of Anki without modifying anything.
+func (h Helper) Plan(conf ankihelperconf.Actions, selection Selection) (Plan, error) {
+	selected := selection.Apply(conf)
+	var plan Plan
+
+	for i, media := range selected.UploadMedia {
+		plan.UploadMedia = append(plan.UploadMedia, PlannedMediaUpload{
+			Rule:     ruleTitle(i, media.Name),
+			AnkiName: media.AnkiName,
+			FilePath: media.FilePath,
+		})
+	}
+
+	if len(selected.NoteTypes) > 0 {
+		existing, err := h.ankiConnect.ModelNames()
+		if err != nil {
+			return Plan{}, err
+		}
+		existingSet := set.FromSlice(existing...)
+		for _, noteType := range selected.NoteTypes {
+			plan.NoteTypes = append(plan.NoteTypes, PlannedNoteType{
+				Name:   noteType.Name,
+				Exists: existingSet.Contains(noteType.Name),
+			})
+		}
+	}
+
+	if len(selected.Decks) > 0 {
+		existing, err := h.ankiConnect.DeckNames()
+		if err != nil {
+			return Plan{}, err
+		}
+		existingSet := set.FromSlice(existing...)
+		for _, deck := range selected.Decks {
+			planned := PlannedDeck{Name: deck.Name, Exists: existingSet.Contains(deck.Name)}
+			if deck.Preset != nil {
+				planned.Preset = deck.Preset.Name
+				planned.AssignPreset = true
+				if planned.Exists {
+					config, err := h.ankiConnect.GetDeckConfig(deck.Name)
+					if err != nil {
+						return Plan{}, err
+					}
+					planned.AssignPreset = config.Name != deck.Preset.Name
+					planned.UpdateOptions = !planned.AssignPreset && applyDeckPreset(&config, *deck.Preset)
+				}
+			}
+			plan.Decks = append(plan.Decks, planned)
+		}
+	}
+
+	for i, imp := range selected.Import {
+		changes, err := h.findImportChanges(context.Background(), imp)
+		if err != nil {
+			return Plan{}, errorx.Decorate(err, "failed to plan import %s", ruleTitle(i, imp.Name))
+		}
+		plan.Import = append(plan.Import, PlannedImport{
+			Rule:     ruleTitle(i, imp.Name),
+			FilePath: imp.FilePath,
+			New:      len(changes.New),
+			Updated:  len(changes.Updates),
+			UpToDate: changes.UpToDate,
+			Failures: len(changes.Failures),
+		})
+	}
+
+	for i, rule := range selected.Dedupe {
+		groups, err := h.findDuplicates(rule)
+		if err != nil {
+			return Plan{}, errorx.Decorate(err, "failed to find duplicates for dedupe rule %s", ruleTitle(i, rule.Name))
+		}
+		plan.Dedupe = append(plan.Dedupe, PlannedDedupe{Rule: ruleTitle(i, rule.Name), Groups: groups})
+	}
+
+	for i, rule := range selected.NoteProcessing {
+		noteIDs, err := h.ankiConnect.FindNotes(restrictQuery(rule.NoteFilter, selection.NoteQuery))
+		if err != nil {
+			return Plan{}, errorx.Decorate(err, "failed to find notes for note processing rule %s", ruleTitle(i, rule.Name))
+		}
+		planned := PlannedNoteProcessing{
+			Rule:       ruleTitle(i, rule.Name),
+			NoteFilter: rule.NoteFilter,
+			Notes:      len(noteIDs),
+		}
+		if h.stateStore != nil && len(noteIDs) > 0 {
+			notes, err := h.ankiConnect.NotesInfo(noteIDs)
+			if err != nil {
+				return Plan{}, errorx.Decorate(err, "failed to get notes for note processing rule %s", ruleTitle(i, rule.Name))
+			}
+			stateKey := processingStateKey(i, rule)
+			for noteID, note := range notes {
+				if h.isUpToDate(stateKey, noteID, processingFingerprint(rule, note.Fields)) {
+					planned.Notes--
+					planned.UpToDate++
+				}
+			}
+		}
+		plan.NoteProcessing = append(plan.NoteProcessing, planned)
+	}
+
+	for i, rule := range selected.LLM {
+		noteIDs, err := h.ankiConnect.FindNotes(restrictQuery(rule.NoteFilter, selection.NoteQuery))
+		if err != nil {
+			return Plan{}, errorx.Decorate(err, "failed to find notes for llm rule %s", ruleTitle(i, rule.Name))
+		}
+		planned := PlannedLLM{
+			Rule:       ruleTitle(i, rule.Name),
+			NoteFilter: rule.NoteFilter,
+			Model:      rule.Model,
+			Notes:      len(noteIDs),
+		}
+		if (h.stateStore != nil || h.llmCache != nil) && len(noteIDs) > 0 {
+			notes, err := h.ankiConnect.NotesInfo(noteIDs)
+			if err != nil {
+				return Plan{}, errorx.Decorate(err, "failed to get notes for llm rule %s", ruleTitle(i, rule.Name))
+			}
+			stateKey := llmStateKey(i, rule)
+			for noteID, note := range notes {
+				if h.isUpToDate(stateKey, noteID, llmFingerprint(rule, note.Fields)) {
+					planned.Notes--
+					planned.UpToDate++
+				} else if h.llmCache != nil {
+					// notes whose prompts can't be rendered would fail, so they are not counted as cached
+					if req, err := llmRequest(rule, note); err == nil {
+						if _, ok := h.llmCache.Entry(llmcache.Key(req)); ok {
+							planned.Cached++
+						}
+					}
+				}
+			}
+		}
+		plan.LLM = append(plan.LLM, planned)
+	}
+
+	if len(selected.TTS) > 0 {
+		sources, err := h.getTTSTaskSources(selected.TTS, conf.NoteTypes)
+		if err != nil {
+			return Plan{}, err
+		}
+		tasks, err := h.findTTSTasks(sources, selection.NoteQuery)
+		if err != nil {
+			return Plan{}, err
+		}
+		planned := make([]PlannedTTS, len(sources))
+		for i, source := range sources {
+			planned[i] = PlannedTTS{
+				Rule:       ruleTitle(source.ActionIdx, source.ActionName),
+				NoteFilter: source.NoteFilter,
+				TextField:  source.TextField,
+				AudioField: source.AudioField,
+			}
+		}
+		for task := range tasks {
+			planned[task.SourceIdx].Notes++
+			planned[task.SourceIdx].Characters += len([]rune(task.Text))
+		}
+		plan.TTS = planned
+	}
+
+	assignment, err := h.assignCards(selected.CardsOrganization, selection.cardsNoteQuery())
+	if err != nil {
+		return Plan{}, err
+	}
+	for i, rule := range selected.CardsOrganization {
+		plan.CardsOrganization = append(plan.CardsOrganization, PlannedCardsOrganization{
+			Rule:       ruleTitle(i, rule.Name),
+			TargetDeck: rule.TargetDeckName,
+			Cards:      len(assignment.CardsByRule[i]),
+		})
+	}
+	plan.OrganizationConflicts = assignment.Conflicts
+
+	for i, rule := range selected.CardsState {
+		change, err := h.findCardsStateChange(rule, selection.cardsNoteQuery())
+		if err != nil {
+			return Plan{}, errorx.Decorate(err, "failed to find cards for cards state rule %s", ruleTitle(i, rule.Name))
+		}
+		plan.CardsState = append(plan.CardsState, PlannedCardsState{
+			Rule:        ruleTitle(i, rule.Name),
+			Operation:   rule.Operation,
+			Cards:       len(change.Cards),
+			Unsuspended: len(change.Unsuspended),
+			Failures:    len(change.Failures),
+		})
+	}
+
+	return plan, nil
+}
+
+// NoteTypeDiff describes differences between a configured note type and its state in Anki.
+type NoteTypeDiff struct {
+	Name string
+	// Missing is true if there is no such note type in Anki. Other fields are not set in this case.
+	Missing bool
+
+	MissingFields, ExtraFields       []string
+	MissingTemplates, ExtraTemplates []string
+	// ChangedTemplates lists templates whose front or back differ from the configured ones.
+	ChangedTemplates []string
+}
+
+func (d NoteTypeDiff) IsEmpty() bool {
+	return !d.Missing &&
+		len(d.MissingFields) == 0 && len(d.ExtraFields) == 0 &&
+		len(d.MissingTemplates) == 0 && len(d.ExtraTemplates) == 0 &&
+		len(d.ChangedTemplates) == 0
+}
+
+func (d NoteTypeDiff) String() string {
+	if d.Missing {
+		return fmt.Sprintf("%s: missing in Anki", d.Name)
+	}
+	if d.IsEmpty() {
+		return fmt.Sprintf("%s: up to date", d.Name)
+	}
+	return fmt.Sprintf(
+		"%s: missing fields %v, extra fields %v, missing templates %v, extra templates %v, changed templates %v",
+		d.Name, d.MissingFields, d.ExtraFields, d.MissingTemplates, d.ExtraTemplates, d.ChangedTemplates,
+	)
+}
+
+// DiffNoteTypes compares configured note types with the ones present in Anki.
+// NOTE: the helper never modifies existing note types, so the differences have to be resolved manually.
+func (h Helper) DiffNoteTypes(noteTypes []ankihelperconf.AnkiNoteType) ([]NoteTypeDiff, error) {
+	existing, err := h.ankiConnect.ModelNames()
+	if err != nil {
+		return nil, err
+	}
+	existingSet := set.FromSlice(existing...)
+
+	diffs := make([]NoteTypeDiff, 0, len(noteTypes))
+	for _, noteType := range noteTypes {
+		if !existingSet.Contains(noteType.Name) {
+			diffs = append(diffs, NoteTypeDiff{Name: noteType.Name, Missing: true})
+			continue
+		}
+
+		diff, err := h.diffNoteType(noteType)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to compare note type %q", noteType.Name)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+func (h Helper) diffNoteType(noteType ankihelperconf.AnkiNoteType) (NoteTypeDiff, error) {
+	expected, err := h.noteTypeModel(noteType)
+	if err != nil {
+		return NoteTypeDiff{}, err
+	}
+	actualFields, err := h.ankiConnect.ModelFieldNames(noteType.Name)
+	if err != nil {
+		return NoteTypeDiff{}, err
+	}
+	actualTemplates, err := h.ankiConnect.ModelTemplates(noteType.Name)
+	if err != nil {
+		return NoteTypeDiff{}, err
+	}
+
+	diff := NoteTypeDiff{Name: noteType.Name}
+	diff.MissingFields, diff.ExtraFields = setDifferences(expected.InOrderFields, actualFields)
+
+	expectedTemplateNames := make([]string, 0, len(expected.CardTemplates))
+	for _, tmpl := range expected.CardTemplates {
+		expectedTemplateNames = append(expectedTemplateNames, tmpl.Name)
+		if actual, ok := actualTemplates[tmpl.Name]; ok && actual != tmpl {
+			diff.ChangedTemplates = append(diff.ChangedTemplates, tmpl.Name)
+		}
+	}
+	actualTemplateNames := make([]string, 0, len(actualTemplates))
+	for name := range actualTemplates {
+		actualTemplateNames = append(actualTemplateNames, name)
+	}
+	diff.MissingTemplates, diff.ExtraTemplates = setDifferences(expectedTemplateNames, actualTemplateNames)
+	return diff, nil
+}
+
+// setDifferences returns sorted elements of expected missing in actual, and elements of actual missing in expected.
+func setDifferences(expected, actual []string) (missing, extra []string) {
+	expectedSet, actualSet := set.FromSlice(expected...), set.FromSlice(actual...)
+	for _, e := range expected {
+		if !actualSet.Contains(e) {
+			missing = append(missing, e)
+		}
+	}
+	for _, a := range actual {
+		if !expectedSet.Contains(a) {
+			extra = append(extra, a)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return slices.Compact(missing), slices.Compact(extra)
+}
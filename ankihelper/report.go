@@ -0,0 +1,109 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ttsbudget"
+	"anki-rest-enhancer/util/lang/set"
+	"fmt"
+	"time"
+)
+
+// Report describes the outcome of a run of the configured actions.
+type Report struct {
+	Actions []*ActionReport `json:"actions"`
+	// TTSUsage describes characters converted to speech. It's nil if nothing was converted.
+	TTSUsage *ttsbudget.Usage `json:"ttsUsage,omitempty"`
+}
+
+// ActionReport describes the outcome of a single configured action.
+type ActionReport struct {
+	Type ActionType `json:"type"`
+	Rule string     `json:"rule"`
+
+	StartedAt       time.Time `json:"startedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+
+	// Succeeded and Failed count processed items (notes, fields, media files, etc.) of the action.
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// Skipped counts items left intact because they are up to date according to the state recorded by previous runs,
+	// or because the text-to-speech character budget is exhausted.
+	Skipped int `json:"skipped,omitempty"`
+	// TouchedNoteIDs lists notes modified by the action.
+	TouchedNoteIDs []ankiconnect.NoteID `json:"touchedNoteIds,omitempty"`
+	// Errors lists failures of individual notes. The action proceeds with other notes after such failures.
+	Errors []NoteError `json:"errors,omitempty"`
+	// Error is set if the action is aborted.
+	Error string `json:"error,omitempty"`
+}
+
+type NoteError struct {
+	NoteID ankiconnect.NoteID `json:"noteId,omitempty"`
+	Field  string             `json:"field,omitempty"`
+	// Line refers to the row of an imported file that failed without a note, e.g. because its key is empty.
+	Line  int    `json:"line,omitempty"`
+	Error string `json:"error"`
+}
+
+// Succeeded returns the number of items succeeded across all the actions.
+func (r Report) Succeeded() int {
+	var total int
+	for _, action := range r.Actions {
+		total += action.Succeeded
+	}
+	return total
+}
+
+// Failed returns the number of items failed across all the actions.
+func (r Report) Failed() int {
+	var total int
+	for _, action := range r.Actions {
+		total += action.Failed
+	}
+	return total
+}
+
+// TouchedNoteIDs returns the notes modified by all the actions.
+func (r Report) TouchedNoteIDs() set.Set[ankiconnect.NoteID] {
+	touched := set.New[ankiconnect.NoteID](0)
+	for _, action := range r.Actions {
+		for _, noteID := range action.TouchedNoteIDs {
+			touched[noteID] = struct{}{}
+		}
+	}
+	return touched
+}
+
+func (r *Report) startAction(actionType ActionType, idx int, name string) *ActionReport {
+	action := &ActionReport{
+		Type:      actionType,
+		Rule:      ruleTitle(idx, name),
+		StartedAt: time.Now(),
+	}
+	r.Actions = append(r.Actions, action)
+	return action
+}
+
+// finish records the action duration and its error, if any. err is returned as is.
+func (a *ActionReport) finish(err error) error {
+	a.DurationSeconds = time.Since(a.StartedAt).Seconds()
+	if err != nil {
+		a.Error = fmt.Sprintf("%v", err)
+	}
+	return err
+}
+
+func (a *ActionReport) noteSucceeded(noteID ankiconnect.NoteID) {
+	a.Succeeded++
+	a.TouchedNoteIDs = append(a.TouchedNoteIDs, noteID)
+}
+
+func (a *ActionReport) noteFailed(noteID ankiconnect.NoteID, field string, err error) {
+	a.Failed++
+	a.Errors = append(a.Errors, NoteError{NoteID: noteID, Field: field, Error: fmt.Sprintf("%v", err)})
+}
+
+func (a *ActionReport) rowFailed(line int, err error) {
+	a.Failed++
+	a.Errors = append(a.Errors, NoteError{Line: line, Error: fmt.Sprintf("%v", err)})
+}
@@ -0,0 +1,188 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/lang/slicex"
+	"anki-rest-enhancer/util/stringx"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"strings"
+)
+
+// ActionType is the type of configured actions. Names match keys of the 'actions' section of the config.
+type ActionType string
+
+const (
+	ActionUploadMedia       ActionType = "uploadMedia"
+	ActionNoteTypes         ActionType = "noteTypes"
+	ActionDecks             ActionType = "decks"
+	ActionImport            ActionType = "import"
+	ActionDedupe            ActionType = "dedupe"
+	ActionNoteProcessing    ActionType = "noteProcessing"
+	ActionLLM               ActionType = "llm"
+	ActionTTS               ActionType = "tts"
+	ActionCardsOrganization ActionType = "cardsOrganization"
+	ActionCardsState        ActionType = "cardsState"
+)
+
+// AllActionTypes lists action types in the order they are executed. It must match ankihelperconf.ActionKeys.
+var AllActionTypes = []ActionType{
+	ActionUploadMedia,
+	ActionNoteTypes,
+	ActionDecks,
+	ActionImport,
+	ActionDedupe,
+	ActionNoteProcessing,
+	ActionLLM,
+	ActionTTS,
+	ActionCardsOrganization,
+	ActionCardsState,
+}
+
+var actionTypeAliases = map[string]ActionType{
+	"media":    ActionUploadMedia,
+	"organize": ActionCardsOrganization,
+}
+
+// ParseActionTypes parses comma-separated list of action types.
+func ParseActionTypes(list string) (set.Set[ActionType], error) {
+	types := set.New[ActionType](0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		actionType, ok := actionTypeAliases[strings.ToLower(name)]
+		for _, t := range AllActionTypes {
+			if strings.EqualFold(string(t), name) {
+				actionType, ok = t, true
+			}
+		}
+		if !ok {
+			return nil, errorx.IllegalArgument.New("unknown action type %q, expected one of %v", name, AllActionTypes)
+		}
+		types[actionType] = struct{}{}
+	}
+	return types, nil
+}
+
+// Selection defines which of the configured actions should be executed and which notes they may affect.
+// Zero Selection selects all the actions.
+type Selection struct {
+	// Only restricts action types to execute. Empty set means all types.
+	Only set.Set[ActionType]
+	// Skip lists action types that should not be executed.
+	Skip set.Set[ActionType]
+	// Rules restricts actions to the ones with the specified names. Empty set means all actions.
+	// Note types and decks are identified by their names.
+	Rules set.Set[string]
+	// NoteQuery is an Anki search query that restricts notes processed by note processing, llm, TTS,
+	// cards organization and cards state actions in addition to their own filters. Empty query means no restriction.
+	NoteQuery string
+	// CardsNoteQuery replaces NoteQuery for cards organization and cards state actions, whose outcome may depend
+	// on reviews of the cards rather than on modifications of the notes. Empty query means NoteQuery is used.
+	CardsNoteQuery string
+}
+
+// cardsNoteQuery returns the query restricting notes of cards organization and cards state actions.
+func (s Selection) cardsNoteQuery() string {
+	if s.CardsNoteQuery != "" {
+		return s.CardsNoteQuery
+	}
+	return s.NoteQuery
+}
+
+func (s Selection) IncludesType(actionType ActionType) bool {
+	if len(s.Only) > 0 && !s.Only.Contains(actionType) {
+		return false
+	}
+	return !s.Skip.Contains(actionType)
+}
+
+func (s Selection) includes(actionType ActionType, name string) bool {
+	if !s.IncludesType(actionType) {
+		return false
+	}
+	return len(s.Rules) == 0 || s.Rules.Contains(name)
+}
+
+// Apply returns the actions selected for execution.
+func (s Selection) Apply(actions ankihelperconf.Actions) ankihelperconf.Actions {
+	return ankihelperconf.Actions{
+		UploadMedia: slicex.Filter(actions.UploadMedia, func(m ankihelperconf.AnkiUploadMedia) bool {
+			return s.includes(ActionUploadMedia, m.Name)
+		}),
+		NoteTypes: slicex.Filter(actions.NoteTypes, func(t ankihelperconf.AnkiNoteType) bool {
+			return s.includes(ActionNoteTypes, t.Name)
+		}),
+		Decks: slicex.Filter(actions.Decks, func(d ankihelperconf.AnkiDeck) bool {
+			return s.includes(ActionDecks, d.Name)
+		}),
+		Import: slicex.Filter(actions.Import, func(i ankihelperconf.AnkiImport) bool {
+			return s.includes(ActionImport, i.Name)
+		}),
+		Dedupe: slicex.Filter(actions.Dedupe, func(r ankihelperconf.DedupeRule) bool {
+			return s.includes(ActionDedupe, r.Name)
+		}),
+		NoteProcessing: slicex.Filter(actions.NoteProcessing, func(r ankihelperconf.NoteProcessingRule) bool {
+			return s.includes(ActionNoteProcessing, r.Name)
+		}),
+		LLM: slicex.Filter(actions.LLM, func(r ankihelperconf.LLMRule) bool {
+			return s.includes(ActionLLM, r.Name)
+		}),
+		TTS: slicex.Filter(actions.TTS, func(t ankihelperconf.AnkiTTS) bool {
+			return s.includes(ActionTTS, t.Name)
+		}),
+		CardsOrganization: slicex.Filter(actions.CardsOrganization, func(r ankihelperconf.NotesOrganizationRule) bool {
+			return s.includes(ActionCardsOrganization, r.Name)
+		}),
+		CardsState: slicex.Filter(actions.CardsState, func(r ankihelperconf.CardsStateRule) bool {
+			return s.includes(ActionCardsState, r.Name)
+		}),
+	}
+}
+
+// CountActions returns the number of the actions of the type.
+func CountActions(actions ankihelperconf.Actions, actionType ActionType) int {
+	switch actionType {
+	case ActionUploadMedia:
+		return len(actions.UploadMedia)
+	case ActionNoteTypes:
+		return len(actions.NoteTypes)
+	case ActionDecks:
+		return len(actions.Decks)
+	case ActionImport:
+		return len(actions.Import)
+	case ActionDedupe:
+		return len(actions.Dedupe)
+	case ActionNoteProcessing:
+		return len(actions.NoteProcessing)
+	case ActionLLM:
+		return len(actions.LLM)
+	case ActionTTS:
+		return len(actions.TTS)
+	case ActionCardsOrganization:
+		return len(actions.CardsOrganization)
+	case ActionCardsState:
+		return len(actions.CardsState)
+	default:
+		panic(errorx.IllegalArgument.New("unknown action type %q", actionType))
+	}
+}
+
+// restrictQuery returns the query matching notes that match both query and restriction.
+func restrictQuery(query, restriction string) string {
+	if stringx.IsBlank(restriction) {
+		return query
+	}
+	return fmt.Sprintf("(%s) (%s)", query, restriction)
+}
+
+// ruleTitle is used to refer to a configured rule in logs and errors.
+func ruleTitle(idx int, name string) string {
+	if stringx.IsBlank(name) {
+		return fmt.Sprintf("#%d", idx)
+	}
+	return fmt.Sprintf("#%d (%s)", idx, name)
+}
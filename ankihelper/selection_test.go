@@ -0,0 +1,51 @@
+package ankihelper_test
+
+import (
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/lang/slicex"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseActionTypes(t *testing.T) {
+	types, err := ankihelper.ParseActionTypes("tts, organize,NoteProcessing")
+	require.NoError(t, err)
+	require.Equal(t, set.FromSlice(ankihelper.ActionTTS, ankihelper.ActionCardsOrganization, ankihelper.ActionNoteProcessing), types)
+
+	_, err = ankihelper.ParseActionTypes("tts,unknown")
+	require.Error(t, err)
+}
+
+func TestAllActionTypes_MatchConfigKeys(t *testing.T) {
+	// action types are validated by the config parser, which can't depend on this package
+	keys := slicex.Map(ankihelper.AllActionTypes, func(t ankihelper.ActionType) string { return string(t) })
+	require.Equal(t, ankihelperconf.ActionKeys, keys)
+}
+
+func TestSelection_Apply(t *testing.T) {
+	// given:
+	actions := ankihelperconf.Actions{
+		UploadMedia: []ankihelperconf.AnkiUploadMedia{{Name: "german-gender"}},
+		NoteProcessing: []ankihelperconf.NoteProcessingRule{
+			{Name: "german-gender"},
+			{Name: "german-plural"},
+			{},
+		},
+		CardsOrganization: []ankihelperconf.NotesOrganizationRule{{Name: "german-gender"}},
+	}
+	selection := ankihelper.Selection{
+		Skip:  set.FromSlice(ankihelper.ActionCardsOrganization),
+		Rules: set.FromSlice("german-gender"),
+	}
+
+	// when:
+	selected := selection.Apply(actions)
+
+	// then:
+	require.Equal(t, ankihelperconf.Actions{
+		UploadMedia:    []ankihelperconf.AnkiUploadMedia{{Name: "german-gender"}},
+		NoteProcessing: []ankihelperconf.NoteProcessingRule{{Name: "german-gender"}},
+	}, selected)
+}
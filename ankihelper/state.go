@@ -0,0 +1,113 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/statestore"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/stringx"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// processingStateKey identifies the note processing rule in the state store.
+// Unnamed rules are identified by their positions, so naming rules keeps their state when the config is reordered.
+func processingStateKey(idx int, rule ankihelperconf.NoteProcessingRule) string {
+	if stringx.IsBlank(rule.Name) {
+		return fmt.Sprintf("#%d", idx)
+	}
+	return rule.Name
+}
+
+// llmStateKey identifies the llm rule in the state store. Keys are prefixed, so that they differ from the keys
+// of note processing rules with the same names.
+func llmStateKey(idx int, rule ankihelperconf.LLMRule) string {
+	if stringx.IsBlank(rule.Name) {
+		return fmt.Sprintf("llm#%d", idx)
+	}
+	return "llm:" + rule.Name
+}
+
+// processingFingerprint identifies the rule definition and the values of the rule input fields of a note.
+func processingFingerprint(rule ankihelperconf.NoteProcessingRule, fields map[string]string) string {
+	return fieldsFingerprint(rule.DefinitionHash, rule.InputFields, fields)
+}
+
+// llmFingerprint identifies the rule definition and the values of the rule input fields of a note.
+func llmFingerprint(rule ankihelperconf.LLMRule, fields map[string]string) string {
+	return fieldsFingerprint(rule.DefinitionHash, rule.InputFields, fields)
+}
+
+// fieldsFingerprint identifies the rule definition and the values of the input fields. Empty inputFields means all the fields.
+func fieldsFingerprint(definitionHash string, inputFields []string, fields map[string]string) string {
+	names := inputFields
+	if len(names) == 0 {
+		names = make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(definitionHash))
+	for _, name := range names {
+		value, ok := fields[name]
+		// field name and value lengths make the encoding unambiguous
+		_, _ = fmt.Fprintf(hash, "\n%d:%s %t %d:%s", len(name), name, ok, len(value), value)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// isUpToDate checks whether the note has been successfully processed by the rule with the same inputs.
+func (h Helper) isUpToDate(stateKey string, noteID ankiconnect.NoteID, fingerprint string) bool {
+	if h.stateStore == nil {
+		return false
+	}
+	state, ok := h.stateStore.NoteState(stateKey, noteID)
+	return ok && state.Outcome == statestore.OutcomeSucceeded && state.Fingerprint == fingerprint
+}
+
+func (h Helper) recordProcessingState(stateKey string, noteID ankiconnect.NoteID, fingerprint string, err error) {
+	if h.stateStore == nil {
+		return
+	}
+	state := statestore.NoteState{
+		Fingerprint: fingerprint,
+		Outcome:     statestore.OutcomeSucceeded,
+		ProcessedAt: time.Now(),
+	}
+	if err != nil {
+		state.Outcome = statestore.OutcomeFailed
+		state.Error = fmt.Sprintf("%v", err)
+	}
+	h.stateStore.SetNoteState(stateKey, noteID, state)
+}
+
+// InvalidateNoteProcessing removes the note states of the note processing rules with the names,
+// so that the next run processes all the matching notes again. The number of removed note states is returned.
+func (h Helper) InvalidateNoteProcessing(rules []ankihelperconf.NoteProcessingRule, names set.Set[string]) (int, error) {
+	if h.stateStore == nil {
+		return 0, nil
+	}
+	var notes int
+	for i, rule := range rules {
+		if names.Contains(rule.Name) {
+			notes += h.stateStore.DeleteRule(processingStateKey(i, rule))
+		}
+	}
+	if err := h.saveState(); err != nil {
+		return 0, err
+	}
+	return notes, nil
+}
+
+func (h Helper) saveState() error {
+	if h.stateStore == nil {
+		return nil
+	}
+	return h.stateStore.Save()
+}
@@ -0,0 +1,201 @@
+package ankihelper
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/lang/mapx"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// recordChange records the modification applied by the action in the journal, if it's kept.
+func (h Helper) recordChange(action *ActionReport, change journal.Entry) error {
+	if h.journal == nil {
+		return nil
+	}
+	change.Action = string(action.Type)
+	change.Rule = action.Rule
+	return h.journal.Record(change)
+}
+
+// missingTags returns the tags the note doesn't have yet. Anki tags are case-insensitive.
+func missingTags(noteTags []string, tags []string) []string {
+	var missing []string
+	for _, tag := range tags {
+		found := false
+		for _, noteTag := range noteTags {
+			if strings.EqualFold(tag, noteTag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+// UndoResult counts journal entries processed by Undo.
+type UndoResult struct {
+	Reverted int
+	// Conflicts counts entries that were not reverted or were reverted partially,
+	// because the notes or cards were modified after the recorded change.
+	Conflicts int
+	Failed    int
+}
+
+// Undo reverts the changes recorded in the journal entries, the latest ones first.
+// Fields and cards modified after the recorded change are left intact, unless force is set.
+// Note that generated media files are not deleted from the Anki collection.
+func (h Helper) Undo(ctx context.Context, entries []journal.Entry, force bool) UndoResult {
+	var result UndoResult
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		logger := logx.FromContext(ctx).With(logx.KeyAction, entry.Action, logx.KeyRule, entry.Rule)
+
+		var conflict bool
+		var err error
+		if entry.NoteID != 0 {
+			logger = logger.With(logx.KeyNoteID, entry.NoteID)
+			conflict, err = h.undoNoteChange(logger, entry, force)
+		} else if len(entry.Cards) > 0 {
+			conflict, err = h.undoCardsChange(logger, entry, force)
+		} else {
+			conflict, err = h.undoDeckChange(logger, entry, force)
+		}
+		switch {
+		case err != nil:
+			logger.Warn("Failed to revert change", logx.Err(err))
+			result.Failed++
+		case conflict:
+			result.Conflicts++
+		default:
+			result.Reverted++
+		}
+	}
+	return result
+}
+
+func (h Helper) undoNoteChange(logger *slog.Logger, entry journal.Entry, force bool) (conflict bool, err error) {
+	notes, err := h.ankiConnect.NotesInfo([]ankiconnect.NoteID{entry.NoteID})
+	if err != nil {
+		return false, err
+	}
+	note, ok := notes[entry.NoteID]
+	if !ok {
+		logger.Warn("Note doesn't exist anymore, skip")
+		return true, nil
+	}
+
+	updates := make(map[string]ankiconnect.FieldUpdate)
+	for field, change := range entry.Fields {
+		current, ok := note.Fields[field]
+		if !ok {
+			logger.Warn("Note doesn't have the field anymore, skip it", logx.KeyField, field)
+			conflict = true
+			continue
+		}
+		if current == change.Previous {
+			continue
+		}
+		if current != change.Value && !force {
+			logger.Warn("Field was modified after the change, skip it", logx.KeyField, field)
+			conflict = true
+			continue
+		}
+		previous := change.Previous
+		updates[field] = ankiconnect.FieldUpdate{Value: &previous}
+	}
+	if len(updates) > 0 {
+		if err := h.ankiConnect.UpdateNoteFields(entry.NoteID, updates); err != nil {
+			return conflict, err
+		}
+	}
+	if len(entry.AddedTags) > 0 {
+		if err := h.ankiConnect.RemoveTags([]ankiconnect.NoteID{entry.NoteID}, entry.AddedTags); err != nil {
+			return conflict, err
+		}
+	}
+	if len(entry.DeletedNotes) > 0 {
+		deleted := mapx.Keys(entry.DeletedNotes)
+		slices.Sort(deleted)
+		logger.Warn("Deleted notes can't be restored, find their fields in the journal to recreate them manually",
+			"deleted", deleted)
+		conflict = true
+	}
+	logger.Debug("Reverted note change", "fields", len(updates), "tags", len(entry.AddedTags))
+	return conflict, nil
+}
+
+func (h Helper) undoDeckChange(logger *slog.Logger, entry journal.Entry, force bool) (conflict bool, err error) {
+	cardIDs := make([]ankiconnect.CardID, 0, len(entry.PreviousDecks))
+	for cardID := range entry.PreviousDecks {
+		cardIDs = append(cardIDs, cardID)
+	}
+	cards, err := h.ankiConnect.CardsInfo(cardIDs)
+	if err != nil {
+		return false, err
+	}
+
+	cardsByDeck := make(map[string][]ankiconnect.CardID)
+	for cardID, previousDeck := range entry.PreviousDecks {
+		card, ok := cards[cardID]
+		switch {
+		case !ok:
+			conflict = true
+		case card.DeckName != entry.Deck && !force:
+			conflict = true
+		case card.DeckName != previousDeck:
+			cardsByDeck[previousDeck] = append(cardsByDeck[previousDeck], cardID)
+		}
+	}
+	if conflict {
+		logger.Warn("Some cards were deleted or moved after the change, skip them", "deck", entry.Deck)
+	}
+	for deck, deckCardIDs := range cardsByDeck {
+		if err := h.ankiConnect.ChangeDeck(deck, deckCardIDs); err != nil {
+			return conflict, err
+		}
+		logger.Debug("Moved cards back", "deck", deck, "cards", len(deckCardIDs))
+	}
+	return conflict, nil
+}
+
+func (h Helper) undoCardsChange(logger *slog.Logger, entry journal.Entry, force bool) (conflict bool, err error) {
+	cardIDs := make([]ankiconnect.CardID, 0, len(entry.Cards))
+	for cardID := range entry.Cards {
+		cardIDs = append(cardIDs, cardID)
+	}
+	slices.Sort(cardIDs)
+	cards, err := h.ankiConnect.CardsInfo(cardIDs)
+	if err != nil {
+		return false, err
+	}
+
+	restored := 0
+	for _, cardID := range cardIDs {
+		change := entry.Cards[cardID]
+		card, ok := cards[cardID]
+		switch {
+		case !ok:
+			conflict = true
+		case card.Scheduling() == change.Previous:
+		case card.Scheduling() != change.Value && !force:
+			conflict = true
+		default:
+			if err := h.ankiConnect.SetCardScheduling(cardID, change.Previous); err != nil {
+				return conflict, err
+			}
+			restored++
+		}
+	}
+	if conflict {
+		logger.Warn("Some cards were deleted or reviewed after the change, skip them")
+	}
+	logger.Debug("Restored cards scheduling", "cards", restored)
+	return conflict, nil
+}
@@ -1,6 +1,7 @@
 package ankihelperconf
 
 import (
+	"anki-rest-enhancer/util/httputil"
 	"net/url"
 	"regexp"
 	"strings"
@@ -18,7 +19,24 @@ type Config struct {
 
 	Anki    Anki
 	Azure   Azure
+	State   State
+	Journal Journal
 	Actions Actions
+
+	// LLM is nil if no language model is configured.
+	LLM *LLM
+}
+
+type State struct {
+	// FilePath is the path to the file recording outcomes of note processing between runs.
+	// Empty path means no state is kept, so all the notes matching the filters are processed on each run.
+	FilePath string
+}
+
+type Journal struct {
+	// FilePath is the path to the file recording modifications of notes and cards, so that they could be reverted.
+	// Empty path means no journal is kept.
+	FilePath string
 }
 
 type Azure struct {
@@ -29,15 +47,101 @@ type Azure struct {
 	Language                string
 	MinPauseBetweenRequests time.Duration
 
+	// OutputFormat is the Azure audio output format, e.g. audio-24khz-160kbitrate-mono-mp3
+	OutputFormat string
+	// AudioFormat is the audio file extension matching OutputFormat, e.g. mp3
+	AudioFormat string
+
+	// MaxRequestsPerSecond and Burst configure token-bucket rate limiting of TTS requests.
+	// Zero MaxRequestsPerSecond means no limit.
+	MaxRequestsPerSecond float64
+	Burst                int
+	// Concurrency is the number of texts synthesized in parallel.
+	Concurrency int
+
 	LogRequests            bool
+	RequestLog             httputil.LoggingOptions
 	RetryOnTooManyRequests bool
 	MaxRetries             int
+
+	Budget AzureBudget
+}
+
+type LLMProvider string
+
+const (
+	// LLMOpenAI is OpenAI chat completions API, also implemented by many other providers and local servers.
+	LLMOpenAI LLMProvider = "openai"
+	LLMGemini LLMProvider = "gemini"
+	LLMOllama LLMProvider = "ollama"
+)
+
+var LLMProviders = []LLMProvider{LLMOpenAI, LLMGemini, LLMOllama}
+
+// LLM is the language model used by llm actions.
+type LLM struct {
+	Provider    LLMProvider
+	EndpointURL *url.URL
+	// APIKey may be empty, e.g. for local servers.
+	APIKey string
+	// Model is the default model of llm actions, e.g. gpt-4o-mini
+	Model          string
+	RequestTimeout time.Duration
+
+	// MaxRequestsPerSecond and Burst configure token-bucket rate limiting of requests.
+	// Zero MaxRequestsPerSecond means no limit.
+	MaxRequestsPerSecond float64
+	Burst                int
+	// MaxRetries is the number of attempts made for a request rejected with Too Many Requests.
+	MaxRetries int
+
+	LogRequests bool
+	RequestLog  httputil.LoggingOptions
+
+	// CacheFilePath is the path to the file caching replies of the model, so that the same requests are not sent again.
+	// Empty path means replies are not cached.
+	CacheFilePath string
+}
+
+// AzureBudget limits the number of characters converted to speech. Zero limits mean no limit.
+type AzureBudget struct {
+	// UsageFilePath is the path to the file recording characters converted in each month.
+	// Empty path means the usage is not persisted, so MonthlyCharacters can't be enforced.
+	UsageFilePath     string
+	MonthlyCharacters int
+	RunCharacters     int
+	// WarnRatio is the share of MonthlyCharacters after which a warning is logged.
+	WarnRatio float64
+	// PricePerMillionCharacters is used to estimate the cost of the conversion.
+	PricePerMillionCharacters float64
 }
 
 type Anki struct {
 	ConnectURL     *url.URL
 	RequestTimeout time.Duration
 	LogRequests    bool
+	RequestLog     httputil.LoggingOptions
+	// Backup is nil if no backups should be made.
+	Backup *AnkiBackup
+}
+
+// AnkiBackup defines a backup made before runs that may modify notes.
+type AnkiBackup struct {
+	Dir string
+	// oneof:
+	// Decks are exported to .apkg files with AnkiConnect.
+	Decks []string
+	// CollectionPath is the path to collection.anki2 file that is copied as is.
+	CollectionPath string
+
+	IncludeScheduling bool
+	// Keep is the number of the latest backups kept in Dir. Zero means all the backups are kept.
+	Keep int
+	// BeforeActions are the keys of the 'actions' section, e.g. noteProcessing.
+	// Backup is made before a run that executes actions of any of these types.
+	BeforeActions []string
+	// MinInterval is the minimal time between backups, so that frequent runs don't replace all the backups.
+	MinInterval time.Duration
 }
 
 type Actions struct {
@@ -46,25 +150,65 @@ type Actions struct {
 	NoteTypes         []AnkiNoteType
 	CardsOrganization []NotesOrganizationRule
 	NoteProcessing    []NoteProcessingRule
+	Decks             []AnkiDeck
+	CardsState        []CardsStateRule
+	Import            []AnkiImport
+	Dedupe            []DedupeRule
+	LLM               []LLMRule
 }
 
 type AnkiUploadMedia struct {
+	Name     string
 	AnkiName string
 	FilePath string
 }
 
 type AnkiTTS struct {
+	Name string
+
 	// oneof:
 	Fields                *AnkiTTSFields
 	GeneratedNoteTypeName *string
 
-	TextPreprocessors []TextProcessor
+	TextPreprocessors   []TextProcessor
+	AudioPostProcessing []AudioProcessingStep
+	// AudioFileName is the template of the name of media files created for generated audio.
+	// File extension is appended automatically if the template doesn't produce one.
+	AudioFileName *template.Template
 }
 
 type AnkiTTSFields struct {
 	NoteFilter, TextField, AudioField string
 }
 
+type AudioProcessingStep struct {
+	// oneof:
+	FFmpeg *AudioFFmpeg
+	Exec   *AudioExec
+}
+
+// AudioFFmpeg is a predefined audio processing step implemented with ffmpeg.
+type AudioFFmpeg struct {
+	Path              string
+	TrimSilence       bool
+	SilenceThreshold  string
+	NormalizeLoudness bool
+	Padding           time.Duration
+	// Format is the output file format (extension). Empty format means the input format is preserved.
+	Format  string
+	Bitrate string
+}
+
+// AudioExec is an arbitrary command that converts the audio in the file passed as $$.Input$$
+// and writes the result to $$.Output$$.
+type AudioExec struct {
+	Command string
+	Args    []NoteProcessingExecArg
+	// OutputFormat is the output file format (extension). Empty format means the input format is preserved.
+	OutputFormat string
+	Timeout      time.Duration
+}
+
 type AnkiNoteType struct {
 	Name      string
 	CSS       string
@@ -74,6 +218,75 @@ type AnkiNoteType struct {
 
 type AnkiNoteField YAMLAnkiNoteField
 
+// AnkiDeck is a deck that should exist in Anki.
+type AnkiDeck struct {
+	Name string
+	// Preset is nil if options of the deck are not managed.
+	Preset *AnkiDeckPreset
+}
+
+// AnkiDeckPreset is a deck options group. Nil options are left as they are in Anki.
+type AnkiDeckPreset struct {
+	Name            string
+	NewCardsPerDay  *int
+	ReviewsPerDay   *int
+	LearningSteps   []time.Duration
+	RelearningSteps []time.Duration
+}
+
+// ImportFormat is the format of a file notes are imported from.
+type ImportFormat string
+
+const (
+	// ImportCSV is a CSV or TSV file with a header.
+	ImportCSV ImportFormat = "csv"
+	// ImportKindle is vocab.db of a Kindle e-reader.
+	ImportKindle ImportFormat = "kindle"
+	// ImportKOReader is vocabulary_builder.sqlite3 of KOReader.
+	ImportKOReader ImportFormat = "koreader"
+)
+
+var ImportFormats = []ImportFormat{ImportCSV, ImportKindle, ImportKOReader}
+
+// LookupColumns are the columns of words looked up on e-readers, which can be imported to note fields.
+var LookupColumns = []string{"word", "stem", "usage", "book"}
+
+// AnkiImport creates and updates notes from rows of a CSV or TSV file, or from words looked up on an e-reader.
+type AnkiImport struct {
+	Name     string
+	Format   ImportFormat
+	FilePath string
+	// Delimiter separates the columns of CSV files, e.g. ',' for CSV and '\t' for TSV files.
+	Delimiter rune
+	// SQLitePath is the sqlite3 executable used to read e-reader databases.
+	SQLitePath string
+	// Language restricts Kindle lookups to the words of the language, e.g. de. Empty Language means all the languages.
+	Language string
+	NoteType string
+	// Deck is the deck new notes are created in. Existing notes are not moved.
+	Deck string
+	// Fields maps the columns of the header to note fields. Other columns are ignored.
+	// Nil Fields means that columns are imported to the fields with the same names.
+	Fields map[string]string
+	// KeyField is the note field identifying the note a row is imported to.
+	KeyField string
+	// Tags are added to the created notes.
+	Tags []string
+	// UpdateExisting is true if imported fields of the existing notes should be updated.
+	// Otherwise, only the missing notes are created.
+	UpdateExisting bool
+}
+
+// DedupeRule merges notes of the same note type having the same normalized value of the key field.
+type DedupeRule struct {
+	Name       string
+	NoteFilter string
+	KeyField   string
+	// KeyPreprocessors normalize the key before notes are compared, e.g. remove articles.
+	// Keys are compared case-insensitively after that.
+	KeyPreprocessors []TextProcessor
+}
+
 type AnkiCardTemplate struct {
 	Name      *template.Template
 	ForFields []AnkiNoteField
@@ -82,14 +295,96 @@ type AnkiCardTemplate struct {
 }
 
 type NotesOrganizationRule struct {
+	Name           string
 	NotesFilter    string
 	TargetDeckName string
+
+	// Priority resolves conflicts between rules matching the same cards: the rule with the highest priority wins.
+	Priority int
+	// Exclusive rules win over non-exclusive ones regardless of priority.
+	// Exclusive rules matching the same cards with different target decks are always in conflict.
+	Exclusive bool
+}
+
+// LLMRule generates fields of the notes matching the filter with a language model.
+type LLMRule struct {
+	Name       string
+	NoteFilter string
+	// Model overrides the model of the llm section. Empty Model means the default one.
+	Model string
+	// Temperature is nil if the default temperature of the model should be used.
+	Temperature *float64
+	// System is the optional template of the system instruction, Prompt is the template of the user message.
+	// Both are executed with noteprocessing.TemplateData.
+	System *template.Template
+	Prompt *template.Template
+	// Fields maps keys of the JSON object replied by the model to note fields.
+	Fields map[string]string
+	// TagsKey is the key of the reply holding the tags to add to the note. Empty TagsKey means no tags are replied.
+	TagsKey string
+	// Tags are added to the notes the fields are generated for.
+	Tags []string
+	// ProvenanceField is the optional field storing the model and the cache key of the request the note was generated with.
+	ProvenanceField string
+	// ProvenanceTag is the optional prefix of the tag storing the model and the cache key,
+	// e.g. llm::gpt-4o-mini::3fa2c1d07b9e for prefix llm.
+	ProvenanceTag string
+	// InputFields are the fields the prompt depends on. If the state is kept, fields are only generated again
+	// when these fields change. Empty list means all the fields.
+	InputFields []string
+	// DefinitionHash identifies the rule definition, so that fields are generated again once the rule is changed.
+	DefinitionHash string
+}
+
+type CardsOperation string
+
+const (
+	CardsSuspend    CardsOperation = "suspend"
+	CardsUnsuspend  CardsOperation = "unsuspend"
+	CardsForget     CardsOperation = "forget"
+	CardsSetDue     CardsOperation = "setDue"
+	CardsReposition CardsOperation = "reposition"
+	CardsUnlock     CardsOperation = "unlock"
+)
+
+// CardsOperations lists the supported operations of cards state rules.
+var CardsOperations = []CardsOperation{CardsSuspend, CardsUnsuspend, CardsForget, CardsSetDue, CardsReposition, CardsUnlock}
+
+// CardsStateRule changes the scheduling state of the cards matching the filter.
+type CardsStateRule struct {
+	Name      string
+	Filter    string
+	Operation CardsOperation
+
+	// DueDays is the argument of CardsSetDue operation, e.g. 0, 1-7 or 3!
+	DueDays string
+	// PositionField is the note field containing the position of new cards for CardsReposition operation.
+	PositionField string
+	// Unlock is the argument of CardsUnlock operation.
+	Unlock *SiblingsUnlock
+}
+
+// SiblingsUnlock keeps secondary cards of notes suspended until the primary cards of the same notes mature.
+type SiblingsUnlock struct {
+	// PrimaryCards is the search query matching primary cards, e.g. card:FillInWord*
+	// Other cards matching the rule filter are secondary.
+	PrimaryCards string
+	// MinInterval is the interval in days all the primary cards of a note should reach to unlock its secondary cards.
+	MinInterval int
+	// PerRun is the maximal number of secondary cards of a note unsuspended by a run. Zero means no limit.
+	PerRun int
 }
 
 type NoteProcessingRule struct {
+	Name                      string
 	NoteFilter                string
 	MinPauseBetweenExecutions time.Duration
 	Timeout                   time.Duration
+	// InputFields are the fields the rule depends on. If the state is kept, notes are only processed again
+	// when these fields change. Empty list means all the fields.
+	InputFields []string
+	// DefinitionHash identifies the rule definition, so that notes are processed again once the rule is changed.
+	DefinitionHash string
 
 	Exec NoteProcessingExec
 }
@@ -1,20 +1,28 @@
 package ankihelperconf
 
 import (
+	"anki-rest-enhancer/util/httputil"
 	"anki-rest-enhancer/util/lang"
+	"anki-rest-enhancer/util/lang/mapx"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/lang/slicex"
 	"anki-rest-enhancer/util/stringx"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/joomcode/errorx"
 	"gopkg.in/yaml.v2"
 	"io"
-	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
 )
 
 var defaultTextProcessing = []YAMLTextProcessing{
@@ -71,7 +79,12 @@ type YAML struct {
 
 	Anki    YAMLAnki    `yaml:"anki"`
 	Azure   YAMLAzure   `yaml:"azure"`
+	State   YAMLState   `yaml:"state"`
+	Journal YAMLJournal `yaml:"journal"`
 	Actions YAMLActions `yaml:"actions"`
+
+	// LLM configures the language model used by llm actions.
+	LLM *YAMLLLM `yaml:"llm"`
 }
 
 func (c YAML) Parse(configDir string) (Config, error) {
@@ -87,7 +100,7 @@ func (c YAML) Parse(configDir string) (Config, error) {
 		for idx, configPath := range c.RunConfigs {
 			if !filepath.IsAbs(configPath) {
 				configPath = filepath.Join(configDir, configPath)
-				log.Printf("Resolve relative path of a nested config file: %s", configPath)
+				slog.Debug("Resolve relative path of a nested config file", "path", configPath)
 			}
 
 			config, err := LoadYAML(configPath)
@@ -108,15 +121,26 @@ func (c YAML) Parse(configDir string) (Config, error) {
 	}
 
 	{
-		ankiConf, err := c.Anki.Parse()
+		ankiConf, err := c.Anki.Parse(configDir)
 		if err != nil {
 			return Config{}, errorx.Decorate(err, "invalid Anki config")
 		}
 		conf.Anki = ankiConf
 	}
 
+	conf.State = c.State.Parse(configDir)
+	conf.Journal = c.Journal.Parse(configDir)
+
+	if c.LLM != nil {
+		llmConf, err := c.LLM.Parse(configDir)
+		if err != nil {
+			return Config{}, errorx.Decorate(err, "invalid LLM config")
+		}
+		conf.LLM = &llmConf
+	}
+
 	{
-		Actions, err := c.Actions.Parse(configDir)
+		Actions, err := c.Actions.Parse(configDir, conf.LLM)
 		if err != nil {
 			return Config{}, errorx.Decorate(err, "invalid Actions config")
 		}
@@ -126,6 +150,36 @@ func (c YAML) Parse(configDir string) (Config, error) {
 	return conf, nil
 }
 
+type YAMLState struct {
+	// File is the path to the JSON file recording outcomes of note processing,
+	// so that notes whose inputs haven't changed are skipped by the following runs.
+	File string `yaml:"file"`
+}
+
+func (s YAMLState) Parse(configDir string) State {
+	path := s.File
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(configDir, path)
+		slog.Debug("Resolve state file path against configuration directory", "path", path)
+	}
+	return State{FilePath: path}
+}
+
+type YAMLJournal struct {
+	// File is the path to the JSON lines file recording modifications applied by runs,
+	// so that a run could be reverted with the undo command.
+	File string `yaml:"file"`
+}
+
+func (j YAMLJournal) Parse(configDir string) Journal {
+	path := j.File
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(configDir, path)
+		slog.Debug("Resolve journal file path against configuration directory", "path", path)
+	}
+	return Journal{FilePath: path}
+}
+
 type YAMLAzure struct {
 	// required:
 	APIKey      string `yaml:"apiKey"`
@@ -140,6 +194,23 @@ type YAMLAzure struct {
 	MinPauseBetweenRequests string `yaml:"minPauseBetweenRequests"`
 	RetryOnTooManyRequests  bool   `yaml:"retryOnTooManyRequests"`
 	MaxRetries              *int   `yaml:"maxRetries"`
+	// OutputFormat is one of the audio formats supported by Azure, see
+	// https://learn.microsoft.com/en-us/azure/ai-services/speech-service/rest-text-to-speech#audio-outputs
+	// Default: audio-24khz-160kbitrate-mono-mp3
+	OutputFormat string `yaml:"outputFormat"`
+
+	// MaxRequestsPerSecond enables token-bucket rate limiting and takes precedence over minPauseBetweenRequests.
+	MaxRequestsPerSecond float64 `yaml:"maxRequestsPerSecond"`
+	// Burst is the number of requests that may be sent at once before MaxRequestsPerSecond limit kicks in.
+	Burst *int `yaml:"burst"`
+	// Concurrency is the number of parallel text-to-speech workers.
+	Concurrency *int `yaml:"concurrency"`
+
+	// RequestLog configures logging of requests enabled with logRequests.
+	RequestLog YAMLRequestLog `yaml:"requestLog"`
+
+	// Budget limits the number of characters converted to speech.
+	Budget YAMLAzureBudget `yaml:"budget"`
 }
 
 func (c YAMLAzure) Parse(configDir string) (Azure, error) {
@@ -149,10 +220,10 @@ func (c YAMLAzure) Parse(configDir string) (Azure, error) {
 	} else if keyPath := c.APIKeyFile; keyPath != "" {
 		if !filepath.IsAbs(keyPath) {
 			keyPath = filepath.Join(configDir, keyPath)
-			log.Printf("Resolve relative path to Azure key file against configuration directory: %s", keyPath)
+			slog.Debug("Resolve relative path to Azure key file against configuration directory", "path", keyPath)
 		}
 
-		log.Printf("Loading Azure API Key from %s", keyPath)
+		slog.Debug("Loading Azure API Key", "path", keyPath)
 		file, err := os.Open(keyPath)
 		if err != nil {
 			return Azure{}, errorx.ExternalError.Wrap(err, "failed to open file ")
@@ -185,7 +256,7 @@ func (c YAMLAzure) Parse(configDir string) (Azure, error) {
 	}
 
 	if language := c.Language; language == "" {
-		log.Println("Text-to-speech language is not explicitly specified in the config. Trying to infer from voice name...")
+		slog.Debug("Text-to-speech language is not explicitly specified in the config. Trying to infer from voice name...")
 		langLocaleVoice := strings.SplitN(c.Voice, "-", 3)
 		if len(langLocaleVoice) != 3 {
 			return Azure{}, errorx.IllegalFormat.New("Faile to infer language from voice name. Expected <lang-locale-voice> but got %q", c.Voice)
@@ -199,7 +270,7 @@ func (c YAMLAzure) Parse(configDir string) (Azure, error) {
 		const defaultRequestTimeout = "30s"
 		timeout := c.RequestTimeout
 		if timeout == "" {
-			log.Printf("Azure request timeout is not specified, use default %q", defaultRequestTimeout)
+			slog.Debug("Azure request timeout is not specified, use default", "timeout", defaultRequestTimeout)
 			timeout = defaultRequestTimeout
 		}
 		parsed, err := time.ParseDuration(timeout)
@@ -210,21 +281,69 @@ func (c YAMLAzure) Parse(configDir string) (Azure, error) {
 	}
 
 	conf.LogRequests = c.LogRequests
+	requestLog, err := c.RequestLog.Parse(configDir)
+	if err != nil {
+		return Azure{}, errorx.Decorate(err, "invalid requestLog")
+	}
+	conf.RequestLog = requestLog
+
+	{
+		const defaultOutputFormat = "audio-24khz-160kbitrate-mono-mp3"
+		outputFormat := c.OutputFormat
+		if outputFormat == "" {
+			outputFormat = defaultOutputFormat
+		}
+		audioFormat, err := AzureOutputAudioFormat(outputFormat)
+		if err != nil {
+			return Azure{}, err
+		}
+		conf.OutputFormat = outputFormat
+		conf.AudioFormat = audioFormat
+	}
 
 	{
 		const defaultMinPauseBetweenRequests = "1s"
 		pause := c.MinPauseBetweenRequests
-		if c.MinPauseBetweenRequests == "" {
-			log.Printf("Minimum pause between requests to Azure API is not set. Use default %q", pause)
-			c.MinPauseBetweenRequests = defaultMinPauseBetweenRequests
+		if pause == "" {
+			slog.Debug("Minimum pause between requests to Azure API is not set. Use default", "pause", defaultMinPauseBetweenRequests)
+			pause = defaultMinPauseBetweenRequests
 		}
 		parsed, err := time.ParseDuration(pause)
 		if err != nil {
-			return Azure{}, errorx.IllegalFormat.New("Failed to parse minimum pause between requests to Azure API: %q", parsed)
+			return Azure{}, errorx.IllegalFormat.Wrap(err, "Failed to parse minimum pause between requests to Azure API: %q", pause)
 		}
 		conf.MinPauseBetweenRequests = parsed
 	}
 
+	{
+		if c.MaxRequestsPerSecond < 0 {
+			return Azure{}, errorx.IllegalState.New("Max requests per second must not be negative")
+		}
+		conf.MaxRequestsPerSecond = c.MaxRequestsPerSecond
+		if conf.MaxRequestsPerSecond == 0 && conf.MinPauseBetweenRequests > 0 {
+			// minimum pause between requests is equivalent to a token bucket of size 1
+			conf.MaxRequestsPerSecond = 1 / conf.MinPauseBetweenRequests.Seconds()
+		}
+
+		burst := 1
+		if override := c.Burst; override != nil {
+			if *override <= 0 {
+				return Azure{}, errorx.IllegalState.New("Burst must be positive")
+			}
+			burst = *override
+		}
+		conf.Burst = burst
+
+		concurrency := 1
+		if override := c.Concurrency; override != nil {
+			if *override <= 0 {
+				return Azure{}, errorx.IllegalState.New("Concurrency must be positive")
+			}
+			concurrency = *override
+		}
+		conf.Concurrency = concurrency
+	}
+
 	conf.RetryOnTooManyRequests = c.RetryOnTooManyRequests
 	{
 		const defaultMaxRetries = 5
@@ -238,23 +357,211 @@ func (c YAMLAzure) Parse(configDir string) (Azure, error) {
 		conf.MaxRetries = maxRetries
 	}
 
+	budget, err := c.Budget.Parse(configDir)
+	if err != nil {
+		return Azure{}, errorx.Decorate(err, "invalid budget")
+	}
+	conf.Budget = budget
+
 	return conf, nil
 }
 
-type YAMLAnki struct {
-	ConnectURL     string `yaml:"connectUrl"`
+type YAMLAzureBudget struct {
+	// UsageFile is the path to the JSON file recording characters converted in each month.
+	// It may be shared by several configs using the same Azure subscription.
+	UsageFile string `yaml:"usageFile"`
+	// MonthlyCharacters is the maximal number of characters converted in a calendar month (UTC).
+	// Azure free tier allows 500000 characters per month. Requires usageFile.
+	MonthlyCharacters int `yaml:"monthlyCharacters"`
+	// RunCharacters is the maximal number of characters converted in a single run.
+	RunCharacters int `yaml:"runCharacters"`
+	// WarnAt is the share of monthlyCharacters after which a warning is logged. Default: 0.8
+	WarnAt *float64 `yaml:"warnAt"`
+	// PricePerMillionCharacters is used to estimate the cost in the run report, e.g. 16 for neural voices.
+	PricePerMillionCharacters float64 `yaml:"pricePerMillionCharacters"`
+}
+
+func (b YAMLAzureBudget) Parse(configDir string) (AzureBudget, error) {
+	if b.MonthlyCharacters < 0 || b.RunCharacters < 0 {
+		return AzureBudget{}, errorx.IllegalArgument.New("character limits must not be negative")
+	}
+	if b.MonthlyCharacters > 0 && b.UsageFile == "" {
+		return AzureBudget{}, errorx.IllegalArgument.New("usageFile must be specified to enforce monthlyCharacters")
+	}
+	if b.PricePerMillionCharacters < 0 {
+		return AzureBudget{}, errorx.IllegalArgument.New("pricePerMillionCharacters must not be negative")
+	}
+	conf := AzureBudget{
+		UsageFilePath:             b.UsageFile,
+		MonthlyCharacters:         b.MonthlyCharacters,
+		RunCharacters:             b.RunCharacters,
+		WarnRatio:                 0.8,
+		PricePerMillionCharacters: b.PricePerMillionCharacters,
+	}
+	if conf.UsageFilePath != "" && !filepath.IsAbs(conf.UsageFilePath) {
+		conf.UsageFilePath = filepath.Join(configDir, conf.UsageFilePath)
+		slog.Debug("Resolve TTS usage file path against configuration directory", "path", conf.UsageFilePath)
+	}
+	if override := b.WarnAt; override != nil {
+		if *override <= 0 || *override > 1 {
+			return AzureBudget{}, errorx.IllegalArgument.New("warnAt must be between 0 and 1, got %v", *override)
+		}
+		conf.WarnRatio = *override
+	}
+	return conf, nil
+}
+
+// AzureOutputAudioFormat returns audio file extension for the Azure output format.
+func AzureOutputAudioFormat(outputFormat string) (string, error) {
+	switch {
+	case strings.HasPrefix(outputFormat, "raw-"):
+		return "", errorx.IllegalArgument.New("raw output format %q is not supported as it produces headerless audio", outputFormat)
+	case strings.HasPrefix(outputFormat, "riff-"):
+		return "wav", nil
+	case strings.HasPrefix(outputFormat, "ogg-"):
+		return "ogg", nil
+	case strings.HasPrefix(outputFormat, "webm-"):
+		return "webm", nil
+	case strings.HasPrefix(outputFormat, "amr-wb-"):
+		return "amr", nil
+	case strings.HasPrefix(outputFormat, "audio-") && strings.HasSuffix(outputFormat, "-mp3"):
+		return "mp3", nil
+	case strings.HasPrefix(outputFormat, "audio-") && strings.HasSuffix(outputFormat, "-opus"):
+		return "opus", nil
+	default:
+		return "", errorx.IllegalArgument.New("unknown Azure output format %q", outputFormat)
+	}
+}
+
+type YAMLLLM struct {
+	// Provider is one of openai (or any OpenAI-compatible API), gemini and ollama.
+	Provider string `yaml:"provider"`
+	// EndpointURL is the base URL of the API. Default: the public endpoint of the provider,
+	// or http://localhost:11434 for ollama
+	EndpointURL string `yaml:"endpointUrl"`
+	APIKey      string `yaml:"apiKey"`
+	APIKeyFile  string `yaml:"apiKeyFile"`
+	// Model is the default model of llm actions, e.g. gpt-4o-mini
+	Model          string `yaml:"model"`
 	RequestTimeout string `yaml:"requestTimeout"`
-	LogRequests    bool   `yaml:"logRequests"`
+
+	MaxRequestsPerSecond float64 `yaml:"maxRequestsPerSecond"`
+	Burst                *int    `yaml:"burst"`
+	MaxRetries           *int    `yaml:"maxRetries"`
+
+	LogRequests bool           `yaml:"logRequests"`
+	RequestLog  YAMLRequestLog `yaml:"requestLog"`
+
+	// CacheFile is the path to the JSON file caching replies by the model and the rendered prompts.
+	// Relative paths are resolved relative to the config directory.
+	CacheFile string `yaml:"cacheFile"`
 }
 
-func (c YAMLAnki) Parse() (Anki, error) {
+var defaultLLMEndpoints = map[LLMProvider]string{
+	LLMOpenAI: "https://api.openai.com/v1",
+	LLMGemini: "https://generativelanguage.googleapis.com/v1beta",
+	LLMOllama: "http://localhost:11434",
+}
+
+func (c YAMLLLM) Parse(configDir string) (LLM, error) {
+	conf := LLM{Provider: LLMProvider(c.Provider)}
+	if !slices.Contains(LLMProviders, conf.Provider) {
+		return LLM{}, errorx.IllegalArgument.New("unknown provider %q, expected one of %v", c.Provider, LLMProviders)
+	}
+
+	endpoint := c.EndpointURL
+	if endpoint == "" {
+		endpoint = defaultLLMEndpoints[conf.Provider]
+	}
+	parsed, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return LLM{}, errorx.IllegalFormat.Wrap(err, "malformed endpointUrl %q", endpoint)
+	}
+	conf.EndpointURL = parsed
+
+	switch {
+	case c.APIKey != "" && c.APIKeyFile != "":
+		return LLM{}, errorx.IllegalArgument.New("apiKey and apiKeyFile are mutually exclusive")
+	case c.APIKey != "":
+		conf.APIKey = c.APIKey
+	case c.APIKeyFile != "":
+		keyPath := ResolvePath(configDir, c.APIKeyFile)
+		rawKey, err := os.ReadFile(keyPath)
+		if err != nil {
+			return LLM{}, errorx.ExternalError.Wrap(err, "failed to read API key file %q", keyPath)
+		}
+		conf.APIKey = strings.TrimSpace(string(rawKey))
+	case conf.Provider == LLMGemini:
+		return LLM{}, errorx.IllegalArgument.New("apiKey or apiKeyFile must be specified for gemini")
+	}
+
+	if stringx.IsBlank(c.Model) {
+		return LLM{}, errorx.IllegalArgument.New("model must be specified")
+	}
+	conf.Model = c.Model
+
+	{
+		const defaultRequestTimeout = "2m"
+		timeout := c.RequestTimeout
+		if timeout == "" {
+			timeout = defaultRequestTimeout
+		}
+		parsed, err := time.ParseDuration(timeout)
+		if err != nil {
+			return LLM{}, errorx.IllegalFormat.Wrap(err, "malformed request timeout")
+		}
+		conf.RequestTimeout = parsed
+	}
+
+	if c.MaxRequestsPerSecond < 0 {
+		return LLM{}, errorx.IllegalArgument.New("maxRequestsPerSecond must not be negative")
+	}
+	conf.MaxRequestsPerSecond = c.MaxRequestsPerSecond
+	conf.Burst = 1
+	if override := c.Burst; override != nil {
+		if *override <= 0 {
+			return LLM{}, errorx.IllegalArgument.New("burst must be positive")
+		}
+		conf.Burst = *override
+	}
+	conf.MaxRetries = 5
+	if override := c.MaxRetries; override != nil {
+		if *override <= 0 {
+			return LLM{}, errorx.IllegalArgument.New("maxRetries must be positive")
+		}
+		conf.MaxRetries = *override
+	}
+
+	conf.LogRequests = c.LogRequests
+	requestLog, err := c.RequestLog.Parse(configDir)
+	if err != nil {
+		return LLM{}, errorx.Decorate(err, "invalid requestLog")
+	}
+	conf.RequestLog = requestLog
+	if c.CacheFile != "" {
+		conf.CacheFilePath = ResolvePath(configDir, c.CacheFile)
+	}
+	return conf, nil
+}
+
+type YAMLAnki struct {
+	ConnectURL     string         `yaml:"connectUrl"`
+	RequestTimeout string         `yaml:"requestTimeout"`
+	LogRequests    bool           `yaml:"logRequests"`
+	RequestLog     YAMLRequestLog `yaml:"requestLog"`
+
+	// Backup enables backups before runs that may modify notes.
+	Backup *YAMLAnkiBackup `yaml:"backup"`
+}
+
+func (c YAMLAnki) Parse(configDir string) (Anki, error) {
 	var conf Anki
 
 	{
 		const defaultAnkiConnectAddress = "http://localhost:8765"
 		addr := c.ConnectURL
 		if addr == "" {
-			log.Printf("AnkiConnect address is not specified in the config. Use default: %s", defaultAnkiConnectAddress)
+			slog.Debug("AnkiConnect address is not specified in the config. Use default", "address", defaultAnkiConnectAddress)
 			addr = defaultAnkiConnectAddress
 		}
 		parsed, err := url.Parse(addr)
@@ -268,7 +575,7 @@ func (c YAMLAnki) Parse() (Anki, error) {
 		const defaultAnkiRequestTimeout = "30s"
 		timeout := c.RequestTimeout
 		if timeout == "" {
-			log.Printf("Anki request timeout is not specified in the config. Use default timeout %q", defaultAnkiRequestTimeout)
+			slog.Debug("Anki request timeout is not specified in the config. Use default", "timeout", defaultAnkiRequestTimeout)
 			timeout = defaultAnkiRequestTimeout
 		}
 		parsed, err := time.ParseDuration(timeout)
@@ -279,19 +586,154 @@ func (c YAMLAnki) Parse() (Anki, error) {
 	}
 
 	conf.LogRequests = c.LogRequests
+	requestLog, err := c.RequestLog.Parse(configDir)
+	if err != nil {
+		return Anki{}, errorx.Decorate(err, "invalid requestLog")
+	}
+	conf.RequestLog = requestLog
+
+	if c.Backup != nil {
+		backup, err := c.Backup.Parse(configDir)
+		if err != nil {
+			return Anki{}, errorx.Decorate(err, "invalid backup")
+		}
+		conf.Backup = &backup
+	}
 
 	return conf, nil
 }
 
+// ActionKeys are the keys of the 'actions' section. They must match ankihelper.AllActionTypes.
+var ActionKeys = []string{
+	"uploadMedia", "noteTypes", "decks", "import", "dedupe", "noteProcessing", "llm", "tts", "cardsOrganization", "cardsState",
+}
+
+type YAMLAnkiBackup struct {
+	// Dir is the directory to write backups to.
+	Dir string `yaml:"dir"`
+	// Decks to export with AnkiConnect to .apkg files.
+	Decks []string `yaml:"decks"`
+	// CollectionPath is the path to collection.anki2 file to copy instead of exporting decks.
+	CollectionPath string `yaml:"collectionPath"`
+	// IncludeScheduling specifies whether exported decks include review history. Default: true
+	IncludeScheduling *bool `yaml:"includeScheduling"`
+	// Keep is the number of the latest backups to keep. Default: 10
+	Keep *int `yaml:"keep"`
+	// BeforeActions lists action types that require a backup. Default: [noteTypes, import, dedupe, noteProcessing, llm, cardsState]
+	BeforeActions []string `yaml:"beforeActions"`
+	// MinInterval is the minimal time between backups, e.g. 24h. Default: 0, so backups are made before each run.
+	MinInterval string `yaml:"minInterval"`
+}
+
+func (b YAMLAnkiBackup) Parse(configDir string) (AnkiBackup, error) {
+	if stringx.IsBlank(b.Dir) {
+		return AnkiBackup{}, errorx.IllegalArgument.New("dir must be specified")
+	}
+	if (len(b.Decks) > 0) == (b.CollectionPath != "") {
+		return AnkiBackup{}, errorx.IllegalArgument.New("either decks or collectionPath must be specified")
+	}
+	conf := AnkiBackup{
+		Dir:               b.Dir,
+		Decks:             b.Decks,
+		CollectionPath:    b.CollectionPath,
+		IncludeScheduling: true,
+		Keep:              10,
+		BeforeActions:     b.BeforeActions,
+	}
+	if !filepath.IsAbs(conf.Dir) {
+		conf.Dir = filepath.Join(configDir, conf.Dir)
+		slog.Debug("Resolve backup directory against configuration directory", "path", conf.Dir)
+	}
+	if conf.CollectionPath != "" && !filepath.IsAbs(conf.CollectionPath) {
+		conf.CollectionPath = filepath.Join(configDir, conf.CollectionPath)
+		slog.Debug("Resolve collection path against configuration directory", "path", conf.CollectionPath)
+	}
+	if override := b.IncludeScheduling; override != nil {
+		conf.IncludeScheduling = *override
+	}
+	if override := b.Keep; override != nil {
+		if *override < 0 {
+			return AnkiBackup{}, errorx.IllegalArgument.New("keep must not be negative")
+		}
+		conf.Keep = *override
+	}
+
+	if len(conf.BeforeActions) == 0 {
+		conf.BeforeActions = []string{"noteTypes", "import", "dedupe", "noteProcessing", "llm", "cardsState"}
+	}
+	for _, action := range conf.BeforeActions {
+		if !slices.Contains(ActionKeys, action) {
+			return AnkiBackup{}, errorx.IllegalArgument.New("unknown action type %q in beforeActions, expected one of %v", action, ActionKeys)
+		}
+	}
+
+	if raw := b.MinInterval; raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return AnkiBackup{}, errorx.IllegalFormat.Wrap(err, "malformed minInterval")
+		}
+		conf.MinInterval = parsed
+	}
+	return conf, nil
+}
+
+// YAMLRequestLog configures logging of HTTP requests enabled with logRequests.
+type YAMLRequestLog struct {
+	// RedactHeaders lists headers to hide in addition to the default ones, see httputil.DefaultRedactedHeaders.
+	RedactHeaders []string `yaml:"redactHeaders"`
+	// RedactJSONFields lists JSON object fields to hide. Default: key (AnkiConnect API key)
+	RedactJSONFields *[]string `yaml:"redactJsonFields"`
+	// MaxStringLength is the maximal length of JSON string values (e.g. base64 media) to log as is. Default: 128
+	MaxStringLength *int `yaml:"maxStringLength"`
+	// MaxBodySize is the maximal size of logged bodies in bytes. Default: 16384
+	MaxBodySize *int `yaml:"maxBodySize"`
+	// File is the path of the file to write requests to instead of the main log.
+	File string `yaml:"file"`
+}
+
+func (l YAMLRequestLog) Parse(configDir string) (httputil.LoggingOptions, error) {
+	opts := httputil.LoggingOptions{
+		RedactHeaders:       l.RedactHeaders,
+		RedactJSONFields:    []string{"key"},
+		MaxJSONStringLength: 128,
+		MaxBodySize:         16 * 1024,
+	}
+	if l.RedactJSONFields != nil {
+		opts.RedactJSONFields = *l.RedactJSONFields
+	}
+	if l.MaxStringLength != nil {
+		if *l.MaxStringLength < 0 {
+			return httputil.LoggingOptions{}, errorx.IllegalArgument.New("maxStringLength should not be negative")
+		}
+		opts.MaxJSONStringLength = *l.MaxStringLength
+	}
+	if l.MaxBodySize != nil {
+		if *l.MaxBodySize < 0 {
+			return httputil.LoggingOptions{}, errorx.IllegalArgument.New("maxBodySize should not be negative")
+		}
+		opts.MaxBodySize = *l.MaxBodySize
+	}
+	if l.File != "" {
+		opts.FilePath = ResolvePath(configDir, l.File)
+	}
+	return opts, nil
+}
+
 type YAMLActions struct {
 	UploadMedia       []YAMLUploadMedia       `yaml:"uploadMedia"`
 	TTS               []YAMLAnkiTTS           `yaml:"tts"`
 	NoteTypes         []YAMLAnkiNoteType      `yaml:"noteTypes"`
 	CardsOrganization []YAMLNotesOrganization `yaml:"cardsOrganization"`
 	NoteProcessing    []YAMLNoteProcessing    `yaml:"noteProcessing"`
+	Decks             []YAMLAnkiDeck          `yaml:"decks"`
+	CardsState        []YAMLCardsState        `yaml:"cardsState"`
+	Import            []YAMLImport            `yaml:"import"`
+	Dedupe            []YAMLDedupe            `yaml:"dedupe"`
+	LLM               []YAMLLLMRule           `yaml:"llm"`
 }
 
-func (e YAMLActions) Parse(configDir string) (Actions, error) {
+// Parse parses the actions. llm is the parsed llm section, nil if it's missing.
+func (e YAMLActions) Parse(configDir string, llm *LLM) (Actions, error) {
 	var actions Actions
 
 	for i, mediaUpload := range e.UploadMedia {
@@ -303,7 +745,7 @@ func (e YAMLActions) Parse(configDir string) (Actions, error) {
 	}
 
 	for i, tts := range e.TTS {
-		parsed, err := tts.Parse()
+		parsed, err := tts.Parse(configDir)
 		if err != nil {
 			return Actions{}, errorx.Decorate(err, "invalid tts #%d", i)
 		}
@@ -318,6 +760,33 @@ func (e YAMLActions) Parse(configDir string) (Actions, error) {
 		actions.NoteTypes = append(actions.NoteTypes, parsed)
 	}
 
+	for i, deck := range e.Decks {
+		parsed, err := deck.Parse()
+		if err != nil {
+			return Actions{}, errorx.Decorate(err, "invalid deck #%d", i)
+		}
+		actions.Decks = append(actions.Decks, parsed)
+	}
+	if err := validateDeckPresets(actions.Decks); err != nil {
+		return Actions{}, err
+	}
+
+	for i, imp := range e.Import {
+		parsed, err := imp.Parse(configDir)
+		if err != nil {
+			return Actions{}, errorx.Decorate(err, "invalid import #%d", i)
+		}
+		actions.Import = append(actions.Import, parsed)
+	}
+
+	for i, dedupe := range e.Dedupe {
+		parsed, err := dedupe.Parse()
+		if err != nil {
+			return Actions{}, errorx.Decorate(err, "invalid dedupe rule #%d", i)
+		}
+		actions.Dedupe = append(actions.Dedupe, parsed)
+	}
+
 	for i, orgRule := range e.CardsOrganization {
 		parsed, err := orgRule.Parse()
 		if err != nil {
@@ -326,6 +795,14 @@ func (e YAMLActions) Parse(configDir string) (Actions, error) {
 		actions.CardsOrganization = append(actions.CardsOrganization, parsed)
 	}
 
+	for i, stateRule := range e.CardsState {
+		parsed, err := stateRule.Parse()
+		if err != nil {
+			return Actions{}, errorx.Decorate(err, "invalid cards state rule #%d", i)
+		}
+		actions.CardsState = append(actions.CardsState, parsed)
+	}
+
 	for i, populationRule := range e.NoteProcessing {
 		parsed, err := populationRule.Parse(configDir)
 		if err != nil {
@@ -334,10 +811,52 @@ func (e YAMLActions) Parse(configDir string) (Actions, error) {
 		actions.NoteProcessing = append(actions.NoteProcessing, parsed)
 	}
 
+	if len(e.LLM) > 0 && llm == nil {
+		return Actions{}, errorx.IllegalArgument.New("llm actions require the llm section of the config")
+	}
+	for i, rule := range e.LLM {
+		parsed, err := rule.Parse(configDir, *llm)
+		if err != nil {
+			return Actions{}, errorx.Decorate(err, "invalid llm rule #%d", i)
+		}
+		actions.LLM = append(actions.LLM, parsed)
+	}
+
+	if err := actions.validateNames(); err != nil {
+		return Actions{}, err
+	}
+
 	return actions, nil
 }
 
+// validateNames checks that action names are unique within each action type.
+func (a Actions) validateNames() error {
+	for _, names := range []struct {
+		actionType string
+		names      []string
+	}{
+		{"uploadMedia", slicex.Map(a.UploadMedia, func(m AnkiUploadMedia) string { return m.Name })},
+		{"decks", slicex.Map(a.Decks, func(d AnkiDeck) string { return d.Name })},
+		{"import", slicex.Map(a.Import, func(i AnkiImport) string { return i.Name })},
+		{"dedupe", slicex.Map(a.Dedupe, func(r DedupeRule) string { return r.Name })},
+		{"tts", slicex.Map(a.TTS, func(t AnkiTTS) string { return t.Name })},
+		{"cardsOrganization", slicex.Map(a.CardsOrganization, func(r NotesOrganizationRule) string { return r.Name })},
+		{"cardsState", slicex.Map(a.CardsState, func(r CardsStateRule) string { return r.Name })},
+		{"noteProcessing", slicex.Map(a.NoteProcessing, func(r NoteProcessingRule) string { return r.Name })},
+		{"llm", slicex.Map(a.LLM, func(r LLMRule) string { return r.Name })},
+	} {
+		for name, count := range slicex.ElementCounts(names.names) {
+			if name != "" && count > 1 {
+				return errorx.IllegalState.New("name %q is used by %d %s actions", name, count, names.actionType)
+			}
+		}
+	}
+	return nil
+}
+
 type YAMLUploadMedia struct {
+	// Name optionally identifies the action, so that it could be selected from the command line.
+	Name     string `yaml:"name"`
 	AnkiName string `yaml:"ankiName"`
 	Path     string `yaml:"path"`
 }
@@ -352,15 +871,19 @@ func (um YAMLUploadMedia) Parse(configDir string) (AnkiUploadMedia, error) {
 	}
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(configDir, path)
-		log.Printf("Resolve media upload file path against configuration directory: %s", path)
+		slog.Debug("Resolve media upload file path against configuration directory", "path", path)
 	}
 	return AnkiUploadMedia{
+		Name:     um.Name,
 		AnkiName: name,
 		FilePath: path,
 	}, nil
 }
 
 type YAMLAnkiTTS struct {
+	// Name optionally identifies the action, so that it could be selected from the command line.
+	Name string `yaml:"name"`
+
 	ForGeneratedNoteType string `yaml:"forGeneratedNoteType"`
 	TextField            string `yaml:"textField"`
 	AudioField           string `yaml:"audioField"`
@@ -368,10 +891,17 @@ type YAMLAnkiTTS struct {
 	// optional:
 	NoteFilter     string               `yaml:"noteFilter"`
 	TextProcessing []YAMLTextProcessing `yaml:"textPreprocessing"`
+	// AudioPostProcessing steps are applied to the generated audio one by one before it's stored in Anki.
+	AudioPostProcessing []YAMLAudioProcessing `yaml:"audioPostProcessing"`
+	// AudioFileName is a template of media file name, e.g. 'tts_$$.NoteType$$_$$.Field$$_$$.Hash$$'.
+	// Available variables are defined by ankihelper.AudioFileNameData.
+	// Extension matching the audio format is appended unless the template already ends with it.
+	// Default: '$$.Hash$$'
+	AudioFileName string `yaml:"audioFileName"`
 }
 
-func (c YAMLAnkiTTS) Parse() (AnkiTTS, error) {
-	var conf AnkiTTS
+func (c YAMLAnkiTTS) Parse(configDir string) (AnkiTTS, error) {
+	conf := AnkiTTS{Name: c.Name}
 
 	switch {
 	case c.ForGeneratedNoteType != "" && c.TextField == "" && c.AudioField == "":
@@ -385,7 +915,7 @@ func (c YAMLAnkiTTS) Parse() (AnkiTTS, error) {
 		noteFilter := c.NoteFilter
 		if noteFilter == "" {
 			defaultFilter := fmt.Sprintf(`"%s:_*" "%s:"`, c.TextField, c.AudioField)
-			log.Printf("No filter specified in TTS for fields %s->%s. Infer filter: %s", c.TextField, c.AudioField, defaultFilter)
+			slog.Debug("No filter specified in TTS. Infer filter", "textField", c.TextField, "audioField", c.AudioField, "filter", defaultFilter)
 			noteFilter = defaultFilter
 		}
 
@@ -410,6 +940,27 @@ func (c YAMLAnkiTTS) Parse() (AnkiTTS, error) {
 		conf.TextPreprocessors = append(conf.TextPreprocessors, parsed)
 	}
 
+	for i, processing := range c.AudioPostProcessing {
+		parsed, err := processing.Parse(configDir)
+		if err != nil {
+			return AnkiTTS{}, errorx.Decorate(err, "invalid audio post-processing step #%d", i)
+		}
+		conf.AudioPostProcessing = append(conf.AudioPostProcessing, parsed)
+	}
+
+	{
+		const defaultAudioFileName = "$$.Hash$$"
+		fileName := c.AudioFileName
+		if fileName == "" {
+			fileName = defaultAudioFileName
+		}
+		parsed, err := ParseTextTemplate(configDir, "AudioFileName", fileName)
+		if err != nil {
+			return AnkiTTS{}, errorx.IllegalFormat.Wrap(err, "malformed audio file name template")
+		}
+		conf.AudioFileName = parsed
+	}
+
 	return conf, nil
 }
 
@@ -434,6 +985,118 @@ func (c YAMLTextProcessing) Parse() (TextProcessor, error) {
 	}
 }
 
+type YAMLAudioProcessing struct {
+	// oneof:
+	FFmpeg *YAMLAudioFFmpeg `yaml:"ffmpeg"`
+	Exec   *YAMLAudioExec   `yaml:"exec"`
+}
+
+func (p YAMLAudioProcessing) Parse(configDir string) (AudioProcessingStep, error) {
+	switch {
+	case p.FFmpeg != nil && p.Exec == nil:
+		parsed, err := p.FFmpeg.Parse()
+		if err != nil {
+			return AudioProcessingStep{}, errorx.Decorate(err, "invalid ffmpeg step")
+		}
+		return AudioProcessingStep{FFmpeg: &parsed}, nil
+	case p.FFmpeg == nil && p.Exec != nil:
+		parsed, err := p.Exec.Parse(configDir)
+		if err != nil {
+			return AudioProcessingStep{}, errorx.Decorate(err, "invalid exec step")
+		}
+		return AudioProcessingStep{Exec: &parsed}, nil
+	default:
+		return AudioProcessingStep{}, errorx.IllegalFormat.New("exactly one of 'ffmpeg' and 'exec' must be specified in audio processing step")
+	}
+}
+
+// FFmpegAudioFormats lists output formats supported by the ffmpeg audio processing step.
+var FFmpegAudioFormats = set.FromSlice("mp3", "opus", "ogg", "wav")
+
+type YAMLAudioFFmpeg struct {
+	// Path is the ffmpeg executable. Default: ffmpeg
+	Path string `yaml:"path"`
+	// TrimSilence removes leading and trailing silence.
+	TrimSilence bool `yaml:"trimSilence"`
+	// SilenceThreshold is the volume below which audio is considered silent. Default: -50dB
+	SilenceThreshold string `yaml:"silenceThreshold"`
+	// NormalizeLoudness applies EBU R128 loudness normalization.
+	NormalizeLoudness bool `yaml:"normalizeLoudness"`
+	// Padding is the duration of silence added both at the start and at the end of the audio.
+	Padding string `yaml:"padding"`
+	// Format is one of mp3, opus, ogg, wav. Default: preserve input format.
+	Format string `yaml:"format"`
+	// Bitrate is passed to ffmpeg as is, e.g. 64k.
+	Bitrate string `yaml:"bitrate"`
+}
+
+func (f YAMLAudioFFmpeg) Parse() (AudioFFmpeg, error) {
+	conf := AudioFFmpeg{
+		Path:              f.Path,
+		TrimSilence:       f.TrimSilence,
+		SilenceThreshold:  f.SilenceThreshold,
+		NormalizeLoudness: f.NormalizeLoudness,
+		Format:            f.Format,
+		Bitrate:           f.Bitrate,
+	}
+	if conf.Path == "" {
+		conf.Path = "ffmpeg"
+	}
+	if conf.SilenceThreshold == "" {
+		conf.SilenceThreshold = "-50dB"
+	}
+	if conf.Format != "" && !FFmpegAudioFormats.Contains(conf.Format) {
+		return AudioFFmpeg{}, errorx.IllegalArgument.New("unsupported audio format %q, expected one of %v", conf.Format, FFmpegAudioFormats.AsSlice())
+	}
+	if raw := f.Padding; raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return AudioFFmpeg{}, errorx.IllegalFormat.Wrap(err, "malformed padding")
+		}
+		conf.Padding = parsed
+	}
+	return conf, nil
+}
+
+type YAMLAudioExec struct {
+	Command      string   `yaml:"command"`
+	Args         []string `yaml:"args"`
+	OutputFormat string   `yaml:"outputFormat"`
+	Timeout      string   `yaml:"timeout"`
+}
+
+func (e YAMLAudioExec) Parse(configDir string) (AudioExec, error) {
+	if stringx.IsBlank(e.Command) {
+		return AudioExec{}, errorx.IllegalArgument.New("exec command must be specified")
+	}
+	command := resolveCommandPath(configDir, e.Command)
+
+	args := make([]NoteProcessingExecArg, 0, len(e.Args))
+	for i, arg := range e.Args {
+		parsed, err := parseExecArg(configDir, fmt.Sprintf("arg#%d", i), arg)
+		if err != nil {
+			return AudioExec{}, errorx.Decorate(err, "failed to parse exec argument #%d", i)
+		}
+		args = append(args, parsed)
+	}
+
+	var timeout time.Duration
+	if raw := e.Timeout; raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return AudioExec{}, errorx.IllegalFormat.Wrap(err, "malformed timeout")
+		}
+		timeout = parsed
+	}
+
+	return AudioExec{
+		Command:      command,
+		Args:         args,
+		OutputFormat: e.OutputFormat,
+		Timeout:      timeout,
+	}, nil
+}
+
 type YAMLAnkiNoteType struct {
 	Name      string                 `yaml:"name"`
 	CSS       string                 `yaml:"css"`
@@ -530,9 +1193,112 @@ func (t YAMLAnkiCardTemplate) Parse(configDir string, fieldsByName map[string]An
 	}, nil
 }
 
+type YAMLAnkiDeck struct {
+	// Name is the full name of the deck, e.g. German::01_VerbsInfinitive
+	Name string `yaml:"name"`
+	// Preset is the options group assigned to the deck. Options of the deck are not managed if it's not set.
+	Preset *YAMLAnkiDeckPreset `yaml:"preset"`
+}
+
+func (d YAMLAnkiDeck) Parse() (AnkiDeck, error) {
+	if stringx.IsBlank(d.Name) {
+		return AnkiDeck{}, errorx.IllegalFormat.New("name is missing")
+	}
+	deck := AnkiDeck{Name: d.Name}
+	if d.Preset != nil {
+		preset, err := d.Preset.Parse()
+		if err != nil {
+			return AnkiDeck{}, errorx.Decorate(err, "invalid preset")
+		}
+		deck.Preset = &preset
+	}
+	return deck, nil
+}
+
+type YAMLAnkiDeckPreset struct {
+	// Name identifies the options group in Anki. It's created if it doesn't exist.
+	Name string `yaml:"name"`
+	// Options below are left as they are in Anki if they are not set.
+	NewCardsPerDay *int `yaml:"newCardsPerDay"`
+	ReviewsPerDay  *int `yaml:"reviewsPerDay"`
+	// LearningSteps and RelearningSteps are durations, e.g. [1m, 10m, 1h]
+	LearningSteps   []string `yaml:"learningSteps"`
+	RelearningSteps []string `yaml:"relearningSteps"`
+}
+
+func (p YAMLAnkiDeckPreset) Parse() (AnkiDeckPreset, error) {
+	if stringx.IsBlank(p.Name) {
+		return AnkiDeckPreset{}, errorx.IllegalFormat.New("name is missing")
+	}
+	for _, limit := range []*int{p.NewCardsPerDay, p.ReviewsPerDay} {
+		if limit != nil && *limit < 0 {
+			return AnkiDeckPreset{}, errorx.IllegalArgument.New("limits must not be negative")
+		}
+	}
+	learningSteps, err := parseSteps(p.LearningSteps)
+	if err != nil {
+		return AnkiDeckPreset{}, errorx.Decorate(err, "invalid learningSteps")
+	}
+	relearningSteps, err := parseSteps(p.RelearningSteps)
+	if err != nil {
+		return AnkiDeckPreset{}, errorx.Decorate(err, "invalid relearningSteps")
+	}
+	return AnkiDeckPreset{
+		Name:            p.Name,
+		NewCardsPerDay:  p.NewCardsPerDay,
+		ReviewsPerDay:   p.ReviewsPerDay,
+		LearningSteps:   learningSteps,
+		RelearningSteps: relearningSteps,
+	}, nil
+}
+
+func parseSteps(steps []string) ([]time.Duration, error) {
+	var parsed []time.Duration
+	for _, step := range steps {
+		duration, err := time.ParseDuration(step)
+		if err != nil {
+			return nil, errorx.IllegalFormat.Wrap(err, "malformed step %q", step)
+		}
+		if duration <= 0 {
+			return nil, errorx.IllegalArgument.New("step %q must be positive", step)
+		}
+		parsed = append(parsed, duration)
+	}
+	return parsed, nil
+}
+
+// validateDeckPresets checks that decks sharing a preset don't define different options for it.
+// A preset may be defined by one of the decks and referenced by name by the others.
+func validateDeckPresets(decks []AnkiDeck) error {
+	presets := make(map[string]AnkiDeckPreset)
+	for _, deck := range decks {
+		if deck.Preset == nil || isPresetReference(*deck.Preset) {
+			continue
+		}
+		if defined, ok := presets[deck.Preset.Name]; ok && !reflect.DeepEqual(defined, *deck.Preset) {
+			return errorx.IllegalState.New("preset %q is defined with different options by several decks", deck.Preset.Name)
+		}
+		presets[deck.Preset.Name] = *deck.Preset
+	}
+	return nil
+}
+
+// isPresetReference reports whether the preset only refers to a preset by name without defining any options.
+func isPresetReference(preset AnkiDeckPreset) bool {
+	return reflect.DeepEqual(preset, AnkiDeckPreset{Name: preset.Name})
+}
+
 type YAMLNotesOrganization struct {
+	// Name optionally identifies the rule, so that it could be selected from the command line.
+	Name       string `yaml:"name"`
 	Filter     string `yaml:"filter"`
 	TargetDeck string `yaml:"targetDeck"`
+
+	// Priority decides which rule moves cards matched by several rules with different target decks.
+	// Default: 0. Cards matched by several rules with the same highest priority are reported as conflicts.
+	Priority int `yaml:"priority"`
+	// Exclusive makes the rule win over all the non-exclusive rules matching the same cards.
+	Exclusive bool `yaml:"exclusive"`
 }
 
 func (o YAMLNotesOrganization) Parse() (NotesOrganizationRule, error) {
@@ -545,16 +1311,219 @@ func (o YAMLNotesOrganization) Parse() (NotesOrganizationRule, error) {
 		return NotesOrganizationRule{}, errorx.IllegalFormat.New("target deck is missing")
 	}
 	return NotesOrganizationRule{
+		Name:           o.Name,
 		NotesFilter:    filter,
 		TargetDeckName: targetDeck,
+		Priority:       o.Priority,
+		Exclusive:      o.Exclusive,
 	}, nil
 }
 
+type YAMLImport struct {
+	// Name optionally identifies the action, so that it could be selected from the command line.
+	Name string `yaml:"name"`
+	// Format is one of csv, kindle or koreader. Default: csv
+	Format string `yaml:"format"`
+	// Path is the path to the file. The first row of CSV and TSV files is the header.
+	Path string `yaml:"path"`
+	// Delimiter is the column separator of CSV files. Default: tab for .tsv files, comma otherwise
+	Delimiter string `yaml:"delimiter"`
+	// SQLitePath is the sqlite3 executable used to read kindle and koreader databases. Default: sqlite3
+	SQLitePath string `yaml:"sqlitePath"`
+	// Language restricts imported Kindle lookups to the language, e.g. de. Default: all the languages
+	Language string `yaml:"language"`
+	NoteType string `yaml:"noteType"`
+	// Deck is the deck new notes are created in.
+	Deck string `yaml:"deck"`
+	// Fields maps header columns to note fields. Default: columns are imported to the fields with the same names
+	Fields map[string]string `yaml:"fields"`
+	// KeyField is the note field used to find the existing note of a row, e.g. Word
+	KeyField string `yaml:"keyField"`
+	// Tags are added to the created notes.
+	Tags []string `yaml:"tags"`
+	// UpdateExisting specifies whether imported fields of existing notes are updated.
+	// Default: true for csv, false for kindle and koreader, so that edited notes are left intact
+	UpdateExisting *bool `yaml:"updateExisting"`
+}
+
+func (i YAMLImport) Parse(configDir string) (AnkiImport, error) {
+	if stringx.IsBlank(i.Path) {
+		return AnkiImport{}, errorx.IllegalFormat.New("path is missing")
+	}
+	if stringx.IsBlank(i.NoteType) {
+		return AnkiImport{}, errorx.IllegalFormat.New("noteType is missing")
+	}
+	if stringx.IsBlank(i.Deck) {
+		return AnkiImport{}, errorx.IllegalFormat.New("deck is missing")
+	}
+	if stringx.IsBlank(i.KeyField) {
+		return AnkiImport{}, errorx.IllegalFormat.New("keyField is missing")
+	}
+	if i.Fields != nil && !slices.Contains(mapx.Values(i.Fields), i.KeyField) {
+		return AnkiImport{}, errorx.IllegalArgument.New("keyField %q is not mapped to any column in fields", i.KeyField)
+	}
+
+	conf := AnkiImport{
+		Name:           i.Name,
+		Format:         ImportCSV,
+		FilePath:       ResolvePath(configDir, i.Path),
+		Delimiter:      ',',
+		SQLitePath:     "sqlite3",
+		Language:       i.Language,
+		NoteType:       i.NoteType,
+		Deck:           i.Deck,
+		Fields:         i.Fields,
+		KeyField:       i.KeyField,
+		Tags:           i.Tags,
+		UpdateExisting: true,
+	}
+	if override := i.Format; override != "" {
+		conf.Format = ImportFormat(override)
+		if !slices.Contains(ImportFormats, conf.Format) {
+			return AnkiImport{}, errorx.IllegalFormat.New("unknown format %q, expected one of %v", override, ImportFormats)
+		}
+	}
+	if override := i.SQLitePath; override != "" {
+		conf.SQLitePath = override
+	}
+	if override := i.UpdateExisting; override != nil {
+		conf.UpdateExisting = *override
+	} else {
+		conf.UpdateExisting = conf.Format == ImportCSV
+	}
+	if i.Language != "" && conf.Format != ImportKindle {
+		return AnkiImport{}, errorx.IllegalFormat.New("language must be specified for kindle format only")
+	}
+	if conf.Format != ImportCSV {
+		if i.Delimiter != "" {
+			return AnkiImport{}, errorx.IllegalFormat.New("delimiter must be specified for csv format only")
+		}
+		// lookup columns are unlikely to match field names, so the mapping is required
+		if i.Fields == nil {
+			return AnkiImport{}, errorx.IllegalFormat.New("fields must be specified for %s format", conf.Format)
+		}
+		for column := range i.Fields {
+			if !slices.Contains(LookupColumns, column) {
+				return AnkiImport{}, errorx.IllegalFormat.New("unknown column %q in fields, expected one of %v", column, LookupColumns)
+			}
+		}
+		return conf, nil
+	}
+
+	if strings.EqualFold(filepath.Ext(i.Path), ".tsv") {
+		conf.Delimiter = '\t'
+	}
+	if override := i.Delimiter; override != "" {
+		delimiter := []rune(override)
+		if len(delimiter) != 1 {
+			return AnkiImport{}, errorx.IllegalFormat.New("delimiter must be a single character, got %q", override)
+		}
+		conf.Delimiter = delimiter[0]
+	}
+	return conf, nil
+}
+
+type YAMLDedupe struct {
+	// Name optionally identifies the rule, so that it could be selected from the command line.
+	Name       string `yaml:"name"`
+	NoteFilter string `yaml:"noteFilter"`
+	// KeyField is the field whose normalized value identifies duplicates, e.g. Word
+	KeyField string `yaml:"keyField"`
+	// KeyPreprocessing normalizes the key like textPreprocessing of TTS does. Default: the one of TTS
+	KeyPreprocessing []YAMLTextProcessing `yaml:"keyPreprocessing"`
+}
+
+func (d YAMLDedupe) Parse() (DedupeRule, error) {
+	if stringx.IsBlank(d.NoteFilter) {
+		return DedupeRule{}, errorx.IllegalFormat.New("noteFilter is missing")
+	}
+	if stringx.IsBlank(d.KeyField) {
+		return DedupeRule{}, errorx.IllegalFormat.New("keyField is missing")
+	}
+	rule := DedupeRule{Name: d.Name, NoteFilter: d.NoteFilter, KeyField: d.KeyField}
+	keyProcessing := d.KeyPreprocessing
+	if len(keyProcessing) == 0 {
+		keyProcessing = defaultTextProcessing
+	}
+	for i, processing := range keyProcessing {
+		parsed, err := processing.Parse()
+		if err != nil {
+			return DedupeRule{}, errorx.Decorate(err, "invalid key preprocessing #%d", i)
+		}
+		rule.KeyPreprocessors = append(rule.KeyPreprocessors, parsed)
+	}
+	return rule, nil
+}
+
+type YAMLCardsState struct {
+	// Name optionally identifies the rule, so that it could be selected from the command line.
+	Name   string `yaml:"name"`
+	Filter string `yaml:"filter"`
+	// Operation is one of suspend, unsuspend, forget, setDue or reposition.
+	Operation string `yaml:"operation"`
+	// DueDays is required by setDue operation: a number of days from today, a range like 1-7,
+	// or a number with exclamation mark like 3! to reset the interval as well.
+	DueDays string `yaml:"dueDays"`
+	// PositionField is required by reposition operation: the note field containing the position of new cards.
+	PositionField string `yaml:"positionField"`
+
+	// PrimaryCards is required by unlock operation: the query matching primary cards, e.g. card:FillInWord*
+	PrimaryCards string `yaml:"primaryCards"`
+	// MinIntervalDays is the interval primary cards should reach to unlock secondary cards. Default: 21
+	MinIntervalDays *int `yaml:"minIntervalDays"`
+	// UnlockPerRun limits the number of secondary cards of a note unsuspended by a run. Default: no limit
+	UnlockPerRun int `yaml:"unlockPerRun"`
+}
+
+func (c YAMLCardsState) Parse() (CardsStateRule, error) {
+	if stringx.IsBlank(c.Filter) {
+		return CardsStateRule{}, errorx.IllegalFormat.New("filter is missing")
+	}
+	operation := CardsOperation(c.Operation)
+	if !slices.Contains(CardsOperations, operation) {
+		return CardsStateRule{}, errorx.IllegalFormat.New("unknown operation %q, expected one of %v", c.Operation, CardsOperations)
+	}
+	if (operation == CardsSetDue) != (c.DueDays != "") {
+		return CardsStateRule{}, errorx.IllegalFormat.New("dueDays must be specified for setDue operation only")
+	}
+	if (operation == CardsReposition) != (c.PositionField != "") {
+		return CardsStateRule{}, errorx.IllegalFormat.New("positionField must be specified for reposition operation only")
+	}
+	rule := CardsStateRule{
+		Name:          c.Name,
+		Filter:        c.Filter,
+		Operation:     operation,
+		DueDays:       c.DueDays,
+		PositionField: c.PositionField,
+	}
+	if (operation == CardsUnlock) != (c.PrimaryCards != "") {
+		return CardsStateRule{}, errorx.IllegalFormat.New("primaryCards must be specified for unlock operation only")
+	}
+	if operation == CardsUnlock {
+		unlock := SiblingsUnlock{PrimaryCards: c.PrimaryCards, MinInterval: 21, PerRun: c.UnlockPerRun}
+		if override := c.MinIntervalDays; override != nil {
+			if *override <= 0 {
+				return CardsStateRule{}, errorx.IllegalArgument.New("minIntervalDays must be positive")
+			}
+			unlock.MinInterval = *override
+		}
+		if unlock.PerRun < 0 {
+			return CardsStateRule{}, errorx.IllegalArgument.New("unlockPerRun must not be negative")
+		}
+		rule.Unlock = &unlock
+	}
+	return rule, nil
+}
+
 type YAMLNoteProcessing struct {
+	// Name optionally identifies the rule, so that it could be selected from the command line.
+	Name                          string `yaml:"name"`
 	NoteFilter                    string `yaml:"noteFilter"`
 	MinPauseBetweenExecutions     string `yaml:"minPauseBetweenExecutions"`
 	Timeout                       string `yaml:"timeout"`
 	DisableAutoFilterOptimization *bool  `yaml:"disableAutoFilterOptimization"`
+	// InputFields are the fields the script depends on. Used to detect changed notes if the state file is configured.
+	InputFields []string `yaml:"inputFields"`
 
 	Exec YAMLNotesPopulationExec `yaml:"exec"`
 }
@@ -588,14 +1557,122 @@ func (np YAMLNoteProcessing) Parse(configDir string) (NoteProcessingRule, error)
 		timeout = parsed
 	}
 
+	// only the script invocation affects the results, so changes of e.g. timeout don't cause reprocessing
+	definition, err := yaml.Marshal(np.Exec)
+	if err != nil {
+		return NoteProcessingRule{}, errorx.IllegalState.Wrap(err, "failed to serialize note processing rule")
+	}
+	definitionHash := sha256.Sum256(definition)
+
 	return NoteProcessingRule{
+		Name:                      np.Name,
 		NoteFilter:                noteFilter,
 		MinPauseBetweenExecutions: minPauseBetweenExecutions,
 		Timeout:                   timeout,
+		InputFields:               np.InputFields,
+		DefinitionHash:            hex.EncodeToString(definitionHash[:]),
 		Exec:                      exec,
 	}, nil
 }
 
+type YAMLLLMRule struct {
+	// Name optionally identifies the rule, so that it could be selected from the command line.
+	Name       string `yaml:"name"`
+	NoteFilter string `yaml:"noteFilter"`
+	// Model overrides the model of the llm section.
+	Model       string   `yaml:"model"`
+	Temperature *float64 `yaml:"temperature"`
+	// System and Prompt are templates with the note available as $$ .Note $$, like args of noteProcessing.
+	System string `yaml:"system"`
+	Prompt string `yaml:"prompt"`
+	// Fields maps keys of the JSON object replied by the model to note fields.
+	Fields map[string]string `yaml:"fields"`
+	// TagsKey is the key of the reply holding a list of tags to add to the note.
+	TagsKey string   `yaml:"tagsKey"`
+	Tags    []string `yaml:"tags"`
+	// ProvenanceField is the field to store the model and the cache key of the request in.
+	ProvenanceField string `yaml:"provenanceField"`
+	// ProvenanceTag is the prefix of the tag to store the model and the cache key in, e.g. llm.
+	ProvenanceTag string `yaml:"provenanceTag"`
+	// InputFields are the fields the prompt depends on. Used to detect changed notes if the state file is configured.
+	InputFields []string `yaml:"inputFields"`
+}
+
+func (r YAMLLLMRule) Parse(configDir string, llm LLM) (LLMRule, error) {
+	noteFilter := strings.NewReplacer("\t", " ", "\n", " ", "\r", "").Replace(r.NoteFilter)
+	if stringx.IsBlank(noteFilter) {
+		return LLMRule{}, errorx.IllegalArgument.New("noteFilter must be specified")
+	}
+	if stringx.IsBlank(r.Prompt) {
+		return LLMRule{}, errorx.IllegalArgument.New("prompt must be specified")
+	}
+	if len(r.Fields) == 0 && r.TagsKey == "" {
+		return LLMRule{}, errorx.IllegalArgument.New("fields or tagsKey must be specified")
+	}
+	for key, field := range r.Fields {
+		if stringx.IsBlank(key) || stringx.IsBlank(field) {
+			return LLMRule{}, errorx.IllegalArgument.New("fields must map reply keys to note fields, got %q: %q", key, field)
+		}
+	}
+	if override := r.Temperature; override != nil && *override < 0 {
+		return LLMRule{}, errorx.IllegalArgument.New("temperature must not be negative")
+	}
+	if r.ProvenanceField != "" && slices.Contains(mapx.Values(r.Fields), r.ProvenanceField) {
+		return LLMRule{}, errorx.IllegalArgument.New("provenanceField %q is one of the generated fields", r.ProvenanceField)
+	}
+	if strings.ContainsFunc(r.ProvenanceTag, unicode.IsSpace) {
+		return LLMRule{}, errorx.IllegalArgument.New("provenanceTag must not contain spaces, got %q", r.ProvenanceTag)
+	}
+	if r.Model == "" {
+		r.Model = llm.Model
+	}
+
+	rule := LLMRule{
+		Name:        r.Name,
+		NoteFilter:  noteFilter,
+		Model:       r.Model,
+		Temperature: r.Temperature,
+		Fields:      r.Fields,
+		TagsKey:     r.TagsKey,
+		Tags:        r.Tags,
+		InputFields: r.InputFields,
+
+		ProvenanceField: r.ProvenanceField,
+		ProvenanceTag:   r.ProvenanceTag,
+	}
+	if r.System != "" {
+		system, err := ParseTextTemplate(configDir, "system", r.System)
+		if err != nil {
+			return LLMRule{}, errorx.IllegalFormat.Wrap(err, "malformed system template")
+		}
+		rule.System = system
+	}
+	prompt, err := ParseTextTemplate(configDir, "prompt", r.Prompt)
+	if err != nil {
+		return LLMRule{}, errorx.IllegalFormat.Wrap(err, "malformed prompt template")
+	}
+	rule.Prompt = prompt
+
+	// only the request and the way the reply is stored affect the generated fields
+	definition, err := yaml.Marshal(YAMLLLMRule{
+		Model:       r.Model,
+		Temperature: r.Temperature,
+		System:      r.System,
+		Prompt:      r.Prompt,
+		Fields:      r.Fields,
+		TagsKey:     r.TagsKey,
+
+		ProvenanceField: r.ProvenanceField,
+		ProvenanceTag:   r.ProvenanceTag,
+	})
+	if err != nil {
+		return LLMRule{}, errorx.IllegalState.Wrap(err, "failed to serialize llm rule")
+	}
+	definitionHash := sha256.Sum256(definition)
+	rule.DefinitionHash = hex.EncodeToString(definitionHash[:])
+	return rule, nil
+}
+
 type YAMLNotesPopulationExec struct {
 	Command string            `yaml:"command"`
 	Args    []string          `yaml:"args"`
@@ -607,35 +1684,20 @@ func (e YAMLNotesPopulationExec) Parse(configDir string) (NoteProcessingExec, er
 	if stringx.IsBlank(e.Command) {
 		return NoteProcessingExec{}, errorx.IllegalArgument.New("exec command must be specified")
 	}
-	if strings.HasPrefix(e.Command, "./") || strings.HasPrefix(e.Command, "../") {
-		e.Command = filepath.Join(configDir, e.Command)
-		log.Printf("Resolve relative exec command path in note population rule against configuration directory: %s", e.Command)
-	}
+	e.Command = resolveCommandPath(configDir, e.Command)
 
 	var args []NoteProcessingExecArg
 	for i, arg := range e.Args {
-		if strings.Contains(arg, templateOpen) && strings.Contains(arg, templateClose) {
-			parsed, err := ParseTextTemplate(configDir, fmt.Sprintf("arg#%d", i), arg)
-			if err != nil {
-				return NoteProcessingExec{}, errorx.IllegalFormat.Wrap(err, "failed to parse exec argument #%d", i)
-			}
-			args = append(args, NoteProcessingExecArg{
-				Template: parsed,
-			})
-		} else {
-			args = append(args, NoteProcessingExecArg{
-				PlainString: lang.New(arg),
-			})
+		parsed, err := parseExecArg(configDir, fmt.Sprintf("arg#%d", i), arg)
+		if err != nil {
+			return NoteProcessingExec{}, errorx.Decorate(err, "failed to parse exec argument #%d", i)
 		}
+		args = append(args, parsed)
 	}
 
-	stdin := NoteProcessingExecArg{PlainString: lang.New(e.Stdin)}
-	if strings.Contains(e.Stdin, templateOpen) && strings.Contains(e.Stdin, templateClose) {
-		parsed, err := ParseTextTemplate(configDir, "stdin", e.Stdin)
-		if err != nil {
-			return NoteProcessingExec{}, errorx.IllegalFormat.Wrap(err, "failed to parse stdin template")
-		}
-		stdin = NoteProcessingExecArg{Template: parsed}
+	stdin, err := parseExecArg(configDir, "stdin", e.Stdin)
+	if err != nil {
+		return NoteProcessingExec{}, errorx.Decorate(err, "failed to parse stdin template")
 	}
 
 	return NoteProcessingExec{
@@ -646,6 +1708,27 @@ func (e YAMLNotesPopulationExec) Parse(configDir string) (NoteProcessingExec, er
 	}, nil
 }
 
+// resolveCommandPath resolves commands starting with ./ or ../ against the configuration directory.
+func resolveCommandPath(configDir, command string) string {
+	if strings.HasPrefix(command, "./") || strings.HasPrefix(command, "../") {
+		command = filepath.Join(configDir, command)
+		slog.Debug("Resolve relative exec command path against configuration directory", "command", command)
+	}
+	return command
+}
+
+// parseExecArg parses arg as a template if it contains template delimiters, and as a plain string otherwise.
+func parseExecArg(configDir, name, arg string) (NoteProcessingExecArg, error) {
+	if strings.Contains(arg, templateOpen) && strings.Contains(arg, templateClose) {
+		parsed, err := ParseTextTemplate(configDir, name, arg)
+		if err != nil {
+			return NoteProcessingExecArg{}, errorx.IllegalFormat.Wrap(err, "malformed template")
+		}
+		return NoteProcessingExecArg{Template: parsed}, nil
+	}
+	return NoteProcessingExecArg{PlainString: lang.New(arg)}, nil
+}
+
 var namePattern = regexp.MustCompile(`^[A-Za-z_]\w*$`)
 
 func ValidateName(name string) error {
@@ -0,0 +1,25 @@
+package audioprocessing
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"context"
+)
+
+type Audio struct {
+	Data []byte
+	// Format is the audio file extension, e.g. mp3
+	Format string
+}
+
+type Processor interface {
+	// Process applies processing steps to the audio one by one and returns the result of the last step.
+	Process(ctx context.Context, steps []ankihelperconf.AudioProcessingStep, audio Audio) (Audio, error)
+}
+
+// TemplateData is the data that's available in the templates of exec processing step arguments.
+type TemplateData struct {
+	// Input is the path to the file containing audio to be processed.
+	Input string
+	// Output is the path to the file where the processed audio should be written.
+	Output string
+}
@@ -0,0 +1,150 @@
+package audioprocessing
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/execx"
+	"anki-rest-enhancer/util/templatex"
+	"context"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func NewProcessor() *processor {
+	return &processor{}
+}
+
+type processor struct {
+	// nop
+}
+
+var _ Processor = (*processor)(nil)
+
+func (p *processor) Process(ctx context.Context, steps []ankihelperconf.AudioProcessingStep, audio Audio) (Audio, error) {
+	for i, step := range steps {
+		processed, err := p.processStep(ctx, step, audio)
+		if err != nil {
+			return Audio{}, errorx.Decorate(err, "audio processing step #%d failed", i)
+		}
+		audio = processed
+	}
+	return audio, nil
+}
+
+func (p *processor) processStep(ctx context.Context, step ankihelperconf.AudioProcessingStep, audio Audio) (Audio, error) {
+	dir, err := os.MkdirTemp("", "anki-helper-audio-*")
+	if err != nil {
+		return Audio{}, errorx.ExternalError.Wrap(err, "failed to create temporary directory")
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	var outputFormat string
+	switch {
+	case step.FFmpeg != nil:
+		outputFormat = step.FFmpeg.Format
+	case step.Exec != nil:
+		outputFormat = step.Exec.OutputFormat
+	default:
+		panic(errorx.Panic(errorx.IllegalState.New("unexpected audio processing step: %+v", step)))
+	}
+	if outputFormat == "" {
+		outputFormat = audio.Format
+	}
+
+	files := TemplateData{
+		Input:  filepath.Join(dir, "input."+audio.Format),
+		Output: filepath.Join(dir, "output."+outputFormat),
+	}
+	if err := os.WriteFile(files.Input, audio.Data, 0600); err != nil {
+		return Audio{}, errorx.ExternalError.Wrap(err, "failed to write audio to a temporary file")
+	}
+
+	var params execx.Params
+	cmdCtx := ctx
+	switch {
+	case step.FFmpeg != nil:
+		params = FFmpegParams(*step.FFmpeg, files)
+	case step.Exec != nil:
+		params, err = execParams(*step.Exec, files)
+		if err != nil {
+			return Audio{}, err
+		}
+		if timeout := step.Exec.Timeout; timeout > 0 {
+			ctx, cancel := context.WithTimeout(cmdCtx, timeout)
+			defer cancel()
+			cmdCtx = ctx
+		}
+	}
+
+	if _, err := execx.RunAndCollectOutput(cmdCtx, params); err != nil {
+		return Audio{}, errorx.ExternalError.Wrap(err, "audio processing command %s failed", params.Command)
+	}
+
+	processed, err := os.ReadFile(files.Output)
+	if err != nil {
+		return Audio{}, errorx.ExternalError.Wrap(err, "failed to read audio processing command output")
+	}
+	if len(processed) == 0 {
+		return Audio{}, errorx.ExternalError.New("audio processing command %s produced empty output", params.Command)
+	}
+	return Audio{Data: processed, Format: outputFormat}, nil
+}
+
+var ffmpegCodecs = map[string]string{
+	"mp3":  "libmp3lame",
+	"opus": "libopus",
+	"ogg":  "libvorbis",
+	"wav":  "pcm_s16le",
+}
+
+// FFmpegParams builds ffmpeg command line that applies conf to the input file.
+func FFmpegParams(conf ankihelperconf.AudioFFmpeg, files TemplateData) execx.Params {
+	var filters []string
+	if conf.TrimSilence {
+		// silenceremove only trims the beginning of the audio reliably, so the audio is reversed to trim the ending.
+		trim := fmt.Sprintf("silenceremove=start_periods=1:start_threshold=%s", conf.SilenceThreshold)
+		filters = append(filters, trim, "areverse", trim, "areverse")
+	}
+	if conf.NormalizeLoudness {
+		filters = append(filters, "loudnorm=I=-16:TP=-1.5:LRA=11")
+	}
+	if pad := conf.Padding; pad > 0 {
+		filters = append(filters,
+			fmt.Sprintf("adelay=delays=%d:all=1", pad.Milliseconds()),
+			fmt.Sprintf("apad=pad_dur=%.3f", pad.Seconds()),
+		)
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", files.Input}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	if codec, ok := ffmpegCodecs[conf.Format]; ok {
+		args = append(args, "-c:a", codec)
+	}
+	if conf.Bitrate != "" {
+		args = append(args, "-b:a", conf.Bitrate)
+	}
+	args = append(args, files.Output)
+
+	return execx.Params{Command: conf.Path, Args: args}
+}
+
+func execParams(conf ankihelperconf.AudioExec, files TemplateData) (execx.Params, error) {
+	args := make([]string, len(conf.Args))
+	for i, arg := range conf.Args {
+		switch {
+		case arg.PlainString != nil:
+			args[i] = *arg.PlainString
+		case arg.Template != nil:
+			executed, err := templatex.Execute(arg.Template, files)
+			if err != nil {
+				return execx.Params{}, errorx.IllegalFormat.Wrap(err, "failed to substitute template in argument #%d", i)
+			}
+			args[i] = executed
+		}
+	}
+	return execx.Params{Command: conf.Command, Args: args}, nil
+}
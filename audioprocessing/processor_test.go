@@ -0,0 +1,60 @@
+package audioprocessing
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFFmpegParams(t *testing.T) {
+	// given:
+	conf := ankihelperconf.AudioFFmpeg{
+		Path:              "ffmpeg",
+		TrimSilence:       true,
+		SilenceThreshold:  "-40dB",
+		NormalizeLoudness: true,
+		Padding:           250 * time.Millisecond,
+		Format:            "opus",
+		Bitrate:           "48k",
+	}
+
+	// when:
+	params := FFmpegParams(conf, TemplateData{Input: "/tmp/in.mp3", Output: "/tmp/out.opus"})
+
+	// then:
+	require.Equal(t, "ffmpeg", params.Command)
+	require.Equal(t, []string{
+		"-hide_banner", "-loglevel", "error", "-y", "-i", "/tmp/in.mp3",
+		"-af", "silenceremove=start_periods=1:start_threshold=-40dB,areverse," +
+			"silenceremove=start_periods=1:start_threshold=-40dB,areverse," +
+			"loudnorm=I=-16:TP=-1.5:LRA=11," +
+			"adelay=delays=250:all=1,apad=pad_dur=0.250",
+		"-c:a", "libopus",
+		"-b:a", "48k",
+		"/tmp/out.opus",
+	}, params.Args)
+}
+
+func TestProcess_Exec(t *testing.T) {
+	// given:
+	input, err := ankihelperconf.ParseTextTemplate("/", "input", "$$.Input$$")
+	require.NoError(t, err)
+	output, err := ankihelperconf.ParseTextTemplate("/", "output", "$$.Output$$")
+	require.NoError(t, err)
+	steps := []ankihelperconf.AudioProcessingStep{{
+		Exec: &ankihelperconf.AudioExec{
+			Command:      "cp",
+			Args:         []ankihelperconf.NoteProcessingExecArg{{Template: input}, {Template: output}},
+			OutputFormat: "ogg",
+		},
+	}}
+
+	// when:
+	processed, err := NewProcessor().Process(context.Background(), steps, Audio{Data: []byte("abacaba"), Format: "mp3"})
+
+	// then:
+	require.NoError(t, err)
+	require.Equal(t, Audio{Data: []byte("abacaba"), Format: "ogg"}, processed)
+}
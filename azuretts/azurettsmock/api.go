@@ -2,11 +2,12 @@ package azurettsmock
 
 import (
 	"anki-rest-enhancer/azuretts"
+	"context"
 	"github.com/joomcode/errorx"
 )
 
 type API struct {
-	TextToSpeechFunc func(texts map[string]struct{}) map[string]azuretts.TextToSpeechResult
+	TextToSpeechFunc func(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error
 }
 
 var _ azuretts.API = (*API)(nil)
@@ -15,9 +16,9 @@ func (api *API) Reset() {
 	*api = API{}
 }
 
-func (api *API) TextToSpeech(texts map[string]struct{}) map[string]azuretts.TextToSpeechResult {
+func (api *API) TextToSpeech(ctx context.Context, texts map[string]struct{}, onResult azuretts.ResultHandler) error {
 	if behaviour := api.TextToSpeechFunc; behaviour != nil {
-		return behaviour(texts)
+		return behaviour(ctx, texts, onResult)
 	}
 	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method TextToSpeech")))
 }
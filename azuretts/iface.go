@@ -1,11 +1,24 @@
 package azuretts
 
+import "context"
+
 type TextToSpeechResult struct {
-	Error    error
-	AudioMP3 []byte
+	Error error
+	Audio []byte
+	// Format is the audio file extension corresponding to the configured output format, e.g. mp3
+	Format string
 }
 
+// ResultHandler is called with the text-to-speech result for a single text.
+type ResultHandler func(text string, result TextToSpeechResult)
+
 type API interface {
 	// TextToSpeech runs bulk text-to-speech generation for all the specified texts.
-	TextToSpeech(texts map[string]struct{}) map[string]TextToSpeechResult
+	// onResult is called exactly once per text as soon as its speech is generated (or generation failed),
+	// so that the caller may store the result without waiting for the whole batch.
+	// onResult is never called concurrently.
+	//
+	// If ctx is cancelled, the generation stops and the context error is returned.
+	// Texts that have not been processed by that moment are not reported to onResult.
+	TextToSpeech(ctx context.Context, texts map[string]struct{}, onResult ResultHandler) error
 }
@@ -0,0 +1,40 @@
+package azuretts
+
+import (
+	"anki-rest-enhancer/metrics"
+	"github.com/joomcode/errorx"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"anki_helper_tts_requests_total",
+		"Azure text-to-speech requests by outcome: success, too_many_requests or error.",
+		"outcome",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"anki_helper_tts_request_duration_seconds",
+		"Duration of Azure text-to-speech requests.",
+		metrics.SlowBuckets,
+	)
+	charactersTotal = metrics.NewCounterVec(
+		"anki_helper_tts_characters_total",
+		"Characters of texts successfully converted to speech. Azure bills text-to-speech by characters.",
+	)
+)
+
+func observeRequest(text string, start time.Time, err error) {
+	outcome := "success"
+	switch {
+	case errorx.IsOfType(err, TooManyRequests):
+		outcome = "too_many_requests"
+	case err != nil:
+		outcome = "error"
+	}
+	requestsTotal.Inc(outcome)
+	requestDuration.Observe(time.Since(start).Seconds())
+	if err == nil {
+		charactersTotal.Add(float64(utf8.RuneCountInString(text)))
+	}
+}
@@ -2,23 +2,30 @@ package azuretts
 
 import (
 	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/ratelimit"
 	"anki-rest-enhancer/util/httputil"
+	"anki-rest-enhancer/util/logx"
 	"bytes"
+	"context"
 	"encoding/xml"
+	"fmt"
 	"github.com/joomcode/errorx"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func NewAPI(conf ankihelperconf.Azure) *api {
 	client := &http.Client{
 		Timeout: conf.RequestTimeout,
 	}
-	client.Transport = httputil.NewThrottlingTransport(http.DefaultTransport, conf.MinPauseBetweenRequests)
+	limiter := ratelimit.NewLimiter(conf.MaxRequestsPerSecond, conf.Burst)
+	client.Transport = httputil.NewRateLimitingTransport(http.DefaultTransport, limiter)
 	if conf.LogRequests {
-		client.Transport = httputil.NewLoggingRoundTripper(client.Transport)
+		client.Transport = httputil.NewLoggingRoundTripper(client.Transport, conf.RequestLog)
 	}
 
 	return &api{client: client, conf: conf}
@@ -29,34 +36,85 @@ type api struct {
 	conf   ankihelperconf.Azure
 }
 
-func (api api) TextToSpeech(texts map[string]struct{}) map[string]TextToSpeechResult {
-	results := make(map[string]TextToSpeechResult, len(texts))
-	i := 0
-	for text := range texts {
-		i++ // make i equal to 1 on the first iteration
-		log.Printf("Speech synthesis [%d / %d]: call text-to-speech for text %q", i, len(texts), text)
-
-		var audio []byte
-		var err error
-		for i := 0; i < api.conf.MaxRetries; i++ {
-			audio, err = api.doTextToSpeech(text)
-			if err != nil && api.conf.RetryOnTooManyRequests && errorx.IsOfType(err, TooManyRequests) {
-				log.Println("Got Too Many Requests from Azure...")
-				continue
+func (api api) TextToSpeech(ctx context.Context, texts map[string]struct{}, onResult ResultHandler) error {
+	for result := range api.synthesize(ctx, texts) {
+		onResult(result.text, result.TextToSpeechResult)
+	}
+	return ctx.Err()
+}
+
+type textResult struct {
+	text string
+	TextToSpeechResult
+}
+
+// synthesize runs text-to-speech for all the texts using conf.Concurrency workers.
+// Results are sent to the returned channel as soon as they are ready. The channel is closed once all texts are processed.
+func (api api) synthesize(ctx context.Context, texts map[string]struct{}) <-chan textResult {
+	tasks := make(chan string)
+	go func() {
+		defer close(tasks)
+		for text := range texts {
+			select {
+			case tasks <- text:
+			case <-ctx.Done():
+				return
 			}
-			break
 		}
-		if err != nil {
-			results[text] = TextToSpeechResult{Error: err}
+	}()
+
+	workers := api.conf.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	results := make(chan textResult)
+	var started atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for text := range tasks {
+				i := started.Add(1)
+				logx.FromContext(ctx).Debug("Call text-to-speech", "progress", fmt.Sprintf("%d/%d", i, len(texts)), "text", text)
+				result := api.textToSpeechWithRetries(ctx, text)
+				if ctx.Err() != nil {
+					// the caller is not interested in the results anymore
+					return
+				}
+				results <- textResult{text: text, TextToSpeechResult: result}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+func (api api) textToSpeechWithRetries(ctx context.Context, text string) TextToSpeechResult {
+	var audio []byte
+	var err error
+	for i := 0; i < api.conf.MaxRetries && ctx.Err() == nil; i++ {
+		audio, err = api.doTextToSpeech(ctx, text)
+		if err != nil && api.conf.RetryOnTooManyRequests && errorx.IsOfType(err, TooManyRequests) {
+			logx.FromContext(ctx).Warn("Got Too Many Requests from Azure, retry...")
 			continue
 		}
-		results[text] = TextToSpeechResult{AudioMP3: audio}
+		break
 	}
-	return results
+	if err != nil {
+		return TextToSpeechResult{Error: err}
+	}
+	return TextToSpeechResult{Audio: audio, Format: api.conf.AudioFormat}
 }
 
-func (api api) doTextToSpeech(text string) ([]byte, error) {
-	req, err := api.makeTextToSpeechRequest(text)
+func (api api) doTextToSpeech(ctx context.Context, text string) (_ []byte, err error) {
+	start := time.Now()
+	defer func() { observeRequest(text, start, err) }()
+
+	req, err := api.makeTextToSpeechRequest(ctx, text)
 	if err != nil {
 		return nil, err
 	}
@@ -88,7 +146,7 @@ func (api api) doTextToSpeech(text string) ([]byte, error) {
 	return audio, nil
 }
 
-func (api api) makeTextToSpeechRequest(text string) (*http.Request, error) {
+func (api api) makeTextToSpeechRequest(ctx context.Context, text string) (*http.Request, error) {
 	type voice struct {
 		Name string `xml:"name,attr"`
 		Text string `xml:",chardata"`
@@ -122,11 +180,11 @@ func (api api) makeTextToSpeechRequest(text string) (*http.Request, error) {
 		Header: http.Header{
 			"Ocp-Apim-Subscription-Key": []string{api.conf.APIKey},
 			"Content-Type":              []string{"application/ssml+xml"},
-			"X-Microsoft-OutputFormat":  []string{"audio-24khz-160kbitrate-mono-mp3"},
+			"X-Microsoft-OutputFormat":  []string{api.conf.OutputFormat},
 		},
 		Body:          io.NopCloser(bytes.NewReader(body)),
 		ContentLength: int64(len(body)),
 	}
 
-	return req, nil
+	return req.WithContext(ctx), nil
 }
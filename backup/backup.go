@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/iox"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"errors"
+	"github.com/joomcode/errorx"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// fileNamePrefix marks the files in the backup directory managed by the Backuper.
+	fileNamePrefix  = "anki-backup-"
+	timestampFormat = "20060102-150405"
+)
+
+// deckNameReplacer replaces characters that are not allowed in file names on some platforms,
+// including '::' separating subdeck names.
+var deckNameReplacer = strings.NewReplacer(
+	"::", "__", "/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", `"`, "_", "<", "_", ">", "_", "|", "_",
+)
+
+func NewBackuper(ankiConnect ankiconnect.API, conf ankihelperconf.AnkiBackup) *Backuper {
+	return &Backuper{
+		ankiConnect: ankiConnect,
+		conf:        conf,
+		now:         time.Now,
+	}
+}
+
+// Backuper makes backups of the Anki collection and removes the outdated ones.
+// Each backup consists of one or more files named anki-backup-<timestamp>-<name>.
+type Backuper struct {
+	ankiConnect ankiconnect.API
+	conf        ankihelperconf.AnkiBackup
+	now         func() time.Time
+}
+
+// Backup makes a backup, unless the latest one is more recent than the configured minimal interval,
+// and removes the backups exceeding the configured retention.
+// If the backup fails, its partially written files are removed.
+func (b *Backuper) Backup(ctx context.Context) error {
+	logger := logx.FromContext(ctx)
+	if err := os.MkdirAll(b.conf.Dir, 0o755); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to create backup directory %s", b.conf.Dir)
+	}
+	backups, err := b.list()
+	if err != nil {
+		return err
+	}
+
+	now := b.now()
+	if n := len(backups); n > 0 && b.conf.MinInterval > 0 && now.Sub(backups[n-1].CreatedAt) < b.conf.MinInterval {
+		logger.Info("Skip backup, since the latest one is recent enough", "createdAt", backups[n-1].CreatedAt)
+		return nil
+	}
+
+	timestamp := now.Format(timestampFormat)
+	files, err := b.create(timestamp)
+	if err != nil {
+		for _, file := range files {
+			_ = os.Remove(file)
+		}
+		return err
+	}
+	logger.Info("Backup created", "files", files)
+
+	backups = append(backups, backupInfo{Timestamp: timestamp, Files: files})
+	return b.prune(ctx, backups)
+}
+
+// create writes the backup files and returns their paths, including the ones written before a failure.
+func (b *Backuper) create(timestamp string) ([]string, error) {
+	var files []string
+	for _, deck := range b.conf.Decks {
+		// the path is resolved by Anki, so it should not depend on the working directory of this tool
+		path, err := filepath.Abs(b.fileName(timestamp, deckNameReplacer.Replace(deck)+".apkg"))
+		if err != nil {
+			return files, errorx.ExternalError.Wrap(err, "failed to resolve backup file path")
+		}
+		if err := b.ankiConnect.ExportPackage(deck, path, b.conf.IncludeScheduling); err != nil {
+			return files, errorx.Decorate(err, "failed to export deck %q", deck)
+		}
+		files = append(files, path)
+	}
+
+	if collection := b.conf.CollectionPath; collection != "" {
+		name := filepath.Base(collection)
+		// Anki keeps recent changes in the write-ahead log, so it's copied as well if it exists
+		for _, suffix := range []string{"", "-wal"} {
+			path := b.fileName(timestamp, name+suffix)
+			copied, err := copyFile(collection+suffix, path, suffix != "")
+			if copied {
+				files = append(files, path)
+			}
+			if err != nil {
+				return files, errorx.Decorate(err, "failed to copy collection")
+			}
+		}
+	}
+	return files, nil
+}
+
+func (b *Backuper) fileName(timestamp, name string) string {
+	return filepath.Join(b.conf.Dir, fileNamePrefix+timestamp+"-"+name)
+}
+
+type backupInfo struct {
+	Timestamp string
+	CreatedAt time.Time
+	Files     []string
+}
+
+// list returns the backups found in the backup directory, the oldest first.
+func (b *Backuper) list() ([]backupInfo, error) {
+	entries, err := os.ReadDir(b.conf.Dir)
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to list backup directory %s", b.conf.Dir)
+	}
+
+	backupsByTimestamp := make(map[string]*backupInfo)
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), fileNamePrefix)
+		if !ok || entry.IsDir() || len(name) < len(timestampFormat) {
+			continue
+		}
+		timestamp := name[:len(timestampFormat)]
+		createdAt, err := time.ParseInLocation(timestampFormat, timestamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backup, ok := backupsByTimestamp[timestamp]
+		if !ok {
+			backup = &backupInfo{Timestamp: timestamp, CreatedAt: createdAt}
+			backupsByTimestamp[timestamp] = backup
+		}
+		backup.Files = append(backup.Files, filepath.Join(b.conf.Dir, entry.Name()))
+	}
+
+	backups := make([]backupInfo, 0, len(backupsByTimestamp))
+	for _, backup := range backupsByTimestamp {
+		backups = append(backups, *backup)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Timestamp < backups[j].Timestamp })
+	return backups, nil
+}
+
+// prune removes the oldest backups exceeding the configured retention.
+func (b *Backuper) prune(ctx context.Context, backups []backupInfo) error {
+	if b.conf.Keep == 0 || len(backups) <= b.conf.Keep {
+		return nil
+	}
+	for _, backup := range backups[:len(backups)-b.conf.Keep] {
+		for _, file := range backup.Files {
+			if err := os.Remove(file); err != nil {
+				return errorx.ExternalError.Wrap(err, "failed to remove outdated backup file %s", file)
+			}
+		}
+		logx.FromContext(ctx).Info("Removed outdated backup", "timestamp", backup.Timestamp)
+	}
+	return nil
+}
+
+// copyFile copies src file to dst and reports whether dst was created.
+// If optional is set, missing src is not an error.
+func copyFile(src, dst string, optional bool) (copied bool, err error) {
+	in, err := os.Open(src)
+	if optional && errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errorx.ExternalError.Wrap(err, "failed to open %s", src)
+	}
+	defer iox.Close(in)
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false, errorx.ExternalError.Wrap(err, "failed to create %s", dst)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return true, errorx.ExternalError.Wrap(err, "failed to copy %s to %s", src, dst)
+	}
+	if err := out.Close(); err != nil {
+		return true, errorx.ExternalError.Wrap(err, "failed to close %s", dst)
+	}
+	return true, nil
+}
@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"anki-rest-enhancer/ankiconnect/ankiconnectmock"
+	"anki-rest-enhancer/ankihelperconf"
+	"context"
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBackup_ExportDecksWithRetention(t *testing.T) {
+	dir := t.TempDir()
+	ankiMock := &ankiconnectmock.API{}
+	var exportedDecks []string
+	ankiMock.ExportPackageFunc = func(deckName string, path string, includeScheduling bool) error {
+		require.True(t, filepath.IsAbs(path))
+		require.True(t, includeScheduling)
+		exportedDecks = append(exportedDecks, deckName)
+		return os.WriteFile(path, []byte(deckName), 0o644)
+	}
+	backuper := NewBackuper(ankiMock, ankihelperconf.AnkiBackup{
+		Dir:               dir,
+		Decks:             []string{"German", "German::Verbs"},
+		IncludeScheduling: true,
+		Keep:              2,
+	})
+
+	now := time.Date(2024, 3, 15, 10, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		backuper.now = func() time.Time { return now.Add(time.Duration(i) * time.Hour) }
+		require.NoError(t, backuper.Backup(context.Background()))
+	}
+
+	require.Len(t, exportedDecks, 6)
+	require.Equal(t, []string{
+		"anki-backup-20240315-110000-German.apkg",
+		"anki-backup-20240315-110000-German__Verbs.apkg",
+		"anki-backup-20240315-120000-German.apkg",
+		"anki-backup-20240315-120000-German__Verbs.apkg",
+	}, dirFiles(t, dir), "the oldest backup should be removed")
+}
+
+func TestBackup_MinInterval(t *testing.T) {
+	dir := t.TempDir()
+	collection := filepath.Join(t.TempDir(), "collection.anki2")
+	require.NoError(t, os.WriteFile(collection, []byte("data"), 0o644))
+	backuper := NewBackuper(&ankiconnectmock.API{}, ankihelperconf.AnkiBackup{
+		Dir:            dir,
+		CollectionPath: collection,
+		MinInterval:    24 * time.Hour,
+	})
+
+	now := time.Date(2024, 3, 15, 10, 0, 0, 0, time.Local)
+	for _, offset := range []time.Duration{0, time.Hour, 25 * time.Hour} {
+		backuper.now = func() time.Time { return now.Add(offset) }
+		require.NoError(t, backuper.Backup(context.Background()))
+	}
+
+	require.Equal(t, []string{
+		"anki-backup-20240315-100000-collection.anki2",
+		"anki-backup-20240316-110000-collection.anki2",
+	}, dirFiles(t, dir))
+	data, err := os.ReadFile(filepath.Join(dir, "anki-backup-20240315-100000-collection.anki2"))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
+
+func TestBackup_FailureRemovesPartialBackup(t *testing.T) {
+	dir := t.TempDir()
+	ankiMock := &ankiconnectmock.API{}
+	ankiMock.ExportPackageFunc = func(deckName string, path string, includeScheduling bool) error {
+		if deckName == "Spanish" {
+			return errorx.ExternalError.New("export failed")
+		}
+		return os.WriteFile(path, []byte(deckName), 0o644)
+	}
+	backuper := NewBackuper(ankiMock, ankihelperconf.AnkiBackup{Dir: dir, Decks: []string{"German", "Spanish"}})
+
+	err := backuper.Backup(context.Background())
+
+	require.Error(t, err)
+	require.Empty(t, dirFiles(t, dir))
+}
+
+func dirFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/audioprocessing"
+	"anki-rest-enhancer/azuretts"
+	"anki-rest-enhancer/backup"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/llm"
+	"anki-rest-enhancer/llmcache"
+	"anki-rest-enhancer/noteprocessing"
+	"anki-rest-enhancer/statestore"
+	"anki-rest-enhancer/ttsbudget"
+	"anki-rest-enhancer/util/lang/set"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"encoding/json"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFlags are the flags shared by all commands that need a config file.
+type configFlags struct {
+	path        *string
+	printConfig *bool
+	filter      *string
+}
+
+func addConfigFlags(fs *commandFlags) configFlags {
+	return configFlags{
+		path:        fs.String("config", "", "path to config file"),
+		printConfig: fs.Bool("print-config", false, "whether the internal representation of the config should be printed once it's loaded"),
+		filter:      fs.String("config-filter", "", "glob pattern of config files to use among the ones listed in runConfigs, e.g. 'german.yaml'"),
+	}
+}
+
+// load finds and loads the config file, optionally printing it.
+func (f configFlags) load() (ankihelperconf.Config, error) {
+	configPath, err := findConfigFile(*f.path)
+	if err != nil {
+		return ankihelperconf.Config{}, err
+	}
+
+	conf, err := ankihelperconf.LoadYAML(configPath)
+	if err != nil {
+		return ankihelperconf.Config{}, configError.Wrap(err, "failed to load config %s", configPath)
+	}
+
+	if *f.printConfig {
+		if err := printConfig(conf); err != nil {
+			return ankihelperconf.Config{}, err
+		}
+	}
+	return conf, nil
+}
+
+// leafConfigs returns configs with actual settings, i.e. the ones without runConfigs, that match -config-filter.
+func (f configFlags) leafConfigs(conf ankihelperconf.Config) ([]ankihelperconf.Config, error) {
+	if len(conf.RunConfigs) > 0 {
+		var leaves []ankihelperconf.Config
+		for _, conf := range conf.RunConfigs {
+			confLeaves, err := f.leafConfigs(conf)
+			if err != nil {
+				return nil, err
+			}
+			leaves = append(leaves, confLeaves...)
+		}
+		return leaves, nil
+	}
+
+	if matches, err := f.matchesFilter(conf.Path); err != nil {
+		return nil, err
+	} else if !matches {
+		slog.Info("Skip config file as it doesn't match config filter", logx.KeyConfig, conf.Path)
+		return nil, nil
+	}
+	return []ankihelperconf.Config{conf}, nil
+}
+
+// singleConfig returns the only leaf config for commands that operate on a single Anki/Azure setup.
+func (f configFlags) singleConfig(conf ankihelperconf.Config) (ankihelperconf.Config, error) {
+	leaves, err := f.leafConfigs(conf)
+	if err != nil {
+		return ankihelperconf.Config{}, err
+	}
+	switch len(leaves) {
+	case 0:
+		return ankihelperconf.Config{}, usageError.New("no config file matches -config-filter")
+	case 1:
+		return leaves[0], nil
+	default:
+		paths := make([]string, len(leaves))
+		for i, leaf := range leaves {
+			paths[i] = leaf.Path
+		}
+		return ankihelperconf.Config{}, usageError.New("several config files match, use -config-filter to choose one of %v", paths)
+	}
+}
+
+// matchesFilter checks whether the config file path matches -config-filter pattern
+// either as a whole or by its base name.
+func (f configFlags) matchesFilter(path string) (bool, error) {
+	pattern := *f.filter
+	if pattern == "" {
+		return true, nil
+	}
+	for _, candidate := range []string{path, filepath.Base(path)} {
+		matches, err := filepath.Match(pattern, candidate)
+		if err != nil {
+			return false, usageError.Wrap(err, "malformed -config-filter pattern")
+		}
+		if matches {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// selectionFlags are the flags that restrict configured actions to execute.
+type selectionFlags struct {
+	only, skip, rule *string
+}
+
+func addSelectionFlags(fs *commandFlags) selectionFlags {
+	return selectionFlags{
+		only: fs.String("only", "", "comma-separated list of action types to execute, e.g. 'tts,cardsOrganization'"),
+		skip: fs.String("skip", "", "comma-separated list of action types not to execute, e.g. 'noteProcessing'"),
+		rule: fs.String("rule", "", "comma-separated list of names of actions to execute. Actions with no name are skipped if set"),
+	}
+}
+
+func (f selectionFlags) parse() (ankihelper.Selection, error) {
+	only, err := ankihelper.ParseActionTypes(*f.only)
+	if err != nil {
+		return ankihelper.Selection{}, usageError.Wrap(err, "invalid -only flag")
+	}
+	skip, err := ankihelper.ParseActionTypes(*f.skip)
+	if err != nil {
+		return ankihelper.Selection{}, usageError.Wrap(err, "invalid -skip flag")
+	}
+	rules := set.New[string](0)
+	for _, rule := range strings.Split(*f.rule, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			rules[rule] = struct{}{}
+		}
+	}
+	return ankihelper.Selection{Only: only, Skip: skip, Rules: rules}, nil
+}
+
+// ttsBudgets shares text-to-speech budgets between the leaf configs of a run,
+// so that the run limit applies to the whole run rather than to each config.
+type ttsBudgets map[ankihelperconf.AzureBudget]*ttsbudget.Budget
+
+// open returns the budget shared by the configs with the same budget settings.
+// A nil ttsBudgets opens a new budget on every call.
+func (b ttsBudgets) open(conf ankihelperconf.AzureBudget) (*ttsbudget.Budget, error) {
+	if budget, ok := b[conf]; ok {
+		return budget, nil
+	}
+	budget, err := ttsbudget.Open(conf)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		b[conf] = budget
+	}
+	return budget, nil
+}
+
+// newHelper creates the helper for the leaf config. runID identifies the modifications recorded in the journal;
+// it's empty for commands that don't modify notes, so that nothing is recorded.
+// budgets are shared by the configs of the run; they may be nil for commands that don't convert text to speech.
+func newHelper(conf ankihelperconf.Config, runID string, budgets ttsBudgets) (*ankihelper.Helper, error) {
+	azureTTS := azuretts.NewAPI(conf.Azure)
+	ankiConnect := ankiconnect.NewAPI(conf.Anki)
+	scriptRunner := noteprocessing.NewScriptRunner()
+	audioProcessor := audioprocessing.NewProcessor()
+
+	var stateStore statestore.Store
+	if path := conf.State.FilePath; path != "" {
+		store, err := statestore.OpenFile(path)
+		if err != nil {
+			return nil, err
+		}
+		stateStore = store
+	}
+	var changeJournal journal.Journal
+	if path := conf.Journal.FilePath; path != "" && runID != "" {
+		changeJournal = journal.OpenFile(path, runID)
+	}
+	ttsBudget, err := budgets.open(conf.Azure.Budget)
+	if err != nil {
+		return nil, err
+	}
+	var llmAPI llm.API
+	var llmCache llmcache.Cache
+	if conf.LLM != nil {
+		llmAPI = llm.NewAPI(*conf.LLM)
+		if path := conf.LLM.CacheFilePath; path != "" {
+			cache, err := llmcache.OpenFile(path)
+			if err != nil {
+				return nil, err
+			}
+			llmCache = cache
+		}
+	}
+	return ankihelper.NewHelper(
+		ankiConnect, azureTTS, scriptRunner, audioProcessor, stateStore, changeJournal, ttsBudget.Voice(conf.Azure.Voice), llmAPI, llmCache,
+	), nil
+}
+
+// backupBeforeRun makes the backup configured for the leaf config if the selected actions require it.
+func backupBeforeRun(ctx context.Context, conf ankihelperconf.Config, selection ankihelper.Selection) error {
+	backupConf := conf.Anki.Backup
+	if backupConf == nil {
+		return nil
+	}
+	selected := selection.Apply(conf.Actions)
+	required := false
+	for _, actionType := range backupConf.BeforeActions {
+		if ankihelper.CountActions(selected, ankihelper.ActionType(actionType)) > 0 {
+			required = true
+		}
+	}
+	if !required {
+		return nil
+	}
+
+	backuper := backup.NewBackuper(ankiconnect.NewAPI(conf.Anki), *backupConf)
+	if err := backuper.Backup(ctx); err != nil {
+		return errorx.Decorate(err, "backup failed, so no actions are executed")
+	}
+	return nil
+}
+
+func printConfig(conf ankihelperconf.Config) error {
+	return printJSON(conf)
+}
+
+func printJSON(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return errorx.Decorate(err, "failed to print JSON")
+	}
+	return nil
+}
+
+func findConfigFile(path string) (string, error) {
+	if path != "" {
+		slog.Info("Use config path from CLI arguments", "path", path)
+		return path, nil
+	}
+
+	var dirs []string
+	for _, source := range []struct {
+		dirType string
+		getDir  func() (string, error)
+	}{
+		{"current directory", os.Getwd},
+		{"user config directory", os.UserConfigDir},
+		{"user home directory", os.UserHomeDir},
+	} {
+		dir, err := source.getDir()
+		if err != nil {
+			slog.Warn("Failed to get directory", "directory", source.dirType, logx.Err(err))
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+
+	const defaultConfigFileName = "anki-helper.yaml"
+	for _, dir := range dirs {
+		path := filepath.Join(dir, defaultConfigFileName)
+		slog.Debug("Check for config file", "path", path)
+		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+			slog.Info("Use configuration", "path", path)
+			return path, nil
+		}
+	}
+	return "", configError.New("failed to find %s in any of %v, specify the path with -config flag", defaultConfigFileName, dirs)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"anki-rest-enhancer/llmcache"
+	"anki-rest-enhancer/util/lang/set"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func llmInvalidateCommand(_ context.Context, args []string) error {
+	fs := newFlagSet("llm invalidate")
+	configFlags := addConfigFlags(fs)
+	rule := fs.String("rule", "", "comma-separated list of names of llm actions whose cached replies should be removed")
+	all := fs.Bool("all", false, "remove cached replies of all llm actions, including the ones with no name")
+	scriptRule := fs.String("script-rule", "", "comma-separated list of -rule values of the Gemini script whose cached replies should be removed")
+	processingRule := fs.String("processing-rule", "", "comma-separated list of names of note processing actions whose note states should be removed, e.g. the ones running the Gemini script")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	names := parseNames(*rule)
+	scriptNames := parseNames(*scriptRule)
+	processingNames := parseNames(*processingRule)
+	if len(names) == 0 && len(scriptNames) == 0 && len(processingNames) == 0 && !*all {
+		return usageError.New("either -rule, -script-rule, -processing-rule or -all flag is required")
+	}
+	if len(names) > 0 && *all {
+		return usageError.New("-rule and -all flags are mutually exclusive")
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	configs, err := configFlags.leafConfigs(conf)
+	if err != nil {
+		return err
+	}
+	unknown := names.Clone()
+	unknownProcessing := processingNames.Clone()
+	for _, conf := range configs {
+		for _, rule := range conf.Actions.LLM {
+			unknown.Delete(rule.Name)
+		}
+		for _, rule := range conf.Actions.NoteProcessing {
+			unknownProcessing.Delete(rule.Name)
+		}
+	}
+	if unknown.Len() > 0 {
+		unknownNames := unknown.AsSlice()
+		sort.Strings(unknownNames)
+		return usageError.New("there are no llm actions named %v", unknownNames)
+	}
+	if unknownProcessing.Len() > 0 {
+		unknownNames := unknownProcessing.AsSlice()
+		sort.Strings(unknownNames)
+		return usageError.New("there are no note processing actions named %v", unknownNames)
+	}
+
+	for _, conf := range configs {
+		if len(names) > 0 || *all {
+			if len(conf.Actions.LLM) == 0 {
+				continue
+			}
+			helper, err := newHelper(conf, "", nil)
+			if err != nil {
+				return err
+			}
+			replies, notes, err := helper.InvalidateLLM(conf.Actions.LLM, names)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: removed %d cached replies and states of %d notes\n", conf.Path, replies, notes)
+		}
+		if len(scriptNames) > 0 {
+			if conf.LLM == nil || conf.LLM.CacheFilePath == "" {
+				return usageError.New("-script-rule requires cacheFile of the llm section in %s", conf.Path)
+			}
+			cache, err := llmcache.OpenFile(conf.LLM.CacheFilePath)
+			if err != nil {
+				return err
+			}
+			replies := 0
+			for name := range scriptNames {
+				replies += cache.Invalidate(llmcache.ScriptRule(name))
+			}
+			if err := cache.Save(); err != nil {
+				return err
+			}
+			fmt.Printf("%s: removed %d cached replies of scripts\n", conf.Path, replies)
+		}
+		if len(processingNames) > 0 {
+			if conf.State.FilePath == "" {
+				continue
+			}
+			helper, err := newHelper(conf, "", nil)
+			if err != nil {
+				return err
+			}
+			notes, err := helper.InvalidateNoteProcessing(conf.Actions.NoteProcessing, processingNames)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: removed states of %d notes of note processing actions\n", conf.Path, notes)
+		}
+	}
+	return nil
+}
+
+// parseNames parses comma-separated list of names.
+func parseNames(list string) set.Set[string] {
+	names := set.New[string](0)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/ankihelperconf"
+	"context"
+	"path/filepath"
+)
+
+func mediaUploadCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("media upload")
+	configFlags := addConfigFlags(fs)
+	file := fs.String("file", "", "path to the file to upload")
+	name := fs.String("name", "", "name of the file in Anki media collection. Default: base name of the file")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	if *file == "" {
+		return usageError.New("-file flag is required")
+	}
+	ankiName := *name
+	if ankiName == "" {
+		ankiName = filepath.Base(*file)
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	conf, err = configFlags.singleConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	actions := ankihelperconf.Actions{
+		UploadMedia: []ankihelperconf.AnkiUploadMedia{{AnkiName: ankiName, FilePath: *file}},
+	}
+	helper, err := newHelper(conf, "", nil)
+	if err != nil {
+		return err
+	}
+	_, err = helper.RunSelected(ctx, actions, ankihelper.Selection{})
+	return err
+}
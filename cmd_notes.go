@@ -0,0 +1,156 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/notesexport"
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func notesFindCommand(_ context.Context, args []string) error {
+	fs := newFlagSet("notes find")
+	configFlags := addConfigFlags(fs)
+	query := fs.String("query", "", "Anki search query, e.g. 'deck:German Word:_*'")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	if *query == "" {
+		return usageError.New("-query flag is required")
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	conf, err = configFlags.singleConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	noteIDs, err := ankiconnect.NewAPI(conf.Anki).FindNotes(*query)
+	if err != nil {
+		return err
+	}
+	sort.Slice(noteIDs, func(i, j int) bool { return noteIDs[i] < noteIDs[j] })
+	for _, noteID := range noteIDs {
+		fmt.Println(noteID)
+	}
+	return nil
+}
+
+func notesShowCommand(_ context.Context, args []string) error {
+	fs := newFlagSet("notes show")
+	configFlags := addConfigFlags(fs)
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	if fs.NArg() == 0 {
+		return usageError.New("note IDs should be passed as arguments")
+	}
+	var noteIDs []ankiconnect.NoteID
+	for _, arg := range fs.Args() {
+		for _, rawID := range strings.Split(arg, ",") {
+			if rawID = strings.TrimSpace(rawID); rawID == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(rawID, 10, 64)
+			if err != nil {
+				return usageError.Wrap(err, "malformed note ID %q", rawID)
+			}
+			noteIDs = append(noteIDs, ankiconnect.NoteID(id))
+		}
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	conf, err = configFlags.singleConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	notes, err := ankiconnect.NewAPI(conf.Anki).NotesInfo(noteIDs)
+	if err != nil {
+		return err
+	}
+	result := make([]ankiconnect.NoteInfo, 0, len(noteIDs))
+	for _, noteID := range noteIDs {
+		note, ok := notes[noteID]
+		if !ok {
+			return errorx.IllegalArgument.New("note %d is not found", noteID)
+		}
+		result = append(result, note)
+	}
+	return printJSON(result)
+}
+
+func notesExportCommand(ctx context.Context, args []string) (err error) {
+	fs := newFlagSet("notes export")
+	configFlags := addConfigFlags(fs)
+	query := fs.String("query", "", "Anki search query, e.g. 'deck:German'")
+	format := fs.String("format", string(notesexport.FormatJSONL), "output format: jsonl or csv")
+	fields := fs.String("fields", "", "comma-separated list of note fields written to CSV. Default: fields of all the note types")
+	out := fs.String("out", "", "path to the file to write notes to. Default: standard output")
+	batchSize := fs.Int("batch-size", notesexport.DefaultBatchSize, "number of notes requested from AnkiConnect at once")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	if *query == "" {
+		return usageError.New("-query flag is required")
+	}
+	if !slices.Contains(notesexport.Formats, notesexport.Format(*format)) {
+		return usageError.New("unknown format %q, expected one of %v", *format, notesexport.Formats)
+	}
+	if *batchSize <= 0 {
+		return usageError.New("-batch-size should be positive")
+	}
+	opts := notesexport.Options{Query: *query, Format: notesexport.Format(*format), BatchSize: *batchSize}
+	for _, field := range strings.Split(*fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			opts.Fields = append(opts.Fields, field)
+		}
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	conf, err = configFlags.singleConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return errorx.ExternalError.Wrap(err, "failed to create %s", *out)
+		}
+		defer func() {
+			if closeErr := file.Close(); closeErr != nil && err == nil {
+				err = errorx.ExternalError.Wrap(closeErr, "failed to write notes to %s", *out)
+			}
+		}()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	exported, err := notesexport.Export(ctx, ankiconnect.NewAPI(conf.Anki), buffered, opts)
+	if flushErr := buffered.Flush(); err == nil && flushErr != nil {
+		err = errorx.ExternalError.Wrap(flushErr, "failed to write notes")
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("Notes are exported", "notes", exported, "format", *format)
+	return nil
+}
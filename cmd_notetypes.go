@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+func noteTypesDiffCommand(_ context.Context, args []string) error {
+	fs := newFlagSet("note-types diff")
+	configFlags := addConfigFlags(fs)
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	configs, err := configFlags.leafConfigs(conf)
+	if err != nil {
+		return err
+	}
+	for _, conf := range configs {
+		if len(conf.Actions.NoteTypes) == 0 {
+			continue
+		}
+		helper, err := newHelper(conf, "", nil)
+		if err != nil {
+			return err
+		}
+		diffs, err := helper.DiffNoteTypes(conf.Actions.NoteTypes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Config file %s:\n", conf.Path)
+		for _, diff := range diffs {
+			fmt.Printf("  %s\n", diff)
+		}
+	}
+	return nil
+}
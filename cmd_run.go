@@ -0,0 +1,245 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/lang/mapx"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+func runCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("run")
+	configFlags := addConfigFlags(fs)
+	selectionFlags := addSelectionFlags(fs)
+	noOp := fs.Bool("noop", false, "if this flag is set to true, tool exits after the config is loaded (and optionally printed)")
+	reportPath := fs.String("report", "", "path to the JSON file to write the run report to")
+	maxFailureRatio := fs.Float64("max-failure-ratio", 0, "maximal ratio of failed items (e.g. notes) at which the run is considered successful")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	if *maxFailureRatio < 0 || *maxFailureRatio > 1 {
+		return usageError.New("-max-failure-ratio should be between 0 and 1, got %v", *maxFailureRatio)
+	}
+
+	selection, err := selectionFlags.parse()
+	if err != nil {
+		return err
+	}
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	if *noOp {
+		return nil
+	}
+
+	configs, err := configFlags.leafConfigs(conf)
+	if err != nil {
+		return err
+	}
+	report := newRunReport(journal.NewRunID())
+	slog.Info("Start run", logx.KeyRunID, report.RunID)
+	err = runConfigs(ctx, &report, configs, selection)
+	for _, usage := range report.ttsUsage() {
+		slog.Info("Text-to-speech usage", "voice", usage.Voice, "characters", usage.Characters, "estimatedCost", usage.EstimatedCost)
+	}
+	if err == nil {
+		err = report.checkFailures(*maxFailureRatio)
+	}
+	if *reportPath != "" {
+		if writeErr := report.write(*reportPath, err); writeErr != nil {
+			if err != nil {
+				// the run error is returned as is to preserve the exit code
+				slog.Error("Failed to write run report", logx.Err(writeErr))
+				return err
+			}
+			return writeErr
+		}
+	}
+	return err
+}
+
+func runConfigs(ctx context.Context, report *runReport, configs []ankihelperconf.Config, selection ankihelper.Selection) error {
+	budgets := make(ttsBudgets)
+	for _, conf := range configs {
+		ctx := logx.With(ctx, logx.KeyConfig, conf.Path)
+		logx.FromContext(ctx).Info("Running config file")
+		if err := backupBeforeRun(ctx, conf, selection); err != nil {
+			return err
+		}
+		helper, err := newHelper(conf, report.RunID, budgets)
+		if err != nil {
+			return err
+		}
+		configReport, err := helper.RunSelected(ctx, conf.Actions, selection)
+		report.Configs = append(report.Configs, runConfigReport{
+			Path:     conf.Path,
+			Actions:  configReport.Actions,
+			TTSUsage: configReport.TTSUsage,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCommand(_ context.Context, args []string) error {
+	fs := newFlagSet("validate")
+	configFlags := addConfigFlags(fs)
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	configs, err := configFlags.leafConfigs(conf)
+	if err != nil {
+		return err
+	}
+	for _, conf := range configs {
+		fmt.Printf("%s: OK\n", conf.Path)
+	}
+	return nil
+}
+
+func planCommand(_ context.Context, args []string) error {
+	fs := newFlagSet("plan")
+	configFlags := addConfigFlags(fs)
+	selectionFlags := addSelectionFlags(fs)
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	selection, err := selectionFlags.parse()
+	if err != nil {
+		return err
+	}
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	configs, err := configFlags.leafConfigs(conf)
+	if err != nil {
+		return err
+	}
+	for _, conf := range configs {
+		helper, err := newHelper(conf, "", nil)
+		if err != nil {
+			return err
+		}
+		plan, err := helper.Plan(conf.Actions, selection)
+		if err != nil {
+			return err
+		}
+		printPlan(conf.Path, plan)
+	}
+	return nil
+}
+
+func printPlan(configPath string, plan ankihelper.Plan) {
+	fmt.Printf("Config file %s:\n", configPath)
+	for _, media := range plan.UploadMedia {
+		fmt.Printf("  uploadMedia %s: upload %s as %s\n", media.Rule, media.FilePath, media.AnkiName)
+	}
+	for _, noteType := range plan.NoteTypes {
+		if noteType.Exists {
+			fmt.Printf("  noteTypes %q: already exists\n", noteType.Name)
+		} else {
+			fmt.Printf("  noteTypes %q: create\n", noteType.Name)
+		}
+	}
+	for _, deck := range plan.Decks {
+		if deck.Exists {
+			fmt.Printf("  decks %q: already exists", deck.Name)
+		} else {
+			fmt.Printf("  decks %q: create", deck.Name)
+		}
+		switch {
+		case deck.AssignPreset:
+			fmt.Printf(", assign preset %q", deck.Preset)
+		case deck.UpdateOptions:
+			fmt.Printf(", update options of preset %q", deck.Preset)
+		}
+		fmt.Println()
+	}
+	for _, imp := range plan.Import {
+		fmt.Printf("  import %s: create %d notes, update %d notes from %s", imp.Rule, imp.New, imp.Updated, imp.FilePath)
+		if imp.UpToDate > 0 {
+			fmt.Printf(", skip %d up-to-date notes", imp.UpToDate)
+		}
+		if imp.Failures > 0 {
+			fmt.Printf(", %d rows would fail", imp.Failures)
+		}
+		fmt.Println()
+	}
+	for _, rule := range plan.Dedupe {
+		fmt.Printf("  dedupe %s: merge %d groups of duplicate notes\n", rule.Rule, len(rule.Groups))
+		for _, group := range rule.Groups {
+			fmt.Printf("    %s %q: keep %d, delete %v", group.NoteType, group.Key, group.Keep, group.Delete)
+			if len(group.Fields) > 0 {
+				fields := mapx.Keys(group.Fields)
+				sort.Strings(fields)
+				fmt.Printf(", copy fields %v", fields)
+			}
+			if len(group.Tags) > 0 {
+				fmt.Printf(", add tags %v", group.Tags)
+			}
+			fmt.Println()
+		}
+	}
+	for _, rule := range plan.NoteProcessing {
+		fmt.Printf("  noteProcessing %s: process %d notes matching %q", rule.Rule, rule.Notes, rule.NoteFilter)
+		if rule.UpToDate > 0 {
+			fmt.Printf(", skip %d up-to-date notes", rule.UpToDate)
+		}
+		fmt.Println()
+	}
+	for _, rule := range plan.LLM {
+		fmt.Printf("  llm %s: generate fields with %s for %d notes matching %q", rule.Rule, rule.Model, rule.Notes, rule.NoteFilter)
+		if rule.Cached > 0 {
+			fmt.Printf(" (%d from cache)", rule.Cached)
+		}
+		if rule.UpToDate > 0 {
+			fmt.Printf(", skip %d up-to-date notes", rule.UpToDate)
+		}
+		fmt.Println()
+	}
+	for _, tts := range plan.TTS {
+		fmt.Printf("  tts %s: generate %s -> %s for %d notes matching %q (%d characters)\n",
+			tts.Rule, tts.TextField, tts.AudioField, tts.Notes, tts.NoteFilter, tts.Characters)
+	}
+	for _, rule := range plan.CardsOrganization {
+		fmt.Printf("  cardsOrganization %s: move %d cards to deck %q\n", rule.Rule, rule.Cards, rule.TargetDeck)
+	}
+	for _, conflict := range plan.OrganizationConflicts {
+		fmt.Printf("  cardsOrganization conflict: %s\n", conflict)
+	}
+	for _, rule := range plan.CardsState {
+		if rule.Operation == ankihelperconf.CardsUnlock {
+			fmt.Printf("  cardsState %s: unlock: suspend %d cards, unsuspend %d cards", rule.Rule, rule.Cards, rule.Unsuspended)
+		} else {
+			fmt.Printf("  cardsState %s: %s %d cards", rule.Rule, rule.Operation, rule.Cards)
+		}
+		if rule.Failures > 0 {
+			fmt.Printf(", %d cards would fail", rule.Failures)
+		}
+		fmt.Println()
+	}
+}
+
+// ignoreHelp makes a command succeed if help is requested.
+func ignoreHelp(err error) error {
+	if errors.Is(err, errHelp) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/schedule"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+func serveCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("serve")
+	configFlags := addConfigFlags(fs)
+	selectionFlags := addSelectionFlags(fs)
+	interval := fs.Duration("interval", 0, "interval between runs. Default: 15m unless -cron is set")
+	cronExpr := fs.String("cron", "", "cron expression defining when to run, e.g. '*/30 * * * *'")
+	fullRunInterval := fs.Duration("full-run-interval", 24*time.Hour, "how often to process all the notes rather than the ones changed since the previous run")
+	listenAddr := fs.String("listen", "", "address to serve /metrics and /status HTTP endpoints on, e.g. localhost:9090. Disabled by default")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+
+	var sched schedule.Schedule
+	switch {
+	case *interval != 0 && *cronExpr != "":
+		return usageError.New("-interval and -cron flags are mutually exclusive")
+	case *cronExpr != "":
+		parsed, err := schedule.ParseCron(*cronExpr)
+		if err != nil {
+			return usageError.Wrap(err, "invalid -cron flag")
+		}
+		sched = parsed
+	case *interval < 0:
+		return usageError.New("-interval should be positive")
+	case *interval == 0:
+		sched = schedule.Every(15 * time.Minute)
+	default:
+		sched = schedule.Every(*interval)
+	}
+
+	selection, err := selectionFlags.parse()
+	if err != nil {
+		return err
+	}
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+
+	s := server{
+		configFlags:     configFlags,
+		selection:       selection,
+		fullRunInterval: *fullRunInterval,
+		lastRuns:        make(map[string]time.Time),
+		ownChanges:      make(map[string]ankihelper.OwnChanges),
+	}
+	s.status.update(func(status *serverStatus) { status.StartedAt = time.Now() })
+	s.setConfig(conf)
+	if *listenAddr != "" {
+		if err := startHTTPServer(ctx, *listenAddr, &s.status); err != nil {
+			return err
+		}
+	}
+	for {
+		s.reloadConfigIfChanged()
+		s.runOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			return usageError.New("schedule has no more runs")
+		}
+		s.status.update(func(status *serverStatus) { status.NextRunAt = &next })
+		slog.Info("Wait for the next run", "at", next)
+		select {
+		case <-ctx.Done():
+			slog.Info("Stop serving")
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// server executes the configured actions repeatedly.
+// Between full runs, only notes changed since the previous run of the config are processed.
+type server struct {
+	configFlags     configFlags
+	selection       ankihelper.Selection
+	fullRunInterval time.Duration
+
+	conf ankihelperconf.Config
+	// configModTimes are modification times of the config files at the moment they were loaded.
+	configModTimes map[string]time.Time
+
+	lastFullRun time.Time
+	// lastRuns are the start times of the last successful runs of leaf configs by their paths.
+	lastRuns map[string]time.Time
+	// ownChanges are the notes modified by the last runs of leaf configs by their paths,
+	// so that the following delta runs don't process them again.
+	ownChanges map[string]ankihelper.OwnChanges
+
+	status statusTracker
+}
+
+func (s *server) setConfig(conf ankihelperconf.Config) {
+	s.conf = conf
+	s.configModTimes = configModTimes(conf)
+	// the configured filters may have changed, so all the notes should be processed
+	s.lastFullRun = time.Time{}
+}
+
+func (s *server) reloadConfigIfChanged() {
+	changed := false
+	for path, modTime := range s.configModTimes {
+		if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(modTime) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+
+	slog.Info("Config files changed, reload")
+	conf, err := s.configFlags.load()
+	if err != nil {
+		slog.Error("Failed to reload config, keep using the previous one", logx.Err(err))
+		// don't try to reload the same broken config on every run
+		for path := range s.configModTimes {
+			if info, err := os.Stat(path); err == nil {
+				s.configModTimes[path] = info.ModTime()
+			}
+		}
+		return
+	}
+	s.setConfig(conf)
+}
+
+func (s *server) runOnce(ctx context.Context) {
+	configs, err := s.configFlags.leafConfigs(s.conf)
+	if err != nil {
+		slog.Error("Failed to select configs", logx.Err(err))
+		return
+	}
+
+	start := time.Now()
+	fullRun := start.Sub(s.lastFullRun) >= s.fullRunInterval
+	runID := journal.NewRunID()
+	ctx = logx.With(ctx, logx.KeyRunID, runID)
+	s.status.update(func(status *serverStatus) {
+		status.Running = true
+		status.NextRunAt = nil
+	})
+	succeeded := true
+	budgets := make(ttsBudgets)
+	for _, conf := range configs {
+		if !s.runConfig(ctx, conf, runID, budgets, fullRun, start) {
+			succeeded = false
+		}
+	}
+	if fullRun && succeeded {
+		s.lastFullRun = start
+	}
+
+	if succeeded {
+		serveRunsTotal.Inc("success")
+	} else {
+		serveRunsTotal.Inc("failure")
+	}
+	s.status.update(func(status *serverStatus) {
+		status.Running = false
+		status.LastRun = &runStatus{
+			RunID:      runID,
+			StartedAt:  start,
+			FinishedAt: time.Now(),
+			FullRun:    fullRun,
+			Succeeded:  succeeded,
+		}
+	})
+}
+
+// runConfig runs actions of the leaf config and reports whether the run succeeded.
+func (s *server) runConfig(ctx context.Context, conf ankihelperconf.Config, runID string, budgets ttsBudgets, fullRun bool, start time.Time) bool {
+	ctx = logx.With(ctx, logx.KeyConfig, conf.Path)
+	logger := logx.FromContext(ctx)
+	helper, err := newHelper(conf, runID, budgets)
+	if err != nil {
+		logger.Error("Failed to initialize", logx.Err(err))
+		return false
+	}
+
+	selection := s.selection
+	lastRun, ok := s.lastRuns[conf.Path]
+	if !fullRun && ok {
+		changed, err := helper.ChangedNotes(lastRun, start, s.ownChanges[conf.Path])
+		if err != nil {
+			logger.Error("Failed to find changed notes", logx.Err(err))
+			return false
+		}
+		// reviews don't modify notes, but they affect cards organization and state, e.g. unlocking of siblings
+		reviewed, err := helper.ReviewedNotes(lastRun, start)
+		if err != nil {
+			logger.Error("Failed to find reviewed notes", logx.Err(err))
+			return false
+		}
+		if len(changed) == 0 && len(reviewed) == 0 {
+			logger.Info("No notes changed or reviewed since the previous run")
+			s.lastRuns[conf.Path] = start
+			return true
+		}
+		logger.Info("Process notes changed or reviewed since the previous run",
+			"changed", len(changed), "reviewed", len(reviewed), "since", lastRun)
+		// media, note types, decks and imports don't depend on notes, and duplicates are found among all the notes,
+		// so they are only handled by full runs
+		selection.Skip = selection.Skip.Clone()
+		selection.Skip[ankihelper.ActionUploadMedia] = struct{}{}
+		selection.Skip[ankihelper.ActionNoteTypes] = struct{}{}
+		selection.Skip[ankihelper.ActionDecks] = struct{}{}
+		selection.Skip[ankihelper.ActionImport] = struct{}{}
+		selection.Skip[ankihelper.ActionDedupe] = struct{}{}
+		if len(changed) > 0 {
+			selection.NoteQuery = ankihelper.NoteIDsQuery(changed)
+		} else {
+			// only cards of reviewed notes should be handled
+			selection.Skip[ankihelper.ActionNoteProcessing] = struct{}{}
+			selection.Skip[ankihelper.ActionLLM] = struct{}{}
+			selection.Skip[ankihelper.ActionTTS] = struct{}{}
+		}
+		selection.CardsNoteQuery = ankihelper.NoteIDsQuery(append(slices.Clone(changed), reviewed...))
+	} else {
+		logger.Info("Process all the notes")
+	}
+
+	if err := backupBeforeRun(ctx, conf, selection); err != nil {
+		logger.Error("Run skipped", logx.Err(err))
+		return false
+	}
+	report, err := helper.RunSelected(ctx, conf.Actions, selection)
+	if err != nil {
+		logger.Error("Run failed", logx.Err(err))
+		return false
+	}
+	logger.Info("Run completed", "succeeded", report.Succeeded(), "failed", report.Failed())
+	s.lastRuns[conf.Path] = start
+	s.ownChanges[conf.Path] = ankihelper.OwnChanges{NoteIDs: report.TouchedNoteIDs(), FinishedAt: time.Now()}
+	return true
+}
+
+// configModTimes returns modification times of the config file and all the nested ones.
+func configModTimes(conf ankihelperconf.Config) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	var collect func(conf ankihelperconf.Config)
+	collect = func(conf ankihelperconf.Config) {
+		if conf.Path != "" {
+			if info, err := os.Stat(conf.Path); err == nil {
+				modTimes[conf.Path] = info.ModTime()
+			}
+		}
+		for _, nested := range conf.RunConfigs {
+			collect(nested)
+		}
+	}
+	collect(conf)
+	return modTimes
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"anki-rest-enhancer/azuretts"
+	"context"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"os"
+)
+
+func ttsSayCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("tts say")
+	configFlags := addConfigFlags(fs)
+	text := fs.String("text", "", "text to convert to speech")
+	out := fs.String("out", "", "path to the file to write audio to. Its format is defined by azure.outputFormat")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	if *text == "" {
+		return usageError.New("-text flag is required")
+	}
+	if *out == "" {
+		return usageError.New("-out flag is required")
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	conf, err = configFlags.singleConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	var result *azuretts.TextToSpeechResult
+	texts := map[string]struct{}{*text: {}}
+	err = azuretts.NewAPI(conf.Azure).TextToSpeech(ctx, texts, func(_ string, r azuretts.TextToSpeechResult) {
+		result = &r
+	})
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return errorx.IllegalState.New("no text-to-speech result is reported")
+	}
+	if result.Error != nil {
+		return errorx.Decorate(result.Error, "text-to-speech failed")
+	}
+
+	if err := os.WriteFile(*out, result.Audio, 0o644); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to write audio to %s", *out)
+	}
+	slog.Info("Audio is written", "path", *out, "format", result.Format)
+	return nil
+}
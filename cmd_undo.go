@@ -0,0 +1,121 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/journal"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"fmt"
+	"time"
+)
+
+func undoCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("undo")
+	configFlags := addConfigFlags(fs)
+	force := fs.Bool("force", false, "revert fields and cards even if they were modified after the run")
+	list := fs.Bool("list", false, "list runs recorded in the journal instead of reverting a run")
+	if err := fs.parse(args); err != nil {
+		return ignoreHelp(err)
+	}
+	var runID string
+	switch {
+	case *list && fs.NArg() > 0:
+		return usageError.New("run ID should not be specified with -list flag")
+	case !*list && fs.NArg() != 1:
+		return usageError.New("expected a single run ID, e.g. 'undo 20240315-101742-3fa2'")
+	case !*list:
+		runID = fs.Arg(0)
+	}
+
+	conf, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	configs, err := configFlags.leafConfigs(conf)
+	if err != nil {
+		return err
+	}
+
+	var total ankihelper.UndoResult
+	journals := make(map[string]struct{})
+	found := false
+	for _, conf := range configs {
+		path := conf.Journal.FilePath
+		if path == "" {
+			continue
+		}
+		// several configs may share the journal, but each run should only be reverted once
+		if _, ok := journals[path]; ok {
+			continue
+		}
+		journals[path] = struct{}{}
+
+		entries, err := journal.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if *list {
+			printJournalRuns(path, entries)
+			continue
+		}
+		runEntries := journal.RunEntries(entries, runID)
+		if len(runEntries) == 0 {
+			continue
+		}
+		found = true
+
+		ctx := logx.With(ctx, logx.KeyConfig, conf.Path)
+		helper, err := newHelper(conf, "", nil)
+		if err != nil {
+			return err
+		}
+		logx.FromContext(ctx).Info("Revert changes of the run", logx.KeyRunID, runID, "changes", len(runEntries))
+		result := helper.Undo(ctx, runEntries, *force)
+		logx.FromContext(ctx).Info("Reverted changes of the run",
+			"reverted", result.Reverted, "conflicts", result.Conflicts, "failed", result.Failed)
+		total.Reverted += result.Reverted
+		total.Conflicts += result.Conflicts
+		total.Failed += result.Failed
+	}
+
+	switch {
+	case len(journals) == 0:
+		return configError.New("no journal file is configured, see 'journal' config section")
+	case *list:
+		return nil
+	case !found:
+		return usageError.New("run %s is not found in the journal", runID)
+	case total.Conflicts > 0 || total.Failed > 0:
+		return partialFailureError.New(
+			"%d changes were not reverted because of later modifications and %d failed; "+
+				"see the log for details and use -force to overwrite later modifications",
+			total.Conflicts, total.Failed,
+		)
+	}
+	return nil
+}
+
+// printJournalRuns prints the runs recorded in the journal in the order they were started.
+func printJournalRuns(path string, entries []journal.Entry) {
+	type run struct {
+		ID        string
+		StartedAt time.Time
+		Changes   int
+	}
+	var runs []*run
+	runsByID := make(map[string]*run)
+	for _, entry := range entries {
+		r, ok := runsByID[entry.RunID]
+		if !ok {
+			r = &run{ID: entry.RunID, StartedAt: entry.Time}
+			runsByID[entry.RunID] = r
+			runs = append(runs, r)
+		}
+		r.Changes++
+	}
+
+	fmt.Printf("Journal %s:\n", path)
+	for _, r := range runs {
+		fmt.Printf("  %s  %s  %d changes\n", r.ID, r.StartedAt.Local().Format(time.DateTime), r.Changes)
+	}
+}
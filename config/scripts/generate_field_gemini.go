@@ -1,6 +1,8 @@
 package main
 
 import (
+	"anki-rest-enhancer/llm"
+	"anki-rest-enhancer/llmcache"
 	"anki-rest-enhancer/noteprocessing"
 	"anki-rest-enhancer/util/iox"
 	"anki-rest-enhancer/util/lang"
@@ -13,6 +15,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 type Params struct {
@@ -21,6 +24,11 @@ type Params struct {
 	Field      string
 	Prompt     string
 	Tag        string
+
+	CacheFile       string
+	Rule            string
+	ProvenanceField string
+	ProvenanceTag   string
 }
 
 func mustParseArgs() Params {
@@ -31,6 +39,10 @@ func mustParseArgs() Params {
 	fs.StringVar(&params.Field, "field", "", "name of the target note field that should be set")
 	fs.StringVar(&params.Prompt, "prompt", "", "text that should be sent to Gemini to generate the field")
 	fs.StringVar(&params.Tag, "add-tag", "", "optional tag ")
+	fs.StringVar(&params.CacheFile, "cache-file", "", "optional path to the JSON file caching generated content by the model and the prompt")
+	fs.StringVar(&params.Rule, "rule", "", "name identifying cached content, so that it could be invalidated with -script-rule of llm invalidate command. Default: the target field")
+	fs.StringVar(&params.ProvenanceField, "provenance-field", "", "optional note field to store the model and the cache key in")
+	fs.StringVar(&params.ProvenanceTag, "provenance-tag", "", "optional prefix of the tag to store the model and the cache key in, e.g. llm")
 	_ = fs.Parse(os.Args[1:]) // ignore error as it's never returned due to ExitOnError setting
 
 	if params.APIKeyFile == "" {
@@ -42,6 +54,9 @@ func mustParseArgs() Params {
 	if params.Prompt == "" {
 		log.Fatalf("Prompt must be provided")
 	}
+	if params.Rule == "" {
+		params.Rule = params.Field
+	}
 	return params
 }
 
@@ -60,33 +75,76 @@ func main() {
 }
 
 func doMain(ctx context.Context, params Params) ([]noteprocessing.Modification, error) {
+	// the script is started for each note, so the cache is loaded on each run and saved after each generation.
+	// Thus, the cache I/O grows quadratically with the number of notes; llm actions don't have this limitation.
+	var cache llmcache.Cache
+	if params.CacheFile != "" {
+		var err error
+		if cache, err = llmcache.OpenFile(params.CacheFile); err != nil {
+			return nil, err
+		}
+	}
+	key := llmcache.Key(llm.Request{Model: params.ModelID, Prompt: params.Prompt})
+
+	var generatedContent string
+	if entry, ok := cachedEntry(cache, key); ok {
+		generatedContent = entry.Reply
+	} else {
+		generated, err := generateContent(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		generatedContent = generated
+		if cache != nil {
+			cache.Put(llmcache.Entry{Key: key, Rule: llmcache.ScriptRule(params.Rule), Model: params.ModelID, Reply: generated, CreatedAt: time.Now()})
+			if err := cache.Save(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fields := map[string]string{
+		params.Field: strings.TrimSpace(generatedContent),
+	}
+	if params.ProvenanceField != "" {
+		fields[params.ProvenanceField] = llmcache.ProvenanceValue(params.ModelID, key)
+	}
+	modifications := []noteprocessing.Modification{{SetField: lang.New(fields)}}
+	if params.Tag != "" {
+		modifications = append(modifications, noteprocessing.Modification{
+			AddTag: lang.New(params.Tag),
+		})
+	}
+	if params.ProvenanceTag != "" {
+		modifications = append(modifications, noteprocessing.Modification{
+			AddTag: lang.New(llmcache.ProvenanceTag(params.ProvenanceTag, params.ModelID, key)),
+		})
+	}
+	return modifications, nil
+}
+
+func cachedEntry(cache llmcache.Cache, key string) (llmcache.Entry, bool) {
+	if cache == nil {
+		return llmcache.Entry{}, false
+	}
+	return cache.Entry(key)
+}
+
+func generateContent(ctx context.Context, params Params) (string, error) {
 	apiKey, err := os.ReadFile(params.APIKeyFile)
 	if err != nil {
-		return nil, errorx.ExternalError.New("failed to read API key file %q: %+v", params.APIKeyFile, err)
+		return "", errorx.ExternalError.New("failed to read API key file %q: %+v", params.APIKeyFile, err)
 	}
 	client, err := genai.NewClient(ctx, option.WithAPIKey(string(apiKey)))
 	if err != nil {
-		return nil, errorx.ExternalError.Wrap(err, "failed to construct a Gemini client")
+		return "", errorx.ExternalError.Wrap(err, "failed to construct a Gemini client")
 	}
 	defer iox.Close(client)
 	model := client.GenerativeModel(params.ModelID)
 
 	content, err := model.GenerateContent(ctx, genai.Text(params.Prompt))
 	if err != nil {
-		return nil, errorx.ExternalError.Wrap(err, "content generation failed")
+		return "", errorx.ExternalError.Wrap(err, "content generation failed")
 	}
-
-	var modifications []noteprocessing.Modification
-	generatedContent := string(content.Candidates[0].Content.Parts[0].(genai.Text))
-	modifications = append(modifications, noteprocessing.Modification{
-		SetField: lang.New(map[string]string{
-			params.Field: strings.TrimSpace(generatedContent),
-		}),
-	})
-	if params.Tag != "" {
-		modifications = append(modifications, noteprocessing.Modification{
-			AddTag: lang.New(params.Tag),
-		})
-	}
-	return modifications, nil
+	return string(content.Candidates[0].Content.Parts[0].(genai.Text)), nil
 }
@@ -0,0 +1,101 @@
+package journal
+
+import (
+	"anki-rest-enhancer/util/iox"
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewRunID returns a new identifier of a run, e.g. 20240315-101742-3fa2.
+// Identifiers start with the run start time, so that they are easy to find and sort.
+func NewRunID() string {
+	suffix := make([]byte, 2)
+	_, _ = rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// OpenFile returns the journal appending entries of the run to the JSON lines file.
+// The file is created on the first recorded entry.
+func OpenFile(path string, runID string) Journal {
+	return &fileJournal{path: path, runID: runID}
+}
+
+type fileJournal struct {
+	path  string
+	runID string
+
+	mu sync.Mutex
+}
+
+func (j *fileJournal) Record(entry Entry) error {
+	entry.RunID = j.runID
+	entry.Time = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errorx.IllegalState.Wrap(err, "failed to serialize journal entry")
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// the file is reopened for each entry, so that no file is kept open between runs of a long-living process
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to open journal file %s", j.path)
+	}
+	defer iox.Close(file)
+	// entries are written with a single call, so that concurrent runs don't interleave them
+	if _, err := file.Write(line); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to write to journal file %s", j.path)
+	}
+	return nil
+}
+
+// ReadFile reads all the entries of the journal file. A missing file is treated as an empty journal.
+func ReadFile(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to open journal file %s", path)
+	}
+	defer iox.Close(file)
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	// entries of notes with long fields may exceed the default limit
+	scanner.Buffer(nil, 64*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errorx.IllegalFormat.Wrap(err, "malformed entry at line %d of journal file %s", lineNo, path)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to read journal file %s", path)
+	}
+	return entries, nil
+}
+
+// RunEntries returns the entries recorded by the run in the order they were recorded.
+func RunEntries(entries []Entry, runID string) []Entry {
+	var result []Entry
+	for _, entry := range entries {
+		if entry.RunID == runID {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package journal
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileJournal_RecordAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	entries, err := ReadFile(path)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	first := OpenFile(path, "run-1")
+	require.NoError(t, first.Record(Entry{
+		Action: "noteProcessing",
+		Rule:   "#0",
+		NoteID: 1,
+		Fields: map[string]FieldChange{"Gender": {Previous: "feminine", Value: "f"}},
+	}))
+	second := OpenFile(path, "run-2")
+	require.NoError(t, second.Record(Entry{
+		Action:        "cardsOrganization",
+		Rule:          "#0",
+		Deck:          "German",
+		PreviousDecks: map[ankiconnect.CardID]string{10: "Default"},
+	}))
+	require.NoError(t, first.Record(Entry{Action: "noteProcessing", Rule: "#0", NoteID: 2, AddedTags: []string{"processed"}}))
+
+	entries, err = ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	runEntries := RunEntries(entries, "run-1")
+	require.Len(t, runEntries, 2)
+	require.Equal(t, ankiconnect.NoteID(1), runEntries[0].NoteID)
+	require.Equal(t, "f", runEntries[0].Fields["Gender"].Value)
+	require.Equal(t, "feminine", runEntries[0].Fields["Gender"].Previous)
+	require.False(t, runEntries[0].Time.IsZero())
+	require.Equal(t, []string{"processed"}, runEntries[1].AddedTags)
+
+	runEntries = RunEntries(entries, "run-2")
+	require.Len(t, runEntries, 1)
+	require.Equal(t, map[ankiconnect.CardID]string{10: "Default"}, runEntries[0].PreviousDecks)
+}
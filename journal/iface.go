@@ -0,0 +1,51 @@
+package journal
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"time"
+)
+
+// Journal records modifications applied to Anki, so that they could be reverted later.
+type Journal interface {
+	// Record appends the entry to the journal. RunID and Time of the entry are set by the journal.
+	Record(entry Entry) error
+}
+
+// Entry describes a single modification of a note or a group of cards.
+type Entry struct {
+	// RunID identifies the run that applied the modification.
+	RunID string    `json:"runId"`
+	Time  time.Time `json:"time"`
+	// Action and Rule identify the configured action that applied the modification.
+	Action string `json:"action"`
+	Rule   string `json:"rule"`
+
+	// NoteID is set for modifications of note fields and tags.
+	NoteID ankiconnect.NoteID `json:"noteId,omitempty"`
+	// Fields lists modified fields of the note by their names.
+	Fields map[string]FieldChange `json:"fields,omitempty"`
+	// AddedTags lists tags added to the note. Tags the note already had are not listed.
+	AddedTags []string `json:"addedTags,omitempty"`
+	// DeletedNotes maps the notes deleted by merging them into the note to their fields.
+	// They can't be restored by undo, but may be recreated manually.
+	DeletedNotes map[ankiconnect.NoteID]map[string]string `json:"deletedNotes,omitempty"`
+
+	// Deck is the deck the cards listed in PreviousDecks were moved to.
+	Deck string `json:"deck,omitempty"`
+	// PreviousDecks maps moved cards to the decks they were moved from.
+	PreviousDecks map[ankiconnect.CardID]string `json:"previousDecks,omitempty"`
+
+	// Cards lists the cards whose scheduling was changed, e.g. suspended or forgotten.
+	Cards map[ankiconnect.CardID]CardChange `json:"cards,omitempty"`
+}
+
+type CardChange struct {
+	Previous ankiconnect.CardScheduling `json:"previous"`
+	Value    ankiconnect.CardScheduling `json:"value"`
+}
+
+type FieldChange struct {
+	Previous string `json:"previous"`
+	// Value is the value written to the field, e.g. the [sound:...] reference to generated audio.
+	Value string `json:"value"`
+}
@@ -0,0 +1,119 @@
+package llm
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/ratelimit"
+	"anki-rest-enhancer/util/httputil"
+	"anki-rest-enhancer/util/logx"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/joomcode/errorx"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+func NewAPI(conf ankihelperconf.LLM) *api {
+	client := &http.Client{
+		Timeout: conf.RequestTimeout,
+	}
+	limiter := ratelimit.NewLimiter(conf.MaxRequestsPerSecond, conf.Burst)
+	client.Transport = httputil.NewRateLimitingTransport(http.DefaultTransport, limiter)
+	if conf.LogRequests {
+		client.Transport = httputil.NewLoggingRoundTripper(client.Transport, conf.RequestLog)
+	}
+
+	return &api{client: client, conf: conf}
+}
+
+type api struct {
+	client *http.Client
+	conf   ankihelperconf.LLM
+}
+
+var _ API = (*api)(nil)
+
+// retryDelay is multiplied by the attempt number to wait before a request rejected with Too Many Requests is retried.
+const retryDelay = time.Second
+
+func (api api) Generate(ctx context.Context, req Request) (string, error) {
+	if req.Model == "" {
+		req.Model = api.conf.Model
+	}
+	var reply string
+	var err error
+	for attempt := 1; attempt <= api.conf.MaxRetries; attempt++ {
+		reply, err = api.doGenerate(ctx, req)
+		if err == nil || !errorx.IsOfType(err, TooManyRequests) || attempt == api.conf.MaxRetries {
+			break
+		}
+		logx.FromContext(ctx).Warn("Got Too Many Requests from the language model API, retry...", "attempt", attempt)
+		select {
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	return reply, err
+}
+
+func (api api) doGenerate(ctx context.Context, req Request) (_ string, err error) {
+	start := time.Now()
+	defer func() { observeRequest(req.Model, start, err) }()
+
+	var call providerCall
+	switch api.conf.Provider {
+	case ankihelperconf.LLMOpenAI:
+		call = openAICall(api.conf, req)
+	case ankihelperconf.LLMGemini:
+		call = geminiCall(api.conf, req)
+	case ankihelperconf.LLMOllama:
+		call = ollamaCall(api.conf, req)
+	default:
+		panic(errorx.Panic(errorx.IllegalState.New("unexpected provider %q", api.conf.Provider)))
+	}
+
+	body, err := json.Marshal(call.body)
+	if err != nil {
+		return "", errorx.IllegalState.Wrap(err, "failed to construct request body")
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, call.url, bytes.NewReader(body))
+	if err != nil {
+		return "", errorx.IllegalState.Wrap(err, "failed to construct request")
+	}
+	httpReq.Header = call.header
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := api.client.Do(httpReq)
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return "", errorx.TimeoutElapsed.Wrap(err, "language model request timed out")
+		}
+		return "", errorx.ExternalError.Wrap(err, "language model request failed")
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return "", TooManyRequests.NewWithNoMessage()
+		}
+		const maxBodySize = 1000
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+		body := string(bodyBytes)
+		if len(body) == maxBodySize {
+			body += "..."
+		}
+		return "", errorx.ExternalError.New("language model API returned non-200 status code %d with the following body: %s", resp.StatusCode, body)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errorx.ExternalError.Wrap(err, "failed to read language model response body")
+	}
+	reply, err := call.reply(respBody)
+	if err != nil {
+		return "", errorx.ExternalError.Wrap(err, "malformed language model response")
+	}
+	return reply, nil
+}
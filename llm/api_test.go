@@ -0,0 +1,169 @@
+package llm
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/lang"
+	"context"
+	"github.com/joomcode/errorx"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type recordedRequest struct {
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// newServer starts a server replying with the response to all the requests.
+func newServer(t *testing.T, status int, response string) (*url.URL, *[]recordedRequest) {
+	var requests []recordedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests = append(requests, recordedRequest{Path: r.URL.Path, Header: r.Header, Body: string(body)})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, response)
+	}))
+	t.Cleanup(server.Close)
+	endpoint, err := url.Parse(server.URL + "/v1")
+	require.NoError(t, err)
+	return endpoint, &requests
+}
+
+func newTestAPI(provider ankihelperconf.LLMProvider, endpoint *url.URL) *api {
+	return NewAPI(ankihelperconf.LLM{
+		Provider:       provider,
+		EndpointURL:    endpoint,
+		APIKey:         "secret",
+		Model:          "default-model",
+		RequestTimeout: 5 * time.Second,
+		Burst:          1,
+		MaxRetries:     1,
+	})
+}
+
+func TestGenerate_Providers(t *testing.T) {
+	request := Request{System: "You are a German teacher.", Prompt: "Translate Hund", Temperature: lang.New(0.2)}
+	for _, tc := range []struct {
+		provider      ankihelperconf.LLMProvider
+		model         string
+		response      string
+		expectedPath  string
+		expectedKey   string
+		expectedKeyIn string
+		expectedBody  string
+	}{
+		{
+			provider:      ankihelperconf.LLMOpenAI,
+			response:      `{"choices": [{"message": {"role": "assistant", "content": "{\"translation\": \"dog\"}"}}]}`,
+			expectedPath:  "/v1/chat/completions",
+			expectedKeyIn: "Authorization",
+			expectedKey:   "Bearer secret",
+			expectedBody: `{
+				"model": "default-model",
+				"messages": [
+					{"role": "system", "content": "You are a German teacher."},
+					{"role": "user", "content": "Translate Hund"}
+				],
+				"temperature": 0.2,
+				"response_format": {"type": "json_object"}
+			}`,
+		},
+		{
+			provider:      ankihelperconf.LLMGemini,
+			model:         "gemini-1.5-flash",
+			response:      `{"candidates": [{"content": {"role": "model", "parts": [{"text": "{\"translation\": "}, {"text": "\"dog\"}"}]}}]}`,
+			expectedPath:  "/v1/models/gemini-1.5-flash:generateContent",
+			expectedKeyIn: "X-Goog-Api-Key",
+			expectedKey:   "secret",
+			expectedBody: `{
+				"systemInstruction": {"parts": [{"text": "You are a German teacher."}]},
+				"contents": [{"role": "user", "parts": [{"text": "Translate Hund"}]}],
+				"generationConfig": {"temperature": 0.2, "responseMimeType": "application/json"}
+			}`,
+		},
+		{
+			provider:     ankihelperconf.LLMOllama,
+			response:     `{"message": {"role": "assistant", "content": "{\"translation\": \"dog\"}"}, "done": true}`,
+			expectedPath: "/v1/api/chat",
+			expectedBody: `{
+				"model": "default-model",
+				"messages": [
+					{"role": "system", "content": "You are a German teacher."},
+					{"role": "user", "content": "Translate Hund"}
+				],
+				"stream": false,
+				"format": "json",
+				"options": {"temperature": 0.2}
+			}`,
+		},
+	} {
+		t.Run(string(tc.provider), func(t *testing.T) {
+			// given:
+			endpoint, requests := newServer(t, http.StatusOK, tc.response)
+			api := newTestAPI(tc.provider, endpoint)
+			req := request
+			req.Model = tc.model
+
+			// when:
+			reply, err := api.Generate(context.Background(), req)
+
+			// then:
+			require.NoError(t, err)
+			require.JSONEq(t, `{"translation": "dog"}`, reply)
+			require.Len(t, *requests, 1)
+			recorded := (*requests)[0]
+			require.Equal(t, tc.expectedPath, recorded.Path)
+			require.Equal(t, "application/json", recorded.Header.Get("Content-Type"))
+			if tc.expectedKeyIn != "" {
+				require.Equal(t, tc.expectedKey, recorded.Header.Get(tc.expectedKeyIn))
+			}
+			require.JSONEq(t, tc.expectedBody, recorded.Body)
+		})
+	}
+}
+
+func TestGenerate_ErrorStatus(t *testing.T) {
+	// given:
+	endpoint, _ := newServer(t, http.StatusBadRequest, `{"error": {"message": "unknown model"}}`)
+	api := newTestAPI(ankihelperconf.LLMOpenAI, endpoint)
+
+	// when:
+	_, err := api.Generate(context.Background(), Request{Prompt: "Translate Hund"})
+
+	// then:
+	require.ErrorContains(t, err, "unknown model")
+}
+
+func TestGenerate_RetriesTooManyRequests(t *testing.T) {
+	// given:
+	endpoint, requests := newServer(t, http.StatusTooManyRequests, `{}`)
+	api := newTestAPI(ankihelperconf.LLMOllama, endpoint)
+	api.conf.MaxRetries = 2
+
+	// when:
+	_, err := api.Generate(context.Background(), Request{Prompt: "Translate Hund"})
+
+	// then:
+	require.True(t, errorx.IsOfType(err, TooManyRequests), "unexpected error: %v", err)
+	require.Len(t, *requests, 2)
+}
+
+func TestGenerate_MalformedResponse(t *testing.T) {
+	// given:
+	endpoint, _ := newServer(t, http.StatusOK, `{"candidates": []}`)
+	api := newTestAPI(ankihelperconf.LLMGemini, endpoint)
+
+	// when:
+	_, err := api.Generate(context.Background(), Request{Prompt: "Translate Hund"})
+
+	// then:
+	require.ErrorContains(t, err, "no candidates")
+}
@@ -0,0 +1,9 @@
+package llm
+
+import "github.com/joomcode/errorx"
+
+var (
+	Errors = errorx.NewNamespace("llm")
+
+	TooManyRequests = errorx.NewType(Errors, "too_many_requests").ApplyModifiers(errorx.TypeModifierOmitStackTrace)
+)
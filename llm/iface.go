@@ -0,0 +1,19 @@
+package llm
+
+import "context"
+
+// Request is a prompt sent to a language model. The model is asked to reply with a JSON object.
+type Request struct {
+	// Model is empty if the configured default model should be used.
+	Model string
+	// System is the optional system instruction.
+	System string
+	Prompt string
+	// Temperature is nil if the default temperature of the model should be used.
+	Temperature *float64
+}
+
+type API interface {
+	// Generate sends the request to the model and returns the text of its reply.
+	Generate(ctx context.Context, req Request) (string, error)
+}
@@ -0,0 +1,24 @@
+package llmmock
+
+import (
+	"anki-rest-enhancer/llm"
+	"context"
+	"github.com/joomcode/errorx"
+)
+
+type API struct {
+	GenerateFunc func(ctx context.Context, req llm.Request) (string, error)
+}
+
+var _ llm.API = (*API)(nil)
+
+func (api *API) Reset() {
+	*api = API{}
+}
+
+func (api *API) Generate(ctx context.Context, req llm.Request) (string, error) {
+	if behaviour := api.GenerateFunc; behaviour != nil {
+		return behaviour(ctx, req)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method Generate")))
+}
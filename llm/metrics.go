@@ -0,0 +1,33 @@
+package llm
+
+import (
+	"anki-rest-enhancer/metrics"
+	"github.com/joomcode/errorx"
+	"time"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"anki_helper_llm_requests_total",
+		"Language model requests by model and outcome: success, too_many_requests or error.",
+		"model", "outcome",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"anki_helper_llm_request_duration_seconds",
+		"Duration of language model requests by model.",
+		metrics.SlowBuckets,
+		"model",
+	)
+)
+
+func observeRequest(model string, start time.Time, err error) {
+	outcome := "success"
+	switch {
+	case errorx.IsOfType(err, TooManyRequests):
+		outcome = "too_many_requests"
+	case err != nil:
+		outcome = "error"
+	}
+	requestsTotal.Inc(model, outcome)
+	requestDuration.Observe(time.Since(start).Seconds(), model)
+}
@@ -0,0 +1,158 @@
+package llm
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// providerCall is a request to the API of a provider along with the way to extract the reply from its response.
+type providerCall struct {
+	url    string
+	header http.Header
+	body   any
+	reply  func(body []byte) (string, error)
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func chatMessages(req Request) []chatMessage {
+	var messages []chatMessage
+	if req.System != "" {
+		messages = append(messages, chatMessage{Role: "system", Content: req.System})
+	}
+	return append(messages, chatMessage{Role: "user", Content: req.Prompt})
+}
+
+// openAICall calls chat completions API in JSON mode, see https://platform.openai.com/docs/api-reference/chat
+func openAICall(conf ankihelperconf.LLM, req Request) providerCall {
+	type responseFormat struct {
+		Type string `json:"type"`
+	}
+	header := http.Header{}
+	if conf.APIKey != "" {
+		header.Set("Authorization", "Bearer "+conf.APIKey)
+	}
+	return providerCall{
+		url:    conf.EndpointURL.JoinPath("chat", "completions").String(),
+		header: header,
+		body: struct {
+			Model          string         `json:"model"`
+			Messages       []chatMessage  `json:"messages"`
+			Temperature    *float64       `json:"temperature,omitempty"`
+			ResponseFormat responseFormat `json:"response_format"`
+		}{
+			Model:          req.Model,
+			Messages:       chatMessages(req),
+			Temperature:    req.Temperature,
+			ResponseFormat: responseFormat{Type: "json_object"},
+		},
+		reply: func(body []byte) (string, error) {
+			var resp struct {
+				Choices []struct {
+					Message chatMessage `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				return "", err
+			}
+			if len(resp.Choices) == 0 {
+				return "", errors.New("no choices in the response")
+			}
+			return resp.Choices[0].Message.Content, nil
+		},
+	}
+}
+
+// geminiCall calls generateContent method with JSON response type,
+// see https://ai.google.dev/api/generate-content
+func geminiCall(conf ankihelperconf.LLM, req Request) providerCall {
+	type part struct {
+		Text string `json:"text"`
+	}
+	type content struct {
+		Role  string `json:"role,omitempty"`
+		Parts []part `json:"parts"`
+	}
+	type generationConfig struct {
+		Temperature      *float64 `json:"temperature,omitempty"`
+		ResponseMIMEType string   `json:"responseMimeType"`
+	}
+	var system *content
+	if req.System != "" {
+		system = &content{Parts: []part{{Text: req.System}}}
+	}
+	header := http.Header{}
+	header.Set("X-Goog-Api-Key", conf.APIKey)
+	return providerCall{
+		url:    conf.EndpointURL.JoinPath("models", req.Model+":generateContent").String(),
+		header: header,
+		body: struct {
+			SystemInstruction *content         `json:"systemInstruction,omitempty"`
+			Contents          []content        `json:"contents"`
+			GenerationConfig  generationConfig `json:"generationConfig"`
+		}{
+			SystemInstruction: system,
+			Contents:          []content{{Role: "user", Parts: []part{{Text: req.Prompt}}}},
+			GenerationConfig:  generationConfig{Temperature: req.Temperature, ResponseMIMEType: "application/json"},
+		},
+		reply: func(body []byte) (string, error) {
+			var resp struct {
+				Candidates []struct {
+					Content content `json:"content"`
+				} `json:"candidates"`
+				PromptFeedback struct {
+					BlockReason string `json:"blockReason"`
+				} `json:"promptFeedback"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				return "", err
+			}
+			if len(resp.Candidates) == 0 {
+				return "", errors.New("no candidates in the response, block reason: " + resp.PromptFeedback.BlockReason)
+			}
+			var reply strings.Builder
+			for _, part := range resp.Candidates[0].Content.Parts {
+				reply.WriteString(part.Text)
+			}
+			return reply.String(), nil
+		},
+	}
+}
+
+// ollamaCall calls chat API in JSON mode, see https://github.com/ollama/ollama/blob/main/docs/api.md
+func ollamaCall(conf ankihelperconf.LLM, req Request) providerCall {
+	type options struct {
+		Temperature *float64 `json:"temperature,omitempty"`
+	}
+	return providerCall{
+		url:    conf.EndpointURL.JoinPath("api", "chat").String(),
+		header: http.Header{},
+		body: struct {
+			Model    string        `json:"model"`
+			Messages []chatMessage `json:"messages"`
+			Stream   bool          `json:"stream"`
+			Format   string        `json:"format"`
+			Options  options       `json:"options"`
+		}{
+			Model:    req.Model,
+			Messages: chatMessages(req),
+			Format:   "json",
+			Options:  options{Temperature: req.Temperature},
+		},
+		reply: func(body []byte) (string, error) {
+			var resp struct {
+				Message chatMessage `json:"message"`
+			}
+			if err := json.Unmarshal(body, &resp); err != nil {
+				return "", err
+			}
+			return resp.Message.Content, nil
+		},
+	}
+}
@@ -0,0 +1,141 @@
+package llmcache
+
+import (
+	"anki-rest-enhancer/util/iox"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"os"
+	"sort"
+	"sync"
+)
+
+const fileFormatVersion = 1
+
+// fileContent is the JSON representation of the cache file.
+type fileContent struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// OpenFile loads the cache from the JSON file. A missing file is treated as an empty cache
+// and is created on Save.
+func OpenFile(path string) (Cache, error) {
+	entries, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCache{
+		path:        path,
+		entries:     entries,
+		unsaved:     make(map[string]Entry),
+		invalidated: make(map[string]struct{}),
+	}, nil
+}
+
+func readFile(path string) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to read LLM cache file %s", path)
+	}
+
+	var content fileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, errorx.IllegalFormat.Wrap(err, "malformed LLM cache file %s", path)
+	}
+	if content.Version != fileFormatVersion {
+		return nil, errorx.IllegalFormat.New("unsupported version %d of LLM cache file %s", content.Version, path)
+	}
+	for _, entry := range content.Entries {
+		entries[entry.Key] = entry
+	}
+	return entries, nil
+}
+
+// fileCache is shared with other processes, e.g. note processing scripts, only through the file,
+// which is re-read on Save, so that the entries saved by them since the file was read are preserved.
+type fileCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]Entry
+	// unsaved are the entries put since the last Save.
+	unsaved map[string]Entry
+	// invalidated are the rules invalidated since the last Save.
+	invalidated map[string]struct{}
+}
+
+func (c *fileCache) Entry(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *fileCache) Put(entry Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[entry.Key] = entry
+	c.unsaved[entry.Key] = entry
+}
+
+func (c *fileCache) Invalidate(rule string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidated[rule] = struct{}{}
+	deleteRule(c.unsaved, rule)
+	return deleteRule(c.entries, rule)
+}
+
+// deleteRule removes the entries of the rule and returns their number.
+func deleteRule(entries map[string]Entry, rule string) int {
+	var removed int
+	for key, entry := range entries {
+		if entry.Rule == rule {
+			delete(entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *fileCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := readFile(c.path)
+	if err != nil {
+		return err
+	}
+	for rule := range c.invalidated {
+		deleteRule(entries, rule)
+	}
+	for key, entry := range c.unsaved {
+		entries[key] = entry
+	}
+	content := fileContent{Version: fileFormatVersion, Entries: make([]Entry, 0, len(entries))}
+	for _, entry := range entries {
+		content.Entries = append(content.Entries, entry)
+	}
+	// stable order keeps diffs of the file small
+	sort.Slice(content.Entries, func(i, j int) bool { return content.Entries[i].Key < content.Entries[j].Key })
+
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return errorx.IllegalState.Wrap(err, "failed to serialize LLM cache")
+	}
+	if err := iox.WriteFileAtomic(c.path, data, 0o644); err != nil {
+		return errorx.Decorate(err, "failed to save LLM cache file")
+	}
+	c.entries = entries
+	c.unsaved = make(map[string]Entry)
+	c.invalidated = make(map[string]struct{})
+	return nil
+}
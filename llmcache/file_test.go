@@ -0,0 +1,117 @@
+package llmcache
+
+import (
+	"anki-rest-enhancer/llm"
+	"anki-rest-enhancer/util/lang"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCache_SaveReopenAndInvalidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	cache, err := OpenFile(path)
+	require.NoError(t, err)
+	_, ok := cache.Entry("abc")
+	require.False(t, ok)
+
+	entry := Entry{
+		Key:       "abc",
+		Rule:      "translate",
+		Model:     "gpt-4o-mini",
+		Reply:     `{"translation": "dog"}`,
+		CreatedAt: time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC),
+	}
+	cache.Put(entry)
+	cache.Put(Entry{Key: "def", Rule: "examples", Model: "gpt-4o-mini", Reply: "{}"})
+	require.NoError(t, cache.Save())
+
+	reopened, err := OpenFile(path)
+	require.NoError(t, err)
+	loaded, ok := reopened.Entry("abc")
+	require.True(t, ok)
+	require.Equal(t, entry, loaded)
+
+	require.Equal(t, 1, reopened.Invalidate("translate"))
+	require.Equal(t, 0, reopened.Invalidate("translate"))
+	_, ok = reopened.Entry("abc")
+	require.False(t, ok)
+	_, ok = reopened.Entry("def")
+	require.True(t, ok)
+}
+
+func TestFileCache_SavePreservesConcurrentEntries(t *testing.T) {
+	// given: the cache is loaded before a script caches its reply in the same file
+	path := filepath.Join(t.TempDir(), "cache.json")
+	initial, err := OpenFile(path)
+	require.NoError(t, err)
+	initial.Put(Entry{Key: "stale", Rule: ScriptRule("Translation"), Reply: "hound"})
+	require.NoError(t, initial.Save())
+
+	cache, err := OpenFile(path)
+	require.NoError(t, err)
+	script, err := OpenFile(path)
+	require.NoError(t, err)
+	script.Put(Entry{Key: "script", Rule: ScriptRule("Translation"), Reply: "dog"})
+	require.NoError(t, script.Save())
+
+	// when:
+	cache.Put(Entry{Key: "llm", Rule: "llm#0", Reply: "cat"})
+	require.Equal(t, 0, cache.Invalidate("llm#1"))
+	require.NoError(t, cache.Save())
+
+	// then:
+	reopened, err := OpenFile(path)
+	require.NoError(t, err)
+	for _, key := range []string{"stale", "script", "llm"} {
+		_, ok := reopened.Entry(key)
+		require.True(t, ok, key)
+	}
+	_, ok := cache.Entry("script")
+	require.True(t, ok, "entries of other caches should be loaded on save")
+
+	// invalidation removes the entries of the rule saved by other caches too
+	require.Equal(t, 2, cache.Invalidate(ScriptRule("Translation")))
+	require.NoError(t, cache.Save())
+	reopened, err = OpenFile(path)
+	require.NoError(t, err)
+	_, ok = reopened.Entry("script")
+	require.False(t, ok)
+	_, ok = reopened.Entry("stale")
+	require.False(t, ok)
+}
+
+func TestFileCache_Malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 42}`), 0o644))
+
+	_, err := OpenFile(path)
+	require.Error(t, err)
+}
+
+func TestKey(t *testing.T) {
+	req := llm.Request{Model: "gpt-4o-mini", System: "You are a teacher.", Prompt: "Translate Hund"}
+	key := Key(req)
+	require.Len(t, key, 64)
+	require.Equal(t, key, Key(req), "key should be deterministic")
+
+	for _, changed := range []llm.Request{
+		{Model: "gpt-4o", System: req.System, Prompt: req.Prompt},
+		{Model: req.Model, System: "", Prompt: req.Prompt},
+		{Model: req.Model, System: req.System, Prompt: "Translate Katze"},
+		{Model: req.Model, System: req.System, Prompt: req.Prompt, Temperature: lang.New(0.0)},
+		{Model: req.Model, System: req.System + "Translate Hund", Prompt: ""},
+	} {
+		require.NotEqual(t, key, Key(changed), "%+v", changed)
+	}
+}
+
+func TestProvenanceTag(t *testing.T) {
+	tag := ProvenanceTag("llm", "llama3.1:8b q4", "3fa2c1d07b9e0123456789")
+	require.Equal(t, "llm::llama3.1:8b_q4::3fa2c1d07b9e", tag)
+	require.True(t, IsProvenanceTag("LLM", tag))
+	require.False(t, IsProvenanceTag("llm", "llm-other"))
+}
@@ -0,0 +1,26 @@
+package llmcache
+
+import "time"
+
+// Cache stores replies of language models, so that the same requests are not sent again.
+type Cache interface {
+	// Entry returns the entry cached for the key. false is returned if there is none.
+	Entry(key string) (Entry, bool)
+	// Put caches the entry. The entry is persisted by Save.
+	Put(entry Entry)
+	// Invalidate removes the entries of the rule and returns their number. The removal is persisted by Save.
+	Invalidate(rule string) int
+	// Save persists the entries put and invalidated since the last Save.
+	// Entries saved by other caches of the same file in the meantime are preserved.
+	Save() error
+}
+
+type Entry struct {
+	// Key identifies the request the reply was generated for, see Key.
+	Key string `json:"key"`
+	// Rule identifies the rule that sent the request, so that its replies could be invalidated.
+	Rule      string    `json:"rule"`
+	Model     string    `json:"model"`
+	Reply     string    `json:"reply"`
+	CreatedAt time.Time `json:"createdAt"`
+}
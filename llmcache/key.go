@@ -0,0 +1,49 @@
+package llmcache
+
+import (
+	"anki-rest-enhancer/llm"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Key identifies the request by the model, the rendered prompts and the generation parameters.
+func Key(req llm.Request) string {
+	temperature := "default"
+	if req.Temperature != nil {
+		temperature = fmt.Sprint(*req.Temperature)
+	}
+	hash := sha256.New()
+	for _, part := range []string{req.Model, req.System, req.Prompt, temperature} {
+		// lengths make the encoding unambiguous
+		_, _ = fmt.Fprintf(hash, "%d:%s\n", len(part), part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ScriptRule identifies replies cached by note processing scripts with the name, so that they differ
+// from the replies of llm actions.
+func ScriptRule(name string) string {
+	return "script:" + name
+}
+
+// ProvenanceValue is the value of a note field recording the model and the request key the note was generated with.
+func ProvenanceValue(model, key string) string {
+	return model + " " + key
+}
+
+// provenanceKeyLength is the length of the key prefix in provenance tags, which is enough to tell requests apart.
+const provenanceKeyLength = 12
+
+// ProvenanceTag is the tag recording the model and the request key the note was generated with,
+// e.g. llm::gpt-4o-mini::3fa2c1d07b9e for prefix llm. Anki shows such tags as a hierarchy.
+func ProvenanceTag(prefix, model, key string) string {
+	model = strings.Join(strings.Fields(strings.ReplaceAll(model, "::", "_")), "_")
+	return prefix + "::" + model + "::" + key[:min(len(key), provenanceKeyLength)]
+}
+
+// IsProvenanceTag checks whether the tag is a provenance tag with the prefix.
+func IsProvenanceTag(prefix, tag string) bool {
+	return strings.HasPrefix(strings.ToLower(tag), strings.ToLower(prefix)+"::")
+}
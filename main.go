@@ -2,111 +2,181 @@ package main
 
 import (
 	"anki-rest-enhancer/ankiconnect"
-	"anki-rest-enhancer/ankihelper"
-	"anki-rest-enhancer/ankihelperconf"
-	"anki-rest-enhancer/azuretts"
-	"anki-rest-enhancer/noteprocessing"
-	"encoding/json"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/joomcode/errorx"
-	"log"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strings"
 )
 
-var flagConfigPath = flag.String("config", "", "path to config file")
-var flagPrintConfig = flag.Bool("print-config", false, "whether the internal representation of the config should be printed once it's loaded")
-var flagNoOp = flag.Bool("noop", false, "if this flag is set to true, tool exits after the config is loaded (and optionally printed)")
+// Exit codes of the tool.
+const (
+	exitCodeOK              = 0
+	exitCodeFailure         = 1
+	exitCodeUsage           = 2
+	exitCodeConfig          = 3
+	exitCodeAnkiUnreachable = 4
+	exitCodePartialFailure  = 5
+)
+
+var (
+	cliErrors = errorx.NewNamespace("cli")
+
+	// usageError means that the tool is invoked with malformed command line arguments.
+	usageError = errorx.NewType(cliErrors, "usage").ApplyModifiers(errorx.TypeModifierOmitStackTrace)
+	// configError means that the config file is missing or malformed.
+	configError = errorx.NewType(cliErrors, "config")
+	// partialFailureError means that the run completed, but too many notes failed.
+	partialFailureError = errorx.NewType(cliErrors, "partial_failure").ApplyModifiers(errorx.TypeModifierOmitStackTrace)
+)
+
+type command struct {
+	Name        string
+	Description string
+	// oneof:
+	Run         func(ctx context.Context, args []string) error
+	Subcommands []command
+}
+
+var commands = []command{
+	{Name: "run", Description: "execute configured actions (default command)", Run: runCommand},
+	{Name: "validate", Description: "load the config and report whether it is valid", Run: validateCommand},
+	{Name: "plan", Description: "show what configured actions would do without modifying anything", Run: planCommand},
+	{Name: "serve", Description: "keep running and execute configured actions on schedule", Run: serveCommand},
+	{Name: "undo", Description: "revert modifications applied by a run", Run: undoCommand},
+	{Name: "notes", Subcommands: []command{
+		{Name: "find", Description: "print IDs of notes matching a query", Run: notesFindCommand},
+		{Name: "show", Description: "print notes with the specified IDs as JSON", Run: notesShowCommand},
+		{Name: "export", Description: "write notes matching a query with their cards to JSON Lines or CSV", Run: notesExportCommand},
+	}},
+	{Name: "tts", Subcommands: []command{
+		{Name: "say", Description: "convert text to speech and save it to a file", Run: ttsSayCommand},
+	}},
+	{Name: "media", Subcommands: []command{
+		{Name: "upload", Description: "upload a file to Anki media collection", Run: mediaUploadCommand},
+	}},
+	{Name: "llm", Subcommands: []command{
+		{Name: "invalidate", Description: "remove cached replies of llm actions, so that their fields are generated again", Run: llmInvalidateCommand},
+	}},
+	{Name: "note-types", Subcommands: []command{
+		{Name: "diff", Description: "compare configured note types with the ones in Anki", Run: noteTypesDiffCommand},
+	}},
+}
 
 func main() {
-	flag.Parse()
+	// Interruption stops the run gracefully: everything that has been generated so far is already saved to Anki.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	err := doMain()
+	err := dispatch(ctx, "anki-helper", commands, os.Args[1:])
 	if err != nil {
-		log.Printf("Failed with error %+v", err)
-		log.Printf("Exit with status 1")
-		os.Exit(1)
+		code := exitCode(err)
+		slog.Debug("Failure details", logx.KeyError, fmt.Sprintf("%+v", err))
+		slog.Error("Failed", logx.Err(err), "exitCode", code)
+		os.Exit(code)
 	}
-	log.Printf("Completed.")
+	slog.Info("Completed.")
 }
 
-func doMain() error {
-	configPath := findConfigFile()
-
-	conf, err := ankihelperconf.LoadYAML(configPath)
-	if err != nil {
-		return err
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitCodeOK
+	case errorx.IsOfType(err, usageError):
+		return exitCodeUsage
+	case errorx.IsOfType(err, configError):
+		return exitCodeConfig
+	case errorx.IsOfType(err, ankiconnect.Unreachable):
+		return exitCodeAnkiUnreachable
+	case errorx.IsOfType(err, partialFailureError):
+		return exitCodePartialFailure
+	default:
+		return exitCodeFailure
 	}
+}
 
-	if *flagPrintConfig {
-		if err := printConfig(conf); err != nil {
-			return err
+func dispatch(ctx context.Context, path string, cmds []command, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if path == "anki-helper" && (len(args) == 0 || (args[0] != "-h" && args[0] != "-help" && args[0] != "--help")) {
+			// for backward compatibility, the tool runs the configured actions if no command is specified
+			return runCommand(ctx, args)
+		}
+		printUsage(path, cmds)
+		if len(args) == 0 {
+			return usageError.New("command is not specified")
 		}
-	}
-	if *flagNoOp {
 		return nil
 	}
 
-	return runConfig(conf)
-}
-
-func printConfig(conf ankihelperconf.Config) error {
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(conf); err != nil {
-		return errorx.Decorate(err, "failed to dump internal config representation")
+	name := args[0]
+	if name == "help" {
+		printUsage(path, cmds)
+		return nil
 	}
-	return nil
+	for _, cmd := range cmds {
+		if cmd.Name != name {
+			continue
+		}
+		if cmd.Run != nil {
+			return cmd.Run(ctx, args[1:])
+		}
+		return dispatch(ctx, path+" "+name, cmd.Subcommands, args[1:])
+	}
+	printUsage(path, cmds)
+	return usageError.New("unknown command %q", name)
 }
 
-func runConfig(conf ankihelperconf.Config) error {
-	log.Printf("Running config file %s", conf.Path)
-	if len(conf.RunConfigs) > 0 {
-		for _, conf := range conf.RunConfigs {
-			if err := runConfig(conf); err != nil {
-				return err
+func printUsage(path string, cmds []command) {
+	out := flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", path)
+	var printCommands func(prefix string, cmds []command)
+	printCommands = func(prefix string, cmds []command) {
+		for _, cmd := range cmds {
+			if cmd.Run != nil {
+				_, _ = fmt.Fprintf(out, "  %-20s %s\n", prefix+cmd.Name, cmd.Description)
 			}
+			printCommands(prefix+cmd.Name+" ", cmd.Subcommands)
 		}
-		return nil
 	}
+	printCommands("", cmds)
+	_, _ = fmt.Fprintf(out, "\nRun '%s <command> -h' to see command flags.\n", path)
+}
 
-	azureTTS := azuretts.NewAPI(conf.Azure)
-	ankiConnect := ankiconnect.NewAPI(conf.Anki)
-	scriptRunner := noteprocessing.NewScriptRunner()
-	enhancer := ankihelper.NewHelper(ankiConnect, azureTTS, scriptRunner)
-	return enhancer.Run(conf.Actions)
+// commandFlags is the flag set of a command. Flags shared by all the commands are registered by newFlagSet.
+type commandFlags struct {
+	*flag.FlagSet
+	logLevel, logFormat *string
 }
 
-func findConfigFile() string {
-	if path := *flagConfigPath; path != "" {
-		log.Printf("Use config path from CLI arguments: %s", path)
-		return path
+// newFlagSet creates a flag set for a command. Call parse to parse arguments with it.
+func newFlagSet(name string) *commandFlags {
+	fs := flag.NewFlagSet("anki-helper "+name, flag.ContinueOnError)
+	return &commandFlags{
+		FlagSet:   fs,
+		logLevel:  fs.String("log-level", "info", "minimal level of log messages: debug, info, warn or error"),
+		logFormat: fs.String("log-format", logx.FormatText, "format of log messages: text or json"),
 	}
+}
 
-	var dirs []string
-	for _, source := range []struct {
-		dirType string
-		getDir  func() (string, error)
-	}{
-		{"current directory", os.Getwd},
-		{"user config directory", os.UserConfigDir},
-		{"user home directory", os.UserHomeDir},
-	} {
-		dir, err := source.getDir()
-		if err != nil {
-			log.Printf("Failed to get %s: %+v", source.dirType, err)
+// parse parses the arguments and sets up logging.
+// errHelp is returned if help is requested, so the command should exit successfully.
+func (fs *commandFlags) parse(args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return errHelp
 		}
-		dirs = append(dirs, dir)
+		return usageError.Wrap(err, "malformed command line arguments")
 	}
-
-	const defaultConfigFileName = "anki-helper.yaml"
-	for _, dir := range dirs {
-		path := filepath.Join(dir, defaultConfigFileName)
-		log.Printf("Check for config file at %s", path)
-		if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
-			log.Printf("Use configuration from %s", path)
-			return path
-		}
+	if err := logx.Setup(os.Stderr, *fs.logLevel, *fs.logFormat); err != nil {
+		return usageError.Wrap(err, "malformed logging flags")
 	}
-	panic(errorx.Panic(errorx.IllegalState.New("Failed to find")))
+	return nil
 }
+
+// errHelp is returned by commandFlags.parse if help is requested.
+var errHelp = errors.New("help requested")
@@ -0,0 +1,258 @@
+package metrics
+
+import (
+	"bufio"
+	"github.com/joomcode/errorx"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets suitable for durations of requests in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// SlowBuckets are the upper bounds of histogram buckets suitable for durations of long operations
+// like text-to-speech and script executions in seconds.
+var SlowBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Default is the registry the metrics created with package-level functions are registered in.
+var Default = NewRegistry()
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labelNames...)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labelNames...)
+}
+
+// Handler serves the metrics of the default registry in Prometheus text exposition format.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]struct{})}
+}
+
+// Registry keeps metrics and writes them in Prometheus text exposition format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]struct{}
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.names[name]; ok {
+		panic(errorx.IllegalArgument.New("metric %q is already registered", name))
+	}
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all the registered metrics in Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
+
+// vec keeps series of a metric by their label values.
+type vec[S any] struct {
+	name, help, kind string
+	labelNames       []string
+	newSeries        func() *S
+
+	mu     sync.Mutex
+	series map[string]*labeledSeries[S]
+}
+
+type labeledSeries[S any] struct {
+	labelValues []string
+	series      *S
+}
+
+func newVec[S any](name, help, kind string, labelNames []string, newSeries func() *S) *vec[S] {
+	return &vec[S]{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		newSeries:  newSeries,
+		series:     make(map[string]*labeledSeries[S]),
+	}
+}
+
+// with calls f with the series identified by the label values while holding the lock.
+func (v *vec[S]) with(labelValues []string, f func(series *S)) {
+	if len(labelValues) != len(v.labelNames) {
+		panic(errorx.IllegalArgument.New("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &labeledSeries[S]{labelValues: append([]string(nil), labelValues...), series: v.newSeries()}
+		v.series[key] = s
+	}
+	f(s.series)
+}
+
+// writeSeries writes the header of the metric and calls writeOne for each series in a stable order.
+func (v *vec[S]) writeSeries(w *bufio.Writer, writeOne func(labels []string, series *S)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	_, _ = w.WriteString("# HELP " + v.name + " " + escapeHelp(v.help) + "\n")
+	_, _ = w.WriteString("# TYPE " + v.name + " " + v.kind + "\n")
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		labels := make([]string, len(v.labelNames))
+		for i, name := range v.labelNames {
+			labels[i] = name + `="` + escapeLabelValue(s.labelValues[i]) + `"`
+		}
+		writeOne(labels, s.series)
+	}
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	vec *vec[float64]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labelNames, func() *float64 { return new(float64) })}
+	r.register(name, c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter identified by the label values. The value should not be negative.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(errorx.IllegalArgument.New("counter %s can't be decreased", c.vec.name))
+	}
+	c.vec.with(labelValues, func(counter *float64) { *counter += value })
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.vec.writeSeries(w, func(labels []string, counter *float64) {
+		writeSample(w, c.vec.name, labels, *counter)
+	})
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	vec     *vec[histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	// bucketCounts are the numbers of observations that fall into each bucket, not cumulative.
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(errorx.IllegalArgument.New("buckets of histogram %s should be sorted", name))
+	}
+	h := &HistogramVec{
+		vec: newVec(name, help, "histogram", labelNames, func() *histogram {
+			return &histogram{bucketCounts: make([]uint64, len(buckets))}
+		}),
+		buckets: buckets,
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.vec.with(labelValues, func(hist *histogram) {
+		// observations greater than all the bounds are only counted by the implicit +Inf bucket
+		if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+			hist.bucketCounts[i]++
+		}
+		hist.count++
+		hist.sum += value
+	})
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.vec.writeSeries(w, func(labels []string, hist *histogram) {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.bucketCounts[i]
+			writeSample(w, h.vec.name+"_bucket", append(labels, `le="`+formatFloat(bound)+`"`), float64(cumulative))
+		}
+		writeSample(w, h.vec.name+"_bucket", append(labels, `le="+Inf"`), float64(hist.count))
+		writeSample(w, h.vec.name+"_sum", labels, hist.sum)
+		writeSample(w, h.vec.name+"_count", labels, float64(hist.count))
+	})
+}
+
+func writeSample(w *bufio.Writer, name string, labels []string, value float64) {
+	_, _ = w.WriteString(name)
+	if len(labels) > 0 {
+		_, _ = w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	_, _ = w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
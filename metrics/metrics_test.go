@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests by action.", "action", "outcome")
+	duration := registry.NewHistogramVec("request_duration_seconds", "Request duration.", []float64{0.1, 1}, "action")
+
+	requests.Inc("findNotes", "success")
+	requests.Add(2, "findNotes", "success")
+	requests.Inc(`say "hi"`, "error")
+	duration.Observe(0.05, "findNotes")
+	duration.Observe(0.1, "findNotes")
+	duration.Observe(0.5, "findNotes")
+	duration.Observe(3, "findNotes")
+
+	var out strings.Builder
+	require.NoError(t, registry.WriteText(&out))
+	require.Equal(t, `# HELP requests_total Requests by action.
+# TYPE requests_total counter
+requests_total{action="findNotes",outcome="success"} 3
+requests_total{action="say \"hi\"",outcome="error"} 1
+# HELP request_duration_seconds Request duration.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{action="findNotes",le="0.1"} 2
+request_duration_seconds_bucket{action="findNotes",le="1"} 3
+request_duration_seconds_bucket{action="findNotes",le="+Inf"} 4
+request_duration_seconds_sum{action="findNotes"} 3.65
+request_duration_seconds_count{action="findNotes"} 4
+`, out.String())
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("runs_total", "Runs.").Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	require.Equal(t, 200, recorder.Code)
+	require.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	require.Contains(t, recorder.Body.String(), "runs_total 1\n")
+}
+
+func TestCounterVec_WrongLabels(t *testing.T) {
+	counter := NewRegistry().NewCounterVec("requests_total", "Requests.", "action")
+	require.Panics(t, func() { counter.Inc("a", "b") })
+}
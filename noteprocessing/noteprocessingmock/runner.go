@@ -0,0 +1,35 @@
+package noteprocessingmock
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/noteprocessing"
+	"context"
+	"github.com/joomcode/errorx"
+)
+
+type ScriptRunner struct {
+	RunScriptFunc func(
+		ctx context.Context,
+		rule ankihelperconf.NoteProcessingRule,
+		note noteprocessing.NoteData,
+		progress noteprocessing.ProgressInfo,
+	) ([]noteprocessing.Modification, error)
+}
+
+var _ noteprocessing.ScriptRunner = (*ScriptRunner)(nil)
+
+func (r *ScriptRunner) Reset() {
+	*r = ScriptRunner{}
+}
+
+func (r *ScriptRunner) RunScript(
+	ctx context.Context,
+	rule ankihelperconf.NoteProcessingRule,
+	note noteprocessing.NoteData,
+	progress noteprocessing.ProgressInfo,
+) ([]noteprocessing.Modification, error) {
+	if behaviour := r.RunScriptFunc; behaviour != nil {
+		return behaviour(ctx, rule, note, progress)
+	}
+	panic(errorx.Panic(errorx.NotImplemented.New("Mock behaviour is not specified for method RunScript")))
+}
@@ -3,11 +3,12 @@ package noteprocessing
 import (
 	"anki-rest-enhancer/ankihelperconf"
 	"anki-rest-enhancer/util/execx"
+	"anki-rest-enhancer/util/logx"
 	"anki-rest-enhancer/util/stringx"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/joomcode/errorx"
-	"log"
 	"os"
 	"strings"
 )
@@ -41,7 +42,9 @@ func (r *scriptRunner) RunScript(
 	if err != nil {
 		return nil, err
 	}
-	r.logRun(params, progress)
+	// unnamed rules are identified by their commands in metrics
+	params.Rule = rule.Name
+	r.logRun(ctx, params, progress)
 	cmdOut, err := execx.RunAndCollectOutput(cmdCtx, params)
 	if err != nil {
 		return nil, errorx.ExternalError.Wrap(err, "Note population command failed")
@@ -108,12 +111,11 @@ func (r *scriptRunner) prepareExecParams(note NoteData, rule ankihelperconf.Note
 	}, nil
 }
 
-func (r *scriptRunner) logRun(params execx.Params, progress ProgressInfo) {
-	log.Printf(
-		"Executing note processing command [%d/%d]: %s '%s'",
-		progress.CurrentNoteIndex,
-		progress.TotalNotesCount,
-		params.Command,
-		strings.Join(params.Args, "' '"),
+func (r *scriptRunner) logRun(ctx context.Context, params execx.Params, progress ProgressInfo) {
+	logx.FromContext(ctx).Debug(
+		"Executing note processing command",
+		"progress", fmt.Sprintf("%d/%d", progress.CurrentNoteIndex, progress.TotalNotesCount),
+		"command", params.Command,
+		"args", params.Args,
 	)
 }
@@ -0,0 +1,286 @@
+// Package notesexport writes notes along with their cards to JSON Lines or CSV files for analysis outside of Anki.
+package notesexport
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/util/lang/set"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/joomcode/errorx"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	// FormatJSONL writes a JSON object per note, see Note.
+	FormatJSONL Format = "jsonl"
+	// FormatCSV writes a row per note with statistics of its cards.
+	FormatCSV Format = "csv"
+)
+
+var Formats = []Format{FormatJSONL, FormatCSV}
+
+// DefaultBatchSize is the default number of notes requested from AnkiConnect at once.
+const DefaultBatchSize = 500
+
+type Options struct {
+	Query  string
+	Format Format
+	// Fields are the note fields written to CSV columns. Empty Fields means the fields of all the note types.
+	Fields []string
+	// BatchSize is the number of notes requested from AnkiConnect at once, so that large collections
+	// are written gradually.
+	BatchSize int
+}
+
+// Note is an exported note.
+type Note struct {
+	ID       ankiconnect.NoteID `json:"id"`
+	NoteType string             `json:"noteType"`
+	Fields   map[string]string  `json:"fields"`
+	Tags     []string           `json:"tags"`
+	// ModifiedAt is nil if AnkiConnect doesn't report modification time.
+	ModifiedAt *time.Time `json:"modifiedAt,omitempty"`
+	Cards      []Card     `json:"cards"`
+}
+
+// Card is an exported card with its scheduling state.
+type Card struct {
+	ID       ankiconnect.CardID `json:"id"`
+	Template string             `json:"template"`
+	Deck     string             `json:"deck"`
+	// Type is one of new, learning, review and relearning.
+	Type      string `json:"type"`
+	Suspended bool   `json:"suspended,omitempty"`
+	// Due is the position of a new card, or the day the card is due on.
+	Due          int64 `json:"due"`
+	IntervalDays int   `json:"intervalDays"`
+	// Ease is the ease factor, e.g. 2.5. It's zero for new cards.
+	Ease    float64 `json:"ease"`
+	Reviews int     `json:"reviews"`
+	Lapses  int     `json:"lapses"`
+}
+
+var cardTypes = map[int]string{
+	ankiconnect.CardTypeNew:        "new",
+	ankiconnect.CardTypeLearning:   "learning",
+	ankiconnect.CardTypeReview:     "review",
+	ankiconnect.CardTypeRelearning: "relearning",
+}
+
+// Export writes the notes matching the query to w, ordered by their IDs. It returns the number of written notes.
+func Export(ctx context.Context, api ankiconnect.API, w io.Writer, opts Options) (int, error) {
+	noteIDs, err := api.FindNotes(opts.Query)
+	if err != nil {
+		return 0, errorx.Decorate(err, "failed to find notes")
+	}
+	slices.Sort(noteIDs)
+
+	var writer noteWriter
+	switch opts.Format {
+	case FormatJSONL:
+		writer = jsonlWriter{encoder: json.NewEncoder(w)}
+	case FormatCSV:
+		fields := opts.Fields
+		if len(fields) == 0 {
+			if fields, err = allFields(api); err != nil {
+				return 0, err
+			}
+		}
+		if writer, err = newCSVWriter(w, fields); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errorx.IllegalArgument.New("unknown format %q, expected one of %v", opts.Format, Formats)
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	var written int
+	for start := 0; start < len(noteIDs); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		batch := noteIDs[start:min(start+batchSize, len(noteIDs))]
+		notes, err := exportBatch(api, batch)
+		if err != nil {
+			return written, err
+		}
+		for _, note := range notes {
+			if err := writer.write(note); err != nil {
+				return written, errorx.ExternalError.Wrap(err, "failed to write note %d", note.ID)
+			}
+			written++
+		}
+		if err := writer.flush(); err != nil {
+			return written, errorx.ExternalError.Wrap(err, "failed to write notes")
+		}
+	}
+	return written, nil
+}
+
+// exportBatch gets the notes with their cards. Notes deleted since they were found are omitted.
+func exportBatch(api ankiconnect.API, noteIDs []ankiconnect.NoteID) ([]Note, error) {
+	notes, err := api.NotesInfo(noteIDs)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to get notes")
+	}
+	var cardIDs []ankiconnect.CardID
+	for _, note := range notes {
+		cardIDs = append(cardIDs, note.Cards...)
+	}
+	cards, err := api.CardsInfo(cardIDs)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to get cards of the notes")
+	}
+
+	exported := make([]Note, 0, len(notes))
+	for _, noteID := range noteIDs {
+		note, ok := notes[noteID]
+		if !ok {
+			continue
+		}
+		exportedNote := Note{
+			ID:       note.ID,
+			NoteType: note.ModelName,
+			Fields:   note.Fields,
+			Tags:     note.Tags,
+			Cards:    make([]Card, 0, len(note.Cards)),
+		}
+		if !note.ModifiedAt.IsZero() {
+			modifiedAt := note.ModifiedAt.UTC()
+			exportedNote.ModifiedAt = &modifiedAt
+		}
+		for _, cardID := range note.Cards {
+			card, ok := cards[cardID]
+			if !ok {
+				continue
+			}
+			exportedNote.Cards = append(exportedNote.Cards, Card{
+				ID:           card.ID,
+				Template:     card.Template,
+				Deck:         card.DeckName,
+				Type:         cardTypes[card.Type],
+				Suspended:    card.Queue == ankiconnect.CardQueueSuspended,
+				Due:          card.Due,
+				IntervalDays: card.Interval,
+				Ease:         float64(card.Ease) / 1000,
+				Reviews:      card.Reviews,
+				Lapses:       card.Lapses,
+			})
+		}
+		exported = append(exported, exportedNote)
+	}
+	return exported, nil
+}
+
+// allFields returns the fields of all the note types, so that CSV columns are known before notes are fetched.
+func allFields(api ankiconnect.API) ([]string, error) {
+	noteTypes, err := api.ModelNames()
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to get note types")
+	}
+	slices.Sort(noteTypes)
+	var fields []string
+	seen := set.New[string](0)
+	for _, noteType := range noteTypes {
+		names, err := api.ModelFieldNames(noteType)
+		if err != nil {
+			return nil, errorx.Decorate(err, "failed to get fields of note type %q", noteType)
+		}
+		for _, name := range names {
+			if !seen.Contains(name) {
+				seen[name] = struct{}{}
+				fields = append(fields, name)
+			}
+		}
+	}
+	return fields, nil
+}
+
+type noteWriter interface {
+	write(note Note) error
+	flush() error
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func (w jsonlWriter) write(note Note) error {
+	return w.encoder.Encode(note)
+}
+
+func (w jsonlWriter) flush() error {
+	return nil
+}
+
+// csvColumns are the columns written before note fields.
+var csvColumns = []string{
+	"id", "noteType", "tags", "decks", "modifiedAt",
+	"cards", "suspended", "reviews", "lapses", "minIntervalDays", "maxIntervalDays",
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+	fields []string
+}
+
+func newCSVWriter(w io.Writer, fields []string) (csvWriter, error) {
+	writer := csvWriter{writer: csv.NewWriter(w), fields: fields}
+	return writer, writer.writer.Write(append(slices.Clone(csvColumns), fields...))
+}
+
+func (w csvWriter) write(note Note) error {
+	var decks []string
+	var suspended, reviews, lapses, minInterval, maxInterval int
+	for i, card := range note.Cards {
+		if !slices.Contains(decks, card.Deck) {
+			decks = append(decks, card.Deck)
+		}
+		if card.Suspended {
+			suspended++
+		}
+		reviews += card.Reviews
+		lapses += card.Lapses
+		if i == 0 || card.IntervalDays < minInterval {
+			minInterval = card.IntervalDays
+		}
+		maxInterval = max(maxInterval, card.IntervalDays)
+	}
+	var modifiedAt string
+	if note.ModifiedAt != nil {
+		modifiedAt = note.ModifiedAt.Format(time.RFC3339)
+	}
+
+	record := []string{
+		strconv.FormatInt(int64(note.ID), 10),
+		note.NoteType,
+		strings.Join(note.Tags, " "),
+		strings.Join(decks, "; "),
+		modifiedAt,
+		strconv.Itoa(len(note.Cards)),
+		strconv.Itoa(suspended),
+		strconv.Itoa(reviews),
+		strconv.Itoa(lapses),
+		strconv.Itoa(minInterval),
+		strconv.Itoa(maxInterval),
+	}
+	for _, field := range w.fields {
+		record = append(record, note.Fields[field])
+	}
+	return w.writer.Write(record)
+}
+
+func (w csvWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
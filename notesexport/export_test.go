@@ -0,0 +1,106 @@
+package notesexport
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/ankiconnect/ankiconnectmock"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newAPIMock(t *testing.T) *ankiconnectmock.API {
+	notes := map[ankiconnect.NoteID]ankiconnect.NoteInfo{
+		1: {ID: 1, ModelName: "GermanNoun", Fields: map[string]string{"Word": "Hund", "Gender": "der"},
+			Tags: []string{"a1"}, ModifiedAt: time.Unix(1700000000, 0), Cards: []ankiconnect.CardID{10, 11}},
+		2: {ID: 2, ModelName: "GermanVerb", Fields: map[string]string{"Word": "gehen, ging"}, Cards: []ankiconnect.CardID{20}},
+		3: {ID: 3, ModelName: "GermanNoun", Fields: map[string]string{"Word": "Katze", "Gender": "die"}, Cards: []ankiconnect.CardID{30}},
+	}
+	cards := map[ankiconnect.CardID]ankiconnect.CardInfo{
+		10: {ID: 10, NoteID: 1, DeckName: "German::Nouns", Template: "Forward", Type: ankiconnect.CardTypeReview,
+			Due: 700, Interval: 30, Ease: 2500, Reviews: 7, Lapses: 1},
+		11: {ID: 11, NoteID: 1, DeckName: "German::Gender", Template: "Gender", Type: ankiconnect.CardTypeReview,
+			Queue: ankiconnect.CardQueueSuspended, Interval: 4, Ease: 2300, Reviews: 3},
+		20: {ID: 20, NoteID: 2, DeckName: "German::Verbs", Template: "Forward", Due: 5},
+		30: {ID: 30, NoteID: 3, DeckName: "German::Nouns", Template: "Forward", Due: 6},
+	}
+	var batches [][]ankiconnect.NoteID
+	t.Cleanup(func() {
+		require.Equal(t, [][]ankiconnect.NoteID{{1, 2}, {3}}, batches)
+	})
+
+	return &ankiconnectmock.API{
+		FindNotesFunc: func(query string) ([]ankiconnect.NoteID, error) {
+			require.Equal(t, "deck:German", query)
+			return []ankiconnect.NoteID{3, 1, 2}, nil
+		},
+		NotesInfoFunc: func(noteIDs []ankiconnect.NoteID) (map[ankiconnect.NoteID]ankiconnect.NoteInfo, error) {
+			batches = append(batches, noteIDs)
+			result := make(map[ankiconnect.NoteID]ankiconnect.NoteInfo)
+			for _, noteID := range noteIDs {
+				result[noteID] = notes[noteID]
+			}
+			return result, nil
+		},
+		CardsInfoFunc: func(cardIDs []ankiconnect.CardID) (map[ankiconnect.CardID]ankiconnect.CardInfo, error) {
+			result := make(map[ankiconnect.CardID]ankiconnect.CardInfo)
+			for _, cardID := range cardIDs {
+				result[cardID] = cards[cardID]
+			}
+			return result, nil
+		},
+		ModelNamesFunc: func() ([]string, error) {
+			return []string{"GermanVerb", "GermanNoun"}, nil
+		},
+		ModelFieldNamesFunc: func(modelName string) ([]string, error) {
+			if modelName == "GermanNoun" {
+				return []string{"Word", "Gender"}, nil
+			}
+			return []string{"Word", "Conjugation"}, nil
+		},
+	}
+}
+
+func TestExport_CSV(t *testing.T) {
+	// given:
+	api := newAPIMock(t)
+	var out bytes.Buffer
+
+	// when:
+	exported, err := Export(context.Background(), api, &out, Options{Query: "deck:German", Format: FormatCSV, BatchSize: 2})
+
+	// then:
+	require.NoError(t, err)
+	require.Equal(t, 3, exported)
+	require.Equal(t, ""+
+		"id,noteType,tags,decks,modifiedAt,cards,suspended,reviews,lapses,minIntervalDays,maxIntervalDays,Word,Gender,Conjugation\n"+
+		"1,GermanNoun,a1,German::Nouns; German::Gender,2023-11-14T22:13:20Z,2,1,10,1,4,30,Hund,der,\n"+
+		"2,GermanVerb,,German::Verbs,,1,0,0,0,0,0,\"gehen, ging\",,\n"+
+		"3,GermanNoun,,German::Nouns,,1,0,0,0,0,0,Katze,die,\n", out.String())
+}
+
+func TestExport_JSONL(t *testing.T) {
+	// given:
+	api := newAPIMock(t)
+	var out bytes.Buffer
+
+	// when:
+	exported, err := Export(context.Background(), api, &out, Options{Query: "deck:German", Format: FormatJSONL, BatchSize: 2})
+
+	// then:
+	require.NoError(t, err)
+	require.Equal(t, 3, exported)
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 3)
+	require.JSONEq(t, `{
+		"id": 1, "noteType": "GermanNoun", "fields": {"Word": "Hund", "Gender": "der"}, "tags": ["a1"],
+		"modifiedAt": "2023-11-14T22:13:20Z",
+		"cards": [
+			{"id": 10, "template": "Forward", "deck": "German::Nouns", "type": "review", "due": 700,
+				"intervalDays": 30, "ease": 2.5, "reviews": 7, "lapses": 1},
+			{"id": 11, "template": "Gender", "deck": "German::Gender", "type": "review", "suspended": true, "due": 0,
+				"intervalDays": 4, "ease": 2.3, "reviews": 3, "lapses": 0}
+		]
+	}`, string(lines[0]))
+}
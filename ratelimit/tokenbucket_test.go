@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLimiter_BurstIsNotDelayed(t *testing.T) {
+	limiter := NewLimiter(1, 3)
+
+	// when:
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.Wait(context.Background()))
+	}
+	duration := time.Now().Sub(start)
+
+	// then:
+	require.True(t, duration < 100*time.Millisecond)
+}
+
+func TestLimiter_RateIsRespectedAfterBurst(t *testing.T) {
+	limiter := NewLimiter(20, 1)
+
+	// when:
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, limiter.Wait(context.Background()))
+	}
+	duration := time.Now().Sub(start)
+
+	// then: the first event is immediate, four more should take at least 4 * 50ms
+	require.True(t, duration >= 190*time.Millisecond, "duration: %s", duration)
+}
+
+func TestLimiter_WaitRespectsContext(t *testing.T) {
+	limiter := NewLimiter(0.1, 1)
+	require.NoError(t, limiter.Wait(context.Background()))
+
+	// when:
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := limiter.Wait(ctx)
+	duration := time.Now().Sub(start)
+
+	// then:
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.True(t, duration < time.Second)
+}
+
+func TestLimiter_ZeroRateIsUnlimited(t *testing.T) {
+	limiter := NewLimiter(0, 1)
+
+	// when:
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, limiter.Wait(context.Background()))
+	}
+	duration := time.Now().Sub(start)
+
+	// then:
+	require.True(t, duration < 100*time.Millisecond)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"anki-rest-enhancer/ankihelper"
+	"anki-rest-enhancer/ttsbudget"
+	"encoding/json"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"os"
+	"slices"
+	"time"
+)
+
+// runReport is the machine-readable report of the 'run' command written to the file specified with -report flag.
+type runReport struct {
+	// RunID identifies modifications of the run in the journal.
+	RunID           string            `json:"runId"`
+	StartedAt       time.Time         `json:"startedAt"`
+	FinishedAt      time.Time         `json:"finishedAt"`
+	DurationSeconds float64           `json:"durationSeconds"`
+	Succeeded       int               `json:"succeeded"`
+	Failed          int               `json:"failed"`
+	Configs         []runConfigReport `json:"configs"`
+	// TTSUsage summarizes characters converted to speech by voices across the configs.
+	TTSUsage []ttsbudget.Usage `json:"ttsUsage,omitempty"`
+	// Error is set if the run failed, including the case when too many items failed.
+	Error    string `json:"error,omitempty"`
+	ExitCode int    `json:"exitCode"`
+}
+
+type runConfigReport struct {
+	Path     string                     `json:"path"`
+	Actions  []*ankihelper.ActionReport `json:"actions"`
+	TTSUsage *ttsbudget.Usage           `json:"ttsUsage,omitempty"`
+}
+
+func newRunReport(runID string) runReport {
+	return runReport{RunID: runID, StartedAt: time.Now()}
+}
+
+func (r runReport) counts() (succeeded, failed int) {
+	for _, conf := range r.Configs {
+		report := ankihelper.Report{Actions: conf.Actions}
+		succeeded += report.Succeeded()
+		failed += report.Failed()
+	}
+	return succeeded, failed
+}
+
+// ttsUsage sums up text-to-speech usage of the configs by voices.
+func (r runReport) ttsUsage() []ttsbudget.Usage {
+	var usages []ttsbudget.Usage
+	for _, conf := range r.Configs {
+		if conf.TTSUsage == nil {
+			continue
+		}
+		idx := slices.IndexFunc(usages, func(usage ttsbudget.Usage) bool { return usage.Voice == conf.TTSUsage.Voice })
+		if idx < 0 {
+			usages = append(usages, *conf.TTSUsage)
+			continue
+		}
+		usages[idx].Characters += conf.TTSUsage.Characters
+		usages[idx].EstimatedCost += conf.TTSUsage.EstimatedCost
+	}
+	return usages
+}
+
+// checkFailures returns partialFailureError if the ratio of failed items exceeds maxFailureRatio.
+func (r runReport) checkFailures(maxFailureRatio float64) error {
+	succeeded, failed := r.counts()
+	if failed == 0 {
+		return nil
+	}
+	if ratio := float64(failed) / float64(succeeded+failed); ratio > maxFailureRatio {
+		return partialFailureError.New("%d of %d items failed, which exceeds max failure ratio %v", failed, succeeded+failed, maxFailureRatio)
+	}
+	return nil
+}
+
+func (r runReport) write(path string, runErr error) error {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Succeeded, r.Failed = r.counts()
+	r.TTSUsage = r.ttsUsage()
+	if runErr != nil {
+		r.Error = fmt.Sprintf("%v", runErr)
+	}
+	r.ExitCode = exitCode(runErr)
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errorx.Decorate(err, "failed to serialize run report")
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to write run report to %s", path)
+	}
+	return nil
+}
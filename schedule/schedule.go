@@ -0,0 +1,180 @@
+package schedule
+
+import (
+	"github.com/joomcode/errorx"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule defines moments of time when a job should be executed.
+type Schedule interface {
+	// Next returns the first moment strictly after t when the job should be executed.
+	// Zero time is returned if there is no such moment.
+	Next(t time.Time) time.Time
+}
+
+// Every returns the schedule with the fixed interval between executions.
+func Every(interval time.Duration) Schedule {
+	if interval <= 0 {
+		panic(errorx.IllegalArgument.New("expected positive interval but got %s", interval))
+	}
+	return every(interval)
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses standard 5-field cron expression: minute, hour, day of month, month and day of week.
+// Fields support '*', numbers, ranges 'a-b', steps '*/n' and 'a-b/n', and comma-separated lists of them.
+// Macros like @daily and @hourly are supported as well. Times are evaluated in the local time zone.
+func ParseCron(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errorx.IllegalFormat.New("cron expression %q should have 5 fields, got %d", expr, len(fields))
+	}
+
+	var c cron
+	var err error
+	if c.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, errorx.Decorate(err, "malformed minute field of cron expression %q", expr)
+	}
+	if c.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, errorx.Decorate(err, "malformed hour field of cron expression %q", expr)
+	}
+	if c.dayOfMonth, c.anyDayOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, errorx.Decorate(err, "malformed day of month field of cron expression %q", expr)
+	}
+	if c.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, errorx.Decorate(err, "malformed month field of cron expression %q", expr)
+	}
+	if c.dayOfWeek, c.anyDayOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, errorx.Decorate(err, "malformed day of week field of cron expression %q", expr)
+	}
+	// both 0 and 7 mean Sunday
+	if c.dayOfWeek&(1<<7) != 0 {
+		c.dayOfWeek |= 1
+	}
+	return c, nil
+}
+
+// cron stores allowed values of each field as bit sets.
+type cron struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// anyDayOfMonth and anyDayOfWeek are set if the field is '*'.
+	// If both fields are restricted, a day matches if it matches either of them, as in the classic cron.
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+// maxCronSearchYears limits search of the next matching moment for expressions like '0 0 31 2 *'.
+const maxCronSearchYears = 5
+
+func (c cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(maxCronSearchYears, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !has(c.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(c.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(c.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c cron) dayMatches(t time.Time) bool {
+	domMatches := has(c.dayOfMonth, t.Day())
+	dowMatches := has(c.dayOfWeek, int(t.Weekday()))
+	switch {
+	case c.anyDayOfMonth && c.anyDayOfWeek:
+		return true
+	case c.anyDayOfMonth:
+		return dowMatches
+	case c.anyDayOfWeek:
+		return domMatches
+	default:
+		return domMatches || dowMatches
+	}
+}
+
+func has(bits uint64, value int) bool {
+	return bits&(1<<value) != 0
+}
+
+func parseCronField(field string, min, max int) (bits uint64, isAny bool, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, false, errorx.IllegalFormat.New("malformed step %q", stepPart)
+			}
+		}
+
+		var from, to int
+		switch {
+		case rangePart == "*":
+			from, to = min, max
+			isAny = isAny || !hasStep
+		case strings.Contains(rangePart, "-"):
+			fromPart, toPart, _ := strings.Cut(rangePart, "-")
+			if from, err = parseCronValue(fromPart, min, max); err != nil {
+				return 0, false, err
+			}
+			if to, err = parseCronValue(toPart, min, max); err != nil {
+				return 0, false, err
+			}
+			if from > to {
+				return 0, false, errorx.IllegalFormat.New("malformed range %q", rangePart)
+			}
+		default:
+			if from, err = parseCronValue(rangePart, min, max); err != nil {
+				return 0, false, err
+			}
+			to = from
+			if hasStep {
+				to = max
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, isAny, nil
+}
+
+func parseCronValue(value string, min, max int) (int, error) {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errorx.IllegalFormat.New("malformed value %q", value)
+	}
+	if parsed < min || parsed > max {
+		return 0, errorx.IllegalFormat.New("value %d is out of range [%d, %d]", parsed, min, max)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"anki-rest-enhancer/metrics"
+	"anki-rest-enhancer/util/logx"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var serveRunsTotal = metrics.NewCounterVec(
+	"anki_helper_serve_runs_total",
+	"Scheduled runs of serve command by outcome: success or failure.",
+	"outcome",
+)
+
+// serverStatus is reported by /status endpoint of serve command.
+type serverStatus struct {
+	StartedAt time.Time  `json:"startedAt"`
+	Running   bool       `json:"running"`
+	LastRun   *runStatus `json:"lastRun,omitempty"`
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+}
+
+type runStatus struct {
+	RunID      string    `json:"runId"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// FullRun is false if only the notes changed since the previous run were processed.
+	FullRun   bool `json:"fullRun"`
+	Succeeded bool `json:"succeeded"`
+}
+
+// statusTracker keeps the status of the server, which is updated by the run loop and read by HTTP handlers.
+type statusTracker struct {
+	mu     sync.Mutex
+	status serverStatus
+}
+
+func (t *statusTracker) update(f func(status *serverStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.status)
+}
+
+func (t *statusTracker) get() serverStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// startHTTPServer serves /metrics and /status endpoints on the address until ctx is done.
+func startHTTPServer(ctx context.Context, addr string, status *statusTracker) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status.get())
+	})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to listen on %s", addr)
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", logx.Err(err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	slog.Info("Serve metrics and status", "address", listener.Addr().String())
+	return nil
+}
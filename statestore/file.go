@@ -0,0 +1,99 @@
+package statestore
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"anki-rest-enhancer/util/iox"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"os"
+	"sync"
+)
+
+const fileFormatVersion = 1
+
+// fileContent is the JSON representation of the store file.
+type fileContent struct {
+	Version int `json:"version"`
+	// Rules maps rule keys to note states by note IDs.
+	Rules map[string]map[ankiconnect.NoteID]NoteState `json:"rules"`
+}
+
+// OpenFile loads the store from the JSON file. A missing file is treated as an empty store
+// and is created on Save.
+func OpenFile(path string) (Store, error) {
+	s := &fileStore{
+		path:  path,
+		rules: make(map[string]map[ankiconnect.NoteID]NoteState),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to read state file %s", path)
+	}
+
+	var content fileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, errorx.IllegalFormat.Wrap(err, "malformed state file %s", path)
+	}
+	if content.Version != fileFormatVersion {
+		return nil, errorx.IllegalFormat.New("unsupported version %d of state file %s", content.Version, path)
+	}
+	for rule, notes := range content.Rules {
+		s.rules[rule] = notes
+	}
+	return s, nil
+}
+
+type fileStore struct {
+	path string
+
+	mu    sync.Mutex
+	rules map[string]map[ankiconnect.NoteID]NoteState
+}
+
+func (s *fileStore) NoteState(rule string, noteID ankiconnect.NoteID) (NoteState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.rules[rule][noteID]
+	return state, ok
+}
+
+func (s *fileStore) SetNoteState(rule string, noteID ankiconnect.NoteID, state NoteState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notes, ok := s.rules[rule]
+	if !ok {
+		notes = make(map[ankiconnect.NoteID]NoteState)
+		s.rules[rule] = notes
+	}
+	notes[noteID] = state
+}
+
+func (s *fileStore) DeleteRule(rule string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := len(s.rules[rule])
+	delete(s.rules, rule)
+	return deleted
+}
+
+func (s *fileStore) Save() error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(fileContent{Version: fileFormatVersion, Rules: s.rules}, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return errorx.IllegalState.Wrap(err, "failed to serialize state")
+	}
+
+	if err := iox.WriteFileAtomic(s.path, data, 0o644); err != nil {
+		return errorx.Decorate(err, "failed to save state file")
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package statestore
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore_SaveAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	store, err := OpenFile(path)
+	require.NoError(t, err)
+	_, ok := store.NoteState("rule", 1)
+	require.False(t, ok)
+
+	state := NoteState{
+		Fingerprint: "abc",
+		Outcome:     OutcomeSucceeded,
+		ProcessedAt: time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC),
+	}
+	store.SetNoteState("rule", 1, state)
+	store.SetNoteState("other", 2, NoteState{Fingerprint: "def", Outcome: OutcomeFailed, Error: "boom"})
+	require.NoError(t, store.Save())
+
+	reopened, err := OpenFile(path)
+	require.NoError(t, err)
+	loaded, ok := reopened.NoteState("rule", 1)
+	require.True(t, ok)
+	require.Equal(t, state, loaded)
+	_, ok = reopened.NoteState("rule", 2)
+	require.False(t, ok)
+	loaded, ok = reopened.NoteState("other", 2)
+	require.True(t, ok)
+	require.Equal(t, "boom", loaded.Error)
+
+	require.Equal(t, 1, reopened.DeleteRule("rule"))
+	require.Equal(t, 0, reopened.DeleteRule("rule"))
+	_, ok = reopened.NoteState("rule", 1)
+	require.False(t, ok)
+}
+
+func TestFileStore_Malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 42}`), 0o644))
+
+	_, err := OpenFile(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package statestore
+
+import (
+	"anki-rest-enhancer/ankiconnect"
+	"time"
+)
+
+// Store records outcomes of note processing between runs,
+// so that notes whose inputs haven't changed since the previous run could be skipped.
+type Store interface {
+	// NoteState returns the state of the note recorded for the rule. false is returned if there is no record.
+	NoteState(rule string, noteID ankiconnect.NoteID) (NoteState, bool)
+	// SetNoteState records the state of the note for the rule. The record is persisted by Save.
+	SetNoteState(rule string, noteID ankiconnect.NoteID, state NoteState)
+	// DeleteRule removes the states of all the notes recorded for the rule and returns their number.
+	// The removal is persisted by Save.
+	DeleteRule(rule string) int
+	// Save persists all the recorded states.
+	Save() error
+}
+
+type Outcome string
+
+const (
+	OutcomeSucceeded Outcome = "succeeded"
+	OutcomeFailed    Outcome = "failed"
+)
+
+type NoteState struct {
+	// Fingerprint identifies the rule definition and the note inputs the rule was applied to.
+	Fingerprint string    `json:"fingerprint"`
+	Outcome     Outcome   `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+	ProcessedAt time.Time `json:"processedAt"`
+}
@@ -0,0 +1,206 @@
+package ttsbudget
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"anki-rest-enhancer/util/iox"
+	"encoding/json"
+	"errors"
+	"github.com/joomcode/errorx"
+	"os"
+	"sync"
+	"time"
+)
+
+const fileFormatVersion = 1
+
+// monthFormat is the format of the month keys of the usage file.
+const monthFormat = "2006-01"
+
+// fileContent is the JSON representation of the usage file.
+type fileContent struct {
+	Version int `json:"version"`
+	// Months maps months, e.g. 2024-03, to the characters converted by voices.
+	Months map[string]map[string]int `json:"months"`
+}
+
+// Usage describes characters converted to speech with a voice.
+type Usage struct {
+	Voice      string `json:"voice"`
+	Characters int    `json:"characters"`
+	// EstimatedCost is calculated with the configured price and is zero if the price is not set.
+	EstimatedCost float64 `json:"estimatedCost,omitempty"`
+}
+
+// Budget tracks characters converted to speech and enforces the configured limits.
+// It's shared by all the leaf configs of a run, so that the run limit applies to the whole run.
+// Monthly usage is shared with other processes only through the usage file, which is re-read on Save.
+type Budget struct {
+	conf ankihelperconf.AzureBudget
+	now  func() time.Time
+
+	mu sync.Mutex
+	// months is the content of the usage file, nil if the usage is not persisted.
+	months map[string]map[string]int
+	// runCharacters are the characters converted since the budget was opened.
+	runCharacters int
+	// unsaved are the characters converted since the last Save by months and voices.
+	unsaved map[string]map[string]int
+}
+
+// VoiceBudget is the view of the budget for a voice. It counts the characters converted with the voice.
+type VoiceBudget struct {
+	*Budget
+	voice string
+	// characters are guarded by Budget.mu.
+	characters int
+}
+
+// Open loads the usage file of the budget, if it's configured. A missing file means no usage so far.
+func Open(conf ankihelperconf.AzureBudget) (*Budget, error) {
+	b := &Budget{
+		conf:    conf,
+		now:     time.Now,
+		unsaved: make(map[string]map[string]int),
+	}
+	if conf.UsageFilePath != "" {
+		months, err := readFile(conf.UsageFilePath)
+		if err != nil {
+			return nil, err
+		}
+		b.months = months
+	}
+	return b, nil
+}
+
+// Voice returns the view of the budget for the voice.
+func (b *Budget) Voice(voice string) *VoiceBudget {
+	return &VoiceBudget{Budget: b, voice: voice}
+}
+
+func readFile(path string) (map[string]map[string]int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]map[string]int), nil
+	}
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to read TTS usage file %s", path)
+	}
+	var content fileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, errorx.IllegalFormat.Wrap(err, "malformed TTS usage file %s", path)
+	}
+	if content.Version != fileFormatVersion {
+		return nil, errorx.IllegalFormat.New("unsupported version %d of TTS usage file %s", content.Version, path)
+	}
+	if content.Months == nil {
+		content.Months = make(map[string]map[string]int)
+	}
+	return content.Months, nil
+}
+
+func (b *Budget) month() string {
+	return b.now().UTC().Format(monthFormat)
+}
+
+// monthCharacters returns characters converted in the month by all the voices.
+func (b *Budget) monthCharacters(month string) int {
+	var total int
+	for _, characters := range b.months[month] {
+		total += characters
+	}
+	return total
+}
+
+// Remaining returns the number of characters that may still be converted.
+// limited is false if no limit applies, in which case remaining is meaningless.
+func (b *Budget) Remaining() (remaining int, limited bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if limit := b.conf.RunCharacters; limit > 0 {
+		remaining, limited = max(0, limit-b.runCharacters), true
+	}
+	if limit := b.conf.MonthlyCharacters; limit > 0 {
+		monthRemaining := max(0, limit-b.monthCharacters(b.month()))
+		if !limited || monthRemaining < remaining {
+			remaining = monthRemaining
+		}
+		limited = true
+	}
+	return remaining, limited
+}
+
+// ShouldWarn reports whether the monthly usage exceeds the warning threshold,
+// and returns the usage of the current month.
+func (b *Budget) ShouldWarn() (monthCharacters int, warn bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	monthCharacters = b.monthCharacters(b.month())
+	limit := b.conf.MonthlyCharacters
+	return monthCharacters, limit > 0 && float64(monthCharacters) >= b.conf.WarnRatio*float64(limit)
+}
+
+// Save writes the usage to the file. The usage recorded by other processes since the file was read is preserved.
+func (b *Budget) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.months == nil || len(b.unsaved) == 0 {
+		return nil
+	}
+	months, err := readFile(b.conf.UsageFilePath)
+	if err != nil {
+		return err
+	}
+	for month, unsavedVoices := range b.unsaved {
+		voices, ok := months[month]
+		if !ok {
+			voices = make(map[string]int)
+			months[month] = voices
+		}
+		for voice, characters := range unsavedVoices {
+			voices[voice] += characters
+		}
+	}
+	data, err := json.MarshalIndent(fileContent{Version: fileFormatVersion, Months: months}, "", "  ")
+	if err != nil {
+		return errorx.IllegalState.Wrap(err, "failed to serialize TTS usage")
+	}
+	if err := iox.WriteFileAtomic(b.conf.UsageFilePath, data, 0o644); err != nil {
+		return errorx.Decorate(err, "failed to save TTS usage file")
+	}
+	b.months = months
+	b.unsaved = make(map[string]map[string]int)
+	return nil
+}
+
+// Consume records characters converted to speech with the voice.
+func (v *VoiceBudget) Consume(characters int) {
+	b := v.Budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v.characters += characters
+	b.runCharacters += characters
+	if b.months == nil {
+		return
+	}
+	month := b.month()
+	for _, months := range []map[string]map[string]int{b.months, b.unsaved} {
+		voices, ok := months[month]
+		if !ok {
+			voices = make(map[string]int)
+			months[month] = voices
+		}
+		voices[v.voice] += characters
+	}
+}
+
+// Usage returns characters converted with the voice since the view was created.
+func (v *VoiceBudget) Usage() Usage {
+	b := v.Budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Usage{
+		Voice:         v.voice,
+		Characters:    v.characters,
+		EstimatedCost: float64(v.characters) * b.conf.PricePerMillionCharacters / 1e6,
+	}
+}
@@ -0,0 +1,81 @@
+package ttsbudget
+
+import (
+	"anki-rest-enhancer/ankihelperconf"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBudget_Limits(t *testing.T) {
+	conf := ankihelperconf.AzureBudget{
+		UsageFilePath:             filepath.Join(t.TempDir(), "usage.json"),
+		MonthlyCharacters:         100,
+		RunCharacters:             70,
+		WarnRatio:                 0.8,
+		PricePerMillionCharacters: 16,
+	}
+	now := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+
+	shared, err := Open(conf)
+	require.NoError(t, err)
+	shared.now = func() time.Time { return now }
+	budget := shared.Voice("en-US-JennyNeural")
+	remaining, limited := budget.Remaining()
+	require.True(t, limited)
+	require.Equal(t, 70, remaining)
+
+	budget.Consume(60)
+	remaining, _ = budget.Remaining()
+	require.Equal(t, 10, remaining)
+	require.Equal(t, Usage{Voice: "en-US-JennyNeural", Characters: 60, EstimatedCost: 60 * 16 / 1e6}, budget.Usage())
+
+	// the run limit applies to all the voices of the run
+	sharedVoice := shared.Voice("en-US-AriaNeural")
+	sharedVoice.Consume(5)
+	remaining, _ = sharedVoice.Remaining()
+	require.Equal(t, 5, remaining)
+	require.Equal(t, 5, sharedVoice.Usage().Characters)
+	require.NoError(t, budget.Save())
+
+	// the next run is limited by the monthly usage
+	otherShared, err := Open(conf)
+	require.NoError(t, err)
+	otherShared.now = func() time.Time { return now }
+	other := otherShared.Voice("en-US-GuyNeural")
+	remaining, _ = other.Remaining()
+	require.Equal(t, 35, remaining)
+	other.Consume(25)
+	monthCharacters, warn := other.ShouldWarn()
+	require.Equal(t, 90, monthCharacters)
+	require.True(t, warn)
+
+	// usage recorded by concurrent runs is preserved
+	budget.Consume(5)
+	require.NoError(t, budget.Save())
+	require.NoError(t, other.Save())
+	reopened, err := Open(conf)
+	require.NoError(t, err)
+	reopened.now = func() time.Time { return now }
+	monthCharacters, _ = reopened.ShouldWarn()
+	require.Equal(t, 95, monthCharacters)
+
+	// usage is reset in the next month
+	reopened.now = func() time.Time { return now.AddDate(0, 1, 0) }
+	remaining, _ = reopened.Remaining()
+	require.Equal(t, 70, remaining)
+}
+
+func TestBudget_Unlimited(t *testing.T) {
+	shared, err := Open(ankihelperconf.AzureBudget{})
+	require.NoError(t, err)
+	budget := shared.Voice("en-US-JennyNeural")
+	budget.Consume(1000)
+	_, limited := budget.Remaining()
+	require.False(t, limited)
+	_, warn := budget.ShouldWarn()
+	require.False(t, warn)
+	require.Equal(t, 1000, budget.Usage().Characters)
+	require.NoError(t, budget.Save())
+}
@@ -0,0 +1,45 @@
+package execx
+
+import (
+	"anki-rest-enhancer/metrics"
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+var (
+	executionsTotal = metrics.NewCounterVec(
+		"anki_helper_script_executions_total",
+		"Script executions by rule and exit status: exit code, timeout, canceled or error if the script failed to start.",
+		"rule", "status",
+	)
+	executionDuration = metrics.NewHistogramVec(
+		"anki_helper_script_execution_duration_seconds",
+		"Duration of script executions by rule.",
+		metrics.SlowBuckets,
+		"rule",
+	)
+)
+
+func observeExecution(ctx context.Context, rule string, start time.Time, err error) {
+	executionsTotal.Inc(rule, exitStatus(ctx, err))
+	executionDuration.Observe(time.Since(start).Seconds(), rule)
+}
+
+func exitStatus(ctx context.Context, err error) string {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return "0"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "timeout"
+	case ctx.Err() != nil:
+		return "canceled"
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		return strconv.Itoa(exitErr.ExitCode())
+	default:
+		return "error"
+	}
+}
@@ -3,10 +3,14 @@ package execx
 import (
 	"anki-rest-enhancer/util/iox"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Params struct {
@@ -15,54 +19,95 @@ type Params struct {
 	Stdin   string
 	// Env is passed as is to exec.Cmd
 	Env []string
+	// Rule identifies the executions in metrics, e.g. the name of the configured rule the command is executed for.
+	// Default: the base name of the command.
+	Rule string
 }
 
 // RunAndCollectOutput properly handles the case described in https://github.com/golang/go/issues/23019 , i.e.
 // it doesn't hang if executed command spawns a long-living subprocess, passed its stdout to it and then exited shortly.
-func RunAndCollectOutput(ctx context.Context, params Params) ([]byte, error) {
+func RunAndCollectOutput(ctx context.Context, params Params) (_ []byte, err error) {
+	rule := params.Rule
+	if rule == "" {
+		rule = filepath.Base(params.Command)
+	}
+	start := time.Now()
+	defer func() { observeExecution(ctx, rule, start, err) }()
+
 	cmd := exec.CommandContext(ctx, params.Command, params.Args...)
 	if params.Stdin != "" {
 		cmd.Stdin = strings.NewReader(params.Stdin)
 	}
 	cmd.Env = params.Env
 
-	stdout, err := cmd.StdoutPipe()
+	// NOTE: we don't use cmd.StdoutPipe as exec.Cmd closes it as soon as the command exits,
+	// so that the output that hasn't been read by that moment is lost.
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
 	defer iox.Close(stdout)
-	stdoutDone := readInBackground(stdout)
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		iox.Close(stdoutW)
+		return nil, err
+	}
+	defer iox.Close(stderr)
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
 
-	stderr, err := cmd.StderrPipe()
+	err = cmd.Start()
+	// the command has its own copies of the pipes now, so ours should be closed to get EOF once the command exits
+	iox.Close(stdoutW)
+	iox.Close(stderrW)
 	if err != nil {
 		return nil, err
 	}
-	defer func() { _ = stdout.Close() }()
+	stdoutDone := readInBackground(stdout)
 	stderrDone := readInBackground(stderr)
 
-	if err := cmd.Run(); err != nil {
-		select {
-		// NOTE: we can't read from the channel synchronously, as the stderr pipe
-		// could have leaked to child processes spawned by the executed process,
-		// which may be alive indefinitely long, keeping the reading goroutine hanging forever.
-		case res := <-stderrDone:
-			// we ignore any errors occurred while reading from the stderr as we're only interested in anything that
-			// was read from there
-			err = fmt.Errorf("%w\nScript stderr:\n%s", err, string(res.bytes))
-		default:
-			// continue execution
-		}
-		return nil, err
+	if err := cmd.Wait(); err != nil {
+		// we ignore any errors occurred while reading from the stderr as we're only interested in anything that
+		// was read from there, even if it's cut off
+		res, _ := awaitOutput(ctx, stderr, stderrDone)
+		return nil, fmt.Errorf("%w\nScript stderr:\n%s", err, string(res.bytes))
 	}
 
-	select {
-	case <-ctx.Done():
+	res, complete := awaitOutput(ctx, stdout, stdoutDone)
+	switch {
+	case ctx.Err() != nil:
 		return nil, ctx.Err()
-	case res := <-stdoutDone:
+	case !complete:
+		return nil, fmt.Errorf("%w: stdout is still open %v after the command exited, probably by its child process",
+			ErrOutputCutOff, outputGracePeriod)
+	default:
 		return res.bytes, res.err
 	}
 }
 
+// ErrOutputCutOff means that the command exited, but its output could not be read till the end.
+var ErrOutputCutOff = errors.New("output of the command is cut off")
+
+// outputGracePeriod is how long the output is awaited after the command exits.
+var outputGracePeriod = time.Second
+
+// awaitOutput waits for the output to be read till EOF. false is returned if the output is cut off.
+// NOTE: we can't wait for the reader indefinitely, as the pipe could have leaked to child processes spawned
+// by the executed process, which may be alive indefinitely long, keeping the reading goroutine hanging forever.
+// So, the pipe is closed after a grace period (or once ctx is done), and everything read by that moment is returned.
+func awaitOutput(ctx context.Context, pipe io.Closer, done <-chan readerResult) (readerResult, bool) {
+	timer := time.NewTimer(outputGracePeriod)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	iox.Close(pipe)
+	return <-done, false
+}
+
 type readerResult struct {
 	bytes []byte
 	err   error
@@ -59,6 +59,35 @@ func TestRunAndCollectOutput_ErrorContainsStderrOnBadExitStatus(t *testing.T) {
 	require.ErrorContains(t, err, "test message written to stderr")
 }
 
+func TestRunAndCollectOutput_LargeOutput(t *testing.T) {
+	// when:
+	output, err := RunAndCollectOutput(context.Background(), Params{
+		Command: "head",
+		Args:    []string{"-c", "1000000", "/dev/zero"},
+	})
+
+	// then:
+	require.NoError(t, err)
+	require.Len(t, output, 1000000, "the output should not be lost once the command exits")
+}
+
+func TestRunAndCollectOutput_ErrorOnOutputHeldByChildProcess(t *testing.T) {
+	// setup:
+	defer func(period time.Duration) { outputGracePeriod = period }(outputGracePeriod)
+	outputGracePeriod = 100 * time.Millisecond
+
+	// when:
+	start := time.Now()
+	_, err := RunAndCollectOutput(context.Background(), Params{
+		Command: "bash",
+		Args:    []string{"-c", "echo '[{\"partial\"'; sleep 5 & exit 0"},
+	})
+
+	// then:
+	require.ErrorIs(t, err, ErrOutputCutOff, "cut off output should not be returned as complete")
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
 func writeIntoTmp(t *testing.T, content []byte) (fileName string) {
 	tmpFile, err := os.CreateTemp("", "")
 	defer iox.Close(tmpFile)
@@ -1,55 +1,210 @@
 package httputil
 
 import (
+	"anki-rest-enhancer/util/logx"
+	"anki-rest-enhancer/util/stringx"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/joomcode/errorx"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
-func NewLoggingRoundTripper(transport http.RoundTripper) http.RoundTripper {
+// DefaultRedactedHeaders are always redacted in logged requests and responses.
+var DefaultRedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"Ocp-Apim-Subscription-Key",
+	"X-Goog-Api-Key",
+}
+
+const (
+	redacted = "[REDACTED]"
+
+	// truncatedStringPrefixLength is the number of characters kept from a truncated JSON string value.
+	truncatedStringPrefixLength = 32
+)
+
+type LoggingOptions struct {
+	// RedactHeaders are the names of headers whose values are replaced with a placeholder
+	// in addition to DefaultRedactedHeaders.
+	RedactHeaders []string
+	// RedactJSONFields are the names of JSON object fields (at any depth) whose values are replaced with a placeholder.
+	RedactJSONFields []string
+	// MaxJSONStringLength is the maximal length of JSON string values, e.g. base64-encoded media, to be logged as is.
+	// Longer values are truncated. Zero means no limit.
+	MaxJSONStringLength int
+	// MaxBodySize is the maximal size of the logged body. Longer bodies are truncated. Zero means no limit.
+	MaxBodySize int
+	// FilePath is the path to the file to append the log to. If empty, the logger of the request context is used.
+	FilePath string
+}
+
+func NewLoggingRoundTripper(transport http.RoundTripper, opts LoggingOptions) http.RoundTripper {
+	l := &requestLogger{opts: opts, redactHeaders: make(map[string]struct{}), redactFields: make(map[string]struct{})}
+	for _, headers := range [][]string{DefaultRedactedHeaders, opts.RedactHeaders} {
+		for _, header := range headers {
+			l.redactHeaders[http.CanonicalHeaderKey(header)] = struct{}{}
+		}
+	}
+	for _, field := range opts.RedactJSONFields {
+		l.redactFields[strings.ToLower(field)] = struct{}{}
+	}
+
 	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
-		logReq(req)
+		l.logReq(req)
 		resp, err := transport.RoundTrip(req)
 		if err != nil {
 			return nil, err
 		}
-		if err := logResp(resp); err != nil {
+		if err := l.logResp(req, resp); err != nil {
 			return nil, err
 		}
 		return resp, nil
 	})
 }
 
-func logReq(req *http.Request) {
-	var buf strings.Builder
-	buf.WriteString("Request:\n")
+type requestLogger struct {
+	opts          LoggingOptions
+	redactHeaders map[string]struct{}
+	redactFields  map[string]struct{}
 
-	body, _ := io.ReadAll(req.Body)
-	_ = req.Body.Close()
-	req.Body = io.NopCloser(bytes.NewReader(body))
-	_ = req.Write(&buf)
-	req.Body = io.NopCloser(bytes.NewReader(body))
+	// fileLogger is opened on the first use, so that no file is created unless there are requests to log.
+	openFileLogger sync.Once
+	fileLogger     *slog.Logger
+}
 
-	log.Println(buf.String())
+func (l *requestLogger) logger(req *http.Request) *slog.Logger {
+	ctxLogger := logx.FromContext(req.Context())
+	if l.opts.FilePath == "" {
+		return ctxLogger
+	}
+	l.openFileLogger.Do(func() {
+		fileLogger, err := logx.NewFileLogger(l.opts.FilePath)
+		if err != nil {
+			ctxLogger.Error("Failed to open request log file, use the main log instead", logx.Err(err))
+			return
+		}
+		l.fileLogger = fileLogger
+	})
+	if l.fileLogger == nil {
+		return ctxLogger
+	}
+	return l.fileLogger
 }
 
-func logResp(resp *http.Response) error {
-	var buf strings.Builder
-	buf.WriteString("Response:\n")
+func (l *requestLogger) logReq(req *http.Request) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	l.logger(req).Info(
+		"HTTP request",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"headers", l.headers(req.Header),
+		"body", l.body(body),
+	)
+}
 
+func (l *requestLogger) logResp(req *http.Request, resp *http.Response) error {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errorx.ExternalError.Wrap(err, "failed to read Azure response body")
+		return errorx.ExternalError.Wrap(err, "failed to read response body")
 	}
 	_ = resp.Body.Close()
-
-	resp.Body = io.NopCloser(bytes.NewReader(body))
-	_ = resp.Write(&buf)
 	resp.Body = io.NopCloser(bytes.NewReader(body))
 
-	log.Println(buf.String())
+	l.logger(req).Info(
+		"HTTP response",
+		"method", req.Method,
+		"url", req.URL.String(),
+		"status", resp.StatusCode,
+		"headers", l.headers(resp.Header),
+		"body", l.body(body),
+	)
 	return nil
 }
+
+func (l *requestLogger) headers(headers http.Header) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	for _, name := range names {
+		values := headers[name]
+		if _, ok := l.redactHeaders[http.CanonicalHeaderKey(name)]; ok {
+			values = []string{redacted}
+		}
+		for _, value := range values {
+			if buf.Len() > 0 {
+				buf.WriteString("; ")
+			}
+			buf.WriteString(name + ": " + value)
+		}
+	}
+	return buf.String()
+}
+
+// body returns the body representation to be logged.
+func (l *requestLogger) body(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if !utf8.Valid(body) {
+		return fmt.Sprintf("[binary data, %d bytes]", len(body))
+	}
+
+	var parsed any
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if sanitized, err := json.Marshal(l.sanitizeJSON(parsed)); err == nil {
+			body = sanitized
+		}
+	}
+
+	if maxSize := l.opts.MaxBodySize; maxSize > 0 && len(body) > maxSize {
+		return fmt.Sprintf("%s...[truncated, %d bytes total]", stringx.TruncateBytes(string(body), maxSize), len(body))
+	}
+	return string(body)
+}
+
+func (l *requestLogger) sanitizeJSON(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, fieldValue := range value {
+			if _, ok := l.redactFields[strings.ToLower(key)]; ok {
+				value[key] = redacted
+				continue
+			}
+			value[key] = l.sanitizeJSON(fieldValue)
+		}
+		return value
+	case []any:
+		for i, elem := range value {
+			value[i] = l.sanitizeJSON(elem)
+		}
+		return value
+	case string:
+		if maxLen := l.opts.MaxJSONStringLength; maxLen > 0 && len(value) > maxLen {
+			prefixLen := min(truncatedStringPrefixLength, maxLen)
+			return fmt.Sprintf("%s...[truncated, %d bytes total]", stringx.TruncateBytes(value, prefixLen), len(value))
+		}
+		return value
+	default:
+		return value
+	}
+}
@@ -0,0 +1,83 @@
+package httputil
+
+import (
+	"anki-rest-enhancer/util/logx"
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggingRoundTripper_RedactsAndTruncates(t *testing.T) {
+	// setup:
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// the request should be sent as is
+		require.Contains(t, string(body), "secret-key")
+		w.Header().Set("Set-Cookie", "session=secret-session")
+		_, _ = w.Write([]byte{0xff, 0xfe, 0x00, 0x01})
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	ctx := logx.With(context.Background(), logx.KeyAction, "test")
+
+	client := &http.Client{Transport: NewLoggingRoundTripper(http.DefaultTransport, LoggingOptions{
+		RedactJSONFields:    []string{"key"},
+		MaxJSONStringLength: 40,
+	})}
+
+	// given:
+	audio := strings.Repeat("A", 1000)
+	reqBody := `{"action": "storeMediaFile", "key": "secret-key", "params": {"data": "` + audio + `"}}`
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader(reqBody))
+	require.NoError(t, err)
+	req.Header.Set("Ocp-Apim-Subscription-Key", "secret-subscription")
+
+	// when:
+	resp, err := client.Do(req)
+
+	// then:
+	require.NoError(t, err)
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xff, 0xfe, 0x00, 0x01}, respBody, "response body should be preserved")
+
+	logged := logs.String()
+	require.Contains(t, logged, "action=test", "logger of the request context should be used")
+	require.NotContains(t, logged, "secret")
+	require.NotContains(t, logged, audio)
+	require.Contains(t, logged, "truncated, 1000 bytes total")
+	require.Contains(t, logged, "binary data, 4 bytes")
+}
+
+func TestLoggingRoundTripper_File(t *testing.T) {
+	// setup:
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"result": 42}`))
+	}))
+	defer server.Close()
+
+	logPath := filepath.Join(t.TempDir(), "requests.log")
+	client := &http.Client{Transport: NewLoggingRoundTripper(http.DefaultTransport, LoggingOptions{FilePath: logPath})}
+
+	// when:
+	resp, err := client.Get(server.URL)
+
+	// then:
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	logged, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.Contains(t, string(logged), "HTTP request")
+	require.Contains(t, string(logged), `result`)
+}
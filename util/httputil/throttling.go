@@ -13,3 +13,14 @@ func NewThrottlingTransport(transport http.RoundTripper, delay time.Duration) ht
 		return transport.RoundTrip(req)
 	})
 }
+
+// NewRateLimitingTransport makes every request wait for the limiter before it is sent.
+// Waiting respects request context.
+func NewRateLimitingTransport(transport http.RoundTripper, limiter *ratelimit.Limiter) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		return transport.RoundTrip(req)
+	})
+}
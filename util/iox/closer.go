@@ -3,7 +3,7 @@ package iox
 import (
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 )
 
@@ -15,6 +15,6 @@ func Close(closer io.Closer) {
 			// spam such errors in stdout
 			return
 		}
-		log.Printf("Error occurred while closing a closer: %+v", err)
+		slog.Warn("Error occurred while closing a closer", "error", err)
 	}
 }
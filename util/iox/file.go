@@ -0,0 +1,32 @@
+package iox
+
+import (
+	"github.com/joomcode/errorx"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file next to path and renames it to path,
+// so that readers never observe a partially written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to create temporary file for %s", path)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errorx.ExternalError.Wrap(err, "failed to write %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to close %s", tmp.Name())
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to set permissions of %s", tmp.Name())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errorx.ExternalError.Wrap(err, "failed to replace %s", path)
+	}
+	return nil
+}
@@ -7,3 +7,11 @@ func Keys[M ~map[K]V, K comparable, V any](m M) []K {
 	}
 	return keys
 }
+
+func Values[M ~map[K]V, K comparable, V any](m M) []V {
+	values := make([]V, 0, len(m))
+	for _, value := range m {
+		values = append(values, value)
+	}
+	return values
+}
@@ -13,3 +13,21 @@ func ElementCounts[S ~[]T, T comparable](s S) map[T]int {
 func SameElements[S ~[]T, T comparable](s1, s2 S) bool {
 	return maps.Equal(ElementCounts(s1), ElementCounts(s2))
 }
+
+func Map[S ~[]T, T, R any](s S, f func(T) R) []R {
+	mapped := make([]R, len(s))
+	for i, e := range s {
+		mapped[i] = f(e)
+	}
+	return mapped
+}
+
+func Filter[S ~[]T, T any](s S, pred func(T) bool) S {
+	var filtered S
+	for _, e := range s {
+		if pred(e) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
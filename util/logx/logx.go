@@ -0,0 +1,104 @@
+package logx
+
+import (
+	"context"
+	"github.com/joomcode/errorx"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Keys of the attributes shared across packages, so that logs could be filtered by them.
+const (
+	KeyConfig = "config"
+	KeyAction = "action"
+	KeyRule   = "rule"
+	KeyNoteID = "noteId"
+	KeyField  = "field"
+	KeyRunID  = "runId"
+	KeyError  = "error"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// handlerOptions and format are the ones configured with Setup. They are used by NewFileLogger as well.
+var (
+	handlerOptions = &slog.HandlerOptions{Level: slog.LevelInfo}
+	format         = FormatText
+)
+
+// Setup makes the default slog logger write to w with the specified level and format.
+// Messages of the standard log package are redirected to the default logger as well.
+func Setup(w io.Writer, level, logFormat string) error {
+	parsedLevel, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: parsedLevel}
+	handler, err := newHandler(w, logFormat, opts)
+	if err != nil {
+		return err
+	}
+
+	handlerOptions, format = opts, logFormat
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// NewFileLogger returns the logger appending to the file with the level and the format configured with Setup.
+// NOTE: the file is never closed as the logger is expected to be used until the process exits.
+func NewFileLogger(path string) (*slog.Logger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to open log file %s", path)
+	}
+	handler, err := newHandler(file, format, handlerOptions)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(handler), nil
+}
+
+func newHandler(w io.Writer, logFormat string, opts *slog.HandlerOptions) (slog.Handler, error) {
+	switch strings.ToLower(logFormat) {
+	case FormatText, "":
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, errorx.IllegalArgument.New("unknown log format %q, expected %q or %q", logFormat, FormatText, FormatJSON)
+	}
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return 0, errorx.IllegalArgument.Wrap(err, "unknown log level %q, expected one of debug, info, warn, error", level)
+	}
+	return parsed, nil
+}
+
+// Err is the attribute of the error.
+func Err(err error) slog.Attr {
+	return slog.String(KeyError, err.Error())
+}
+
+type loggerKey struct{}
+
+// With returns the context carrying the logger with the specified attributes
+// in addition to the ones of the context's logger. See FromContext.
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, FromContext(ctx).With(args...))
+}
+
+// FromContext returns the logger of the context, or the default logger if the context has none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,36 @@
+package logx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"testing"
+)
+
+func TestSetup_JSON(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	require.NoError(t, Setup(&buf, "warn", FormatJSON))
+
+	// when:
+	ctx := With(context.Background(), KeyConfig, "anki-helper.yaml")
+	FromContext(ctx).Info("filtered out")
+	FromContext(ctx).Warn("something failed", KeyNoteID, 42, Err(errors.New("boom")))
+
+	// then:
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.Equal(t, "WARN", record["level"])
+	require.Equal(t, "something failed", record["msg"])
+	require.Equal(t, "anki-helper.yaml", record[KeyConfig])
+	require.Equal(t, float64(42), record[KeyNoteID])
+	require.Equal(t, "boom", record[KeyError])
+}
+
+func TestSetup_Malformed(t *testing.T) {
+	require.Error(t, Setup(&bytes.Buffer{}, "verbose", FormatText))
+	require.Error(t, Setup(&bytes.Buffer{}, "info", "xml"))
+}
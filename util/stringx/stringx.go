@@ -1,6 +1,9 @@
 package stringx
 
-import "unicode"
+import (
+	"unicode"
+	"unicode/utf8"
+)
 
 // AppendNonEmpty appends all non-empty strings to the specified slice and returns it.
 // Empty strings already present in the slice are preserved.
@@ -37,3 +40,14 @@ func IsBlank(s string) bool {
 	}
 	return true
 }
+
+// TruncateBytes returns the longest prefix of s that is at most maxBytes long and doesn't split a UTF-8 character.
+func TruncateBytes(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
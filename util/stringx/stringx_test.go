@@ -53,3 +53,11 @@ func TestIsBlank(t *testing.T) {
 	assert.False(t, IsBlank(" foo "))
 	assert.False(t, IsBlank(" foo \n"))
 }
+
+func TestTruncateBytes(t *testing.T) {
+	require.Equal(t, "Hund", TruncateBytes("Hund", 10))
+	require.Equal(t, "Hu", TruncateBytes("Hund", 2))
+	require.Equal(t, "Gr", TruncateBytes("Grüße", 3), "multibyte characters should not be split")
+	require.Equal(t, "Grü", TruncateBytes("Grüße", 4))
+	require.Equal(t, "", TruncateBytes("ü", 1))
+}
@@ -0,0 +1,84 @@
+// Package vocabdb reads words looked up in dictionaries of e-readers from their SQLite databases.
+// Databases are queried with sqlite3 command-line tool.
+package vocabdb
+
+import (
+	"anki-rest-enhancer/util/execx"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/joomcode/errorx"
+	"strings"
+)
+
+// Lookup is a word looked up in a dictionary while reading a book.
+type Lookup struct {
+	Word string `json:"word"`
+	// Stem is the dictionary form of the word. It's empty if the e-reader doesn't record it.
+	Stem string `json:"stem"`
+	// Usage is the sentence of the book the word was looked up in.
+	Usage string `json:"usage"`
+	// Book is the title of the book.
+	Book string `json:"book"`
+}
+
+// ReadKindle reads lookups from vocab.db of a Kindle. Only the latest lookup of each word is returned.
+// Empty language means words of all the languages, otherwise it's a language code like de.
+func ReadKindle(ctx context.Context, sqlitePath, dbPath, language string) ([]Lookup, error) {
+	condition := ""
+	if language != "" {
+		condition = "WHERE w.lang = " + quote(language)
+	}
+	// NOTE: SQLite takes bare columns of an aggregate query from the row with max() value,
+	// so the usage and the book belong to the latest lookup.
+	query := fmt.Sprintf(`
+		SELECT w.word AS word, coalesce(w.stem, '') AS stem, coalesce(l.usage, '') AS usage,
+			coalesce(b.title, '') AS book, max(l.timestamp) AS timestamp
+		FROM LOOKUPS l
+			JOIN WORDS w ON l.word_key = w.id
+			LEFT JOIN BOOK_INFO b ON l.book_key = b.id
+		%s
+		GROUP BY w.id
+		ORDER BY timestamp DESC`, condition)
+	return read(ctx, sqlitePath, dbPath, query)
+}
+
+// ReadKOReader reads lookups from vocabulary_builder.sqlite3 of KOReader vocabulary builder.
+// The usage is the context of the word recorded by KOReader.
+func ReadKOReader(ctx context.Context, sqlitePath, dbPath string) ([]Lookup, error) {
+	const query = `
+		SELECT v.word AS word, '' AS stem,
+			coalesce(v.prev_context, '') || v.word || coalesce(v.next_context, '') AS usage,
+			coalesce(t.name, '') AS book
+		FROM vocabulary v
+			LEFT JOIN title t ON v.title_id = t.id
+		ORDER BY v.create_time DESC`
+	return read(ctx, sqlitePath, dbPath, query)
+}
+
+func read(ctx context.Context, sqlitePath, dbPath, query string) ([]Lookup, error) {
+	output, err := execx.RunAndCollectOutput(ctx, execx.Params{
+		Command: sqlitePath,
+		Args:    []string{"-readonly", "-json", dbPath, query},
+	})
+	if err != nil {
+		return nil, errorx.ExternalError.Wrap(err, "failed to query vocabulary database %s", dbPath)
+	}
+	// sqlite3 prints nothing if there are no rows
+	if len(strings.TrimSpace(string(output))) == 0 {
+		return nil, nil
+	}
+	var lookups []Lookup
+	if err := json.Unmarshal(output, &lookups); err != nil {
+		return nil, errorx.IllegalFormat.Wrap(err, "malformed output of sqlite3")
+	}
+	for i := range lookups {
+		lookups[i].Usage = strings.TrimSpace(lookups[i].Usage)
+	}
+	return lookups, nil
+}
+
+// quote returns SQL string literal of the value.
+func quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,82 @@
+package vocabdb
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func createDB(t *testing.T, sql string) (sqlitePath, dbPath string) {
+	sqlitePath, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	dbPath = filepath.Join(t.TempDir(), "vocab.db")
+	output, err := exec.Command(sqlitePath, dbPath, sql).CombinedOutput()
+	require.NoError(t, err, string(output))
+	return sqlitePath, dbPath
+}
+
+func TestReadKindle(t *testing.T) {
+	// given:
+	sqlitePath, dbPath := createDB(t, `
+		CREATE TABLE WORDS (id TEXT PRIMARY KEY, word TEXT, stem TEXT, lang TEXT, category INTEGER, timestamp INTEGER);
+		CREATE TABLE BOOK_INFO (id TEXT PRIMARY KEY, asin TEXT, guid TEXT, lang TEXT, title TEXT, authors TEXT);
+		CREATE TABLE LOOKUPS (id TEXT PRIMARY KEY, word_key TEXT, book_key TEXT, dict_key TEXT, pos TEXT, usage TEXT, timestamp INTEGER);
+		INSERT INTO WORDS VALUES ('de:Hunde', 'Hunde', 'Hund', 'de', 0, 1), ('en:dog', 'dog', 'dog', 'en', 0, 1);
+		INSERT INTO BOOK_INFO VALUES ('b1', '', '', 'de', 'Der Hund von Baskerville', ''), ('b2', '', '', 'de', 'Emil', '');
+		INSERT INTO LOOKUPS VALUES
+			('1', 'de:Hunde', 'b1', '', '', 'Die Hunde bellen. ', 100),
+			('2', 'de:Hunde', 'b2', '', '', 'Zwei Hunde, die sich streiten.', 200),
+			('3', 'en:dog', 'b1', '', '', 'The dog barks.', 300);
+	`)
+
+	// when:
+	lookups, err := ReadKindle(context.Background(), sqlitePath, dbPath, "de")
+
+	// then:
+	require.NoError(t, err)
+	require.Equal(t, []Lookup{{Word: "Hunde", Stem: "Hund", Usage: "Zwei Hunde, die sich streiten.", Book: "Emil"}}, lookups)
+}
+
+func TestReadKOReader(t *testing.T) {
+	// given:
+	sqlitePath, dbPath := createDB(t, `
+		CREATE TABLE title (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE, filter INTEGER NOT NULL DEFAULT 1);
+		CREATE TABLE vocabulary (word TEXT NOT NULL UNIQUE PRIMARY KEY, title_id INTEGER, create_time INTEGER NOT NULL,
+			review_time INTEGER, due_time INTEGER NOT NULL, review_count INTEGER NOT NULL DEFAULT 0,
+			prev_context TEXT, next_context TEXT, streak_count INTEGER NOT NULL DEFAULT 0);
+		INSERT INTO title (id, name) VALUES (1, 'Emil und die Detektive');
+		INSERT INTO vocabulary (word, title_id, create_time, due_time, prev_context, next_context) VALUES
+			('Detektiv', 1, 100, 0, 'Der ', ' kam.'),
+			('Bahnhof', NULL, 200, 0, NULL, NULL);
+	`)
+
+	// when:
+	lookups, err := ReadKOReader(context.Background(), sqlitePath, dbPath)
+
+	// then:
+	require.NoError(t, err)
+	require.Equal(t, []Lookup{
+		{Word: "Bahnhof", Usage: "Bahnhof"},
+		{Word: "Detektiv", Usage: "Der Detektiv kam.", Book: "Emil und die Detektive"},
+	}, lookups)
+}
+
+func TestReadKindle_Empty(t *testing.T) {
+	// given:
+	sqlitePath, dbPath := createDB(t, `
+		CREATE TABLE WORDS (id TEXT PRIMARY KEY, word TEXT, stem TEXT, lang TEXT, category INTEGER, timestamp INTEGER);
+		CREATE TABLE BOOK_INFO (id TEXT PRIMARY KEY, asin TEXT, guid TEXT, lang TEXT, title TEXT, authors TEXT);
+		CREATE TABLE LOOKUPS (id TEXT PRIMARY KEY, word_key TEXT, book_key TEXT, dict_key TEXT, pos TEXT, usage TEXT, timestamp INTEGER);
+	`)
+
+	// when:
+	lookups, err := ReadKindle(context.Background(), sqlitePath, dbPath, "")
+
+	// then:
+	require.NoError(t, err)
+	require.Empty(t, lookups)
+}